@@ -0,0 +1,1412 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/backup"
+	"github.com/ermos/docker-redis-backup/internal/buildinfo"
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/crypt"
+	"github.com/ermos/docker-redis-backup/internal/kube"
+	"github.com/ermos/docker-redis-backup/internal/notify"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+	"golang.org/x/term"
+)
+
+// notifyFlushTimeout bounds the wait for queued notifications before exiting
+const notifyFlushTimeout = 30 * time.Second
+
+// command is a one-shot CLI command run instead of the scheduler
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{
+		name:  "--version",
+		usage: "--version [-json]",
+		run:   versionCommand,
+	},
+	{
+		name:  "config",
+		usage: "config show [-changed] [-json]",
+		run:   configCommand,
+	},
+	{
+		name:  "schedule",
+		usage: "schedule [-count <n>] [-json | -ics]",
+		run:   scheduleCommand,
+	},
+	{
+		name:  "list",
+		usage: "list",
+		run:   listCommand,
+	},
+	{
+		name:  "manifest",
+		usage: "manifest <backup-name>",
+		run:   manifestCommand,
+	},
+	{
+		name:  "snapshot",
+		usage: "snapshot -reason <text> [-pin-days <n>]",
+		run:   snapshotCommand,
+	},
+	{
+		name:  "maintenance",
+		usage: "maintenance on|off|status [-reason <text>] [-duration <d>] [-target <service>]",
+		run:   maintenanceCommand,
+	},
+	{
+		name:  "pin",
+		usage: "pin [-reason <text>] [-days <n>] <backup-name>",
+		run:   pinCommand,
+	},
+	{
+		name:  "unpin",
+		usage: "unpin <backup-name>",
+		run:   unpinCommand,
+	},
+	{
+		name:  "delete",
+		usage: "delete [-unlock <token>] <backup-name>...",
+		run:   deleteCommand,
+	},
+	{
+		name:  "fsck",
+		usage: "fsck [-verify] [-repair] [-json]",
+		run:   fsckCommand,
+	},
+	{
+		name:  "doctor",
+		usage: "doctor [-json]",
+		run:   doctorCommand,
+	},
+	{
+		name:  "cleanup",
+		usage: "cleanup [-max-age <duration>]",
+		run:   cleanupCommand,
+	},
+	{
+		name:  "report",
+		usage: "report [-json] [-target <service>]",
+		run:   reportCommand,
+	},
+	{
+		name:  "audit",
+		usage: "audit [-since <duration>] [-operation <name>] [-target <text>] [-storage] [-json]",
+		run:   auditCommand,
+	},
+	{
+		name:  "rekey",
+		usage: "rekey [<backup-name>...]",
+		run:   rekeyCommand,
+	},
+	{
+		name:  "sign",
+		usage: "sign [<backup-name>...]",
+		run:   signCommand,
+	},
+	{
+		name:  "copy",
+		usage: "copy -to <s3://bucket/prefix|gs://bucket/prefix|/path> [<backup-name>...]",
+		run:   copyCommand,
+	},
+	{
+		name:  "import",
+		usage: "import [-from <s3://bucket/prefix|gs://bucket/prefix|/path>] [-dry-run] [-delete]",
+		run:   importCommand,
+	},
+	{
+		name:  "verify",
+		usage: "verify <backup-name> | verify -latest",
+		run:   verifyCommand,
+	},
+	{
+		name:  "export",
+		usage: "export [-format json|csv|resp] [-match <pattern>...] [-db <n>] [-max-value-size <size>] [-max-elements <n>] [-limit <n>] [-o <file>] <backup-name> | export -latest ... | export -live ...",
+		run:   exportCommand,
+	},
+	{
+		name:  "restore",
+		usage: "restore [-force] [-aof] [-on-conflict replace|skip|fail] [-yes-flush-target [-confirm-target <host:port>]] [-max-keys-per-sec <n>] [-max-bytes-per-sec <size>] [-progress <interval>] [-resume <token>] -match <pattern> [-match <pattern>...] <backup-name> | restore -interactive [-force] [-aof] [-match <pattern>...] | restore -from-stdin [-force] -match <pattern> [-match <pattern>...] [<backup-name>] | restore -estimate [-match <pattern>...] <backup-name>",
+		run:   restoreCommand,
+	},
+	{
+		name:  "restore-functions",
+		usage: "restore-functions [-policy APPEND|REPLACE|FLUSH] <backup-name>",
+		run:   restoreFunctionsCommand,
+	},
+}
+
+// runCommand executes the named command and returns the process exit code
+func runCommand(name string, args []string) int {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return execute(cmd, args)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\nUsage:\n  redis-backup                 start the backup scheduler\n", name)
+	fmt.Fprintf(os.Stderr, "  redis-backup --dry-run [<command>]\n  redis-backup [--dry-run] --once [-verify]\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  redis-backup %s\n", cmd.usage)
+	}
+	return exitUsage
+}
+
+// execute runs a command and returns its exit code
+func execute(cmd command, args []string) int {
+	err := cmd.run(args)
+	notify.Flush(notifyFlushTimeout)
+	if err != nil {
+		log.Printf("%s failed: %v", cmd.name, err)
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			return exitErr.code
+		}
+		return exitFailure
+	}
+	return exitOK
+}
+
+// globalFlags are the flags given before the command
+type globalFlags struct {
+	// dryRun sets DRY_RUN for the command, or runs a single dry run without one
+	dryRun bool
+	// once runs a single backup instead of the scheduler
+	once bool
+}
+
+// parseGlobalFlags consumes the global flags at the start of args and returns the rest
+func parseGlobalFlags(args []string) (globalFlags, []string) {
+	var flags globalFlags
+	for len(args) > 0 {
+		switch args[0] {
+		case "--dry-run":
+			flags.dryRun = true
+		case "--once":
+			flags.once = true
+		default:
+			return flags, args
+		}
+		args = args[1:]
+	}
+	return flags, args
+}
+
+// setupStorage loads the configuration and initializes storage only
+// Commands that don't talk to Redis use it so they work when Redis is down
+func setupStorage() (*config.Config, storage.Storage, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	store, err := storage.New(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize storage: %w", err)
+	}
+
+	return cfg, store, nil
+}
+
+// targetConfig returns the configuration of a discovered service, with its
+// own credentials and keys
+func targetConfig(cfg *config.Config, target string) (*config.Config, error) {
+	cfg = cfg.ForTarget(target, "", "")
+	if err := useTargetSecrets(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// setup loads the configuration and initializes storage and the backup manager
+func setup() (*config.Config, *backup.Manager, error) {
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newManager(cfg, store)
+}
+
+// setupRestore is like setup, but the manager connects to the restore target
+// (RESTORE_REDIS_*) so the backup source doesn't need to be reachable
+func setupRestore() (*config.Config, *backup.Manager, error) {
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, backupManager, err := newManager(cfg.ForRestore(), store)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkPermissions(cfg, backupManager, true); err != nil {
+		backupManager.Close()
+		return nil, nil, fmt.Errorf("permission check failed: %w", err)
+	}
+	return cfg, backupManager, nil
+}
+
+// newManager creates a backup manager for an initialized storage
+func newManager(cfg *config.Config, store storage.Storage) (*config.Config, *backup.Manager, error) {
+	backupManager, err := backup.New(cfg, store)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize backup manager: %w", err)
+	}
+
+	return cfg, backupManager, nil
+}
+
+// versionCommand prints the version, commit, build date and Go version
+// It needs no configuration
+func versionCommand(args []string) error {
+	flags := flag.NewFlagSet("--version", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the build as JSON")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: redis-backup --version [-json]")
+	}
+
+	build := buildinfo.Get()
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(build)
+	}
+
+	fmt.Printf("%s %s\n", build.Name, build.Version)
+	for _, field := range []struct{ name, value string }{
+		{"commit", build.Commit},
+		{"built", build.BuildDate},
+		{"go", build.GoVersion},
+	} {
+		if field.value != "" {
+			fmt.Printf("  %-7s %s\n", field.name+":", field.value)
+		}
+	}
+	return nil
+}
+
+// dryRunCommand goes once through a backup run without changing anything
+func dryRunCommand(args []string) error {
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	cfg.DryRun = true
+
+	if cfg.TargetDiscovery == "kubernetes" {
+		kubeClient, err := kube.NewInClusterClient()
+		if err != nil {
+			return fmt.Errorf("failed to initialize Kubernetes client: %w", err)
+		}
+		_, err = runKubernetesBackups(context.Background(), cfg, kubeClient)
+		return err
+	}
+
+	_, backupManager, err := newManager(cfg, store)
+	if err != nil {
+		return err
+	}
+	defer backupManager.Close()
+
+	return backupManager.Run(context.Background())
+}
+
+// restoreCommand restores the keys of a backup matching the given patterns
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	var opts backup.RestoreOptions
+	flags.Func("match", "glob-style key pattern to restore (repeatable)", func(pattern string) error {
+		opts.Patterns = append(opts.Patterns, pattern)
+		return nil
+	})
+	flags.BoolVar(&opts.Force, "force", false, "restore even if the target is older than the backup's RDB version")
+	flags.BoolVar(&opts.ReplayAOF, "aof", false, "replay the AOF segments shipped after the backup (requires -match '*')")
+	interactive := flags.Bool("interactive", false, "pick the backup from a list and confirm before restoring (all keys unless -match is given)")
+	fromStdin := flags.Bool("from-stdin", false, "read the backup from stdin instead of the storage; the optional name tells its format (e.g. backup.rdb.gz.gpg)")
+	estimate := flags.Bool("estimate", false, "predict the duration and memory needs of the restore without writing anything (all keys unless -match is given)")
+	flags.IntVar(&opts.KeysPerSecond, "max-keys-per-sec", 0, "limit the number of keys restored per second (0 = unlimited)")
+	flags.Func("max-bytes-per-sec", "limit the data restored per second, e.g. 20MB (0 = unlimited)", func(value string) error {
+		size, err := config.ParseSize(value)
+		opts.BytesPerSecond = size
+		return err
+	})
+	flags.DurationVar(&opts.Progress, "progress", 10*time.Second, "interval between progress logs (0 = disabled)")
+	resume := flags.String("resume", "", "resume token logged by an interrupted restore")
+	flags.StringVar(&opts.Conflict, "on-conflict", backup.ConflictReplace, "what to do with keys that already exist: replace, skip or fail")
+	flags.BoolVar(&opts.Flush, "yes-flush-target", false, "delete every key of the target with FLUSHALL before restoring, after a safety backup (requires -match '*')")
+	flags.StringVar(&opts.FlushConfirm, "confirm-target", "", "address (host:port) of the target, confirming -yes-flush-target without a prompt")
+	_ = flags.Parse(args)
+
+	if (*interactive || *estimate) && len(opts.Patterns) == 0 {
+		opts.Patterns = []string{"*"}
+	}
+	validArgs := flags.NArg() == 1 || (*interactive || *fromStdin) && flags.NArg() == 0
+	if !validArgs || len(opts.Patterns) == 0 || *fromStdin && (*interactive || opts.ReplayAOF) || *estimate && (*interactive || *fromStdin) {
+		return fmt.Errorf("usage: redis-backup restore [-force] [-aof] [-on-conflict replace|skip|fail] [-yes-flush-target [-confirm-target <host:port>]] [-max-keys-per-sec <n>] [-max-bytes-per-sec <size>] [-progress <interval>] [-resume <token>] -match <pattern> [-match <pattern>...] <backup-name> | restore -interactive [-force] [-aof] [-match <pattern>...] | restore -from-stdin [-force] -match <pattern> [-match <pattern>...] [<backup-name>] | restore -estimate [-match <pattern>...] <backup-name>")
+	}
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	cfg, backupManager, err := newManager(cfg.ForRestore(), store)
+	if err != nil {
+		return err
+	}
+	defer backupManager.Close()
+
+	if *resume != "" {
+		if opts.Resume, err = backup.ParseRestoreCursor(*resume); err != nil {
+			return err
+		}
+	}
+
+	// An interrupted restore logs its resume token
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	opts.DB = cfg.RestoreRedisDB
+	name := flags.Arg(0)
+	in := bufio.NewReader(os.Stdin)
+	if *estimate {
+		estimate, err := backupManager.EstimateRestore(ctx, name, opts)
+		if err != nil {
+			return err
+		}
+		return printRestoreEstimate(estimate)
+	}
+	if *interactive {
+		if name, err = pickRestore(ctx, cfg, store, opts, in); err != nil {
+			return err
+		}
+	}
+	if opts.Flush && opts.FlushConfirm == "" {
+		if *fromStdin {
+			return errors.New("-yes-flush-target with -from-stdin needs -confirm-target, stdin holds the backup")
+		}
+		if opts.FlushConfirm, err = promptFlushTarget(backupManager.FlushTarget(), in); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Restoring into %s:%s", cfg.RedisHost, cfg.RedisPort)
+	var result backup.RestoreResult
+	if *fromStdin {
+		log.Printf("Reading backup from stdin...")
+		result, err = backupManager.RestoreStream(ctx, os.Stdin, name, opts)
+	} else {
+		result, err = backupManager.Restore(ctx, name, opts)
+	}
+	log.Printf("Restored %d key(s), skipped %d expired key(s)", result.Restored, result.Expired)
+	if opts.Conflict != "" && opts.Conflict != backup.ConflictReplace {
+		log.Printf("Existing keys (on conflict: %s): %d skipped, %d conflicting", opts.Conflict, result.Skipped, result.Conflicts)
+	}
+	if result.Deleted > 0 {
+		log.Printf("Deleted %d key(s) removed since the full backup", result.Deleted)
+	}
+	if opts.ReplayAOF {
+		log.Printf("Replayed %d AOF command(s)", result.Replayed)
+	}
+	if err != nil && result.Cursor != nil {
+		log.Printf("Restore interrupted, continue it with: -resume %s", result.Cursor.Token())
+	}
+	return err
+}
+
+// promptFlushTarget asks the operator to type the address of the target
+// before it is flushed
+func promptFlushTarget(target string, in *bufio.Reader) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", errors.New("-yes-flush-target needs -confirm-target or a terminal")
+	}
+	fmt.Fprintf(os.Stderr, "Every key of %s will be deleted before the restore. Type its address to confirm: ", target)
+	answer, err := in.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+// printRestoreEstimate prints a restore estimate and fails when the restored
+// keys don't fit in the memory of the target
+func printRestoreEstimate(estimate *backup.RestoreEstimate) error {
+	scope := "every key"
+	if estimate.Partial {
+		scope = "upper bound, the key patterns select part of the backup"
+	}
+	fmt.Printf("Backup:   %s\n", estimate.Backup)
+	fmt.Printf("Target:   %s\n", estimate.Target)
+	fmt.Printf("Data:     %s RDB, %d key(s) (%s)\n", config.FormatSize(estimate.Bytes), estimate.Keys, scope)
+	if estimate.Duration > 0 {
+		fmt.Printf("Duration: about %s (%s)\n", estimate.Duration.Round(time.Second), estimate.DurationBasis)
+	} else {
+		fmt.Printf("Duration: unknown (%s)\n", estimate.DurationBasis)
+	}
+	memory := "about " + config.FormatSize(estimate.Memory)
+	if estimate.MemoryLowerBound {
+		memory = "at least " + config.FormatSize(estimate.Memory) + " (size of the backup, the manifest has no memory usage)"
+	}
+	fmt.Printf("Memory:   %s\n", memory)
+
+	fits, known := estimate.Fits()
+	switch {
+	case !known:
+		fmt.Printf("Usage:    %s used, memory limit unknown\n", config.FormatSize(estimate.UsedMemory))
+	case fits:
+		fmt.Printf("Usage:    %s used of %s, the keys fit\n", config.FormatSize(estimate.UsedMemory), config.FormatSize(estimate.MemoryLimit))
+	default:
+		fmt.Printf("Usage:    %s used of %s, the keys may not fit\n", config.FormatSize(estimate.UsedMemory), config.FormatSize(estimate.MemoryLimit))
+		return fmt.Errorf("the restored keys need %s but only %s is free on the target",
+			config.FormatSize(estimate.Memory), config.FormatSize(max(estimate.MemoryLimit-estimate.UsedMemory, 0)))
+	}
+	return nil
+}
+
+// copyCommand copies backups (all of them by default) to another storage
+func copyCommand(args []string) error {
+	flags := flag.NewFlagSet("copy", flag.ExitOnError)
+	to := flags.String("to", "", "destination: s3://bucket/prefix, gs://bucket/prefix or a local path")
+	_ = flags.Parse(args)
+
+	if *to == "" {
+		return fmt.Errorf("usage: redis-backup copy -to <s3://bucket/prefix|gs://bucket/prefix|/path> [<backup-name>...]")
+	}
+
+	cfg, src, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	if closer, ok := src.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	dstCfg, err := cfg.ForStorageURI(*to)
+	if err != nil {
+		return err
+	}
+	dst, err := storage.New(dstCfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize destination storage: %w", err)
+	}
+	if closer, ok := dst.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	result, err := backup.CopyBackups(context.Background(), src, dst, flags.Args())
+	log.Printf("Copied %d backup(s), skipped %d already present", result.Copied, result.Skipped)
+	return err
+}
+
+// importCommand adopts RDB files not created by the service as backups
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	from := flags.String("from", "", "storage to scan (default: the configured storage)")
+	var opts backup.ImportOptions
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "only print what would be imported")
+	flags.BoolVar(&opts.DeleteOriginals, "delete", false, "delete each original file once imported")
+	_ = flags.Parse(args)
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	src := store
+	if *from != "" {
+		srcCfg, err := cfg.ForStorageURI(*from)
+		if err != nil {
+			return err
+		}
+		// Importing from the configured storage itself renames the files in place
+		if filepath.Clean(srcCfg.StorageURI()) != filepath.Clean(cfg.StorageURI()) {
+			if src, err = storage.New(srcCfg); err != nil {
+				return fmt.Errorf("failed to initialize source storage: %w", err)
+			}
+			if closer, ok := src.(io.Closer); ok {
+				defer closer.Close()
+			}
+		}
+	}
+
+	backupManager, err := backup.NewOffline(cfg, store)
+	if err != nil {
+		return fmt.Errorf("failed to initialize backup manager: %w", err)
+	}
+
+	result, err := backupManager.Import(context.Background(), src, opts)
+	log.Printf("Imported %d file(s), skipped %d, failed %d", result.Imported, result.Skipped, result.Failed)
+	return err
+}
+
+// verifyCommand downloads a backup and checks it against its manifest
+// It does not need Redis, so it can run from CI
+func verifyCommand(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	latest := flags.Bool("latest", false, "verify the most recent backup")
+	_ = flags.Parse(args)
+
+	if (flags.NArg() == 1) == *latest || flags.NArg() > 1 {
+		return fmt.Errorf("usage: redis-backup verify <backup-name> | verify -latest")
+	}
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	backupManager, err := backup.NewOffline(cfg, store)
+	if err != nil {
+		return fmt.Errorf("failed to initialize backup manager: %w", err)
+	}
+
+	ctx := context.Background()
+	name := flags.Arg(0)
+	if *latest {
+		if name, err = backupManager.LatestBackup(ctx); err != nil {
+			return err
+		}
+	}
+
+	result, err := backupManager.Verify(ctx, name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	checked := "RDB structure and checksum"
+	if result.Manifest {
+		checked += ", manifest size, checksums and key count"
+	}
+	if result.Signature != "" {
+		checked += ", signature of " + result.Signature
+	}
+	log.Printf("%s OK: %d key(s), %s, sha256 %s (%s)", name, result.Keys, config.FormatSize(result.SizeBytes), result.SHA256, checked)
+	return nil
+}
+
+// exportCommand writes the keys of a backup, or of the live Redis, as JSON lines or CSV
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	opts := backup.ExportOptions{}
+	flags.StringVar(&opts.Format, "format", "json", "output format: json (one object per line), csv or resp (for redis-cli --pipe)")
+	flags.Func("match", "glob-style key pattern to export (repeatable, default: every key)", func(pattern string) error {
+		opts.Patterns = append(opts.Patterns, pattern)
+		return nil
+	})
+	flags.IntVar(&opts.DB, "db", -1, "only export this database (-1 = every database)")
+	maxValueSize := flags.String("max-value-size", "1KB", "truncate strings and collection elements to this size (0 = no limit)")
+	flags.IntVar(&opts.MaxElements, "max-elements", 100, "truncate collections to this many elements (0 = no limit)")
+	flags.IntVar(&opts.Limit, "limit", 0, "stop after this many keys (0 = no limit)")
+	output := flags.String("o", "", "file to write (default: standard output)")
+	latest := flags.Bool("latest", false, "export the most recent backup")
+	live := flags.Bool("live", false, "export the live Redis with SCAN instead of a backup")
+	_ = flags.Parse(args)
+
+	sources := flags.NArg()
+	if *latest {
+		sources++
+	}
+	if *live {
+		sources++
+	}
+	if sources != 1 || flags.NArg() > 1 {
+		return fmt.Errorf("usage: redis-backup export [flags] <backup-name> | export -latest [flags] | export -live [flags]")
+	}
+	size, err := config.ParseSize(*maxValueSize)
+	if err != nil {
+		return fmt.Errorf("invalid -max-value-size: %w", err)
+	}
+	opts.MaxValueSize = int(size)
+
+	// Mass insert needs the whole values, the truncation defaults don't apply
+	if opts.Format == "resp" {
+		set := map[string]bool{}
+		flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["max-value-size"] {
+			opts.MaxValueSize = 0
+		}
+		if !set["max-elements"] {
+			opts.MaxElements = 0
+		}
+	}
+
+	var backupManager *backup.Manager
+	if *live {
+		_, backupManager, err = setup()
+	} else {
+		var cfg *config.Config
+		var store storage.Storage
+		if cfg, store, err = setupStorage(); err == nil {
+			backupManager, err = backup.NewOffline(cfg, store)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer backupManager.Close()
+
+	ctx := context.Background()
+	name := flags.Arg(0)
+	if *latest {
+		if name, err = backupManager.LatestBackup(ctx); err != nil {
+			return err
+		}
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer file.Close()
+		w = file
+	}
+	buffered := bufio.NewWriter(w)
+
+	var result backup.ExportResult
+	if *live {
+		result, err = backupManager.ExportLive(ctx, buffered, opts)
+	} else {
+		result, err = backupManager.Export(ctx, name, buffered, opts)
+	}
+	if flushErr := buffered.Flush(); err == nil && flushErr != nil {
+		err = fmt.Errorf("failed to write export: %w", flushErr)
+	}
+	if opts.Format == "resp" {
+		log.Printf("Exported %d key(s) as commands, skipped %d (streams and module types)", result.Exported, result.Undecoded)
+	} else {
+		log.Printf("Exported %d key(s), %d truncated, %d without value (streams and module types)", result.Exported, result.Truncated, result.Undecoded)
+	}
+	return err
+}
+
+// rekeyCommand re-encrypts backups (all of them by default) with the current key
+func rekeyCommand(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	_, backupManager, err := setup()
+	if err != nil {
+		return err
+	}
+	defer backupManager.Close()
+
+	rekeyed, err := backupManager.Rekey(context.Background(), flags.Args())
+	log.Printf("Re-encrypted %d backup(s)", rekeyed)
+	return err
+}
+
+// signCommand signs the backups stored without a signature
+// It does not need Redis
+func signCommand(args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	backupManager, err := backup.NewOffline(cfg, store)
+	if err != nil {
+		return fmt.Errorf("failed to initialize backup manager: %w", err)
+	}
+
+	signed, err := backupManager.Sign(context.Background(), flags.Args())
+	log.Printf("Signed %d backup(s)", signed)
+	return err
+}
+
+// restoreFunctionsCommand restores the functions saved alongside a backup
+func restoreFunctionsCommand(args []string) error {
+	flags := flag.NewFlagSet("restore-functions", flag.ExitOnError)
+	policy := flags.String("policy", "APPEND", "FUNCTION RESTORE policy: APPEND, REPLACE or FLUSH")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: redis-backup restore-functions [-policy APPEND|REPLACE|FLUSH] <backup-name>")
+	}
+
+	_, backupManager, err := setupRestore()
+	if err != nil {
+		return err
+	}
+	defer backupManager.Close()
+
+	return backupManager.RestoreFunctions(context.Background(), flags.Arg(0), *policy)
+}
+
+// listCommand prints the stored backups and the total storage usage
+func listCommand(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+
+	objects, err := store.ListObjects(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	pinned := backup.PinnedBackups(context.Background(), store, objects, cfg.PinTag)
+	_, partial := backup.BackupSets(objects)
+
+	var total int64
+	for _, obj := range objects {
+		total += obj.Size
+		if storage.IsBackupName(obj.Name) {
+			note := ""
+			if pinned[obj.Name] {
+				note = "  pinned"
+			}
+			if slices.Contains(partial, obj.Name) {
+				note += "  incomplete"
+			}
+			fmt.Printf("%-50s %10s  %s%s\n", obj.Name, config.FormatSize(obj.Size), obj.ModTime.UTC().Format("2006-01-02 15:04:05"), note)
+		}
+	}
+
+	fmt.Printf("\nTotal storage usage: %s in %d object(s) (%s)\n", config.FormatSize(total), len(objects), store.Type())
+	if cfg.StorageQuota > 0 {
+		fmt.Printf("Storage quota: %s (%.1f%% used)\n", config.FormatSize(cfg.StorageQuota), float64(total)*100/float64(cfg.StorageQuota))
+	}
+	return nil
+}
+
+// manifestCommand prints the manifest (size and key statistics) of a backup
+func manifestCommand(args []string) error {
+	flags := flag.NewFlagSet("manifest", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: redis-backup manifest <backup-name>")
+	}
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	keyring, err := crypt.NewKeyring(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize encryption: %w", err)
+	}
+
+	manifest, err := backup.LoadManifest(context.Background(), store, flags.Arg(0), keyring)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// snapshotCommand takes a backup now and pins it, printing the names of the
+// backups stored on stdout
+func snapshotCommand(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	reason := flags.String("reason", "", "why the snapshot is taken (e.g. a deployment ID), recorded in the pin and the audit log")
+	pinDays := flags.Int("pin-days", -1, "days the snapshot stays pinned (0 = until unpinned, default SNAPSHOT_PIN_DAYS)")
+	_ = flags.Parse(args)
+
+	if *reason == "" || flags.NArg() != 0 || *pinDays < -1 {
+		return fmt.Errorf("usage: redis-backup snapshot -reason <text> [-pin-days <n>]")
+	}
+
+	cfg, backupManager, err := setup()
+	if err != nil {
+		return err
+	}
+	defer backupManager.Close()
+	if cfg.TargetDiscovery == "kubernetes" {
+		return errors.New("snapshot is not available with TARGET_DISCOVERY")
+	}
+	if *pinDays == -1 {
+		*pinDays = cfg.SnapshotPinDays
+	}
+
+	stored, err := backupManager.Snapshot(context.Background(), *reason, *pinDays)
+	if err != nil {
+		return err
+	}
+	for _, backup := range stored {
+		fmt.Println(backup.Name)
+	}
+	return nil
+}
+
+// configCommand prints the effective configuration with its sources, secrets
+// redacted, then fails if it does not validate
+func configCommand(args []string) error {
+	usage := errors.New("usage: redis-backup config show [-changed] [-json]")
+	if len(args) == 0 || args[0] != "show" {
+		return usage
+	}
+	flags := flag.NewFlagSet("config show", flag.ExitOnError)
+	changed := flags.Bool("changed", false, "only print the variables set in the environment, the .env file or by PROFILE")
+	asJSON := flags.Bool("json", false, "print the settings as JSON")
+	_ = flags.Parse(args[1:])
+	if flags.NArg() != 0 {
+		return usage
+	}
+
+	var settings []config.Setting
+	for _, setting := range config.Settings() {
+		if *changed && (setting.Source == config.SourceDefault || setting.Source == config.SourceUnset) {
+			continue
+		}
+		settings = append(settings, setting)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(settings); err != nil {
+			return err
+		}
+	} else {
+		for _, setting := range settings {
+			fmt.Printf("%-50s # %s\n", setting.Name+"="+setting.Value, setting.Source)
+		}
+	}
+
+	if _, err := config.Load(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return nil
+}
+
+// scheduleCommand prints the next runs of BACKUP_CRON, as text, JSON or an
+// iCalendar to import in a maintenance calendar
+func scheduleCommand(args []string) error {
+	flags := flag.NewFlagSet("schedule", flag.ExitOnError)
+	count := flags.Int("count", backup.DefaultScheduleRuns, "number of runs to print")
+	asJSON := flags.Bool("json", false, "print the runs as JSON")
+	asICal := flags.Bool("ics", false, "print the runs as an iCalendar")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 || (*asJSON && *asICal) {
+		return errors.New("usage: redis-backup schedule [-count <n>] [-json | -ics]")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	targets := []string{cfg.Target()}
+	if cfg.TargetDiscovery == "kubernetes" {
+		kubeClient, err := kube.NewInClusterClient()
+		if err != nil {
+			return fmt.Errorf("failed to initialize Kubernetes client: %w", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		targets, err = discoverTargets(cfg, kubeClient)(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	runs, err := backup.Schedule(cfg, now, *count, targets)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *asICal:
+		return backup.WriteICal(os.Stdout, runs, now)
+	case *asJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(runs)
+	}
+	for _, run := range runs {
+		fmt.Printf("%s  until %s  %s\n", run.Start.Local().Format("2006-01-02 15:04:05 MST"),
+			run.End.Local().Format("15:04:05"), strings.Join(run.Targets, ", "))
+	}
+	return nil
+}
+
+// maintenanceCommand opens or closes the maintenance window of a target,
+// during which its backups still run but their failures are not alerted
+func maintenanceCommand(args []string) error {
+	usage := errors.New("usage: redis-backup maintenance on|off|status [-reason <text>] [-duration <d>] [-target <service>]")
+	if len(args) == 0 {
+		return usage
+	}
+	action := args[0]
+	flags := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	reason := flags.String("reason", "", "why the failure alerts are muted, required with on")
+	duration := flags.Duration("duration", time.Hour, "how long the failure alerts are muted, at most MAINTENANCE_MAX_DURATION")
+	target := flags.String("target", "", "discovered service in maintenance, with TARGET_DISCOVERY")
+	_ = flags.Parse(args[1:])
+	if flags.NArg() != 0 || (action != "on" && action != "off" && action != "status") {
+		return usage
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if *target != "" {
+		if cfg, err = targetConfig(cfg, *target); err != nil {
+			return err
+		}
+	}
+	store, err := storage.New(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage: %w", err)
+	}
+
+	ctx := context.Background()
+	switch action {
+	case "on":
+		window, err := backup.StartMaintenance(ctx, cfg, store, *reason, *duration)
+		details := "on"
+		if window != nil {
+			details = "on until " + window.Until.Format(time.RFC3339)
+		}
+		backup.Audit(ctx, cfg, store, backup.AuditEntry{Operation: "maintenance", Target: cfg.Target(), Details: details, Reason: *reason}, err)
+		if err != nil {
+			return err
+		}
+		log.Printf("%s in maintenance until %s, its failures are not alerted", cfg.Target(), window.Until.Format(time.RFC3339))
+	case "off":
+		err := backup.EndMaintenance(ctx, cfg, store)
+		backup.Audit(ctx, cfg, store, backup.AuditEntry{Operation: "maintenance", Target: cfg.Target(), Details: "off"}, err)
+		if err != nil {
+			return err
+		}
+		log.Printf("Maintenance of %s ended", cfg.Target())
+	default:
+		window, err := backup.LoadMaintenance(ctx, store)
+		if err != nil {
+			return err
+		}
+		if window == nil {
+			fmt.Printf("%s is not in maintenance\n", cfg.Target())
+			return nil
+		}
+		fmt.Printf("%s is in maintenance until %s: %s\n", cfg.Target(), window.Until.Format(time.RFC3339), window.Reason)
+	}
+	return nil
+}
+
+// pinCommand pins a backup so the retention policy never deletes it
+func pinCommand(args []string) error {
+	flags := flag.NewFlagSet("pin", flag.ExitOnError)
+	reason := flags.String("reason", "", "why the backup is kept, recorded in the pin")
+	days := flags.Int("days", 0, "days the backup stays pinned (0 = until unpinned)")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 || *days < 0 {
+		return fmt.Errorf("usage: redis-backup pin [-reason <text>] [-days <n>] <backup-name>")
+	}
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+
+	var until time.Time
+	if *days > 0 {
+		until = time.Now().AddDate(0, 0, *days)
+	}
+	ctx := context.Background()
+	err = backup.PinBackup(ctx, store, flags.Arg(0), *reason, until)
+	backup.Audit(ctx, cfg, store, backup.AuditEntry{Operation: "pin", Target: flags.Arg(0), Details: *reason}, err)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s pinned, the retention policy will keep it", flags.Arg(0))
+	return nil
+}
+
+// unpinCommand removes the pin of a backup
+func unpinCommand(args []string) error {
+	flags := flag.NewFlagSet("unpin", flag.ExitOnError)
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: redis-backup unpin <backup-name>")
+	}
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	err = backup.UnpinBackup(ctx, store, flags.Arg(0))
+	backup.Audit(ctx, cfg, store, backup.AuditEntry{Operation: "unpin", Target: flags.Arg(0)}, err)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s unpinned", flags.Arg(0))
+	if cfg.PinTag != "" {
+		log.Printf("The backup stays pinned while its object is tagged %s", cfg.PinTag)
+	}
+	return nil
+}
+
+// deleteCommand deletes backups with their sidecars
+// In compliance mode, the unlock token must be given with -unlock
+func deleteCommand(args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	unlock := flags.String("unlock", "", "unlock token required in compliance mode")
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: redis-backup delete [-unlock <token>] <backup-name>...")
+	}
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	backupManager, err := backup.NewOffline(cfg, store)
+	if err != nil {
+		return fmt.Errorf("failed to initialize backup manager: %w", err)
+	}
+
+	deleted, err := backupManager.DeleteBackups(context.Background(), flags.Args(), *unlock)
+	if err != nil {
+		return err
+	}
+	log.Printf("Deleted %d backup(s)", deleted)
+	if deleted < flags.NArg() {
+		return fmt.Errorf("failed to delete %d backup(s)", flags.NArg()-deleted)
+	}
+	return nil
+}
+
+// fsckCommand checks the consistency of the storage and optionally repairs
+// the set manifests
+// It fails when issues are left
+func fsckCommand(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	verify := flags.Bool("verify", false, "also download and verify every backup")
+	repair := flags.Bool("repair", false, "rewrite the set manifests that don't match the storage")
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: redis-backup fsck [-verify] [-repair] [-json]")
+	}
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	backupManager, err := backup.NewOffline(cfg, store)
+	if err != nil {
+		return fmt.Errorf("failed to initialize backup manager: %w", err)
+	}
+
+	result, err := backupManager.Fsck(context.Background(), backup.FsckOptions{Verify: *verify, Repair: *repair})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		for _, issue := range result.Issues {
+			repaired := ""
+			if issue.Repaired {
+				repaired = "  (repaired)"
+			}
+			fmt.Printf("%-18s %-60s %s%s\n", issue.Kind, issue.Object, issue.Detail, repaired)
+		}
+		fmt.Printf("\nChecked %d backup(s) in %d object(s): %d issue(s), %d repaired\n",
+			result.Backups, result.Objects, len(result.Issues), len(result.Issues)-result.Unrepaired())
+	}
+
+	if left := result.Unrepaired(); left > 0 {
+		return fmt.Errorf("%d issue(s) found", left)
+	}
+	return nil
+}
+
+// doctorCommand checks that this build can decode every backup, listing the
+// builds that stored them
+// It fails when warnings are found
+func doctorCommand(args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: redis-backup doctor [-json]")
+	}
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	backupManager, err := backup.NewOffline(cfg, store)
+	if err != nil {
+		return fmt.Errorf("failed to initialize backup manager: %w", err)
+	}
+
+	result, err := backupManager.Doctor(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		for _, warning := range result.Warnings {
+			fmt.Printf("%-18s %-60s %s\n", warning.Kind, warning.Backup, warning.Detail)
+		}
+		fmt.Printf("\nChecked %d backup(s) with %s %s: %d warning(s)\n", result.Backups, result.Tool.Name, result.Tool, len(result.Warnings))
+		tools := make([]string, 0, len(result.Tools))
+		for tool := range result.Tools {
+			tools = append(tools, tool)
+		}
+		slices.Sort(tools)
+		for _, tool := range tools {
+			fmt.Printf("  stored by %s: %d\n", tool, result.Tools[tool])
+		}
+		if result.Untracked > 0 {
+			fmt.Printf("  stored before build metadata: %d\n", result.Untracked)
+		}
+	}
+
+	if len(result.Warnings) > 0 {
+		return fmt.Errorf("%d warning(s) found", len(result.Warnings))
+	}
+	return nil
+}
+
+// cleanupCommand removes the partial uploads left by failed uploads
+func cleanupCommand(args []string) error {
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	maxAge := flags.Duration("max-age", 0, "only remove partial uploads older than this (default PARTIAL_UPLOAD_MAX_AGE)")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: redis-backup cleanup [-max-age <duration>]")
+	}
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+	backupManager, err := backup.NewOffline(cfg, store)
+	if err != nil {
+		return fmt.Errorf("failed to initialize backup manager: %w", err)
+	}
+
+	if *maxAge == 0 {
+		*maxAge = time.Duration(cfg.PartialUploadMaxAge) * time.Hour
+	}
+	removed, err := backupManager.CleanupPartialUploads(context.Background(), *maxAge)
+	for _, name := range removed {
+		log.Printf("Removed partial upload %s", name)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed %d partial upload(s) older than %s", len(removed), *maxAge)
+	return nil
+}
+
+// reportCommand prints the trends of the backups: size growth, durations,
+// failure rate and when the storage quota will be reached
+func reportCommand(args []string) error {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	target := flags.String("target", "", "discovered service to report on, with TARGET_DISCOVERY")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: redis-backup report [-json] [-target <service>]")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if *target != "" {
+		if cfg, err = targetConfig(cfg, *target); err != nil {
+			return err
+		}
+	}
+	store, err := storage.New(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage: %w", err)
+	}
+	backupManager, err := backup.NewOffline(cfg, store)
+	if err != nil {
+		return err
+	}
+	defer backupManager.Close()
+
+	report, err := backupManager.Report(context.Background())
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	printReport(report)
+	return nil
+}
+
+// printReport prints a report as a table
+func printReport(report *backup.Report) {
+	fmt.Printf("Target: %s (%s)\n\n", report.Target, report.GeneratedAt.Format("2006-01-02 15:04 MST"))
+
+	row := func(label string, value func(period backup.ReportPeriod) string) {
+		fmt.Printf("%-18s", label)
+		for _, period := range report.Periods {
+			fmt.Printf("%-18s", value(period))
+		}
+		fmt.Println()
+	}
+	row("", func(period backup.ReportPeriod) string { return fmt.Sprintf("Last %d days", period.Days) })
+	row("Runs", func(period backup.ReportPeriod) string { return strconv.Itoa(period.Runs) })
+	row("Failures", func(period backup.ReportPeriod) string {
+		return fmt.Sprintf("%d (%.1f%%)", period.Failures, period.FailureRate*100)
+	})
+	row("Average duration", func(period backup.ReportPeriod) string {
+		return time.Duration(period.AverageDuration * float64(time.Second)).Round(100 * time.Millisecond).String()
+	})
+	row("Average size", func(period backup.ReportPeriod) string {
+		if period.SizeBasis == "" {
+			return "-"
+		}
+		return config.FormatSize(period.AverageBytes)
+	})
+	row("Size growth", func(period backup.ReportPeriod) string {
+		if period.SizeBasis == "" {
+			return "-"
+		}
+		return formatGrowth(period.SizeGrowth)
+	})
+	fmt.Println()
+
+	usage := report.Storage
+	line := "Storage: " + config.FormatSize(usage.Bytes) + " used"
+	if usage.Quota > 0 {
+		line += " of " + config.FormatSize(usage.Quota) + " (STORAGE_QUOTA)"
+	}
+	switch {
+	case !usage.GrowthKnown:
+		line += ", growth unknown until a run is recorded"
+	case usage.Quota > 0 && usage.Bytes >= usage.Quota:
+		line += ", quota exceeded"
+	case usage.FullAt != nil:
+		line += fmt.Sprintf(", growing %s, full around %s (in %d days)", formatGrowth(usage.Growth),
+			usage.FullAt.Format("2006-01-02"), int(usage.FullAt.Sub(report.GeneratedAt).Hours()/24))
+	default:
+		line += ", " + formatGrowth(usage.Growth)
+	}
+	fmt.Println(line)
+	for _, period := range report.Periods {
+		if period.SizeBasis == "catalog" {
+			fmt.Printf("Sizes over the last %d days come from the stored backups, the run history is too short\n", period.Days)
+		}
+	}
+}
+
+// formatGrowth formats a growth in bytes per day
+func formatGrowth(perDay float64) string {
+	if perDay < 0 {
+		return "-" + config.FormatSize(int64(-perDay)) + "/day"
+	}
+	return "+" + config.FormatSize(int64(perDay)) + "/day"
+}
+
+// auditCommand prints the entries of the audit log
+// It reads AUDIT_LOG_FILE when set, the audit objects in the storage otherwise
+func auditCommand(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	since := flags.Duration("since", 30*24*time.Hour, "only show entries more recent than this")
+	operation := flags.String("operation", "", "only show this operation (backup, restore, delete, ...)")
+	target := flags.String("target", "", "only show entries whose target contains this text")
+	fromStorage := flags.Bool("storage", false, "read the audit objects in the storage even when AUDIT_LOG_FILE is set")
+	asJSON := flags.Bool("json", false, "print the entries as JSON lines")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: redis-backup audit [-since <duration>] [-operation <name>] [-target <text>] [-storage] [-json]")
+	}
+
+	cfg, store, err := setupStorage()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var entries []backup.AuditEntry
+	if cfg.AuditLogFile != "" && !*fromStorage {
+		entries, err = backup.ReadAuditFile(cfg.AuditLogFile)
+	} else {
+		entries, err = backup.ReadAuditObjects(context.Background(), store, now.Add(-*since), now)
+	}
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, entry := range entries {
+		if entry.Time.Before(now.Add(-*since)) ||
+			(*operation != "" && entry.Operation != *operation) ||
+			!strings.Contains(entry.Target, *target) {
+			continue
+		}
+		if *asJSON {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		notes := []string{entry.Reason, entry.Details, entry.Error}
+		notes = slices.DeleteFunc(notes, func(note string) bool { return note == "" })
+		fmt.Printf("%s  %-17s %-45s %-8s %s  %s\n", entry.Time.UTC().Format("2006-01-02 15:04:05"),
+			entry.Operation, entry.Target, entry.Result, entry.Actor, strings.Join(notes, "; "))
+	}
+	return nil
+}
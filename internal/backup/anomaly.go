@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/notify"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// checkMaxSize enforces MAX_BACKUP_SIZE before a backup is uploaded
+// It returns an error when the upload must be aborted
+func (m *Manager) checkMaxSize(ctx context.Context, backupName, localPath string) error {
+	if m.cfg.MaxBackupSize <= 0 {
+		return nil
+	}
+
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to check backup size: %w", err)
+	}
+	if stat.Size() <= m.cfg.MaxBackupSize {
+		return nil
+	}
+
+	message := fmt.Sprintf("Backup %s is %s, larger than MAX_BACKUP_SIZE (%s)",
+		backupName, config.FormatSize(stat.Size()), config.FormatSize(m.cfg.MaxBackupSize))
+	abort := m.cfg.MaxBackupSizeAction == "abort"
+	if abort {
+		message += ", upload aborted"
+	}
+	log.Printf("WARNING: %s", message)
+
+	err = m.notifier.Notify(ctx, notify.Event{
+		Type:    notify.EventBackupTooBig,
+		Message: message,
+		Details: map[string]interface{}{
+			"backup":     backupName,
+			"size_bytes": stat.Size(),
+			"max_bytes":  m.cfg.MaxBackupSize,
+			"aborted":    abort,
+		},
+	})
+	if err != nil {
+		log.Printf("Warning: failed to send backup size notification: %v", err)
+	}
+
+	if abort {
+		return fmt.Errorf("backup size %s exceeds MAX_BACKUP_SIZE %s",
+			config.FormatSize(stat.Size()), config.FormatSize(m.cfg.MaxBackupSize))
+	}
+	return nil
+}
+
+// checkSizeAnomaly compares a new backup with the average of the previous
+// backups of its series and sends a notification when it deviates too much
+// A sudden drop usually means a flushed Redis, a sudden growth runaway keys
+func (m *Manager) checkSizeAnomaly(ctx context.Context, backupName, localPath string) {
+	if m.cfg.SizeAnomalyDropPercent <= 0 && m.cfg.SizeAnomalyGrowthPercent <= 0 {
+		return
+	}
+
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		log.Printf("Warning: failed to check backup size: %v", err)
+		return
+	}
+	size := stat.Size()
+
+	average, count, err := m.averageBackupSize(ctx, backupName)
+	if err != nil {
+		log.Printf("Warning: failed to check backup size: %v", err)
+		return
+	}
+	if count == 0 || average == 0 {
+		return
+	}
+
+	delta := (float64(size) - average) * 100 / average
+	drop := m.cfg.SizeAnomalyDropPercent > 0 && -delta > m.cfg.SizeAnomalyDropPercent
+	growth := m.cfg.SizeAnomalyGrowthPercent > 0 && delta > m.cfg.SizeAnomalyGrowthPercent
+	if !drop && !growth {
+		return
+	}
+
+	message := fmt.Sprintf("Backup %s is %s (%+.1f%%) compared to the average of the last %d backup(s) (%s)",
+		backupName, config.FormatSize(size), delta, count, config.FormatSize(int64(average)))
+	log.Printf("WARNING: %s", message)
+
+	err = m.notifier.Notify(ctx, notify.Event{
+		Type:    notify.EventSizeAnomaly,
+		Message: message,
+		Details: map[string]interface{}{
+			"backup":        backupName,
+			"size_bytes":    size,
+			"average_bytes": int64(average),
+			"delta_percent": delta,
+			"window":        count,
+		},
+	})
+	if err != nil {
+		log.Printf("Warning: failed to send size anomaly notification: %v", err)
+	}
+}
+
+// averageBackupSize returns the average size of the latest backups of the
+// same series as backupName (excluding it) and how many were used
+func (m *Manager) averageBackupSize(ctx context.Context, backupName string) (float64, int, error) {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	series := backupSeries(backupName)
+	var previous []storage.ObjectInfo
+	for _, obj := range objects {
+		if obj.Name == backupName || !storage.IsBackupName(obj.Name) || backupSeries(obj.Name) != series {
+			continue
+		}
+		previous = append(previous, obj)
+	}
+
+	// Names include the timestamp, so sorting keeps the latest last
+	sort.Slice(previous, func(i, j int) bool { return previous[i].Name < previous[j].Name })
+	if window := m.cfg.SizeAnomalyWindow; window > 0 && len(previous) > window {
+		previous = previous[len(previous)-window:]
+	}
+	if len(previous) == 0 {
+		return 0, 0, nil
+	}
+
+	var total int64
+	for _, obj := range previous {
+		total += obj.Size
+	}
+	return float64(total) / float64(len(previous)), len(previous), nil
+}
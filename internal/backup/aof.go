@@ -0,0 +1,569 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/storage"
+	"github.com/redis/go-redis/v9"
+)
+
+// aofMarkerKey is set in the same transaction as BGSAVE, so the position of the
+// snapshot in the AOF is known exactly
+const aofMarkerKey = "redis-backup:aof-marker"
+
+// aofSegmentInfix separates a backup name from the sequence number of its AOF segments
+const aofSegmentInfix = ".aof."
+
+// aofFile is an incremental file of a Redis 7 multi-part AOF
+type aofFile struct {
+	Name string
+	Seq  int
+}
+
+// aofStart is the position of a snapshot in the AOF
+type aofStart struct {
+	marker string
+	file   aofFile
+	offset int64
+}
+
+// aofShipper tracks the AOF data shipped after the latest backup
+type aofShipper struct {
+	mu sync.Mutex
+	// dir and manifest locate the AOF files, discovered on first use
+	dir      string
+	manifest string
+	// pending is the position of the snapshot being backed up
+	pending *aofStart
+	// backup is the backup the shipped segments follow
+	backup   string
+	file     *os.File
+	seq      int
+	offset   int64
+	segments int
+}
+
+// aofPaths discovers the AOF directory and manifest from the server configuration
+func (m *Manager) aofPaths(ctx context.Context) (string, string, error) {
+	s := m.aof
+	if s.dir != "" {
+		return s.dir, s.manifest, nil
+	}
+
+	dirName, fileName := "appendonlydir", "appendonly.aof"
+	if result, err := m.configGet(ctx, "appenddirname"); err == nil && result["appenddirname"] != "" {
+		dirName = result["appenddirname"]
+	}
+	if result, err := m.configGet(ctx, "appendfilename"); err == nil && result["appendfilename"] != "" {
+		fileName = result["appendfilename"]
+	}
+
+	dir := filepath.Join(m.cfg.RedisDataPath, dirName)
+	manifest := filepath.Join(dir, fileName+".manifest")
+	if _, err := os.Stat(manifest); err != nil {
+		return "", "", fmt.Errorf("AOF manifest not found (AOF shipping requires Redis 7 with appendonly yes): %w", err)
+	}
+	s.dir, s.manifest = dir, manifest
+	return dir, manifest, nil
+}
+
+// readAOFManifest returns the incremental files listed in a multi-part AOF manifest, by sequence
+func readAOFManifest(path string) ([]aofFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AOF manifest: %w", err)
+	}
+
+	var files []aofFile
+	for _, line := range strings.Split(string(data), "\n") {
+		// Each line is "file <name> seq <n> type <b|h|i>"
+		fields := strings.Fields(line)
+		var file aofFile
+		incremental := false
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				file.Name = fields[i+1]
+			case "seq":
+				file.Seq, _ = strconv.Atoi(fields[i+1])
+			case "type":
+				incremental = fields[i+1] == "i"
+			}
+		}
+		if incremental && file.Name != "" {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("AOF manifest lists no incremental file")
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Seq < files[j].Seq })
+	return files, nil
+}
+
+// markedBGSAVE starts BGSAVE in a transaction with a marker written to the AOF
+// The commands following the marker in the AOF are exactly those missing from the snapshot
+func (m *Manager) markedBGSAVE(ctx context.Context) error {
+	m.aof.mu.Lock()
+	m.aof.pending = nil
+	m.aof.mu.Unlock()
+
+	dir, manifest, err := m.aofPaths(ctx)
+	if err != nil {
+		return err
+	}
+	files, err := readAOFManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	// The end of the AOF before the transaction is at or before the marker
+	start := aofStart{file: files[len(files)-1]}
+	stat, err := os.Stat(filepath.Join(dir, start.file.Name))
+	if err != nil {
+		return fmt.Errorf("failed to read AOF position: %w", err)
+	}
+	start.offset = stat.Size()
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("failed to generate AOF marker: %w", err)
+	}
+	// The database is part of the marker since the AOF may not select it again
+	start.marker = fmt.Sprintf("%d:%s", m.cfg.RedisDB, hex.EncodeToString(buf))
+
+	_, err = m.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, aofMarkerKey, start.marker, 0)
+		pipe.Do(ctx, m.command("BGSAVE"))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.aof.mu.Lock()
+	m.aof.pending = &start
+	m.aof.mu.Unlock()
+	return nil
+}
+
+// followBackup makes the next AOF segments belong to a completed backup and
+// returns the marker of its snapshot, or an empty string when the snapshot
+// was not taken with a marker
+func (m *Manager) followBackup(backupName string) string {
+	s := m.aof
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := s.pending
+	if start == nil {
+		return ""
+	}
+	s.pending = nil
+
+	file, err := os.Open(filepath.Join(s.dir, start.file.Name))
+	if err != nil {
+		log.Printf("Warning: AOF shipping paused until the next backup: %v", err)
+		return ""
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.backup, s.file, s.seq, s.offset, s.segments = backupName, file, start.file.Seq, start.offset, 0
+	log.Printf("AOF shipping now follows %s", backupName)
+	return start.marker
+}
+
+// ShipAOF uploads the data appended to the AOF every AOF_SHIP_INTERVAL seconds
+// until ctx is canceled, then ships what remains
+// Shipping starts with the first backup taken after the service started
+func (m *Manager) ShipAOF(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(m.cfg.AOFShipInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := m.shipAOF(shutdownCtx); err != nil {
+				log.Printf("Warning: AOF shipping failed: %v", err)
+			}
+			m.aof.mu.Lock()
+			if m.aof.file != nil {
+				m.aof.file.Close()
+				m.aof.file = nil
+			}
+			m.aof.mu.Unlock()
+			return
+		case <-ticker.C:
+			if err := m.shipAOF(ctx); err != nil {
+				log.Printf("Warning: AOF shipping failed: %v", err)
+			}
+		}
+	}
+}
+
+// shipAOF uploads the AOF data appended since the last segment as a new segment
+// The files opened by AOF rewrites since then are followed in sequence; the
+// current file is kept open so it can still be read after Redis removes it
+func (m *Manager) shipAOF(ctx context.Context) error {
+	s := m.aof
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	// The manifest is read before copying: once it lists a newer file, Redis
+	// no longer appends to the older ones
+	files, err := readAOFManifest(s.manifest)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := m.createTemp(ctx, "redis-backup-aof-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer removeTemp(tmp)
+
+	file, seq, offset := s.file, s.seq, s.offset
+	var opened []*os.File
+	closeOpened := func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}
+
+	size := int64(0)
+	for {
+		n, err := io.Copy(tmp, io.NewSectionReader(file, offset, 1<<62))
+		size += n
+		offset += n
+		if err != nil {
+			closeOpened()
+			return fmt.Errorf("failed to read AOF: %w", err)
+		}
+
+		next := -1
+		for i, f := range files {
+			if f.Seq > seq {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		nextFile, err := os.Open(filepath.Join(s.dir, files[next].Name))
+		if err != nil || files[next].Seq != seq+1 {
+			// An AOF file was created and removed between two runs
+			closeOpened()
+			if err == nil {
+				nextFile.Close()
+			}
+			s.file.Close()
+			s.file, s.backup = nil, ""
+			return fmt.Errorf("AOF data was removed before being shipped, shipping resumes with the next backup")
+		}
+		opened = append(opened, nextFile)
+		file, seq, offset = nextFile, files[next].Seq, 0
+	}
+
+	if size > 0 {
+		if err := tmp.Close(); err != nil {
+			closeOpened()
+			return fmt.Errorf("failed to write temporary file: %w", err)
+		}
+		name := aofSegmentName(s.backup, s.segments+1)
+		if err := m.uploadBackup(ctx, tmp.Name(), name); err != nil {
+			closeOpened()
+			return fmt.Errorf("failed to upload %s: %w", name, err)
+		}
+		s.segments++
+	}
+
+	if file != s.file {
+		s.file.Close()
+		for _, f := range opened[:len(opened)-1] {
+			f.Close()
+		}
+		s.file = file
+	}
+	s.seq, s.offset = seq, offset
+	return nil
+}
+
+// aofSegmentName returns the name of an AOF segment following a backup
+// Transform suffixes (e.g. .gpg) stay last so segments are decoded like the backup
+func aofSegmentName(backupName string, seq int) string {
+	base, transforms := storage.SplitBackupName(backupName)
+	return fmt.Sprintf("%s%s%06d%s", base, aofSegmentInfix, seq, strings.Join(transforms, ""))
+}
+
+// aofSegments returns the AOF segments of a backup among objects, in order
+func aofSegments(objects []storage.ObjectInfo, backupName string) []string {
+	base, _ := storage.SplitBackupName(backupName)
+	prefix := base + aofSegmentInfix
+
+	type segment struct {
+		name string
+		seq  int
+	}
+	var segments []segment
+	for _, obj := range objects {
+		rest, ok := strings.CutPrefix(obj.Name, prefix)
+		if !ok {
+			continue
+		}
+		digits, _, _ := strings.Cut(rest, ".")
+		seq, err := strconv.Atoi(digits)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{obj.Name, seq})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+
+	names := make([]string, len(segments))
+	for i, s := range segments {
+		names[i] = s.name
+	}
+	return names
+}
+
+// replayAOF replays the commands of the AOF segments of a backup that follow
+// the marker of its snapshot, and returns how many were replayed
+func (m *Manager) replayAOF(ctx context.Context, backupName, marker string, opts RestoreOptions) (int, error) {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list objects: %w", err)
+	}
+	segments := aofSegments(objects, backupName)
+	if len(segments) == 0 {
+		log.Printf("No AOF segment follows %s", backupName)
+		return 0, nil
+	}
+	log.Printf("Replaying %d AOF segment(s) following %s", len(segments), backupName)
+
+	in := &segmentReader{ctx: ctx, m: m, names: segments}
+	defer in.Close()
+	commands := newAOFReader(in)
+
+	conn := m.conn()
+	defer conn.Close()
+	pipe := conn.Pipeline()
+	flush := func() error {
+		if pipe.Len() == 0 {
+			return nil
+		}
+		cmds, err := pipe.Exec(ctx)
+		for _, cmd := range cmds {
+			if cmd.Err() != nil {
+				return fmt.Errorf("failed to replay %s: %w", cmd.Name(), cmd.Err())
+			}
+		}
+		return err
+	}
+
+	// Before the marker, only the selected database and transactions are tracked
+	db, found, inMulti, skipToExec := -1, false, false, false
+	replayed := 0
+	for {
+		args, err := commands.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Printf("Warning: the last AOF command is incomplete and was skipped")
+			break
+		}
+		if err != nil {
+			return replayed, err
+		}
+		name := strings.ToUpper(args[0])
+
+		if !found {
+			switch {
+			case name == "SELECT" && len(args) == 2:
+				db, _ = strconv.Atoi(args[1])
+			case name == "MULTI":
+				inMulti = true
+			case name == "EXEC":
+				inMulti = false
+			case name == "SET" && len(args) >= 3 && args[1] == aofMarkerKey && args[2] == marker:
+				found, skipToExec = true, inMulti
+				if db < 0 {
+					markerDB, _, _ := strings.Cut(marker, ":")
+					db, _ = strconv.Atoi(markerDB)
+				}
+				if opts.DB >= 0 {
+					db = opts.DB
+				}
+				pipe.Do(ctx, "SELECT", db)
+			}
+			continue
+		}
+		if skipToExec {
+			// The rest of the marker transaction ran before the snapshot
+			skipToExec = name != "EXEC"
+			continue
+		}
+
+		cmdArgs := make([]interface{}, len(args))
+		for i, arg := range args {
+			cmdArgs[i] = arg
+		}
+		if name == "SELECT" && opts.DB >= 0 {
+			cmdArgs[1] = opts.DB
+		}
+		pipe.Do(ctx, cmdArgs...)
+		if name != "SELECT" && name != "MULTI" && name != "EXEC" {
+			replayed++
+		}
+		if pipe.Len() >= restoreBatchSize {
+			if err := flush(); err != nil {
+				return replayed, err
+			}
+		}
+	}
+
+	if !found {
+		return 0, fmt.Errorf("the AOF marker of %s was not found in its segments", backupName)
+	}
+	return replayed, flush()
+}
+
+// segmentReader reads the decoded AOF segments one after the other,
+// downloading each one when the previous one is consumed
+type segmentReader struct {
+	ctx   context.Context
+	m     *Manager
+	names []string
+	cur   *os.File
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.names) == 0 {
+				return 0, io.EOF
+			}
+			file, err := r.m.downloadBackup(r.ctx, r.names[0])
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.names = file, r.names[1:]
+		}
+
+		n, err := r.cur.Read(p)
+		if errors.Is(err, io.EOF) {
+			removeTemp(r.cur)
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close removes the segment being read
+func (r *segmentReader) Close() {
+	if r.cur != nil {
+		removeTemp(r.cur)
+		r.cur = nil
+	}
+}
+
+// aofReader parses the RESP commands of an AOF
+type aofReader struct {
+	r *bufio.Reader
+}
+
+// newAOFReader creates an AOF command reader
+func newAOFReader(r io.Reader) *aofReader {
+	return &aofReader{r: bufio.NewReaderSize(r, 1<<20)}
+}
+
+// Next returns the arguments of the next command
+// It returns io.EOF after the last command and io.ErrUnexpectedEOF when the
+// AOF ends in the middle of a command
+func (a *aofReader) Next() ([]string, error) {
+	for {
+		line, err := a.readLine()
+		if errors.Is(err, io.EOF) && line == "" {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Annotations such as #TS:<unix time>
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "*") {
+			return nil, fmt.Errorf("invalid AOF: unexpected %q", line)
+		}
+
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("invalid AOF: bad argument count %q", line)
+		}
+		args := make([]string, count)
+		for i := range args {
+			line, err := a.readLine()
+			if err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if !strings.HasPrefix(line, "$") {
+				return nil, fmt.Errorf("invalid AOF: unexpected %q", line)
+			}
+			length, err := strconv.Atoi(line[1:])
+			if err != nil || length < 0 {
+				return nil, fmt.Errorf("invalid AOF: bad argument length %q", line)
+			}
+			data := make([]byte, length+2)
+			if _, err := io.ReadFull(a.r, data); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			args[i] = string(data[:length])
+		}
+		return args, nil
+	}
+}
+
+// readLine reads a line without its CRLF; a line cut by the end of the AOF
+// is returned with io.ErrUnexpectedEOF
+func (a *aofReader) readLine() (string, error) {
+	line, err := a.r.ReadString('\n')
+	if errors.Is(err, io.EOF) {
+		if line == "" {
+			return "", io.EOF
+		}
+		return line, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
@@ -0,0 +1,292 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// auditObjectPrefix starts the name of the monthly audit objects
+const auditObjectPrefix = "redis-backup-audit_"
+
+// auditMu serializes the writes to the audit file and objects of this process
+var auditMu sync.Mutex
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Target    string    `json:"target"`
+	Details   string    `json:"details,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Actor     string    `json:"actor"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditEnabled reports whether operations are recorded
+func auditEnabled(cfg *config.Config) bool {
+	return cfg.AuditLogFile != "" || cfg.AuditLogStorage || cfg.ComplianceMode
+}
+
+// Audit records an operation in the audit log, with its result taken from err
+// Failures to write the audit log are logged
+func Audit(ctx context.Context, cfg *config.Config, store storage.Storage, entry AuditEntry, err error) {
+	if !auditEnabled(cfg) {
+		return
+	}
+	entry.Result = "success"
+	if err != nil {
+		entry.Result = "failure"
+		entry.Error = err.Error()
+	}
+	if writeErr := writeAudit(ctx, cfg, store, []AuditEntry{entry}, cfg.AuditLogStorage || cfg.ComplianceMode); writeErr != nil {
+		log.Printf("Warning: %v", writeErr)
+	}
+}
+
+// audit records an operation of the manager in the audit log, also when it
+// was interrupted by the cancellation of ctx
+func (m *Manager) audit(ctx context.Context, operation, target, details string, err error) {
+	Audit(context.WithoutCancel(ctx), m.cfg, m.storage, AuditEntry{Operation: operation, Target: target, Details: details}, err)
+}
+
+// writeAudit appends entries to AUDIT_LOG_FILE and, when toStorage is set,
+// to the audit object of the month
+func writeAudit(ctx context.Context, cfg *config.Config, store storage.Storage, entries []AuditEntry, toStorage bool) error {
+	actor := auditActor()
+	for i := range entries {
+		if entries[i].Time.IsZero() {
+			entries[i].Time = time.Now().UTC()
+		}
+		if entries[i].Actor == "" {
+			entries[i].Actor = actor
+		}
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	var errs []error
+	if cfg.AuditLogFile != "" {
+		if err := appendAuditFile(cfg, entries); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write audit log %s: %w", cfg.AuditLogFile, err))
+		}
+	}
+	if toStorage {
+		// The entry must be stored even when the operation was canceled
+		if err := appendAudit(context.WithoutCancel(ctx), store, entries); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write audit object: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// appendAuditFile appends entries to the audit file, rotating it first when
+// they would take it over AUDIT_LOG_MAX_SIZE
+func appendAuditFile(cfg *config.Config, entries []AuditEntry) error {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	if err := rotateAuditFile(cfg, int64(data.Len())); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(cfg.AuditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rotateAuditFile renames the audit file to <file>.1, the previous rotated
+// files to <file>.2 and so on up to AUDIT_LOG_MAX_FILES, when adding size
+// bytes would exceed AUDIT_LOG_MAX_SIZE
+// Rotated files older than HISTORY_RETENTION days are removed
+func rotateAuditFile(cfg *config.Config, size int64) error {
+	path := cfg.AuditLogFile
+	if cfg.AuditLogMaxSize > 0 {
+		info, err := os.Stat(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil && info.Size() > 0 && info.Size()+size > cfg.AuditLogMaxSize {
+			if err := os.Remove(rotatedAuditFile(path, cfg.AuditLogMaxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			for n := cfg.AuditLogMaxFiles - 1; n >= 1; n-- {
+				if err := os.Rename(rotatedAuditFile(path, n), rotatedAuditFile(path, n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+			}
+			if err := os.Rename(path, rotatedAuditFile(path, 1)); err != nil {
+				return err
+			}
+			log.Printf("Audit log %s rotated (%s)", path, config.FormatSize(info.Size()))
+		}
+	}
+
+	if cfg.HistoryRetentionDays == 0 {
+		return nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -cfg.HistoryRetentionDays)
+	for _, name := range rotatedAuditFiles(path) {
+		// A rotated file is no longer written, its last entry is its modification time
+		if info, err := os.Stat(name); err == nil && info.ModTime().Before(cutoff) {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rotatedAuditFile returns the name of the n-th rotated audit file
+func rotatedAuditFile(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// rotatedAuditFiles returns the rotated audit files, the oldest first
+func rotatedAuditFiles(path string) []string {
+	var names []string
+	for n := 1; ; n++ {
+		name := rotatedAuditFile(path, n)
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		names = append([]string{name}, names...)
+	}
+	return names
+}
+
+// auditObjectName returns the name of the audit object of the month of t
+func auditObjectName(t time.Time) string {
+	return auditObjectPrefix + t.UTC().Format("2006-01") + ".jsonl"
+}
+
+// appendAudit adds entries to the audit object of the current month
+// Objects cannot be appended to, so the object is downloaded and rewritten
+func appendAudit(ctx context.Context, store storage.Storage, entries []AuditEntry) error {
+	name := auditObjectName(time.Now())
+
+	var data bytes.Buffer
+	if err := store.Download(ctx, name, &data); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	encoder := json.NewEncoder(&data)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("failed to encode audit entry: %w", err)
+		}
+	}
+	return uploadData(ctx, store, name, data.Bytes())
+}
+
+// ReadAuditFile reads the entries of an audit file and of its rotated files,
+// oldest first
+func ReadAuditFile(path string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	for _, name := range append(rotatedAuditFiles(path), path) {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+		parsed, err := parseAudit(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		entries = append(entries, parsed...)
+	}
+	return entries, nil
+}
+
+// ReadAuditObjects reads the entries of the audit objects of the months
+// between since and until, oldest first
+func ReadAuditObjects(ctx context.Context, store storage.Storage, since, until time.Time) ([]AuditEntry, error) {
+	objects, err := store.ListObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	var names []string
+	for _, obj := range objects {
+		month, ok := strings.CutPrefix(obj.Name, auditObjectPrefix)
+		if !ok {
+			continue
+		}
+		start, err := time.Parse("2006-01", strings.TrimSuffix(month, ".jsonl"))
+		if err != nil || start.AddDate(0, 1, 0).Before(since) || start.After(until) {
+			continue
+		}
+		names = append(names, obj.Name)
+	}
+	sort.Strings(names)
+
+	var entries []AuditEntry
+	for _, name := range names {
+		var data bytes.Buffer
+		if err := store.Download(ctx, name, &data); err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", name, err)
+		}
+		parsed, err := parseAudit(data.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		entries = append(entries, parsed...)
+	}
+	return entries, nil
+}
+
+// parseAudit decodes JSON lines audit entries
+func parseAudit(data []byte) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid audit entry on line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// auditActor identifies who runs the process, as user@host
+func auditActor() string {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
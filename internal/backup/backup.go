@@ -2,34 +2,96 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/crypt"
+	"github.com/ermos/docker-redis-backup/internal/notify"
+	"github.com/ermos/docker-redis-backup/internal/redisinfo"
 	"github.com/ermos/docker-redis-backup/internal/storage"
 	"github.com/redis/go-redis/v9"
 )
 
 // Manager handles Redis backup operations
 type Manager struct {
-	cfg     *config.Config
-	redis   *redis.Client
-	storage storage.Storage
+	cfg      *config.Config
+	redis    *redis.Client
+	storage  storage.Storage
+	notifier notify.Notifier
+	keyring  *crypt.Keyring
+	gpg      *crypt.GPG
+	signer   *crypt.Signer
+	engine   string
+	aof      *aofShipper
+	writes   writeCounter
+	// running is held during a run so scheduled and triggered runs don't overlap
+	running sync.Mutex
+	// stored lists the backups stored by the current or last run
+	stored []StoredBackup
+	// fork holds the statistics of the BGSAVE of the current run, nil when
+	// the snapshot was not taken with BGSAVE
+	fork *ForkStats
+	// verification is the outcome of the sampled verification of the current
+	// or last run, empty when its backups were not verified
+	verification string
+	// lastUsage is the storage usage measured by the current run, 0 until then
+	lastUsage int64
+	// replica is the manager of REPLICA_STORAGE, nil when replication is disabled
+	replica        *Manager
+	replication    sync.WaitGroup
+	replicating    sync.Mutex
+	replicaLagging bool
+	// standby is the manager of STANDBY_REDIS_HOST, connected on the first seeding
+	standby *Manager
+	seeds   sync.WaitGroup
+	seeding sync.Mutex
+	// phase is the phase of the current run (snapshot, upload, ...)
+	phase string
+	// clockSkew is the offset of the Redis clock from the local clock, as
+	// last measured with TIME, and clockUnavailable is set when TIME failed
+	clockSkew        time.Duration
+	clockUnavailable bool
+	// work is the scratch space of temporary files
+	work *workDir
+}
+
+// StoredBackup is a backup stored by a run
+type StoredBackup struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
 }
 
 // New creates a new backup manager with retry logic for Redis connection
 func New(cfg *config.Config, store storage.Storage) (*Manager, error) {
+	m, err := NewOffline(cfg, store)
+	if err != nil {
+		return nil, err
+	}
+
 	redisClient := redis.NewClient(&redis.Options{
 		Addr:     fmt.Sprintf("%s:%s", cfg.RedisHost, cfg.RedisPort),
 		Password: cfg.RedisPassword,
 		DB:       cfg.RedisDB,
 	})
+	if cfg.ReadOnly {
+		redisClient.AddHook(newReadOnlyHook(cfg.CommandAliases))
+	}
 
 	// Retry connection with exponential backoff
-	maxRetries := 10
+	maxRetries := cfg.RedisConnectRetries
+	if maxRetries < 1 {
+		maxRetries = 1
+	}
 	var lastErr error
 
 	for i := 0; i < maxRetries; i++ {
@@ -38,14 +100,31 @@ func New(cfg *config.Config, store storage.Storage) (*Manager, error) {
 		cancel()
 
 		if err == nil {
-			return &Manager{
-				cfg:     cfg,
-				redis:   redisClient,
-				storage: store,
-			}, nil
+			m.redis = redisClient
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			m.engine, err = m.detectEngine(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("Warning: failed to detect server engine, assuming %s: %v", EngineRedis, err)
+				m.engine = EngineRedis
+			}
+			if cfg.RDBReuseMaxAge > 0 {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				m.logSavePoints(ctx)
+				cancel()
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+			m.checkClock(ctx)
+			cancel()
+
+			return m, nil
 		}
 
 		lastErr = err
+		if i == maxRetries-1 {
+			break
+		}
 		waitTime := time.Duration(i+1) * 2 * time.Second
 		if waitTime > 30*time.Second {
 			waitTime = 30 * time.Second
@@ -55,148 +134,514 @@ func New(cfg *config.Config, store storage.Storage) (*Manager, error) {
 	}
 
 	_ = redisClient.Close()
-	return nil, fmt.Errorf("failed to connect to Redis after %d attempts: %w", maxRetries, lastErr)
+	return nil, withStage(StageRedis, fmt.Errorf("failed to connect to Redis after %d attempts: %w", maxRetries, redisError(lastErr)))
+}
+
+// NewOffline creates a backup manager that only works on the storage
+// It is used by commands that must work without Redis (verify, ...)
+func NewOffline(cfg *config.Config, store storage.Storage) (*Manager, error) {
+	if cfg.TargetKeysDir != "" && cfg.TargetName != "" && cfg.TargetKeys == "" {
+		return nil, fmt.Errorf("encryption keys of target %s not loaded from TARGET_KEYS_DIR", cfg.TargetName)
+	}
+
+	notifier, err := newNotifier(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize notifications: %w", err)
+	}
+
+	keyring, err := crypt.NewKeyring(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize encryption: %w", err)
+	}
+
+	gpg, err := crypt.NewGPG(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize GPG encryption: %w", err)
+	}
+
+	signer, err := crypt.NewSigner(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize signing: %w", err)
+	}
+
+	work, err := newWorkDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		cfg:      cfg,
+		storage:  store,
+		notifier: notifier,
+		keyring:  keyring,
+		gpg:      gpg,
+		signer:   signer,
+		aof:      &aofShipper{},
+		work:     work,
+	}
+	if cfg.ReplicaStorage != "" {
+		if m.replica, err = newReplica(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
 }
 
-// Run executes a backup operation
+// Run executes a backup operation and records its result in the target status
 func (m *Manager) Run(ctx context.Context) error {
+	_, err := m.run(ctx)
+	return err
+}
+
+// run is Run, also returning the backups stored, none when the run was skipped
+func (m *Manager) run(ctx context.Context) (stored []StoredBackup, err error) {
+	if !m.running.TryLock() {
+		log.Println("A backup is already running, skipping this run")
+		return nil, nil
+	}
+	defer m.running.Unlock()
+	defer startRun(m.cfg.Target(), time.Now())()
+	m.stored = nil
+	m.verification = ""
+	m.lastUsage = 0
+
+	if m.cfg.DryRun {
+		return nil, m.dryRun(ctx)
+	}
+
 	log.Println("Starting backup process...")
+	RefreshMaintenance(ctx, m.cfg, m.storage)
+
+	start := time.Now()
+	if m.cfg.BackupLock {
+		token, err := m.acquireLock(ctx)
+		if err != nil {
+			err = withStage(StageRedis, redisError(err))
+			RecordRun(ctx, m.cfg, start, err)
+			m.recordHistory(ctx, start, err)
+			m.audit(ctx, "backup", m.cfg.Target(), "", err)
+			return nil, err
+		}
+		if token == "" {
+			log.Println("Backup lock held by another instance, skipping this run")
+			return nil, nil
+		}
+		defer m.releaseLock(token)
+	}
+	defer func() {
+		if err == nil {
+			m.writes.reset()
+		}
+		recordRun(ctx, m.cfg, start, err, m.verification)
+		m.recordHistory(ctx, start, err)
+		stored = slices.Clone(m.stored)
+		names := make([]string, 0, len(m.stored))
+		for _, stored := range m.stored {
+			names = append(names, stored.Name)
+		}
+		m.audit(ctx, "backup", m.cfg.Target(), strings.Join(names, " "), err)
+		m.postBackupHook(ctx, err)
+		if err == nil && m.replica != nil {
+			m.startReplication(ctx)
+		}
+		if err == nil && m.cfg.StandbyRedisHost != "" {
+			m.startSeeding(ctx)
+		}
+	}()
 
-	// Step 1: Trigger BGSAVE
-	if err := m.triggerBGSAVE(ctx); err != nil {
-		return fmt.Errorf("failed to trigger BGSAVE: %w", err)
+	ctx, finish, err := m.work.startRun(ctx, m.cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer finish()
+	ctx, cancel := m.startWindow(ctx, start)
+	defer cancel()
+	defer func() { err = m.endWindow(ctx, start, err) }()
+
+	if err := m.runHook(ctx, hookEvent{Phase: hookPreBackup}); err != nil {
+		return nil, err
+	}
+	m.checkClock(ctx)
+
+	delay := time.Duration(m.cfg.BackupRetryDelay) * time.Second
+	for attempt := 1; ; attempt++ {
+		err = m.runOnce(ctx)
+		if err == nil {
+			return nil, nil
+		}
+		if !Retryable(err) || attempt > m.cfg.BackupRetries {
+			return nil, err
+		}
+
+		log.Printf("Backup failed with a transient error (%s): %v. Retrying in %s (retry %d/%d)...",
+			ErrorCategory(err), err, delay, attempt, m.cfg.BackupRetries)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// runOnce takes and uploads a single backup, verifies it when sampled, then
+// applies retention
+func (m *Manager) runOnce(ctx context.Context) error {
+	m.resumePendingUploads(ctx)
+
+	if m.cfg.BackupSplitDatabases {
+		return m.runSplit(ctx)
+	}
+
+	// Step 1: Trigger BGSAVE (or a synchronous SAVE as fallback)
+	ctx = m.phaseContext(ctx, phaseSnapshot)
+	m.fork = nil
+	restoreConfig := m.tuneBGSAVE(ctx)
+	saved, err := m.triggerBGSAVE(ctx)
+	if err != nil {
+		restoreConfig()
+		return withStage(StageRedis, fmt.Errorf("failed to trigger BGSAVE: %w", redisError(err)))
 	}
 
 	// Step 2: Wait for BGSAVE to complete
-	if err := m.waitForBGSAVE(ctx); err != nil {
-		return fmt.Errorf("failed waiting for BGSAVE: %w", err)
+	if !saved {
+		err := m.waitForBGSAVE(ctx)
+		restoreConfig()
+		if err != nil {
+			return withStage(StageRedis, fmt.Errorf("failed waiting for BGSAVE: %w", redisError(err)))
+		}
+		m.fork = m.recordFork(ctx)
+	} else {
+		restoreConfig()
 	}
 
-	// Step 3: Generate backup filename with timestamp
-	backupName := m.generateBackupName()
+	// Step 3: Retrieve the RDB file
+	rdbFile, err := m.rdbFileName(ctx)
+	if err != nil {
+		return withStage(StageRedis, fmt.Errorf("failed to locate RDB file: %w", redisError(err)))
+	}
+	rdbPath, cleanup, err := m.localRDBPath(ctx, rdbFile)
+	if err != nil {
+		return withStage(StageRedis, fmt.Errorf("failed to retrieve RDB file: %w", err))
+	}
+	defer cleanup()
+	if err := m.runHook(ctx, hookEvent{Phase: hookPostBGSAVE, File: rdbPath}); err != nil {
+		return err
+	}
 
-	// Step 4: Upload RDB file to storage
-	rdbPath := filepath.Join(m.cfg.RedisDataPath, "dump.rdb")
-	if err := m.storage.Upload(ctx, rdbPath, backupName); err != nil {
-		return fmt.Errorf("failed to upload backup: %w", err)
+	// Step 4: Upload the snapshot, or only its changes in differential mode
+	ctx = m.phaseContext(ctx, phaseUpload)
+	base := ""
+	if m.cfg.BackupDifferential {
+		if base, err = m.findDiffBase(ctx); err != nil {
+			log.Printf("Warning: %v, taking a full backup", err)
+		}
+	}
+	if base != "" {
+		if err := m.runDiff(ctx, rdbPath, base); err != nil {
+			return err
+		}
+	} else if err := m.runFull(ctx, rdbPath); err != nil {
+		return err
 	}
 
-	log.Printf("Backup completed successfully: %s (storage: %s)", backupName, m.storage.Type())
+	// Step 5: Verify a sample of the runs, before retention can delete the previous backups
+	if err := m.verifySample(m.phaseContext(ctx, phaseVerify)); err != nil {
+		return err
+	}
 
-	// Step 5: Apply retention policy
-	if m.cfg.RetentionCount > 0 {
+	// Step 6: Apply retention policy
+	ctx = m.phaseContext(ctx, phaseRetention)
+	if m.cfg.RetentionCount > 0 || m.cfg.RetentionMinFree > 0 {
 		if err := m.applyRetention(ctx); err != nil {
 			log.Printf("Warning: failed to apply retention policy: %v", err)
 		}
 	}
 
+	// Step 7: Report storage usage
+	m.reportUsage(ctx)
+
 	return nil
 }
 
+// runFull uploads a snapshot with its manifest and sidecars
+func (m *Manager) runFull(ctx context.Context, rdbPath string) error {
+	backupName := m.generateBackupName("")
+
+	if err := m.checkMaxSize(ctx, backupName, rdbPath); err != nil {
+		return err
+	}
+
+	if err := m.runHook(ctx, hookEvent{Phase: hookPreUpload, Backup: backupName, File: rdbPath}); err != nil {
+		return err
+	}
+	if err := m.uploadBackup(ctx, rdbPath, backupName); err != nil {
+		return withStage(StageUpload, fmt.Errorf("failed to upload backup: %w", err))
+	}
+	m.recordStored(backupName, rdbPath)
+
+	log.Printf("Backup completed successfully: %s (storage: %s)", backupName, m.storage.Type())
+	m.checkSizeAnomaly(ctx, backupName, rdbPath)
+
+	// Store the manifest and optional sidecars (functions, ...)
+	manifest := m.newManifest(ctx, backupName, rdbPath, m.snapshotKeyStats(ctx, rdbPath))
+	manifest.AOFMarker = m.followBackup(backupName)
+	manifest.Fork = m.fork
+	manifest.DatasetMemory = m.datasetMemory(ctx)
+	if m.cfg.BackupDifferential {
+		manifest.Type = manifestTypeFull
+		m.storeKeyIndex(ctx, backupName, rdbPath)
+	}
+	m.storeBackupManifest(ctx, manifest)
+	m.backupSidecars(ctx, backupName)
+	if err := m.commitSet(ctx, backupName); err != nil {
+		return withStage(StageUpload, err)
+	}
+	return m.runHook(ctx, hookEvent{Phase: hookPostUpload, Backup: backupName, File: rdbPath})
+}
+
+// recordStored adds a backup to those stored by the current run
+func (m *Manager) recordStored(backupName, localPath string) {
+	stored := StoredBackup{Name: backupName}
+	if stat, err := os.Stat(localPath); err == nil {
+		stored.Bytes = stat.Size()
+	}
+	m.stored = append(m.stored, stored)
+}
+
+// Stored returns the backups stored by the last run
+func (m *Manager) Stored() []StoredBackup {
+	return m.stored
+}
+
+// resumePendingUploads completes uploads interrupted by a previous process
+func (m *Manager) resumePendingUploads(ctx context.Context) {
+	resumer, ok := m.storage.(storage.Resumer)
+	if !ok {
+		return
+	}
+
+	resumed, err := resumer.ResumePending(ctx)
+	for _, name := range resumed {
+		log.Printf("Interrupted upload completed: %s", name)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to resume interrupted uploads: %v", err)
+	}
+}
+
 // triggerBGSAVE initiates a background save in Redis
-func (m *Manager) triggerBGSAVE(ctx context.Context) error {
+// It returns true when the snapshot is already written: by the SAVE fallback,
+// or recently by the server itself (RDB_REUSE_MAX_AGE)
+func (m *Manager) triggerBGSAVE(ctx context.Context) (bool, error) {
 	log.Println("Triggering BGSAVE...")
 
 	// Check if BGSAVE is already in progress
-	info, err := m.redis.Info(ctx, "persistence").Result()
+	info, err := m.info(ctx, "persistence")
+	if errors.Is(err, ErrCommandDisabled) {
+		return m.saveWithoutInfo(ctx, err)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get persistence info: %w", err)
+		return false, fmt.Errorf("failed to get persistence info: %w", err)
 	}
 
-	if containsBGSAVEInProgress(info) {
-		log.Println("BGSAVE already in progress, waiting...")
-		return nil
+	if reuse, reason := m.reusableSnapshot(ctx, info); reuse && !m.bgsaveInProgress(info) {
+		log.Printf("Skipping BGSAVE, uploading the existing snapshot: %s", reason)
+		return true, nil
 	}
 
-	// Trigger BGSAVE
-	if err := m.redis.BgSave(ctx).Err(); err != nil {
-		return fmt.Errorf("BGSAVE command failed: %w", err)
+	if m.bgsaveInProgress(info) {
+		if !m.cfg.AOFShipping {
+			log.Println("BGSAVE already in progress, waiting...")
+			return false, nil
+		}
+		// The snapshot must start in the same transaction as the AOF marker
+		log.Println("BGSAVE already in progress, waiting to start a new one...")
+		if err := m.waitForBGSAVE(ctx); err != nil {
+			return false, err
+		}
 	}
 
+	return m.startBGSAVE(ctx)
+}
+
+// startBGSAVE sends BGSAVE, or runs the SAVE fallback when it fails
+// It returns true when the snapshot was written synchronously by SAVE
+func (m *Manager) startBGSAVE(ctx context.Context) (bool, error) {
+	bgsave := func() error { return m.do(ctx, "BGSAVE").Err() }
+	if m.cfg.AOFShipping {
+		bgsave = func() error { return m.markedBGSAVE(ctx) }
+	}
+	if err := bgsave(); err != nil {
+		if !m.cfg.FallbackSave {
+			return false, fmt.Errorf("BGSAVE command failed: %w", err)
+		}
+		if err := m.fallbackSave(ctx, err); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// fallbackSave runs a blocking SAVE after BGSAVE failed (disabled command, fork failure, ...)
+// SAVE blocks every other client until the snapshot is written
+func (m *Manager) fallbackSave(ctx context.Context, bgsaveErr error) error {
+	log.Printf("WARNING: BGSAVE failed (%v), falling back to synchronous SAVE", bgsaveErr)
+	log.Println("WARNING: SAVE blocks all Redis clients until the snapshot is written")
+
+	start := time.Now()
+	if err := m.do(ctx, "SAVE").Err(); err != nil {
+		return fmt.Errorf("BGSAVE failed (%v) and SAVE fallback failed: %w", bgsaveErr, err)
+	}
+
+	log.Printf("WARNING: synchronous SAVE completed, Redis was blocked for %s", time.Since(start).Round(time.Millisecond))
 	return nil
 }
 
-// waitForBGSAVE waits for the background save to complete
+// command returns the name to use for a Redis command, honoring COMMAND_ALIASES
+func (m *Manager) command(name string) string {
+	if alias, ok := m.cfg.CommandAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// info runs INFO for a section using the configured command alias
+func (m *Manager) info(ctx context.Context, section string) (*redisinfo.Info, error) {
+	text, err := m.do(ctx, "INFO", section).Text()
+	if err != nil {
+		return nil, err
+	}
+	return redisinfo.Parse(text), nil
+}
+
+// waitForBGSAVE waits for the background save to complete, polling INFO every
+// BGSAVE_POLL_INTERVAL_MS and logging its progress every BGSAVE_PROGRESS_INTERVAL
 func (m *Manager) waitForBGSAVE(ctx context.Context) error {
 	log.Println("Waiting for BGSAVE to complete...")
 
-	ticker := time.NewTicker(1 * time.Second)
+	lastProgress := time.Now()
+	return m.pollSave(ctx, func(waited time.Duration) (bool, error) {
+		info, err := m.info(ctx, "persistence")
+		if err != nil {
+			return false, fmt.Errorf("failed to get persistence info: %w", err)
+		}
+
+		if !m.bgsaveInProgress(info) {
+			if seconds := info.Get("rdb_last_bgsave_time_sec"); seconds != "" && seconds != "-1" {
+				log.Printf("BGSAVE completed (took %ss)", seconds)
+			} else {
+				log.Println("BGSAVE completed")
+			}
+			return true, nil
+		}
+
+		if interval := time.Duration(m.cfg.BGSAVEProgressInterval) * time.Second; interval > 0 && time.Since(lastProgress) >= interval {
+			lastProgress = time.Now()
+			m.logBGSAVEProgress(info, waited)
+		}
+		return false, nil
+	})
+}
+
+// pollSave calls done every BGSAVE_POLL_INTERVAL_MS until it reports the save
+// as complete, with the time waited so far
+// It gives up after BGSAVE_TIMEOUT, leaving the save running on the server
+func (m *Manager) pollSave(ctx context.Context, done func(waited time.Duration) (bool, error)) error {
+	ticker := time.NewTicker(time.Duration(m.cfg.BGSAVEPollInterval) * time.Millisecond)
 	defer ticker.Stop()
 
+	var timeout <-chan time.Time
+	if m.cfg.BGSAVETimeout > 0 {
+		timer := time.NewTimer(time.Duration(m.cfg.BGSAVETimeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	start := time.Now()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("BGSAVE did not complete within BGSAVE_TIMEOUT (%ds)", m.cfg.BGSAVETimeout)
 		case <-ticker.C:
-			info, err := m.redis.Info(ctx, "persistence").Result()
-			if err != nil {
-				return fmt.Errorf("failed to get persistence info: %w", err)
-			}
-
-			if !containsBGSAVEInProgress(info) {
-				log.Println("BGSAVE completed")
-				return nil
+			if complete, err := done(time.Since(start)); complete || err != nil {
+				return err
 			}
 		}
 	}
 }
 
-// generateBackupName creates a unique backup filename
-func (m *Manager) generateBackupName() string {
-	timestamp := time.Now().UTC().Format("2006-01-02_15-04-05")
-	return fmt.Sprintf("redis-backup_%s.rdb", timestamp)
+// logBGSAVEProgress logs how long the running save has taken so far and the
+// writes made since the last one
+func (m *Manager) logBGSAVEProgress(info *redisinfo.Info, waited time.Duration) {
+	progress := fmt.Sprintf("waited %s", waited.Round(time.Second))
+	if seconds := info.Get("rdb_current_bgsave_time_sec"); seconds != "" && seconds != "-1" {
+		progress = fmt.Sprintf("running for %ss", seconds)
+	}
+	if changes, ok := info.ChangesSinceLastSave(); ok {
+		progress += fmt.Sprintf(", %d change(s) since the last save", changes)
+	}
+	log.Printf("BGSAVE in progress: %s", progress)
 }
 
-// applyRetention removes old backups beyond retention count
-func (m *Manager) applyRetention(ctx context.Context) error {
-	log.Printf("Applying retention policy (keeping %d backups)...", m.cfg.RetentionCount)
-
-	backups, err := m.storage.List(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to list backups: %w", err)
+// generateBackupName creates a unique backup filename
+// An optional series (e.g. "db2") is appended to the name prefix so each
+// series is retained independently; with BACKUP_LABELS_IN_NAME the label
+// values (sorted by key) come first, e.g. "redis-backup-prod-payments-db2_..."
+func (m *Manager) generateBackupName(series string) string {
+	name := m.backupNameAt(series, time.Now())
+	if m.gpg.Enabled() {
+		name += crypt.GPGSuffix
 	}
+	return name
+}
 
-	if len(backups) <= m.cfg.RetentionCount {
-		log.Printf("Current backup count (%d) within retention limit", len(backups))
-		return nil
-	}
+// backupNameAt returns the plain .rdb name of a backup of a series taken at t
+func (m *Manager) backupNameAt(series string, t time.Time) string {
+	timestamp := t.UTC().Format("2006-01-02_15-04-05")
 
-	// Delete oldest backups (list is sorted oldest first)
-	toDelete := len(backups) - m.cfg.RetentionCount
-	for i := 0; i < toDelete; i++ {
-		log.Printf("Deleting old backup: %s", backups[i])
-		if err := m.storage.Delete(ctx, backups[i]); err != nil {
-			log.Printf("Warning: failed to delete %s: %v", backups[i], err)
+	prefix := []string{"redis-backup"}
+	if m.cfg.BackupLabelsInName {
+		keys := make([]string, 0, len(m.cfg.BackupLabels))
+		for key := range m.cfg.BackupLabels {
+			keys = append(keys, key)
 		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			prefix = append(prefix, m.cfg.BackupLabels[key])
+		}
+	}
+	if series != "" {
+		prefix = append(prefix, series)
 	}
 
-	log.Printf("Retention policy applied, deleted %d old backup(s)", toDelete)
-	return nil
+	return fmt.Sprintf("%s_%s.rdb", strings.Join(prefix, "-"), timestamp)
 }
 
 // Close closes the Redis connection
 func (m *Manager) Close() error {
-	return m.redis.Close()
-}
-
-// containsBGSAVEInProgress checks if a BGSAVE is currently running
-func containsBGSAVEInProgress(info string) bool {
-	// Redis returns rdb_bgsave_in_progress:1 when BGSAVE is running
-	return containsString(info, "rdb_bgsave_in_progress:1")
-}
-
-// containsString checks if a string contains a substring
-func containsString(s, substr string) bool {
-	return len(s) >= len(substr) && findSubstring(s, substr)
-}
-
-func findSubstring(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
+	// Let the replication of the last backups finish
+	m.replication.Wait()
+	m.seeds.Wait()
+	m.work.close()
+	if m.standby != nil {
+		_ = m.standby.Close()
+	}
+	if m.replica != nil {
+		_ = m.replica.Close()
+		if closer, ok := m.replica.storage.(io.Closer); ok {
+			_ = closer.Close()
 		}
 	}
-	return false
+
+	if m.redis == nil {
+		return nil
+	}
+	return m.redis.Close()
 }
 
 // CheckRDBFile verifies that the RDB file exists
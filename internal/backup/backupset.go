@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// setSuffix is appended to a backup name for its set manifest, stored once
+// every other object of the backup is
+const setSuffix = ".set.json"
+
+// ErrIncompleteSet is returned when a backup was not completely stored
+var ErrIncompleteSet = errors.New("incomplete backup set")
+
+// BackupSet lists the objects a backup is made of: the backup itself and its
+// sidecars (manifest, functions, ...)
+// Its manifest is stored last and deleted first, so a backup without one
+// was interrupted while being stored or deleted; AOF segments shipped after
+// the backup are not part of the set
+type BackupSet struct {
+	Backup    string      `json:"backup"`
+	CreatedAt time.Time   `json:"created_at"`
+	Objects   []SetObject `json:"objects"`
+}
+
+// SetObject is an object of a backup set
+type SetObject struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// commitSet stores the set manifest of a backup whose objects are all stored,
+// which makes it a valid backup
+func (m *Manager) commitSet(ctx context.Context, backupName string) error {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	set := newBackupSet(objects, backupName)
+	if !slices.ContainsFunc(set.Objects, func(obj SetObject) bool { return obj.Name == backupName }) {
+		return fmt.Errorf("%w: %s", storage.ErrNotFound, backupName)
+	}
+	return storeSet(m.work.context(ctx), m.storage, set)
+}
+
+// newBackupSet describes the set of a backup from the objects of the storage
+func newBackupSet(objects []storage.ObjectInfo, backupName string) *BackupSet {
+	set := &BackupSet{Backup: backupName, CreatedAt: time.Now().UTC()}
+	for _, obj := range objects {
+		if obj.Name == backupName || isSidecarOf(obj.Name, backupName) {
+			set.Objects = append(set.Objects, SetObject{Name: obj.Name, Bytes: obj.Size})
+		}
+	}
+	sort.Slice(set.Objects, func(i, j int) bool { return set.Objects[i].Name < set.Objects[j].Name })
+	return set
+}
+
+// storeSet uploads the set manifest of a backup
+func storeSet(ctx context.Context, store storage.Storage, set *BackupSet) error {
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode backup set: %w", err)
+	}
+	if err := uploadData(ctx, store, set.Backup+setSuffix, data); err != nil {
+		return fmt.Errorf("failed to store backup set: %w", err)
+	}
+	return nil
+}
+
+// loadSet downloads the set manifest of a backup
+func loadSet(ctx context.Context, store storage.Storage, backupName string) (*BackupSet, error) {
+	var data bytes.Buffer
+	if err := store.Download(ctx, backupName+setSuffix, &data); err != nil {
+		return nil, err
+	}
+	var set BackupSet
+	if err := json.Unmarshal(data.Bytes(), &set); err != nil {
+		return nil, fmt.Errorf("failed to decode backup set: %w", err)
+	}
+	return &set, nil
+}
+
+// checkSet returns ErrIncompleteSet when a backup or one of the objects of its
+// set is missing
+func (m *Manager) checkSet(ctx context.Context, backupName string) error {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	complete, _ := BackupSets(objects)
+	if !slices.Contains(complete, backupName) {
+		return fmt.Errorf("%w: %s has no set manifest, it was not completely stored", ErrIncompleteSet, backupName)
+	}
+
+	set, err := loadSet(ctx, m.storage, backupName)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Stored before backup sets
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the set of %s: %w", backupName, err)
+	}
+	stored := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		stored[obj.Name] = true
+	}
+	for _, obj := range set.Objects {
+		if !stored[obj.Name] {
+			return fmt.Errorf("%w: %s is missing %s", ErrIncompleteSet, backupName, obj.Name)
+		}
+	}
+	return nil
+}
+
+// listBackups returns the complete backups of the storage, oldest first
+func (m *Manager) listBackups(ctx context.Context) ([]string, error) {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	complete, _ := BackupSets(objects)
+	return complete, nil
+}
+
+// BackupSets sorts the backups among objects into complete and partial sets,
+// oldest first
+// Backups stored before the first set manifest of the storage predate backup
+// sets and are complete
+func BackupSets(objects []storage.ObjectInfo) (complete, partial []string) {
+	committed := make(map[string]bool)
+	var firstSet time.Time
+	for _, obj := range objects {
+		if name, ok := strings.CutSuffix(obj.Name, setSuffix); ok {
+			committed[name] = true
+			if firstSet.IsZero() || obj.ModTime.Before(firstSet) {
+				firstSet = obj.ModTime
+			}
+		}
+	}
+
+	for _, obj := range objects {
+		if !storage.IsBackupName(obj.Name) {
+			continue
+		}
+		if committed[obj.Name] || firstSet.IsZero() || obj.ModTime.Before(firstSet) {
+			complete = append(complete, obj.Name)
+		} else {
+			partial = append(partial, obj.Name)
+		}
+	}
+	sort.Strings(complete)
+	sort.Strings(partial)
+	return complete, partial
+}
+
+// isSidecarOf reports whether an object is a sidecar of a backup
+func isSidecarOf(objectName, backupName string) bool {
+	suffix, ok := strings.CutPrefix(objectName, backupName)
+	return ok && slices.Contains(sidecarSuffixes, suffix)
+}
@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+
+	"github.com/ermos/docker-redis-backup/internal/rdb"
+	"github.com/redis/go-redis/v9"
+)
+
+// BigKey is an entry of the largest keys report
+type BigKey struct {
+	DB              int    `json:"db"`
+	Key             string `json:"key"`
+	Type            string `json:"type"`
+	SerializedBytes int64  `json:"serialized_bytes"`
+	MemoryBytes     int64  `json:"memory_bytes,omitempty"`
+}
+
+// keyCollector gathers key statistics and the largest keys while a snapshot is read
+type keyCollector struct {
+	databases map[int]*KeyStats
+	top       int
+	bigKeys   []BigKey // sorted largest first, at most top entries
+}
+
+// newKeyCollector creates a collector keeping the top largest keys (0 = none)
+func newKeyCollector(top int) *keyCollector {
+	return &keyCollector{databases: make(map[int]*KeyStats), top: top}
+}
+
+// add counts a key and its serialized size
+func (c *keyCollector) add(db int, key string, valueType byte, expires bool, size int64) {
+	if c.databases[db] == nil {
+		c.databases[db] = &KeyStats{}
+	}
+	c.databases[db].add(valueType, expires)
+
+	if c.top <= 0 {
+		return
+	}
+	if len(c.bigKeys) == c.top && size <= c.bigKeys[len(c.bigKeys)-1].SerializedBytes {
+		return
+	}
+
+	i := sort.Search(len(c.bigKeys), func(i int) bool { return c.bigKeys[i].SerializedBytes < size })
+	c.bigKeys = append(c.bigKeys, BigKey{})
+	copy(c.bigKeys[i+1:], c.bigKeys[i:])
+	c.bigKeys[i] = BigKey{DB: db, Key: key, Type: rdb.TypeName(valueType), SerializedBytes: size}
+	if len(c.bigKeys) > c.top {
+		c.bigKeys = c.bigKeys[:c.top]
+	}
+}
+
+// total returns the number of keys collected across every database
+func (c *keyCollector) total() int64 {
+	var total int64
+	for _, stats := range c.databases {
+		total += stats.Keys
+	}
+	return total
+}
+
+// fillMemoryUsage queries MEMORY USAGE for the largest keys
+// Keys deleted since the snapshot keep an empty memory size
+func (m *Manager) fillMemoryUsage(ctx context.Context, bigKeys []BigKey) {
+	if len(bigKeys) == 0 {
+		return
+	}
+
+	if m.disabled("MEMORY") {
+		log.Println("Warning: MEMORY command disabled, big keys report only has serialized sizes")
+		return
+	}
+
+	conn := m.conn()
+	defer conn.Close()
+
+	db := -1
+	for i := range bigKeys {
+		if bigKeys[i].DB != db {
+			if err := conn.Select(ctx, bigKeys[i].DB).Err(); err != nil {
+				log.Printf("Warning: failed to select database %d for MEMORY USAGE: %v", bigKeys[i].DB, err)
+				return
+			}
+			db = bigKeys[i].DB
+		}
+
+		cmd := redis.NewIntCmd(ctx, m.command("MEMORY"), "USAGE", bigKeys[i].Key)
+		_ = conn.Process(ctx, cmd)
+		usage, err := cmd.Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if isUnknownCommand(err) {
+				log.Println("Warning: MEMORY command not available, big keys report only has serialized sizes")
+				return
+			}
+			log.Printf("Warning: MEMORY USAGE failed for key %q: %v", bigKeys[i].Key, err)
+			continue
+		}
+		bigKeys[i].MemoryBytes = usage
+	}
+}
@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/notify"
+)
+
+// newRunID returns a random identifier for a run requested with a callback
+func newRunID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate run ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// runWithCallback runs a backup and posts its result to callbackURL
+// A run skipped because another one holds the lock is reported as skipped, so
+// a pipeline waiting for the callback does not take it for a success
+func (m *Manager) runWithCallback(ctx context.Context, runID, callbackURL string) {
+	start := time.Now().UTC()
+	stored, err := m.run(ctx)
+	result := notify.RunResult{
+		RunID:      runID,
+		Target:     m.cfg.Target(),
+		Status:     notify.RunSuccess,
+		StartedAt:  start,
+		FinishedAt: time.Now().UTC(),
+	}
+	for _, backup := range stored {
+		result.Backups = append(result.Backups, backup.Name)
+	}
+	switch {
+	case err != nil:
+		log.Printf("Backup requested on the control channel failed: %v", err)
+		result.Status = notify.RunFailure
+		result.Error = err.Error()
+	case len(stored) == 0:
+		result.Status = notify.RunSkipped
+	}
+
+	if err := notify.SendCallback(ctx, m.cfg, callbackURL, result); err != nil {
+		log.Printf("Warning: failed to send the callback of run %s: %v", runID, err)
+		return
+	}
+	log.Printf("Callback of run %s sent (%s)", runID, result.Status)
+}
@@ -0,0 +1,135 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/notify"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// CleanupPartialUploads removes the uploads that failed more than maxAge ago
+// (S3 multipart uploads, local .partial files) and, with PARTIAL_SET_DELETE,
+// the backups whose set was never completed, and returns their names
+// In dry-run mode, the backups that would be removed are only logged
+func (m *Manager) CleanupPartialUploads(ctx context.Context, maxAge time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-maxAge)
+	if m.cfg.DryRun {
+		stale, err := m.stalePartialSets(ctx, cutoff)
+		action := "report"
+		if m.cfg.PartialSetDelete {
+			action = "delete"
+		}
+		for _, name := range stale {
+			log.Printf("DRY RUN: would %s incomplete backup set %s", action, name)
+		}
+		return nil, err
+	}
+
+	var removed []string
+	var err error
+	if cleaner, ok := m.storage.(storage.PartialCleaner); ok {
+		if removed, err = cleaner.CleanupPartial(ctx, cutoff); err != nil {
+			err = fmt.Errorf("failed to clean up partial uploads: %w", err)
+		}
+	}
+	if err == nil {
+		var sets []string
+		sets, err = m.deletePartialSets(ctx, cutoff)
+		removed = append(removed, sets...)
+	}
+
+	if len(removed) > 0 || err != nil {
+		m.audit(ctx, "cleanup", m.cfg.Target(), strings.Join(removed, " "), err)
+	}
+	return removed, err
+}
+
+// deletePartialSets deletes the backups stored before cutoff whose set
+// manifest is missing, with the sidecars stored next to them
+// A set commit that failed, or an older instance writing to the same prefix,
+// also leaves backups without a set, so they are only alerted on unless
+// PARTIAL_SET_DELETE is enabled
+func (m *Manager) deletePartialSets(ctx context.Context, cutoff time.Time) ([]string, error) {
+	stale, err := m.stalePartialSets(ctx, cutoff)
+	if err != nil || len(stale) == 0 {
+		return nil, err
+	}
+	if !m.cfg.PartialSetDelete {
+		m.alertPartialSets(ctx, stale)
+		return nil, nil
+	}
+	deleted, err := m.deleteBackups(ctx, stale, "incomplete set", m.cfg.ComplianceUnlockToken)
+	if err != nil {
+		return nil, err
+	}
+	if deleted < len(stale) {
+		return stale, fmt.Errorf("failed to delete %d incomplete backup set(s)", len(stale)-deleted)
+	}
+	return stale, nil
+}
+
+// alertPartialSets logs and notifies the stale backups without a set manifest
+func (m *Manager) alertPartialSets(ctx context.Context, stale []string) {
+	message := fmt.Sprintf("%d backup(s) have no set manifest and were kept: %s (set PARTIAL_SET_DELETE=true to delete them)",
+		len(stale), strings.Join(stale, ", "))
+	log.Printf("WARNING: %s", message)
+
+	err := m.notifier.Notify(ctx, notify.Event{
+		Type:    notify.EventIncompleteSets,
+		Message: message,
+		Details: map[string]interface{}{"backups": stale},
+	})
+	if err != nil {
+		log.Printf("Warning: failed to send incomplete sets notification: %v", err)
+	}
+}
+
+// stalePartialSets returns the backups stored before cutoff whose set manifest is missing
+func (m *Manager) stalePartialSets(ctx context.Context, cutoff time.Time) ([]string, error) {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	_, partial := BackupSets(objects)
+
+	var stale []string
+	for _, obj := range objects {
+		if slices.Contains(partial, obj.Name) && obj.ModTime.Before(cutoff) {
+			stale = append(stale, obj.Name)
+		}
+	}
+	return stale, nil
+}
+
+// CleanPartialUploads removes stale partial uploads every
+// PARTIAL_UPLOAD_CLEANUP_INTERVAL hours until ctx is canceled
+// A cleanup due while a backup runs is skipped
+func (m *Manager) CleanPartialUploads(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(m.cfg.PartialUploadCleanupInterval) * time.Hour)
+	defer ticker.Stop()
+
+	maxAge := time.Duration(m.cfg.PartialUploadMaxAge) * time.Hour
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !m.running.TryLock() {
+			continue
+		}
+		removed, err := m.CleanupPartialUploads(ctx, maxAge)
+		m.running.Unlock()
+		if len(removed) > 0 {
+			log.Printf("Removed %d partial upload(s): %s", len(removed), strings.Join(removed, ", "))
+		}
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
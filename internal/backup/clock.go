@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/metrics"
+)
+
+// checkClock measures the offset of the Redis clock from the local clock
+// with TIME, publishes it and warns when it exceeds CLOCK_SKEW_THRESHOLD
+// The offset corrects the age of the last save (RDB_REUSE_MAX_AGE); when TIME
+// is unavailable, the last measure is kept
+func (m *Manager) checkClock(ctx context.Context) {
+	if m.cfg.ClockSkewThreshold == 0 {
+		return
+	}
+
+	before := time.Now()
+	reply, err := m.do(ctx, "TIME").Slice()
+	after := time.Now()
+	var redisTime time.Time
+	if err == nil {
+		redisTime, err = parseRedisTime(reply)
+	}
+	if err != nil {
+		if !m.clockUnavailable {
+			log.Printf("Warning: clock skew with Redis not checked, TIME failed: %v", err)
+			m.clockUnavailable = true
+		}
+		return
+	}
+	m.clockUnavailable = false
+
+	// The server read its clock about halfway through the round trip
+	local := before.Add(after.Sub(before) / 2)
+	m.clockSkew = redisTime.Sub(local)
+
+	metrics.SetGauge("redis_backup_clock_skew_seconds", "Offset of the Redis clock from the clock of the backup service",
+		map[string]string{"target": m.cfg.Target()}, m.clockSkew.Seconds())
+	if m.clockSkewed() {
+		direction := "ahead of"
+		if m.clockSkew < 0 {
+			direction = "behind"
+		}
+		log.Printf("WARNING: the Redis clock is %s %s the clock of this container (CLOCK_SKEW_THRESHOLD %ds), "+
+			"backup times and the age of the last save may be wrong; check NTP on both hosts",
+			m.clockSkew.Abs().Round(time.Millisecond), direction, m.cfg.ClockSkewThreshold)
+	}
+}
+
+// clockSkewed reports whether the last measured skew exceeds CLOCK_SKEW_THRESHOLD
+func (m *Manager) clockSkewed() bool {
+	return m.cfg.ClockSkewThreshold > 0 && m.clockSkew.Abs() > time.Duration(m.cfg.ClockSkewThreshold)*time.Second
+}
+
+// parseRedisTime decodes the reply of TIME: the Unix time in seconds and the
+// microseconds elapsed in the current second
+func parseRedisTime(reply []any) (time.Time, error) {
+	if len(reply) != 2 {
+		return time.Time{}, fmt.Errorf("unexpected TIME reply %v", reply)
+	}
+	var parts [2]int64
+	for i, value := range reply {
+		n, err := strconv.ParseInt(fmt.Sprint(value), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unexpected TIME reply %v", reply)
+		}
+		parts[i] = n
+	}
+	return time.Unix(parts[0], parts[1]*int64(time.Microsecond/time.Nanosecond)), nil
+}
@@ -0,0 +1,94 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// rdbVersionSince lists the first server release writing each RDB version
+// A server can load RDB files up to the version it writes
+var rdbVersionSince = []struct {
+	major, minor int
+	rdb          int
+}{
+	{2, 6, 6},
+	{3, 2, 7},
+	{4, 0, 8},
+	{5, 0, 9},
+	{7, 0, 10},
+	{7, 2, 11},
+	{7, 4, 12},
+}
+
+// serverVersion returns the version reported in INFO server
+// Valkey reports its own version in valkey_version
+func (m *Manager) serverVersion(ctx context.Context) (string, error) {
+	info, err := m.info(ctx, "server")
+	if err != nil {
+		return "", fmt.Errorf("failed to get server info: %w", err)
+	}
+	if version := info.Get("valkey_version"); version != "" {
+		return version, nil
+	}
+	return info.Get("redis_version"), nil
+}
+
+// maxRDBVersion returns the newest RDB version a server release can load
+// It returns 0 when the version is unknown (Dragonfly, unparsable versions)
+func (m *Manager) maxRDBVersion(version string) int {
+	if m.engine == EngineDragonfly {
+		return 0
+	}
+
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return 0
+	}
+	major, err1 := strconv.Atoi(parts[0])
+	minor, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+
+	// Valkey forked from Redis 7.2.4 and kept RDB version 11
+	if m.engine == EngineValkey && major >= 7 {
+		return 11
+	}
+
+	supported := 0
+	for _, release := range rdbVersionSince {
+		if major > release.major || (major == release.major && minor >= release.minor) {
+			supported = release.rdb
+		}
+	}
+	return supported
+}
+
+// checkRestoreCompatibility refuses to restore a backup written with a newer
+// RDB version than the target server can load, unless force is set
+func (m *Manager) checkRestoreCompatibility(ctx context.Context, rdbVersion int, force bool) error {
+	version, err := m.serverVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	supported := m.maxRDBVersion(version)
+	if supported == 0 {
+		log.Printf("Warning: cannot determine the RDB version supported by %s %s, skipping compatibility check", m.engine, version)
+		return nil
+	}
+	if rdbVersion <= supported {
+		return nil
+	}
+
+	if !force {
+		return fmt.Errorf("backup uses RDB version %d but the target (%s %s) only supports up to version %d, use -force to try anyway",
+			rdbVersion, m.engine, version, supported)
+	}
+	log.Printf("WARNING: backup uses RDB version %d but the target (%s %s) only supports up to version %d, keys may fail to restore",
+		rdbVersion, m.engine, version, supported)
+	return nil
+}
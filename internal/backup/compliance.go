@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// ErrDeletionLocked is returned when compliance mode refuses a deletion
+var ErrDeletionLocked = errors.New("deletions are locked by compliance mode")
+
+// checkUnlock checks the unlock token required to delete backups in compliance mode
+func (m *Manager) checkUnlock(token string) error {
+	if !m.cfg.ComplianceMode {
+		return nil
+	}
+	if token == "" {
+		return fmt.Errorf("%w: an unlock token is required", ErrDeletionLocked)
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	expected := strings.ToLower(m.cfg.ComplianceUnlockHash)
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(expected)) != 1 {
+		return fmt.Errorf("%w: invalid unlock token", ErrDeletionLocked)
+	}
+	return nil
+}
+
+// DeleteBackups deletes backups with their sidecars on request of an operator
+// Pinned backups must be unpinned first
+func (m *Manager) DeleteBackups(ctx context.Context, backupNames []string, unlock string) (int, error) {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list objects: %w", err)
+	}
+	exists := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		exists[obj.Name] = storage.IsBackupName(obj.Name)
+	}
+	pinned := PinnedBackups(ctx, m.storage, objects, m.cfg.PinTag)
+	for _, name := range backupNames {
+		if !exists[name] {
+			return 0, fmt.Errorf("%w: %s", storage.ErrNotFound, name)
+		}
+		if pinned[name] {
+			return 0, fmt.Errorf("%s is pinned, unpin it first", name)
+		}
+	}
+
+	return m.deleteBackups(ctx, backupNames, "manual", unlock)
+}
+
+// auditDeletes records deletions in the audit log
+// result applies to every backup; a backup with an error in errs that was
+// expected to succeed is recorded as a failure
+// In compliance mode, the entries are always stored in the audit object
+func (m *Manager) auditDeletes(ctx context.Context, backupNames []string, reason, result string, errs map[string]error) error {
+	if !auditEnabled(m.cfg) {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	entries := make([]AuditEntry, 0, len(backupNames))
+	for _, name := range backupNames {
+		entry := AuditEntry{Time: now, Operation: "delete", Target: name, Reason: reason, Result: result}
+		if err := errs[name]; err != nil {
+			entry.Error = err.Error()
+			if result == "success" {
+				entry.Result = "failure"
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := writeAudit(ctx, m.cfg, m.storage, entries, m.cfg.AuditLogStorage || m.cfg.ComplianceMode); err != nil {
+		return fmt.Errorf("failed to record deletions in the audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package backup
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// controlReplySuffix is appended to the control channel for the replies
+const controlReplySuffix = ":reply"
+
+// controlReply is published in reply to each control command
+type controlReply struct {
+	Command string         `json:"command"`
+	OK      bool           `json:"ok"`
+	Message string         `json:"message,omitempty"`
+	RunID   string         `json:"run_id,omitempty"`
+	Status  []TargetStatus `json:"status,omitempty"`
+}
+
+// ListenControl subscribes to CONTROL_CHANNEL and executes the commands
+// published on it until ctx is canceled
+// Replies are published as JSON on the same channel suffixed with ":reply"
+func (m *Manager) ListenControl(ctx context.Context) error {
+	pubsub := m.redis.Subscribe(ctx, m.cfg.ControlChannel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", m.cfg.ControlChannel, err)
+	}
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			command, ok := m.controlCommand(msg.Payload)
+			if !ok {
+				log.Printf("Warning: ignored a control message with an invalid token")
+				continue
+			}
+			m.reply(ctx, m.handleControl(ctx, command))
+		}
+	}
+}
+
+// controlCommand extracts the command of a message, checking CONTROL_TOKEN when set
+func (m *Manager) controlCommand(payload string) (string, bool) {
+	payload = strings.TrimSpace(payload)
+	if m.cfg.ControlToken != "" {
+		token, command, _ := strings.Cut(payload, " ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(m.cfg.ControlToken)) != 1 {
+			return "", false
+		}
+		payload = strings.TrimSpace(command)
+	}
+
+	// Arguments (backup names) keep their case
+	verb, args, found := strings.Cut(payload, " ")
+	if !found {
+		return strings.ToLower(verb), true
+	}
+	return strings.ToLower(verb) + " " + strings.TrimSpace(args), true
+}
+
+// handleControl executes a control command and audits the ones changing something
+func (m *Manager) handleControl(ctx context.Context, command string) controlReply {
+	log.Printf("Control command received: %q", command)
+	command, arg, _ := strings.Cut(command, " ")
+
+	reply := m.runControl(ctx, command, arg)
+	// Snapshots audit themselves with their reason
+	if command == "run" || command == "pin" || command == "unpin" || command == "maintenance" {
+		var err error
+		if !reply.OK {
+			err = errors.New(reply.Message)
+		}
+		target, details, _ := strings.Cut(arg, " ")
+		if command == "maintenance" {
+			target, details = m.cfg.Target(), arg
+		}
+		if command == "run" {
+			// The callback URL may carry a token, only the run ID is recorded
+			target, details = m.cfg.Target(), ""
+			if reply.RunID != "" {
+				details = "run " + reply.RunID + " with a callback"
+			}
+		}
+		Audit(ctx, m.cfg, m.storage, AuditEntry{Operation: command, Target: target, Details: details, Reason: "control channel"}, err)
+	}
+	return reply
+}
+
+// runControl executes a control command
+func (m *Manager) runControl(ctx context.Context, command, arg string) controlReply {
+	switch command {
+	case "ping":
+		return controlReply{Command: command, OK: true, Message: "pong"}
+	case "status":
+		return controlReply{Command: command, OK: true, Status: Statuses()}
+	case "run":
+		if !m.running.TryLock() {
+			return controlReply{Command: command, Message: "a backup is already running"}
+		}
+		m.running.Unlock()
+
+		if arg != "" {
+			if !m.cfg.CallbackAllowed(arg) {
+				return controlReply{Command: command, Message: "callback URL not allowed by CALLBACK_URL_PREFIXES"}
+			}
+			runID, err := newRunID()
+			if err != nil {
+				return controlReply{Command: command, Message: err.Error()}
+			}
+			go m.runWithCallback(context.WithoutCancel(ctx), runID, arg)
+			return controlReply{Command: command, OK: true, Message: "backup started, result posted to the callback", RunID: runID}
+		}
+
+		go func() {
+			if err := m.Run(context.WithoutCancel(ctx)); err != nil {
+				log.Printf("Backup requested on the control channel failed: %v", err)
+			}
+		}()
+		return controlReply{Command: command, OK: true, Message: "backup started"}
+	case "pin":
+		name, reason, _ := strings.Cut(arg, " ")
+		if name == "" {
+			return controlReply{Command: command, Message: "usage: pin <backup-name> [reason]"}
+		}
+		if err := PinBackup(ctx, m.storage, name, strings.TrimSpace(reason), time.Time{}); err != nil {
+			return controlReply{Command: command, Message: err.Error()}
+		}
+		log.Printf("Backup %s pinned", name)
+		return controlReply{Command: command, OK: true, Message: name + " pinned"}
+	case "snapshot":
+		if arg == "" {
+			return controlReply{Command: command, Message: "usage: snapshot <reason>"}
+		}
+		// The reply is published once the snapshot is stored
+		stored, err := m.Snapshot(ctx, arg, m.cfg.SnapshotPinDays)
+		if err != nil {
+			return controlReply{Command: command, Message: err.Error()}
+		}
+		names := make([]string, 0, len(stored))
+		for _, backup := range stored {
+			names = append(names, backup.Name)
+		}
+		return controlReply{Command: command, OK: true, Message: strings.Join(names, " ") + " stored and pinned"}
+	case "maintenance":
+		return m.controlMaintenance(ctx, arg)
+	case "unpin":
+		if arg == "" {
+			return controlReply{Command: command, Message: "usage: unpin <backup-name>"}
+		}
+		if err := UnpinBackup(ctx, m.storage, arg); err != nil {
+			return controlReply{Command: command, Message: err.Error()}
+		}
+		log.Printf("Backup %s unpinned", arg)
+		return controlReply{Command: command, OK: true, Message: arg + " unpinned"}
+	default:
+		return controlReply{Command: command, Message: "unknown command, expected run, snapshot, status, ping, pin, unpin or maintenance"}
+	}
+}
+
+// controlMaintenance handles "maintenance on <duration> <reason>" and "maintenance off"
+func (m *Manager) controlMaintenance(ctx context.Context, arg string) controlReply {
+	const command = "maintenance"
+	action, rest, _ := strings.Cut(arg, " ")
+	switch action {
+	case "on":
+		value, reason, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return controlReply{Command: command, Message: "usage: maintenance on <duration> <reason>"}
+		}
+		window, err := StartMaintenance(ctx, m.cfg, m.storage, strings.TrimSpace(reason), duration)
+		if err != nil {
+			return controlReply{Command: command, Message: err.Error()}
+		}
+		log.Printf("In maintenance until %s: %s", window.Until.Format(time.RFC3339), window.Reason)
+		return controlReply{Command: command, OK: true, Message: "in maintenance until " + window.Until.Format(time.RFC3339)}
+	case "off":
+		if err := EndMaintenance(ctx, m.cfg, m.storage); err != nil {
+			return controlReply{Command: command, Message: err.Error()}
+		}
+		log.Printf("Maintenance ended")
+		return controlReply{Command: command, OK: true, Message: "maintenance ended"}
+	default:
+		return controlReply{Command: command, Message: "usage: maintenance on <duration> <reason> or maintenance off"}
+	}
+}
+
+// reply publishes a control reply
+func (m *Manager) reply(ctx context.Context, reply controlReply) {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("Warning: failed to encode control reply: %v", err)
+		return
+	}
+	if err := m.redis.Publish(ctx, m.cfg.ControlChannel+controlReplySuffix, data).Err(); err != nil {
+		log.Printf("Warning: failed to publish control reply: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// CopyResult counts the backups handled by CopyBackups
+type CopyResult struct {
+	Copied  int
+	Skipped int
+}
+
+// CopyBackups copies backups and their sidecars from one storage to another
+// Without names, every backup of the source is copied; backups already present
+// in the destination are skipped
+func CopyBackups(ctx context.Context, src, dst storage.Storage, names []string) (CopyResult, error) {
+	var result CopyResult
+
+	srcObjects, err := src.ListObjects(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list source objects: %w", err)
+	}
+	dstObjects, err := dst.ListObjects(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list destination objects: %w", err)
+	}
+
+	inSource := make(map[string]bool, len(srcObjects))
+	for _, obj := range srcObjects {
+		inSource[obj.Name] = true
+	}
+	inDestination := make(map[string]bool, len(dstObjects))
+	for _, obj := range dstObjects {
+		inDestination[obj.Name] = true
+	}
+
+	complete, _ := BackupSets(srcObjects)
+	if len(names) == 0 {
+		names = complete
+	}
+
+	for _, name := range names {
+		if !inSource[name] {
+			return result, fmt.Errorf("%w: %s", storage.ErrNotFound, name)
+		}
+		if !slices.Contains(complete, name) {
+			return result, fmt.Errorf("%w: %s", ErrIncompleteSet, name)
+		}
+		if inDestination[name] {
+			log.Printf("Skipping %s: already in %s", name, dst.Type())
+			result.Skipped++
+			continue
+		}
+
+		if err := copyBackup(ctx, src, dst, srcObjects, name); err != nil {
+			return result, err
+		}
+
+		log.Printf("Copied %s from %s to %s", name, src.Type(), dst.Type())
+		result.Copied++
+	}
+	return result, nil
+}
+
+// copyBackup copies a backup with its sidecars and AOF segments, then stores
+// its set manifest
+// srcObjects lists the objects of the source
+func copyBackup(ctx context.Context, src, dst storage.Storage, srcObjects []storage.ObjectInfo, name string) error {
+	// Sidecars first, so the backup never appears in the destination without its manifest
+	inSource := make(map[string]bool, len(srcObjects))
+	for _, obj := range srcObjects {
+		inSource[obj.Name] = true
+	}
+	for _, suffix := range sidecarSuffixes {
+		if inSource[name+suffix] {
+			if err := copyObject(ctx, src, dst, name+suffix, name+suffix); err != nil {
+				return err
+			}
+		}
+	}
+	if err := copyObject(ctx, src, dst, name, name); err != nil {
+		return err
+	}
+	for _, segment := range aofSegments(srcObjects, name) {
+		if err := copyObject(ctx, src, dst, segment, segment); err != nil {
+			return err
+		}
+	}
+	return storeSet(ctx, dst, newBackupSet(srcObjects, name))
+}
+
+// copyObject copies one object under a new name, streaming it when the destination supports it
+func copyObject(ctx context.Context, src, dst storage.Storage, name, dstName string) error {
+	if uploader, ok := dst.(storage.StreamUploader); ok {
+		reader, writer := io.Pipe()
+		downloaded := make(chan error, 1)
+		go func() {
+			err := src.Download(ctx, name, writer)
+			writer.CloseWithError(err)
+			downloaded <- err
+		}()
+
+		err := uploader.UploadStream(ctx, reader, dstName)
+		reader.CloseWithError(err)
+		downloadErr := <-downloaded
+		// A failed upload closes the pipe, so the download error is only the cause when the upload succeeded
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", dstName, err)
+		}
+		if downloadErr != nil {
+			return fmt.Errorf("failed to download %s: %w", name, downloadErr)
+		}
+		return nil
+	}
+
+	tmp, err := createTemp(ctx, "redis-backup-copy-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer removeTemp(tmp)
+
+	if err := src.Download(ctx, name, tmp); err != nil {
+		return fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := dst.Upload(ctx, tmp.Name(), dstName); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", dstName, err)
+	}
+	return nil
+}
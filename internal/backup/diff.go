@@ -0,0 +1,366 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/rdb"
+)
+
+// deletedKeysSuffix is appended to a differential backup name for the keys
+// deleted since its full backup
+const deletedKeysSuffix = ".deleted"
+
+// Manifest types of differential backups
+const (
+	manifestTypeFull = "full"
+	manifestTypeDiff = "diff"
+)
+
+// diffSeries is the series of differential backups
+const diffSeries = "diff"
+
+// findDiffBase returns the full backup the next backup can be a differential of,
+// or an empty name when a full backup is due
+func (m *Manager) findDiffBase(ctx context.Context) (string, error) {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	names := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		names[obj.Name] = true
+	}
+	complete, _ := BackupSets(objects)
+
+	fullSeries := backupSeries(m.backupNameAt("", time.Now()))
+	latest := ""
+	for _, obj := range objects {
+		if !slices.Contains(complete, obj.Name) || backupSeries(obj.Name) != fullSeries || !names[obj.Name+keyIndexSuffix] {
+			continue
+		}
+		if latest == "" || backupTimestamp(obj.Name) > backupTimestamp(latest) {
+			latest = obj.Name
+		}
+	}
+	if latest == "" {
+		return "", nil
+	}
+
+	takenAt, err := backupTime(latest)
+	if err != nil || time.Since(takenAt) >= time.Duration(m.cfg.FullBackupIntervalDays)*24*time.Hour {
+		return "", nil
+	}
+	return latest, nil
+}
+
+// backupTime parses the timestamp of a backup name
+func backupTime(backupName string) (time.Time, error) {
+	timestamp := backupTimestamp(backupName)
+	if len(timestamp) < len("2006-01-02_15-04-05") {
+		return time.Time{}, fmt.Errorf("no timestamp in %s", backupName)
+	}
+	return time.Parse("2006-01-02_15-04-05", timestamp[:len("2006-01-02_15-04-05")])
+}
+
+// storeKeyIndex stores the fingerprints of the keys of a full backup, which
+// the following differential backups are compared with
+// Failures are logged: the next run then takes a full backup again
+func (m *Manager) storeKeyIndex(ctx context.Context, backupName, rdbPath string) {
+	tmp, err := m.createTemp(ctx, "redis-backup-keyindex-*")
+	if err != nil {
+		log.Printf("Warning: failed to create key index: %v", err)
+		return
+	}
+	defer removeTemp(tmp)
+
+	src, err := os.Open(rdbPath)
+	if err != nil {
+		log.Printf("Warning: failed to create key index: %v", err)
+		return
+	}
+	defer src.Close()
+
+	index := newKeyIndexWriter(tmp)
+	reader := rdb.NewReader(src)
+	count := 0
+	for {
+		entry, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			err = index.Write(keyRecord{DB: entry.DB, Key: entry.Key, Hash: entryHash(entry)})
+		}
+		if err != nil {
+			log.Printf("Warning: failed to create key index, the next backup will be a full backup: %v", err)
+			return
+		}
+		count++
+	}
+	if err := index.Close(); err != nil {
+		log.Printf("Warning: failed to create key index: %v", err)
+		return
+	}
+
+	if err := m.uploadSidecarFile(ctx, tmp.Name(), backupName+keyIndexSuffix); err != nil {
+		log.Printf("Warning: failed to store key index, the next backup will be a full backup: %v", err)
+		return
+	}
+	log.Printf("Key index stored: %s (%d keys)", backupName+keyIndexSuffix, count)
+}
+
+// runDiff stores the keys of a snapshot that changed since a full backup,
+// and the list of keys deleted since then
+func (m *Manager) runDiff(ctx context.Context, rdbPath, base string) error {
+	backupName := m.generateBackupName(diffSeries)
+	log.Printf("Creating differential backup against %s", base)
+
+	baseIndex, err := m.createTemp(ctx, "redis-backup-keyindex-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer removeTemp(baseIndex)
+	if err := m.downloadSidecar(ctx, base+keyIndexSuffix, baseIndex); err != nil {
+		return fmt.Errorf("failed to download key index of %s: %w", base, err)
+	}
+
+	// Fingerprints of the keys of the full backup; keys found in the snapshot
+	// are removed, so the remaining ones were deleted
+	baseKeys := make(map[keyID]uint64)
+	if _, err := baseIndex.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read key index: %w", err)
+	}
+	err = readKeyIndex(bufio.NewReader(baseIndex), func(record keyRecord) error {
+		baseKeys[record.id()] = record.Hash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	diffFile, err := m.createTemp(ctx, "redis-backup-diff-*.rdb")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer removeTemp(diffFile)
+
+	keys, err := writeDiff(rdbPath, diffFile, baseKeys, m.cfg.BigKeysTop)
+	if err != nil {
+		return err
+	}
+
+	deletedFile, err := m.createTemp(ctx, "redis-backup-deleted-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer removeTemp(deletedFile)
+
+	deleted := int64(0)
+	deletedIndex := newKeyIndexWriter(deletedFile)
+	if _, err := baseIndex.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read key index: %w", err)
+	}
+	err = readKeyIndex(bufio.NewReader(baseIndex), func(record keyRecord) error {
+		if _, ok := baseKeys[record.id()]; !ok {
+			return nil
+		}
+		deleted++
+		return deletedIndex.Write(keyRecord{DB: record.DB, Key: record.Key})
+	})
+	if err == nil {
+		err = deletedIndex.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write deleted keys: %w", err)
+	}
+
+	if err := m.checkMaxSize(ctx, backupName, diffFile.Name()); err != nil {
+		return err
+	}
+
+	// The deleted keys are stored first so the backup is never usable without them
+	if err := m.uploadSidecarFile(ctx, deletedFile.Name(), backupName+deletedKeysSuffix); err != nil {
+		return withStage(StageUpload, fmt.Errorf("failed to upload deleted keys: %w", err))
+	}
+	if err := m.runHook(ctx, hookEvent{Phase: hookPreUpload, Backup: backupName, File: diffFile.Name()}); err != nil {
+		return err
+	}
+	if err := m.uploadBackup(ctx, diffFile.Name(), backupName); err != nil {
+		return withStage(StageUpload, fmt.Errorf("failed to upload backup: %w", err))
+	}
+	m.recordStored(backupName, diffFile.Name())
+
+	log.Printf("Differential backup completed successfully: %s (%d changed key(s), %d deleted key(s), storage: %s)",
+		backupName, keys.total(), deleted, m.storage.Type())
+	m.checkSizeAnomaly(ctx, backupName, diffFile.Name())
+
+	manifest := m.newManifest(ctx, backupName, diffFile.Name(), keys)
+	manifest.Type = manifestTypeDiff
+	manifest.Base = base
+	manifest.DeletedKeys = deleted
+	manifest.AOFMarker = m.followBackup(backupName)
+	manifest.Fork = m.fork
+	manifest.DatasetMemory = m.datasetMemory(ctx)
+	m.storeBackupManifest(ctx, manifest)
+	m.backupSidecars(ctx, backupName)
+	if err := m.commitSet(ctx, backupName); err != nil {
+		return withStage(StageUpload, err)
+	}
+	return m.runHook(ctx, hookEvent{Phase: hookPostUpload, Backup: backupName, File: diffFile.Name()})
+}
+
+// writeDiff writes the entries of an RDB file whose fingerprint differs from
+// baseKeys into w, removing every key found from baseKeys
+func writeDiff(rdbPath string, w io.Writer, baseKeys map[keyID]uint64, bigKeysTop int) (*keyCollector, error) {
+	src, err := os.Open(rdbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open RDB file: %w", err)
+	}
+	defer src.Close()
+
+	out := bufio.NewWriter(w)
+	writer := rdb.NewWriter(out, 0)
+	reader := rdb.NewReader(src)
+	keys := newKeyCollector(bigKeysTop)
+	for {
+		entry, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RDB file: %w", err)
+		}
+
+		id := makeKeyID(entry.DB, entry.Key)
+		baseHash, inBase := baseKeys[id]
+		delete(baseKeys, id)
+		if inBase && baseHash == entryHash(entry) {
+			continue
+		}
+
+		if err := writer.SelectDB(entry.DB); err != nil {
+			return nil, err
+		}
+		if err := writer.WriteDump(entry.Key, entry.ExpireAt, entry.Payload(reader.Version())); err != nil {
+			return nil, fmt.Errorf("failed to write differential backup: %w", err)
+		}
+		keys.add(entry.DB, entry.Key, entry.Type, entry.ExpireAt > 0, int64(len(entry.Value)))
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write differential backup: %w", err)
+	}
+	if err := out.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to write differential backup: %w", err)
+	}
+	return keys, nil
+}
+
+// restoreDiff restores the full backup of a differential backup, then the
+// changed keys, then deletes the keys deleted since the full backup
+func (m *Manager) restoreDiff(ctx context.Context, manifest *Manifest, opts RestoreOptions) (RestoreResult, error) {
+	var result RestoreResult
+	if opts.Resume != nil && opts.Resume.Backup == manifest.Backup {
+		log.Printf("%s is a differential backup, its full backup %s was restored before the interruption", manifest.Backup, manifest.Base)
+	} else {
+		log.Printf("%s is a differential backup, restoring its full backup %s first", manifest.Backup, manifest.Base)
+		var err error
+		if result, err = m.restoreBackup(ctx, manifest.Base, opts); err != nil {
+			return result, fmt.Errorf("failed to restore full backup %s: %w", manifest.Base, err)
+		}
+	}
+
+	diffResult, err := m.restoreBackup(ctx, manifest.Backup, opts)
+	result.Restored += diffResult.Restored
+	result.Expired += diffResult.Expired
+	result.Bytes += diffResult.Bytes
+	result.Cursor = diffResult.Cursor
+	if err != nil {
+		if result.Cursor == nil {
+			// The full backup is restored, resume from the start of the changes
+			result.Cursor = &RestoreCursor{Backup: manifest.Backup}
+		}
+		return result, err
+	}
+
+	deleted, err := m.restoreDeletions(ctx, manifest.Backup, opts)
+	result.Deleted = deleted
+	return result, err
+}
+
+// restoreDeletions deletes the keys listed in the deleted keys of a differential backup
+func (m *Manager) restoreDeletions(ctx context.Context, backupName string, opts RestoreOptions) (int, error) {
+	tmp, err := m.createTemp(ctx, "redis-restore-deleted-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer removeTemp(tmp)
+
+	if err := m.downloadSidecar(ctx, backupName+deletedKeysSuffix, tmp); err != nil {
+		return 0, fmt.Errorf("failed to download deleted keys: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to read deleted keys: %w", err)
+	}
+
+	conn := m.conn()
+	defer conn.Close()
+
+	// Keys are grouped per database to send DEL in batches
+	byDB := make(map[int][]string)
+	err = readKeyIndex(bufio.NewReader(tmp), func(record keyRecord) error {
+		if !matchAny(opts.Patterns, record.Key) {
+			return nil
+		}
+		db := record.DB
+		if opts.DB >= 0 {
+			db = opts.DB
+		}
+		byDB[db] = append(byDB[db], record.Key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for db, keys := range byDB {
+		if err := conn.Select(ctx, db).Err(); err != nil {
+			return deleted, fmt.Errorf("failed to select database %d: %w", db, err)
+		}
+		for start := 0; start < len(keys); start += restoreBatchSize {
+			end := min(start+restoreBatchSize, len(keys))
+			n, err := conn.Del(ctx, keys[start:end]...).Result()
+			if err != nil {
+				return deleted, fmt.Errorf("failed to delete keys: %w", err)
+			}
+			deleted += int(n)
+		}
+	}
+	return deleted, nil
+}
+
+// diffBases returns the full backup of each differential backup among names
+// Differential backups without a readable manifest are mapped to an empty base
+func (m *Manager) diffBases(ctx context.Context, names []string) map[string]string {
+	bases := make(map[string]string)
+	for _, name := range names {
+		manifest, err := LoadManifest(ctx, m.storage, name, nil)
+		if err != nil {
+			log.Printf("Warning: failed to read manifest of %s: %v", name, err)
+			bases[name] = ""
+			continue
+		}
+		bases[name] = manifest.Base
+	}
+	return bases
+}
@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ermos/docker-redis-backup/internal/buildinfo"
+	"github.com/ermos/docker-redis-backup/internal/crypt"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// Kinds of warnings of Doctor
+const (
+	// DoctorOlderDecoder is a backup in a format this build no longer reads
+	DoctorOlderDecoder = "older_decoder"
+	// DoctorNewerDecoder is a backup stored by a newer version than this build
+	DoctorNewerDecoder = "newer_decoder"
+	// DoctorExternalDecoder is a backup compressed or encrypted by another
+	// tool, which restores cannot decode
+	DoctorExternalDecoder = "external_decoder"
+)
+
+// externalDecoders are the commands decoding the suffixes restores don't undo
+var externalDecoders = map[string]string{
+	".zst": "zstd -d",
+	".lz4": "lz4 -d",
+	".age": "age --decrypt",
+	".enc": "the tool that encrypted it",
+}
+
+// DoctorWarning is a backup that this build cannot read as stored
+type DoctorWarning struct {
+	Kind   string `json:"kind"`
+	Backup string `json:"backup"`
+	Detail string `json:"detail"`
+}
+
+// DoctorResult lists the builds that stored the backups and the warnings found
+type DoctorResult struct {
+	Tool    buildinfo.Info `json:"tool"`
+	Backups int            `json:"backups"`
+	// Tools counts the backups per build that stored them
+	Tools map[string]int `json:"tools"`
+	// Untracked counts the backups whose manifest records no build, stored by
+	// earlier versions
+	Untracked int             `json:"untracked"`
+	Warnings  []DoctorWarning `json:"warnings"`
+}
+
+// Doctor checks, from their manifests, that every complete backup can be
+// decoded by this build, and names the decoder needed by those that cannot
+// Backups are not downloaded, so the plaintext fields of encrypted manifests
+// are enough
+func (m *Manager) Doctor(ctx context.Context) (DoctorResult, error) {
+	result := DoctorResult{Tool: buildinfo.Get(), Tools: make(map[string]int)}
+	names, err := m.listBackups(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list backups: %w", err)
+	}
+	result.Backups = len(names)
+
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		manifest, err := LoadManifest(ctx, m.storage, name, m.keyring)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Warning: %v", err)
+		}
+		if manifest == nil || manifest.Tool == nil {
+			result.Untracked++
+		} else {
+			result.Tools[manifest.Tool.String()]++
+		}
+		result.Warnings = append(result.Warnings, doctorBackup(result.Tool, name, manifest)...)
+	}
+	return result, nil
+}
+
+// doctorBackup returns the warnings of a backup, whose manifest may be nil
+func doctorBackup(tool buildinfo.Info, name string, manifest *Manifest) []DoctorWarning {
+	var warnings []DoctorWarning
+	// In decoding order, from the last applied transform
+	_, transforms := storage.SplitBackupName(name)
+	for i := len(transforms) - 1; i >= 0; i-- {
+		suffix := transforms[i]
+		if decoder, ok := externalDecoders[suffix]; ok {
+			warnings = append(warnings, DoctorWarning{
+				Kind:   DoctorExternalDecoder,
+				Backup: name,
+				Detail: fmt.Sprintf("stored as %s, decode it with %s before restoring", suffix, decoder),
+			})
+		}
+	}
+	if manifest == nil {
+		return warnings
+	}
+
+	storedBy := "the version that stored it"
+	if manifest.Tool != nil {
+		storedBy = manifest.Tool.Name + " " + manifest.Tool.String()
+	}
+	if encoding := manifest.Encoding; encoding != nil && encoding.Encryption == "builtin" && encoding.EncryptionFormat != crypt.FormatVersion {
+		kind := DoctorOlderDecoder
+		if encoding.EncryptionFormat > crypt.FormatVersion {
+			kind = DoctorNewerDecoder
+		}
+		return append(warnings, DoctorWarning{
+			Kind:   kind,
+			Backup: name,
+			Detail: fmt.Sprintf("encryption format %d, this build reads format %d: restore it with %s",
+				encoding.EncryptionFormat, crypt.FormatVersion, storedBy),
+		})
+	}
+	if manifest.Tool != nil {
+		if cmp, ok := buildinfo.Compare(manifest.Tool.Version, tool.Version); ok && cmp > 0 {
+			warnings = append(warnings, DoctorWarning{
+				Kind:   DoctorNewerDecoder,
+				Backup: name,
+				Detail: fmt.Sprintf("stored by %s, newer than this build (%s): restore it with that version or later", storedBy, tool),
+			})
+		}
+	}
+	return warnings
+}
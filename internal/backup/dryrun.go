@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// dryRun goes through the steps of a backup and logs what would happen
+// No snapshot is triggered, nothing is uploaded or deleted, no lock is taken
+// and no notification is sent
+func (m *Manager) dryRun(ctx context.Context) error {
+	log.Println("DRY RUN: nothing will be uploaded or deleted")
+
+	if m.cfg.BackupLock {
+		log.Printf("DRY RUN: would take the backup lock %s", m.cfg.BackupLockKey)
+	}
+
+	var names []string
+	if m.cfg.BackupSplitDatabases {
+		dbs := m.cfg.BackupDatabaseList
+		if len(dbs) == 0 {
+			var err error
+			if dbs, err = m.nonEmptyDatabases(ctx); err != nil {
+				return fmt.Errorf("failed to list databases: %w", err)
+			}
+		}
+		if len(dbs) == 0 {
+			log.Println("DRY RUN: no non-empty databases found, nothing would be backed up")
+		}
+		for _, db := range dbs {
+			name := m.generateBackupName(fmt.Sprintf("db%d", db))
+			log.Printf("DRY RUN: would dump database %d and upload it as %s to %s", db, name, m.storage.Type())
+			names = append(names, name)
+		}
+	} else {
+		name, err := m.dryRunSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if m.cfg.RetentionCount > 0 {
+		backups, err := m.listBackups(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list backups: %w", err)
+		}
+
+		// The retention policy runs once the new backups are stored
+		toDelete := m.retentionPlan(ctx, append(backups, names...))
+		for _, name := range toDelete {
+			log.Printf("DRY RUN: would delete old backup %s", name)
+		}
+		log.Printf("DRY RUN: retention policy would delete %d old backup(s)", len(toDelete))
+		if err := m.checkUnlock(m.cfg.ComplianceUnlockToken); err != nil && len(toDelete) > 0 {
+			log.Printf("DRY RUN: the deletions would be refused: %v", err)
+		}
+	}
+
+	if reporter, ok := m.storage.(storage.SpaceReporter); ok && m.cfg.RetentionMinFree > 0 {
+		free, err := reporter.FreeSpace(ctx)
+		if err != nil {
+			return err
+		}
+		if free < m.cfg.RetentionMinFree {
+			log.Printf("DRY RUN: only %s free, below RETENTION_MIN_FREE (%s), the oldest backups would be deleted",
+				config.FormatSize(free), config.FormatSize(m.cfg.RetentionMinFree))
+		}
+	}
+
+	log.Println("DRY RUN completed")
+	return nil
+}
+
+// dryRunSnapshot checks the snapshot steps and returns the name of the full
+// backup that would be stored, or an empty name for a differential backup
+func (m *Manager) dryRunSnapshot(ctx context.Context) (string, error) {
+	info, err := m.info(ctx, "persistence")
+	if err != nil {
+		return "", fmt.Errorf("failed to get persistence info: %w", err)
+	}
+	m.logSavePoints(ctx)
+	if reuse, reason := m.reusableSnapshot(ctx, info); reuse && !m.bgsaveInProgress(info) {
+		log.Printf("DRY RUN: would skip BGSAVE and upload the existing snapshot: %s", reason)
+	} else if m.bgsaveInProgress(info) {
+		log.Println("DRY RUN: BGSAVE in progress, the backup would wait for it")
+	} else {
+		log.Println("DRY RUN: would trigger BGSAVE")
+	}
+	if status := info.LastBGSAVEStatus(); status != "" && status != "ok" {
+		log.Printf("DRY RUN: WARNING: the last BGSAVE failed (rdb_last_bgsave_status:%s)", status)
+	}
+
+	rdbFile, err := m.rdbFileName(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to locate RDB file: %w", err)
+	}
+	rdbPath, cleanup, err := m.localRDBPath(ctx, rdbFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve RDB file: %w", err)
+	}
+	defer cleanup()
+
+	stat, err := os.Stat(rdbPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read RDB file: %w", err)
+	}
+	size := config.FormatSize(stat.Size())
+	log.Printf("DRY RUN: current snapshot %s is %s", rdbFile, size)
+
+	if m.cfg.MaxBackupSize > 0 && stat.Size() > m.cfg.MaxBackupSize {
+		if m.cfg.MaxBackupSizeAction == "abort" {
+			log.Printf("DRY RUN: the upload would be aborted, the snapshot is larger than MAX_BACKUP_SIZE (%s)", config.FormatSize(m.cfg.MaxBackupSize))
+			return "", nil
+		}
+		log.Printf("DRY RUN: the snapshot is larger than MAX_BACKUP_SIZE (%s), a warning would be sent", config.FormatSize(m.cfg.MaxBackupSize))
+	}
+
+	if m.cfg.BackupDifferential {
+		base, err := m.findDiffBase(ctx)
+		if err != nil {
+			log.Printf("DRY RUN: %v, a full backup would be taken", err)
+		}
+		if base != "" {
+			log.Printf("DRY RUN: would upload the keys changed since %s as %s to %s", base, m.generateBackupName(diffSeries), m.storage.Type())
+			return "", nil
+		}
+	}
+
+	name := m.generateBackupName("")
+	log.Printf("DRY RUN: would upload %s (%s) to %s", name, size, m.storage.Type())
+
+	var sidecars []string
+	if m.cfg.BackupFunctions {
+		sidecars = append(sidecars, name+functionsSuffix)
+	}
+	if m.cfg.BackupServerConfig {
+		sidecars = append(sidecars, name+serverConfigSuffix)
+	}
+	if m.cfg.BackupDifferential {
+		sidecars = append(sidecars, name+keyIndexSuffix)
+	}
+	sidecars = append(sidecars, name+manifestSuffix, name+setSuffix)
+	for _, sidecar := range sidecars {
+		log.Printf("DRY RUN: would store %s", sidecar)
+	}
+	return name, nil
+}
@@ -0,0 +1,325 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ermos/docker-redis-backup/internal/buildinfo"
+	"github.com/ermos/docker-redis-backup/internal/crypt"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// uploadBackup uploads a backup file, encrypting it first when ENCRYPTION_KEY,
+// ENCRYPTION_KMS_KEY or GPG_RECIPIENT_KEYS is set, and signs what was stored
+// when SIGNING_KEY_FILE is set
+func (m *Manager) uploadBackup(ctx context.Context, localPath, backupName string) error {
+	var encrypt func(dst io.Writer, src io.Reader) error
+	switch {
+	case m.gpg.Enabled():
+		encrypt = func(dst io.Writer, src io.Reader) error {
+			return m.gpg.Encrypt(dst, src, strings.TrimSuffix(backupName, crypt.GPGSuffix))
+		}
+	case m.keyring.CurrentKeyID() != "":
+		encrypt = func(dst io.Writer, src io.Reader) error {
+			return m.keyring.Encrypt(ctx, dst, src)
+		}
+	}
+
+	uploaded := localPath
+	if encrypt != nil {
+		encrypted, err := encryptFile(m.work.context(ctx), localPath, encrypt)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(encrypted)
+		uploaded = encrypted
+	}
+
+	if err := m.storage.Upload(ctx, uploaded, backupName); err != nil {
+		return err
+	}
+	return m.signBackup(ctx, uploaded, backupName)
+}
+
+// encryptFile encrypts a file into a temporary file
+func encryptFile(ctx context.Context, localPath string, encrypt func(dst io.Writer, src io.Reader) error) (string, error) {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer src.Close()
+
+	tmp, err := createTemp(ctx, "redis-backup-encrypted-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	buf := bufio.NewWriter(tmp)
+	err = encrypt(buf, bufio.NewReader(src))
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to encrypt backup: %w", err)
+	}
+	return tmp.Name(), nil
+}
+
+// downloadBackup downloads a backup into a temporary file, undoing its
+// compression and encryption based on the name suffixes and file header
+// The returned file is positioned at the start; removeTemp must be called when done
+func (m *Manager) downloadBackup(ctx context.Context, backupName string) (*os.File, error) {
+	return m.downloadFrom(ctx, m.storage, backupName)
+}
+
+// downloadFrom is like downloadBackup for a backup of another storage
+func (m *Manager) downloadFrom(ctx context.Context, store storage.Storage, backupName string) (*os.File, error) {
+	tmp, err := m.downloadStored(ctx, store, backupName)
+	if err != nil {
+		return nil, err
+	}
+	return m.decodeBackup(ctx, tmp, backupName)
+}
+
+// downloadStored downloads a backup as stored into a temporary file
+func (m *Manager) downloadStored(ctx context.Context, store storage.Storage, backupName string) (*os.File, error) {
+	tmp, err := m.createTemp(ctx, "redis-restore-*.rdb")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	log.Printf("Downloading %s...", backupName)
+	if err := store.Download(ctx, backupName, tmp); err != nil {
+		removeTemp(tmp)
+		return nil, fmt.Errorf("failed to download backup: %w", err)
+	}
+	return tmp, nil
+}
+
+// decodeBackup undoes the compression and encryption of a backup file based
+// on the suffixes of backupName and the file header
+// The returned file replaces tmp, which is removed when decoded or on error
+func (m *Manager) decodeBackup(ctx context.Context, tmp *os.File, backupName string) (*os.File, error) {
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		removeTemp(tmp)
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	// Undo the transforms from the last applied to the first
+	var err error
+	_, transforms := storage.SplitBackupName(backupName)
+	for i := len(transforms) - 1; i >= 0; i-- {
+		tmp, err = m.decode(ctx, tmp, transforms[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Backups encrypted with ENCRYPTION_KEY/ENCRYPTION_KMS_KEY keep the .rdb name
+	encrypted, err := isEncryptedFile(tmp)
+	if err != nil {
+		removeTemp(tmp)
+		return nil, err
+	}
+	if encrypted {
+		return m.decode(ctx, tmp, "")
+	}
+	return tmp, nil
+}
+
+// decode undoes one transform of a downloaded backup into a new temporary file
+// The input file is always removed; an empty suffix means the built-in encryption
+func (m *Manager) decode(ctx context.Context, in *os.File, suffix string) (*os.File, error) {
+	defer removeTemp(in)
+
+	var decodeFn func(dst io.Writer, src io.Reader) error
+	switch suffix {
+	case "":
+		decodeFn = func(dst io.Writer, src io.Reader) error {
+			keyID, err := m.keyring.Decrypt(ctx, dst, src)
+			if err == nil {
+				log.Printf("Backup decrypted with key %s", keyID)
+			}
+			return err
+		}
+	case crypt.GPGSuffix:
+		decodeFn = m.gpg.Decrypt
+	case ".gz":
+		decodeFn = func(dst io.Writer, src io.Reader) error {
+			gz, err := gzip.NewReader(src)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			_, err = io.Copy(dst, gz)
+			return err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported backup format %q, decode it manually before restoring", suffix)
+	}
+
+	out, err := m.createTemp(ctx, "redis-restore-*.rdb")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	buf := bufio.NewWriter(out)
+	err = decodeFn(buf, bufio.NewReader(in))
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeTemp(out)
+		if suffix == ".gz" {
+			return nil, fmt.Errorf("failed to decompress backup: %w", err)
+		}
+		return nil, fmt.Errorf("failed to decrypt backup: %w", err)
+	}
+	return out, nil
+}
+
+// isEncryptedFile checks the header of a file and rewinds it
+func isEncryptedFile(file *os.File) (bool, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	header := make([]byte, 16)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return crypt.IsEncrypted(header[:n]), nil
+}
+
+// removeTemp closes and deletes a temporary file
+func removeTemp(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// Rekey re-encrypts backups with the current key so older keys can be retired
+// Backups already using the current key are skipped; it returns how many were re-encrypted
+func (m *Manager) Rekey(ctx context.Context, backupNames []string) (int, error) {
+	currentID := m.keyring.CurrentKeyID()
+	if currentID == "" {
+		return 0, errors.New("ENCRYPTION_KEY must be set to re-encrypt backups")
+	}
+
+	if len(backupNames) == 0 {
+		var err error
+		backupNames, err = m.listBackups(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list backups: %w", err)
+		}
+	}
+
+	rekeyed := 0
+	for _, name := range backupNames {
+		manifest, err := LoadManifest(ctx, m.storage, name, m.keyring)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return rekeyed, err
+		}
+		if manifest != nil && manifest.KeyID == currentID {
+			continue
+		}
+		if _, transforms := storage.SplitBackupName(name); len(transforms) > 0 {
+			log.Printf("Skipping %s: only backups stored as .rdb are re-encrypted", name)
+			continue
+		}
+
+		if err := m.rekeyBackup(ctx, name, manifest); err != nil {
+			return rekeyed, fmt.Errorf("failed to re-encrypt %s: %w", name, err)
+		}
+		log.Printf("Re-encrypted %s with key %s", name, currentID)
+		rekeyed++
+	}
+	return rekeyed, nil
+}
+
+// rekeyBackup downloads, decrypts and uploads a backup again encrypted with
+// the current key, then updates its manifest
+func (m *Manager) rekeyBackup(ctx context.Context, backupName string, manifest *Manifest) error {
+	plain, err := m.downloadBackup(ctx, backupName)
+	if err != nil {
+		return err
+	}
+	defer removeTemp(plain)
+
+	if err := m.uploadBackup(ctx, plain.Name(), backupName); err != nil {
+		return fmt.Errorf("failed to upload backup: %w", err)
+	}
+
+	if err := m.rekeySidecars(ctx, backupName); err != nil {
+		return err
+	}
+
+	if manifest != nil {
+		tool := buildinfo.Get()
+		manifest.KeyID = m.keyring.CurrentKeyID()
+		manifest.Tool = &tool
+		manifest.Encoding = m.encoding()
+		if err := m.storeManifest(ctx, manifest); err != nil {
+			return err
+		}
+	}
+	// The set records the new sizes
+	return m.commitSet(ctx, backupName)
+}
+
+// rekeySidecars stores the encrypted sidecars of a backup again encrypted with
+// the current key, including those stored before ENCRYPTION_METADATA was enabled
+func (m *Manager) rekeySidecars(ctx context.Context, backupName string) error {
+	for _, suffix := range sidecarSuffixes {
+		// Signatures are stored in plaintext, the backup upload signed it again
+		if suffix == manifestSuffix || suffix == crypt.MinisignSuffix || suffix == crypt.CosignSuffix {
+			continue
+		}
+		if !m.sidecarEncrypted(backupName + suffix) {
+			continue
+		}
+		if err := m.rekeySidecar(ctx, backupName+suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekeySidecar re-encrypts one sidecar, if it exists
+func (m *Manager) rekeySidecar(ctx context.Context, sidecarName string) error {
+	plain, err := m.createTemp(ctx, "redis-backup-sidecar-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer removeTemp(plain)
+
+	err = m.downloadSidecar(ctx, sidecarName, plain)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", sidecarName, err)
+	}
+	if err := m.uploadSidecarFile(ctx, plain.Name(), sidecarName); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", sidecarName, err)
+	}
+	return nil
+}
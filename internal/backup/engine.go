@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/ermos/docker-redis-backup/internal/redisinfo"
+)
+
+// Supported server engines
+const (
+	EngineRedis     = "redis"
+	EngineValkey    = "valkey"
+	EngineKeyDB     = "keydb"
+	EngineDragonfly = "dragonfly"
+)
+
+// defaultRDBFileName is the dbfilename used by Redis when not configured
+const defaultRDBFileName = "dump.rdb"
+
+// detectEngine determines the server engine from the INFO server section
+func (m *Manager) detectEngine(ctx context.Context) (string, error) {
+	if m.cfg.Engine != "auto" {
+		return m.cfg.Engine, nil
+	}
+
+	info, err := m.info(ctx, "server")
+	if err != nil {
+		return "", fmt.Errorf("failed to get server info: %w", err)
+	}
+
+	switch {
+	case info.Get("dragonfly_version") != "":
+		return EngineDragonfly, nil
+	case info.Get("valkey_version") != "" || info.Get("server_name") == "valkey":
+		return EngineValkey, nil
+	case mentionsKeyDB(info):
+		return EngineKeyDB, nil
+	default:
+		return EngineRedis, nil
+	}
+}
+
+// Engine returns the detected server engine
+func (m *Manager) Engine() string {
+	return m.engine
+}
+
+// bgsaveInProgress checks the engine-specific INFO persistence field for a running save
+func (m *Manager) bgsaveInProgress(info *redisinfo.Info) bool {
+	if m.engine == EngineDragonfly {
+		return info.Flag("saving")
+	}
+	return info.BGSAVEInProgress()
+}
+
+// rdbFileName returns the name of the snapshot file inside REDIS_DATA_PATH
+// It is taken from REDIS_RDB_FILENAME when set, otherwise discovered from the server
+func (m *Manager) rdbFileName(ctx context.Context) (string, error) {
+	if m.cfg.RedisRDBFileName != "" {
+		return m.cfg.RedisRDBFileName, nil
+	}
+
+	if m.engine == EngineDragonfly {
+		// Dragonfly names each snapshot differently, the last one is reported in INFO
+		info, err := m.info(ctx, "persistence")
+		if err != nil {
+			return "", fmt.Errorf("failed to get persistence info: %w", err)
+		}
+		file := info.Get("last_saved_file")
+		if file == "" {
+			return "", fmt.Errorf("dragonfly did not report last_saved_file")
+		}
+		if strings.HasSuffix(file, ".dfs") {
+			return "", fmt.Errorf("dragonfly snapshot %s uses the DF format, start dragonfly with --nodf_snapshot_format to produce RDB files", file)
+		}
+		return path.Base(file), nil
+	}
+
+	result, err := m.configGet(ctx, "dbfilename")
+	if err != nil || result["dbfilename"] == "" {
+		log.Printf("Warning: could not read dbfilename from server (set REDIS_RDB_FILENAME), assuming %s", defaultRDBFileName)
+		return defaultRDBFileName, nil
+	}
+	return result["dbfilename"], nil
+}
+
+// mentionsKeyDB reports whether a section name, field or value of an INFO
+// reply mentions KeyDB, which otherwise reports itself as Redis
+func mentionsKeyDB(info *redisinfo.Info) bool {
+	for _, section := range info.Sections() {
+		if strings.Contains(section, "keydb") {
+			return true
+		}
+		for key, value := range info.Section(section) {
+			if strings.Contains(strings.ToLower(key+":"+value), "keydb") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/ermos/docker-redis-backup/internal/storage"
+	"github.com/redis/go-redis/v9"
+)
+
+// Stages of a backup run errors are attributed to
+const (
+	// StageRedis covers the connection, the snapshot and retrieving the RDB file
+	StageRedis = "redis"
+	// StageUpload covers storing the backup
+	StageUpload = "upload"
+	// StageVerify covers the verification of the stored backups (VERIFY_SAMPLE_RATE)
+	StageVerify = "verify"
+)
+
+// StageError is a backup run error with the stage it happened in
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// withStage attributes an error to a stage, unless it already has one
+func withStage(stage string, err error) error {
+	if err == nil || ErrorStage(err) != "" {
+		return err
+	}
+	return &StageError{Stage: stage, Err: err}
+}
+
+// ErrorStage returns the stage of a backup run error, or an empty string
+func ErrorStage(err error) string {
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return stageErr.Stage
+	}
+	return ""
+}
+
+// ErrRedisUnavailable is returned when Redis cannot be reached or is not ready
+// (connection refused or reset, timeout, dataset still loading)
+var ErrRedisUnavailable = errors.New("redis unavailable")
+
+// ErrRDBMissing is returned when the RDB file written by BGSAVE is not found,
+// usually because REDIS_DATA_PATH does not point at the Redis data directory
+var ErrRDBMissing = errors.New("RDB file not found")
+
+// ErrRedisPermission is returned when the ACL rules of the Redis user deny a
+// command or key (NOPERM)
+var ErrRedisPermission = errors.New("redis permission denied")
+
+// ErrVerifyFailed is returned when a sampled backup fails its verification
+var ErrVerifyFailed = errors.New("backup verification failed")
+
+// ErrWindowExceeded is returned when a run did not complete within
+// MAX_BACKUP_DURATION
+var ErrWindowExceeded = errors.New("backup window exceeded")
+
+// ErrHookFailed is returned when a hook of the run fails or times out
+var ErrHookFailed = errors.New("hook failed")
+
+// Error categories reported in notifications and the status endpoint
+const (
+	CategoryRedisUnavailable = "redis_unavailable"
+	CategoryRDBMissing       = "rdb_missing"
+	CategoryStorageAuth      = "storage_auth"
+	CategoryStorageTransient = "storage_transient"
+	CategoryCommandDisabled  = "command_disabled"
+	CategoryRedisPermission  = "redis_permission"
+	CategoryVerifyFailed     = "verification_failed"
+	CategoryWindowExceeded   = "window_exceeded"
+	CategoryHookFailed       = "hook_failed"
+)
+
+// categorizedError tags an error with a category while keeping its message
+type categorizedError struct {
+	category error
+	err      error
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Unwrap() []error {
+	return []error{e.err, e.category}
+}
+
+// redisError tags the error of a Redis command with ErrRedisUnavailable when
+// the server could not be reached or is not ready, or with ErrRedisPermission
+// when the ACL rules denied it; other errors (wrong password, unknown
+// command, ...) are returned unchanged
+func redisError(err error) error {
+	if err == nil || errors.Is(err, ErrRedisUnavailable) || errors.Is(err, ErrRedisPermission) {
+		return err
+	}
+	var noPerm redis.Error
+	if errors.As(err, &noPerm) && strings.HasPrefix(noPerm.Error(), "NOPERM") {
+		return &categorizedError{category: ErrRedisPermission, err: err}
+	}
+
+	var netErr net.Error
+	unavailable := errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		// Replies of a server that is starting or has lost its master
+		msg := redisErr.Error()
+		unavailable = strings.HasPrefix(msg, "LOADING") || strings.HasPrefix(msg, "MASTERDOWN") || strings.HasPrefix(msg, "TRYAGAIN")
+	}
+	if !unavailable {
+		return err
+	}
+	return &categorizedError{category: ErrRedisUnavailable, err: err}
+}
+
+// ErrorCategory returns the category of a backup run error, or an empty string
+func ErrorCategory(err error) string {
+	switch {
+	case errors.Is(err, ErrWindowExceeded):
+		return CategoryWindowExceeded
+	case errors.Is(err, ErrVerifyFailed):
+		return CategoryVerifyFailed
+	case errors.Is(err, ErrHookFailed):
+		return CategoryHookFailed
+	case errors.Is(err, ErrRedisUnavailable):
+		return CategoryRedisUnavailable
+	case errors.Is(err, ErrRDBMissing):
+		return CategoryRDBMissing
+	case errors.Is(err, storage.ErrStorageAuth):
+		return CategoryStorageAuth
+	case errors.Is(err, storage.ErrStorageTransient):
+		return CategoryStorageTransient
+	case errors.Is(err, ErrCommandDisabled):
+		return CategoryCommandDisabled
+	case errors.Is(err, ErrRedisPermission):
+		return CategoryRedisPermission
+	}
+	return ""
+}
+
+// Retryable reports whether a failed backup run may succeed when run again
+// right away; configuration errors (credentials, paths, ...) are not
+func Retryable(err error) bool {
+	return errors.Is(err, ErrRedisUnavailable) || errors.Is(err, storage.ErrStorageTransient)
+}
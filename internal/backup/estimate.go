@@ -0,0 +1,237 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// restoreHistoryObject records the latest full restores, whose load rate
+// estimates how long the next ones take
+const restoreHistoryObject = "redis-backup-restores.json"
+
+// restoreHistorySize is the number of restores kept in the history
+const restoreHistorySize = 20
+
+// RestoreRecord describes a completed full restore
+type RestoreRecord struct {
+	Time    time.Time `json:"time"`
+	Target  string    `json:"target"`
+	Backup  string    `json:"backup"`
+	Bytes   int64     `json:"bytes"`
+	Keys    int       `json:"keys"`
+	Seconds float64   `json:"seconds"`
+}
+
+// RestoreEstimate predicts the duration and memory needs of a restore
+type RestoreEstimate struct {
+	Backup string
+	Target string
+	// Bytes and Keys are the RDB data read and the keys it holds, with the full
+	// backup of a differential backup
+	Bytes int64
+	Keys  int64
+	// Partial is set when the key patterns select some keys only, which makes
+	// the estimate an upper bound
+	Partial bool
+	// Duration is 0 when nothing is known to base it on, see DurationBasis
+	Duration      time.Duration
+	DurationBasis string
+	// Memory is the memory the restored keys take; MemoryLowerBound is set
+	// when only the size of the backup is known
+	Memory           int64
+	MemoryLowerBound bool
+	// UsedMemory and MemoryLimit (maxmemory, or the memory of the host) are
+	// read from the target, MemoryLimit is 0 when unknown
+	UsedMemory  int64
+	MemoryLimit int64
+}
+
+// Fits reports whether the restored keys fit in the memory of the target,
+// and whether that is known
+func (e *RestoreEstimate) Fits() (fits, known bool) {
+	if e.MemoryLimit == 0 {
+		return false, false
+	}
+	return e.UsedMemory+e.Memory <= e.MemoryLimit, true
+}
+
+// EstimateRestore predicts how long restoring a backup takes and how much
+// memory the restored keys need on the target, without writing anything
+func (m *Manager) EstimateRestore(ctx context.Context, backupName string, opts RestoreOptions) (*RestoreEstimate, error) {
+	if err := m.checkSet(ctx, backupName); err != nil {
+		return nil, err
+	}
+	estimate := &RestoreEstimate{
+		Backup:  backupName,
+		Target:  m.cfg.Target(),
+		Partial: !slices.Contains(opts.Patterns, "*"),
+	}
+
+	manifest, err := LoadManifest(ctx, m.storage, backupName, m.keyring)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		// Only the stored size is known, which may be compressed
+		info, err := m.storage.Stat(ctx, backupName)
+		if err != nil {
+			return nil, err
+		}
+		estimate.Bytes = info.Size
+	case err != nil:
+		return nil, err
+	default:
+		estimate.Bytes, estimate.Keys = manifest.SizeBytes, manifest.TotalKeys()
+		estimate.Memory = manifest.DatasetMemory
+		if manifest.Type == manifestTypeDiff {
+			base, err := LoadManifest(ctx, m.storage, manifest.Base, m.keyring)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the manifest of full backup %s: %w", manifest.Base, err)
+			}
+			estimate.Bytes += base.SizeBytes
+			estimate.Keys += base.TotalKeys()
+		}
+	}
+	if estimate.Memory == 0 {
+		// Keys take more memory in Redis than in the RDB file
+		estimate.Memory, estimate.MemoryLowerBound = estimate.Bytes, true
+	}
+
+	memory, err := m.info(ctx, "memory")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target memory info: %w", err)
+	}
+	estimate.UsedMemory = memory.UsedMemory()
+	if estimate.MemoryLimit = memory.MaxMemory(); estimate.MemoryLimit == 0 {
+		estimate.MemoryLimit, _ = memory.Int("total_system_memory")
+	}
+
+	m.estimateDuration(ctx, estimate)
+	return estimate, nil
+}
+
+// estimateDuration predicts the duration of a restore from the median load
+// rate of the restores recorded into the same target, or into any target
+// Without any, it falls back to the round trips of the RESTORE batches
+func (m *Manager) estimateDuration(ctx context.Context, estimate *RestoreEstimate) {
+	history, err := m.restoreHistory(ctx)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	var same, other []float64
+	for _, record := range history {
+		if record.Bytes <= 0 || record.Seconds <= 0 {
+			continue
+		}
+		rate := float64(record.Bytes) / record.Seconds
+		if record.Target == estimate.Target {
+			same = append(same, rate)
+		} else {
+			other = append(other, rate)
+		}
+	}
+
+	rates, basis := same, "into "+estimate.Target
+	if len(rates) == 0 {
+		rates, basis = other, "into other targets"
+	}
+	if len(rates) > 0 {
+		sort.Float64s(rates)
+		rate := rates[len(rates)/2]
+		estimate.Duration = time.Duration(float64(estimate.Bytes) / rate * float64(time.Second))
+		estimate.DurationBasis = fmt.Sprintf("median load rate of %s/s over the last %d full restore(s) %s",
+			config.FormatSize(int64(rate)), len(rates), basis)
+		return
+	}
+
+	if estimate.Keys == 0 {
+		estimate.DurationBasis = "no full restore recorded and no key count in the manifest"
+		return
+	}
+	start := time.Now()
+	if err := m.redis.Ping(ctx).Err(); err != nil {
+		estimate.DurationBasis = fmt.Sprintf("no full restore recorded and the target did not answer: %v", err)
+		return
+	}
+	rtt := time.Since(start)
+	batches := (estimate.Keys + restoreBatchSize - 1) / restoreBatchSize
+	estimate.Duration = time.Duration(batches) * rtt
+	estimate.DurationBasis = fmt.Sprintf("round trip time of %s to the target, no full restore recorded yet (lower bound: download and load time not included)",
+		rtt.Round(time.Microsecond))
+}
+
+// measurable reports whether a restore loads every key at full speed, so its
+// load rate estimates the next restores
+func measurable(opts RestoreOptions) bool {
+	return slices.Contains(opts.Patterns, "*") && opts.Resume == nil && opts.KeysPerSecond == 0 && opts.BytesPerSecond == 0
+}
+
+// recordRestore adds a full restore to the restore history
+// Failures are logged, the restore itself succeeded
+func (m *Manager) recordRestore(ctx context.Context, backupName string, result RestoreResult, elapsed time.Duration) {
+	if result.Bytes == 0 {
+		return
+	}
+	history, err := m.restoreHistory(ctx)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+
+	history = append(history, RestoreRecord{
+		Time:    time.Now().UTC(),
+		Target:  m.cfg.Target(),
+		Backup:  backupName,
+		Bytes:   result.Bytes,
+		Keys:    result.Restored,
+		Seconds: elapsed.Seconds(),
+	})
+	if len(history) > restoreHistorySize {
+		history = history[len(history)-restoreHistorySize:]
+	}
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err == nil {
+		err = uploadData(m.work.context(ctx), m.storage, restoreHistoryObject, data)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to record the restore: %v", err)
+	}
+}
+
+// restoreHistory downloads the restore history, empty when none was recorded
+func (m *Manager) restoreHistory(ctx context.Context) ([]RestoreRecord, error) {
+	var data bytes.Buffer
+	err := m.storage.Download(ctx, restoreHistoryObject, &data)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the restore history: %w", err)
+	}
+	var history []RestoreRecord
+	if err := json.Unmarshal(data.Bytes(), &history); err != nil {
+		return nil, fmt.Errorf("failed to decode the restore history: %w", err)
+	}
+	return history, nil
+}
+
+// datasetMemory returns the memory taken by the keys of the source
+// (used_memory_dataset, or used_memory), 0 when unknown
+func (m *Manager) datasetMemory(ctx context.Context) int64 {
+	info, err := m.info(ctx, "memory")
+	if err != nil {
+		return 0
+	}
+	if dataset, ok := info.Int("used_memory_dataset"); ok {
+		return dataset
+	}
+	return info.UsedMemory()
+}
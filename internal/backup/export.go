@@ -0,0 +1,460 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/rdb"
+	"github.com/redis/go-redis/v9"
+)
+
+// ExportOptions selects the keys written by an export and how their values are truncated
+type ExportOptions struct {
+	// Format is "json" (one object per line), "csv" or "resp" (commands for
+	// redis-cli --pipe, values are never truncated)
+	Format string
+
+	// Patterns are glob-style key patterns, every key is exported when empty
+	Patterns []string
+
+	// DB only exports one database, -1 exports every database
+	DB int
+
+	// MaxValueSize truncates strings and collection elements to this many bytes (0 = no limit)
+	MaxValueSize int
+
+	// MaxElements truncates lists, sets, hashes and sorted sets to this many elements (0 = no limit)
+	MaxElements int
+
+	// Limit stops the export after this many keys (0 = no limit)
+	Limit int
+}
+
+// ExportResult summarizes an export
+type ExportResult struct {
+	Exported  int
+	Truncated int
+	// Undecoded counts the streams and module values exported without their
+	// value, or skipped in the RESP format
+	Undecoded int
+}
+
+// respBatchSize is the number of elements sent per command in the RESP format
+const respBatchSize = 1000
+
+// errExportLimit stops an export once ExportOptions.Limit keys were written
+var errExportLimit = errors.New("export limit reached")
+
+// exportRecord is an exported key
+type exportRecord struct {
+	DB   int    `json:"db"`
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// TTL is the time to live in milliseconds at the time of the snapshot, -1 without expiry
+	TTL int64 `json:"ttl_ms"`
+	// Size is the size of the serialized value
+	Size      int  `json:"size"`
+	Value     any  `json:"value"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// exportMember is an exported sorted set member
+type exportMember struct {
+	Member string `json:"member"`
+	// Score is a string for infinite scores, which JSON numbers cannot hold
+	Score any `json:"score"`
+}
+
+// exporter writes the keys of an export
+type exporter struct {
+	opts ExportOptions
+	json *json.Encoder
+	csv  *csv.Writer
+	resp io.Writer
+	// db is the database selected by the RESP commands written so far
+	db     int
+	result ExportResult
+}
+
+func newExporter(w io.Writer, opts ExportOptions) (*exporter, error) {
+	x := &exporter{opts: opts, db: -1}
+	switch opts.Format {
+	case "", "json":
+		x.json = json.NewEncoder(w)
+		x.json.SetEscapeHTML(false)
+	case "csv":
+		x.csv = csv.NewWriter(w)
+		if err := x.csv.Write([]string{"db", "key", "type", "ttl_ms", "size", "truncated", "value"}); err != nil {
+			return nil, fmt.Errorf("failed to write export: %w", err)
+		}
+	case "resp":
+		if opts.MaxValueSize > 0 || opts.MaxElements > 0 {
+			return nil, errors.New("values cannot be truncated in the RESP format, they would be restored truncated")
+		}
+		x.resp = w
+	default:
+		return nil, fmt.Errorf("invalid export format %q (supported: json, csv, resp)", opts.Format)
+	}
+	return x, nil
+}
+
+// write exports an entry, whose TTL is computed relative to snapshotMs
+func (x *exporter) write(entry *rdb.Entry, snapshotMs int64) error {
+	if x.opts.DB >= 0 && entry.DB != x.opts.DB {
+		return nil
+	}
+	if len(x.opts.Patterns) > 0 && !matchAny(x.opts.Patterns, entry.Key) {
+		return nil
+	}
+	if x.opts.Limit > 0 && x.result.Exported >= x.opts.Limit {
+		return errExportLimit
+	}
+
+	record := exportRecord{
+		DB:   entry.DB,
+		Key:  entry.Key,
+		Type: rdb.TypeName(entry.Type),
+		TTL:  -1,
+		Size: len(entry.Value),
+	}
+	if entry.ExpireAt > 0 {
+		record.TTL = max(entry.ExpireAt-snapshotMs, 0)
+	}
+
+	value, err := entry.Decode()
+	if x.resp != nil {
+		return x.writeRESP(entry, value, err)
+	}
+	switch {
+	case errors.Is(err, rdb.ErrUnsupportedValue):
+		x.result.Undecoded++
+	case err != nil:
+		return err
+	default:
+		record.Value, record.Truncated = x.truncate(value)
+	}
+	if record.Truncated {
+		x.result.Truncated++
+	}
+
+	if x.csv != nil {
+		err = x.writeCSV(record)
+	} else {
+		err = x.json.Encode(record)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	x.result.Exported++
+	return nil
+}
+
+// truncate converts a decoded value to its exported form, applying the size limits
+func (x *exporter) truncate(value any) (any, bool) {
+	truncated := false
+	str := func(s string) string {
+		if x.opts.MaxValueSize > 0 && len(s) > x.opts.MaxValueSize {
+			truncated = true
+			return s[:x.opts.MaxValueSize]
+		}
+		return s
+	}
+	count := func(n int) int {
+		if x.opts.MaxElements > 0 && n > x.opts.MaxElements {
+			truncated = true
+			return x.opts.MaxElements
+		}
+		return n
+	}
+
+	switch v := value.(type) {
+	case string:
+		return str(v), truncated
+	case []string:
+		elements := make([]string, count(len(v)))
+		for i := range elements {
+			elements[i] = str(v[i])
+		}
+		return elements, truncated
+	case []rdb.HashField:
+		fields := make(map[string]string, count(len(v)))
+		for _, field := range v[:count(len(v))] {
+			fields[str(field.Field)] = str(field.Value)
+		}
+		return fields, truncated
+	case []rdb.ZSetMember:
+		members := make([]exportMember, count(len(v)))
+		for i := range members {
+			members[i] = exportMember{Member: str(v[i].Member), Score: v[i].Score}
+			if math.IsInf(v[i].Score, 0) {
+				members[i].Score = strconv.FormatFloat(v[i].Score, 'g', -1, 64)
+			}
+		}
+		return members, truncated
+	default:
+		return value, false
+	}
+}
+
+// writeCSV writes a record as a CSV row, with the value of collections as JSON
+func (x *exporter) writeCSV(record exportRecord) error {
+	var value string
+	switch v := record.Value.(type) {
+	case nil:
+	case string:
+		value = v
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		value = string(encoded)
+	}
+	return x.csv.Write([]string{
+		strconv.Itoa(record.DB),
+		record.Key,
+		record.Type,
+		strconv.FormatInt(record.TTL, 10),
+		strconv.Itoa(record.Size),
+		strconv.FormatBool(record.Truncated),
+		value,
+	})
+}
+
+// writeRESP writes the commands recreating a key: SELECT when its database
+// differs from the previous key, DEL and commands adding its elements in
+// batches, and PEXPIREAT when it expires
+func (x *exporter) writeRESP(entry *rdb.Entry, value any, decodeErr error) error {
+	if errors.Is(decodeErr, rdb.ErrUnsupportedValue) {
+		log.Printf("Warning: skipping %s key %q, it cannot be written as commands", rdb.TypeName(entry.Type), entry.Key)
+		x.result.Undecoded++
+		return nil
+	}
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	var cmds [][]string
+	if entry.DB != x.db {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(entry.DB)})
+		x.db = entry.DB
+	}
+	batches := func(name string, args []string, stride int) {
+		cmds = append(cmds, []string{"DEL", entry.Key})
+		for len(args) > 0 {
+			n := min(len(args), respBatchSize*stride)
+			cmds = append(cmds, append([]string{name, entry.Key}, args[:n]...))
+			args = args[n:]
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		cmds = append(cmds, []string{"SET", entry.Key, v})
+	case []string:
+		if rdb.TypeName(entry.Type) == "list" {
+			batches("RPUSH", v, 1)
+		} else {
+			batches("SADD", v, 1)
+		}
+	case []rdb.HashField:
+		args := make([]string, 0, len(v)*2)
+		for _, field := range v {
+			args = append(args, field.Field, field.Value)
+		}
+		batches("HSET", args, 2)
+	case []rdb.ZSetMember:
+		args := make([]string, 0, len(v)*2)
+		for _, member := range v {
+			args = append(args, formatScore(member.Score), member.Member)
+		}
+		batches("ZADD", args, 2)
+	}
+	if entry.ExpireAt > 0 {
+		cmds = append(cmds, []string{"PEXPIREAT", entry.Key, strconv.FormatInt(entry.ExpireAt, 10)})
+	}
+
+	var buf bytes.Buffer
+	for _, cmd := range cmds {
+		fmt.Fprintf(&buf, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := x.resp.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	x.result.Exported++
+	return nil
+}
+
+// formatScore formats a sorted set score as accepted by ZADD
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "+inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	default:
+		return strconv.FormatFloat(score, 'g', -1, 64)
+	}
+}
+
+func (x *exporter) close() error {
+	if x.csv == nil {
+		return nil
+	}
+	x.csv.Flush()
+	if err := x.csv.Error(); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	return nil
+}
+
+// Export writes the keys of a backup matching the options to w
+// TTLs are relative to the time the backup was taken; a differential backup
+// only holds the keys changed since its full backup
+func (m *Manager) Export(ctx context.Context, backupName string, w io.Writer, opts ExportOptions) (result ExportResult, err error) {
+	defer func() {
+		m.audit(ctx, "export", backupName, fmt.Sprintf("%d key(s) as %s", result.Exported, opts.Format), err)
+	}()
+
+	x, err := newExporter(w, opts)
+	if err != nil {
+		return ExportResult{}, err
+	}
+
+	file, err := m.downloadBackup(ctx, backupName)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	defer removeTemp(file)
+
+	snapshot := time.Now()
+	if taken, err := backupTime(backupName); err == nil {
+		snapshot = taken
+	}
+
+	reader := rdb.NewReader(bufio.NewReader(file))
+	for {
+		entry, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return x.result, fmt.Errorf("failed to read backup: %w", err)
+		}
+		if err := x.write(entry, snapshot.UnixMilli()); err != nil {
+			if errors.Is(err, errExportLimit) {
+				break
+			}
+			return x.result, err
+		}
+	}
+	return x.result, x.close()
+}
+
+// ExportLive writes the keys of the live Redis matching the options to w,
+// reading them with SCAN, DUMP and PTTL
+func (m *Manager) ExportLive(ctx context.Context, w io.Writer, opts ExportOptions) (result ExportResult, err error) {
+	defer func() {
+		m.audit(ctx, "export", m.cfg.Target(), fmt.Sprintf("%d live key(s) as %s", result.Exported, opts.Format), err)
+	}()
+
+	x, err := newExporter(w, opts)
+	if err != nil {
+		return ExportResult{}, err
+	}
+
+	dbs := []int{opts.DB}
+	if opts.DB < 0 {
+		if dbs, err = m.nonEmptyDatabases(ctx); err != nil {
+			return ExportResult{}, fmt.Errorf("failed to list databases: %w", err)
+		}
+	}
+
+	conn := m.conn()
+	defer conn.Close()
+
+	for _, db := range dbs {
+		err := m.exportDatabase(ctx, conn, db, x)
+		if errors.Is(err, errExportLimit) {
+			break
+		}
+		if err != nil {
+			return x.result, err
+		}
+	}
+	return x.result, x.close()
+}
+
+// exportDatabase exports the keys of a database of the live Redis
+func (m *Manager) exportDatabase(ctx context.Context, conn *redis.Conn, db int, x *exporter) error {
+	if err := conn.Select(ctx, db).Err(); err != nil {
+		return fmt.Errorf("failed to select database %d: %w", db, err)
+	}
+
+	// A single pattern is filtered by Redis
+	match := "*"
+	if len(x.opts.Patterns) == 1 {
+		match = x.opts.Patterns[0]
+	}
+
+	var cursor uint64
+	for {
+		batch, next, err := conn.Scan(ctx, cursor, match, scanBatchSize).Result()
+		if err != nil {
+			return fmt.Errorf("SCAN failed on database %d: %w", db, err)
+		}
+		batch = m.skipInternalKeys(db, batch)
+
+		dumps := make([]*redis.StringCmd, len(batch))
+		ttls := make([]*redis.DurationCmd, len(batch))
+		_, err = conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range batch {
+				dumps[i] = pipe.Dump(ctx, key)
+				ttls[i] = pipe.PTTL(ctx, key)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return fmt.Errorf("DUMP failed: %w", err)
+		}
+
+		now := time.Now().UnixMilli()
+		for i, key := range batch {
+			payload, err := dumps[i].Result()
+			if errors.Is(err, redis.Nil) {
+				// Key expired or was deleted between SCAN and DUMP
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("DUMP failed for key %q: %w", key, err)
+			}
+
+			// The payload is <type><value><version:2><crc:8>
+			entry := &rdb.Entry{DB: db, Key: key, Type: payload[0], Value: []byte(payload[1 : len(payload)-10])}
+			if ttl := ttls[i].Val(); ttl > 0 {
+				entry.ExpireAt = now + ttl.Milliseconds()
+			}
+			if err := x.write(entry, now); err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// safetySeries prefixes the series of the backups taken before a target is
+// flushed, followed by the database (e.g. "safety-db0")
+const safetySeries = "safety-"
+
+// FlushTarget returns the address a flushing restore must be confirmed with
+func (m *Manager) FlushTarget() string {
+	return m.cfg.RedisHost + ":" + m.cfg.RedisPort
+}
+
+// checkFlush validates the flush options of a restore
+func (m *Manager) checkFlush(opts RestoreOptions) error {
+	if !opts.Flush {
+		return nil
+	}
+	if opts.FlushConfirm != m.FlushTarget() {
+		return fmt.Errorf("flushing the target requires confirming its address %s, got %q", m.FlushTarget(), opts.FlushConfirm)
+	}
+	if opts.Resume != nil {
+		return fmt.Errorf("the target was flushed before the interrupted restore, resume it without flushing")
+	}
+	if len(opts.Patterns) != 1 || opts.Patterns[0] != "*" {
+		return fmt.Errorf("flushing the target restores every key, use the \"*\" pattern only")
+	}
+	return nil
+}
+
+// flushTarget backs up every non-empty database of the target, then empties
+// it with FLUSHALL
+// The safety backups are regular split backups of the safety-db<N> series, so
+// the target can be restored as it was before the flush
+func (m *Manager) flushTarget(ctx context.Context, backupName string) (err error) {
+	var safety []string
+	defer func() {
+		details := fmt.Sprintf("%s before restoring %s", m.FlushTarget(), backupName)
+		if len(safety) > 0 {
+			details += ", safety backup(s) " + strings.Join(safety, " ")
+		}
+		m.audit(ctx, "flush", m.FlushTarget(), details, err)
+	}()
+
+	dbs, err := m.nonEmptyDatabases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list the databases of the target: %w", redisError(err))
+	}
+	if len(dbs) == 0 {
+		log.Printf("The target %s is empty, no safety backup needed", m.FlushTarget())
+	}
+	for _, db := range dbs {
+		name, err := m.backupDatabase(ctx, db, fmt.Sprintf("%sdb%d", safetySeries, db))
+		if err != nil {
+			return fmt.Errorf("safety backup of database %d failed, the target was not flushed: %w", db, err)
+		}
+		safety = append(safety, name)
+	}
+
+	log.Printf("Flushing %s...", m.FlushTarget())
+	if err := m.do(ctx, "FLUSHALL").Err(); err != nil {
+		return fmt.Errorf("failed to flush the target: %w", redisError(err))
+	}
+	if len(safety) > 0 {
+		log.Printf("Flushed %s; its previous content is in %s", m.FlushTarget(), strings.Join(safety, ", "))
+	}
+	return nil
+}
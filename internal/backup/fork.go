@@ -0,0 +1,153 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/metrics"
+	"github.com/ermos/docker-redis-backup/internal/notify"
+)
+
+// ForkStats describes the memory impact of the BGSAVE of a backup
+type ForkStats struct {
+	// ForkMs is how long the fork blocked Redis (latest_fork_usec)
+	ForkMs float64 `json:"fork_ms"`
+	// CopyOnWriteBytes is the memory duplicated while the snapshot was written (rdb_last_cow_size)
+	CopyOnWriteBytes int64 `json:"cow_bytes"`
+	SaveSeconds      int64 `json:"save_seconds"`
+	UsedMemoryRSS    int64 `json:"used_memory_rss"`
+	// MemoryLimit is FORK_MEMORY_LIMIT or the memory of the host, 0 when unknown
+	MemoryLimit int64 `json:"memory_limit,omitempty"`
+}
+
+// tuneBGSAVE applies BGSAVE_CONFIG and returns the function restoring the
+// previous values, to call once the snapshot is written
+// Settings that cannot be read or changed are skipped with a warning
+func (m *Manager) tuneBGSAVE(ctx context.Context) func() {
+	if len(m.cfg.BGSAVEConfig) == 0 {
+		return func() {}
+	}
+
+	previous := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(m.cfg.BGSAVEConfig)) {
+		values, err := m.configGet(ctx, name)
+		current, ok := values[name]
+		if err == nil && !ok {
+			err = errors.New("unknown setting")
+		}
+		if err != nil {
+			log.Printf("Warning: BGSAVE_CONFIG: failed to read %s, leaving it unchanged: %v", name, err)
+			continue
+		}
+		value := m.cfg.BGSAVEConfig[name]
+		if current == value {
+			continue
+		}
+		if err := m.do(ctx, "CONFIG", "SET", name, value).Err(); err != nil {
+			log.Printf("Warning: BGSAVE_CONFIG: failed to set %s: %v", name, err)
+			continue
+		}
+		previous[name] = current
+		log.Printf("Set %s to %q for BGSAVE (was %q)", name, value, current)
+	}
+
+	return func() {
+		// The run context may be canceled, the settings must be restored anyway
+		ctx := context.WithoutCancel(ctx)
+		for name, value := range previous {
+			if err := m.do(ctx, "CONFIG", "SET", name, value).Err(); err != nil {
+				log.Printf("WARNING: failed to restore %s to %q after BGSAVE: %v", name, value, err)
+			}
+		}
+	}
+}
+
+// recordFork reads the fork statistics of the BGSAVE that just completed,
+// publishes them and alerts when the memory used during the save came close
+// to the memory available
+// It returns nil when the server doesn't report them (Dragonfly, INFO disabled)
+func (m *Manager) recordFork(ctx context.Context) *ForkStats {
+	stats, err := m.forkStats(ctx)
+	if errors.Is(err, ErrCommandDisabled) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Warning: failed to read fork statistics: %v", err)
+		return nil
+	}
+	if stats == nil {
+		return nil
+	}
+
+	log.Printf("Fork took %.1fms, copy-on-write peak %s (RSS %s)", stats.ForkMs,
+		config.FormatSize(stats.CopyOnWriteBytes), config.FormatSize(stats.UsedMemoryRSS))
+	labels := map[string]string{"target": m.cfg.Target()}
+	metrics.SetGauge("redis_backup_fork_duration_seconds", "Time Redis was blocked by the fork of the last BGSAVE", labels, stats.ForkMs/1000)
+	metrics.SetGauge("redis_backup_cow_peak_bytes", "Memory duplicated by copy-on-write during the last BGSAVE", labels, float64(stats.CopyOnWriteBytes))
+	if stats.MemoryLimit > 0 {
+		ratio := float64(stats.UsedMemoryRSS+stats.CopyOnWriteBytes) / float64(stats.MemoryLimit)
+		metrics.SetGauge("redis_backup_fork_memory_ratio", "Share of the available memory used by Redis and the copy-on-write of the last BGSAVE", labels, ratio)
+		m.checkForkMemory(ctx, stats, ratio)
+	}
+	return stats
+}
+
+// forkStats reads the statistics of the last fork from INFO
+func (m *Manager) forkStats(ctx context.Context) (*ForkStats, error) {
+	stats, err := m.info(ctx, "stats")
+	if err != nil {
+		return nil, err
+	}
+	forkUsec, ok := stats.Int("latest_fork_usec")
+	if !ok {
+		return nil, nil
+	}
+	persistence, err := m.info(ctx, "persistence")
+	if err != nil {
+		return nil, err
+	}
+	memory, err := m.info(ctx, "memory")
+	if err != nil {
+		return nil, err
+	}
+
+	fork := &ForkStats{ForkMs: float64(forkUsec) / 1000, MemoryLimit: m.cfg.ForkMemoryLimit}
+	fork.CopyOnWriteBytes, _ = persistence.Int("rdb_last_cow_size")
+	fork.SaveSeconds, _ = persistence.Int("rdb_last_bgsave_time_sec")
+	fork.UsedMemoryRSS, _ = memory.Int("used_memory_rss")
+	if fork.MemoryLimit == 0 {
+		fork.MemoryLimit, _ = memory.Int("total_system_memory")
+	}
+	return fork, nil
+}
+
+// checkForkMemory notifies when Redis and the copy-on-write of the save used
+// more than FORK_MEMORY_ALERT_PERCENT of the memory available
+func (m *Manager) checkForkMemory(ctx context.Context, stats *ForkStats, ratio float64) {
+	if m.cfg.ForkMemoryAlertPercent == 0 || ratio*100 < m.cfg.ForkMemoryAlertPercent {
+		return
+	}
+
+	event := notify.Event{
+		Type: notify.EventForkMemoryHigh,
+		Message: fmt.Sprintf("BGSAVE of %s used %.0f%% of the available memory (RSS %s + copy-on-write %s of %s)",
+			m.cfg.Target(), ratio*100, config.FormatSize(stats.UsedMemoryRSS),
+			config.FormatSize(stats.CopyOnWriteBytes), config.FormatSize(stats.MemoryLimit)),
+		Details: map[string]interface{}{
+			"used_memory_rss": stats.UsedMemoryRSS,
+			"cow_bytes":       stats.CopyOnWriteBytes,
+			"memory_limit":    stats.MemoryLimit,
+			"fork_ms":         stats.ForkMs,
+			"threshold":       m.cfg.ForkMemoryAlertPercent,
+		},
+	}
+	log.Printf("WARNING: %s", event.Message)
+	if err := m.notifier.Notify(ctx, event); err != nil {
+		log.Printf("Warning: failed to send %s notification: %v", event.Type, err)
+	}
+}
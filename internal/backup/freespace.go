@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// applyFreeSpaceRetention deletes the oldest backups, whatever their series,
+// until the volume has RETENTION_MIN_FREE free
+// Pinned backups and the newest backup of each series are kept; differential
+// backups are deleted with their full backup
+func (m *Manager) applyFreeSpaceRetention(ctx context.Context) error {
+	reporter, ok := m.storage.(storage.SpaceReporter)
+	if !ok {
+		return nil
+	}
+	free, err := reporter.FreeSpace(ctx)
+	if err != nil {
+		return err
+	}
+	if free >= m.cfg.RetentionMinFree {
+		return nil
+	}
+	log.Printf("Only %s free on the backup volume, deleting old backups until %s are free...",
+		config.FormatSize(free), config.FormatSize(m.cfg.RetentionMinFree))
+
+	candidates, attached, err := m.freeSpacePlan(ctx)
+	if err != nil {
+		return err
+	}
+
+	reason := fmt.Sprintf("less than RETENTION_MIN_FREE (%s) free", config.FormatSize(m.cfg.RetentionMinFree))
+	deleted := 0
+	for _, backup := range candidates {
+		if free >= m.cfg.RetentionMinFree {
+			break
+		}
+		n, err := m.deleteBackups(ctx, append([]string{backup}, attached[backup]...), reason, m.cfg.ComplianceUnlockToken)
+		deleted += n
+		if err != nil {
+			return fmt.Errorf("failed to delete old backups: %w", err)
+		}
+		if free, err = reporter.FreeSpace(ctx); err != nil {
+			return err
+		}
+	}
+
+	if free < m.cfg.RetentionMinFree {
+		log.Printf("WARNING: deleted %d backup(s) but only %s is free, below RETENTION_MIN_FREE (%s); the newest backup of each series and pinned backups are kept",
+			deleted, config.FormatSize(free), config.FormatSize(m.cfg.RetentionMinFree))
+		return nil
+	}
+	log.Printf("Deleted %d backup(s), %s free", deleted, config.FormatSize(free))
+	return nil
+}
+
+// freeSpacePlan returns the backups free space retention may delete, oldest
+// first, and the differential backups to delete with each of them
+func (m *Manager) freeSpacePlan(ctx context.Context) ([]string, map[string][]string, error) {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	backups, _ := BackupSets(objects)
+	pinned, diffs, err := m.retentionScope(ctx, backups)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attached := make(map[string][]string)
+	for diff, base := range m.diffBases(ctx, diffs) {
+		if base != "" && !pinned[diff] {
+			attached[base] = append(attached[base], diff)
+		}
+	}
+
+	// backups is sorted by name, so the last backup of a series is its newest
+	newest := make(map[string]string)
+	for _, backup := range backups {
+		newest[backupSeries(backup)] = backup
+	}
+	diffKey := m.diffSeriesKey()
+	var candidates []string
+	for _, backup := range backups {
+		series := backupSeries(backup)
+		if pinned[backup] || newest[series] == backup || (diffKey != "" && series == diffKey) {
+			continue
+		}
+		candidates = append(candidates, backup)
+	}
+
+	modTimes := make(map[string]int64, len(objects))
+	for _, obj := range objects {
+		modTimes[obj.Name] = obj.ModTime.UnixNano()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return modTimes[candidates[i]] < modTimes[candidates[j]] })
+	for _, diffs := range attached {
+		sort.Strings(diffs)
+	}
+	return candidates, attached, nil
+}
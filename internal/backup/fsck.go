@@ -0,0 +1,254 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// Kinds of issues found by Fsck
+const (
+	// FsckIncompleteSet is a backup without set manifest, interrupted while
+	// being stored or deleted
+	FsckIncompleteSet = "incomplete_set"
+	// FsckNoSet is a backup stored before backup sets, valid but not described
+	FsckNoSet = "no_set"
+	// FsckSetMismatch is a set manifest that doesn't match the stored objects
+	FsckSetMismatch = "set_mismatch"
+	// FsckManifestMismatch is a missing manifest, or one describing another backup
+	FsckManifestMismatch = "manifest_mismatch"
+	// FsckChecksum is a backup that failed its verification (-verify)
+	FsckChecksum = "checksum"
+	// FsckOrphan is a sidecar, set, pin or AOF segment of a backup that no
+	// longer exists, or a leftover storage probe
+	FsckOrphan = "orphan"
+	// FsckUnknown is an object not stored by this service
+	FsckUnknown = "unknown"
+)
+
+// FsckOptions selects the checks and repairs of Fsck
+type FsckOptions struct {
+	// Verify downloads every complete backup and checks it against its manifest
+	Verify bool
+	// Repair rewrites the set manifests that don't match the storage, writes
+	// those of backups stored before sets and deletes those of missing backups
+	Repair bool
+}
+
+// FsckIssue is a problem found in the storage
+type FsckIssue struct {
+	Kind     string `json:"kind"`
+	Object   string `json:"object"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// FsckResult lists the issues found by Fsck
+type FsckResult struct {
+	Objects int         `json:"objects"`
+	Backups int         `json:"backups"`
+	Issues  []FsckIssue `json:"issues"`
+}
+
+// Unrepaired returns the number of issues left
+func (r FsckResult) Unrepaired() int {
+	count := 0
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			count++
+		}
+	}
+	return count
+}
+
+// Fsck scans the storage for incomplete sets, set and manifest mismatches,
+// orphaned objects and, with opts.Verify, checksum discrepancies
+// Data objects are never deleted: incomplete sets are left to the partial
+// upload cleanup and orphans are only reported
+func (m *Manager) Fsck(ctx context.Context, opts FsckOptions) (result FsckResult, err error) {
+	if opts.Repair {
+		defer func() {
+			var repaired []string
+			for _, issue := range result.Issues {
+				if issue.Repaired {
+					repaired = append(repaired, issue.Object)
+				}
+			}
+			if len(repaired) > 0 || err != nil {
+				m.audit(ctx, "fsck", m.cfg.Target(), "repaired "+strings.Join(repaired, " "), err)
+			}
+		}()
+	}
+
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list objects: %w", err)
+	}
+	result.Objects = len(objects)
+
+	complete, partial := BackupSets(objects)
+	result.Backups = len(complete)
+	sizes := make(map[string]int64, len(objects))
+	for _, obj := range objects {
+		sizes[obj.Name] = obj.Size
+	}
+
+	for _, name := range partial {
+		result.Issues = append(result.Issues, FsckIssue{
+			Kind:   FsckIncompleteSet,
+			Object: name,
+			Detail: "no set manifest, deleted by the partial upload cleanup once older than PARTIAL_UPLOAD_MAX_AGE",
+		})
+	}
+
+	for _, name := range complete {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if issue := m.fsckSet(ctx, objects, sizes, name); issue != nil {
+			if opts.Repair {
+				if err := m.commitSet(ctx, name); err != nil {
+					log.Printf("Warning: failed to repair the set of %s: %v", name, err)
+				} else {
+					issue.Repaired = true
+				}
+			}
+			result.Issues = append(result.Issues, *issue)
+		}
+		if issue := m.fsckManifest(ctx, complete, name); issue != nil {
+			result.Issues = append(result.Issues, *issue)
+		}
+		if opts.Verify {
+			if _, err := m.verifyBackup(ctx, name); err != nil {
+				result.Issues = append(result.Issues, FsckIssue{Kind: FsckChecksum, Object: name, Detail: err.Error()})
+			} else {
+				log.Printf("%s verified", name)
+			}
+		}
+	}
+
+	for _, issue := range fsckOrphans(objects, sizes) {
+		if opts.Repair && strings.HasSuffix(issue.Object, setSuffix) {
+			issue.Repaired = m.deleteOrphanSet(ctx, issue.Object)
+		}
+		result.Issues = append(result.Issues, issue)
+	}
+	return result, nil
+}
+
+// fsckSet compares the set manifest of a complete backup with the stored objects
+func (m *Manager) fsckSet(ctx context.Context, objects []storage.ObjectInfo, sizes map[string]int64, name string) *FsckIssue {
+	if _, ok := sizes[name+setSuffix]; !ok {
+		return &FsckIssue{Kind: FsckNoSet, Object: name, Detail: "stored before backup sets, no set manifest"}
+	}
+	set, err := loadSet(ctx, m.storage, name)
+	if err != nil {
+		return &FsckIssue{Kind: FsckSetMismatch, Object: name, Detail: err.Error()}
+	}
+	if set.Backup != name {
+		return &FsckIssue{Kind: FsckSetMismatch, Object: name, Detail: fmt.Sprintf("set manifest describes %s", set.Backup)}
+	}
+
+	listed := make(map[string]bool, len(set.Objects))
+	for _, obj := range set.Objects {
+		listed[obj.Name] = true
+		size, ok := sizes[obj.Name]
+		if !ok {
+			return &FsckIssue{Kind: FsckSetMismatch, Object: name, Detail: fmt.Sprintf("%s is missing", obj.Name)}
+		}
+		if size != obj.Bytes {
+			return &FsckIssue{Kind: FsckSetMismatch, Object: name, Detail: fmt.Sprintf("%s is %d bytes, %d in the set", obj.Name, size, obj.Bytes)}
+		}
+	}
+	for _, obj := range newBackupSet(objects, name).Objects {
+		if !listed[obj.Name] {
+			return &FsckIssue{Kind: FsckSetMismatch, Object: name, Detail: fmt.Sprintf("%s is not in the set", obj.Name)}
+		}
+	}
+	return nil
+}
+
+// fsckManifest checks that a backup has a manifest describing it and, for a
+// differential backup, that its full backup exists
+func (m *Manager) fsckManifest(ctx context.Context, complete []string, name string) *FsckIssue {
+	// Only the plaintext fields are needed
+	manifest, err := LoadManifest(ctx, m.storage, name, nil)
+	if errors.Is(err, storage.ErrNotFound) {
+		return &FsckIssue{Kind: FsckManifestMismatch, Object: name, Detail: "no manifest"}
+	}
+	if err != nil {
+		return &FsckIssue{Kind: FsckManifestMismatch, Object: name, Detail: err.Error()}
+	}
+	if manifest.Backup != name {
+		return &FsckIssue{Kind: FsckManifestMismatch, Object: name, Detail: fmt.Sprintf("manifest describes %s", manifest.Backup)}
+	}
+	if manifest.Type == manifestTypeDiff && !slices.Contains(complete, manifest.Base) {
+		return &FsckIssue{Kind: FsckManifestMismatch, Object: name, Detail: fmt.Sprintf("full backup %s is missing", manifest.Base)}
+	}
+	return nil
+}
+
+// fsckOrphans returns the objects that belong to no backup
+func fsckOrphans(objects []storage.ObjectInfo, sizes map[string]int64) []FsckIssue {
+	bases := make(map[string]bool)
+	for _, obj := range objects {
+		if storage.IsBackupName(obj.Name) {
+			base, _ := storage.SplitBackupName(obj.Name)
+			bases[base] = true
+		}
+	}
+
+	suffixes := append([]string{setSuffix, pinSuffix}, sidecarSuffixes...)
+	var issues []FsckIssue
+	for _, obj := range objects {
+		name := obj.Name
+		switch {
+		case storage.IsBackupName(name), storage.IsChunkName(name), strings.HasPrefix(name, auditObjectPrefix), strings.HasPrefix(name, runHistoryPrefix), name == restoreHistoryObject, name == maintenanceObject:
+			continue
+		case strings.HasPrefix(name, probeObjectPrefix):
+			issues = append(issues, FsckIssue{Kind: FsckOrphan, Object: name, Detail: "leftover storage probe"})
+			continue
+		}
+
+		owner, known := "", false
+		for _, suffix := range suffixes {
+			if backup, ok := strings.CutSuffix(name, suffix); ok {
+				owner, known = backup, true
+				break
+			}
+		}
+		if known {
+			if _, ok := sizes[owner]; !ok {
+				issues = append(issues, FsckIssue{Kind: FsckOrphan, Object: name, Detail: fmt.Sprintf("%s does not exist", owner)})
+			}
+			continue
+		}
+		if base, _, ok := strings.Cut(name, aofSegmentInfix); ok {
+			if !bases[base] {
+				issues = append(issues, FsckIssue{Kind: FsckOrphan, Object: name, Detail: fmt.Sprintf("AOF segment of %s, which does not exist", base)})
+			}
+			continue
+		}
+		issues = append(issues, FsckIssue{Kind: FsckUnknown, Object: name, Detail: "not stored by redis-backup"})
+	}
+	return issues
+}
+
+// deleteOrphanSet deletes the set manifest of a missing backup
+// In compliance mode, it needs COMPLIANCE_UNLOCK_TOKEN
+func (m *Manager) deleteOrphanSet(ctx context.Context, setName string) bool {
+	if err := m.checkUnlock(m.cfg.ComplianceUnlockToken); err != nil {
+		log.Printf("Warning: %s kept: %v", setName, err)
+		return false
+	}
+	if err := m.storage.Delete(ctx, setName); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Warning: failed to delete %s: %v", setName, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// functionsSuffix is appended to a backup name for its FUNCTION DUMP sidecar
+const functionsSuffix = ".functions"
+
+// backupFunctions stores the FUNCTION DUMP payload next to a backup
+// Redis versions without functions (< 7.0) are skipped with a warning
+func (m *Manager) backupFunctions(ctx context.Context, backupName string) error {
+	payload, err := m.redis.FunctionDump(ctx).Result()
+	if err != nil {
+		if isUnknownCommand(err) {
+			log.Println("Warning: FUNCTION DUMP not supported by this server (Redis >= 7.0 required), skipping functions backup")
+			return nil
+		}
+		return fmt.Errorf("FUNCTION DUMP failed: %w", err)
+	}
+
+	sidecarName := backupName + functionsSuffix
+	if err := m.uploadSidecar(ctx, sidecarName, []byte(payload)); err != nil {
+		return err
+	}
+
+	log.Printf("Functions backup completed: %s", sidecarName)
+	return nil
+}
+
+// RestoreFunctions loads the functions saved alongside a backup with FUNCTION RESTORE
+// policy is one of APPEND, REPLACE or FLUSH (see FUNCTION RESTORE)
+func (m *Manager) RestoreFunctions(ctx context.Context, backupName, policy string) (err error) {
+	policy = strings.ToUpper(policy)
+	defer func() {
+		m.audit(ctx, "restore-functions", backupName, fmt.Sprintf("into %s, policy %s", m.cfg.Target(), policy), err)
+	}()
+	if err := m.checkWritable("function restore"); err != nil {
+		return err
+	}
+	switch policy {
+	case "APPEND", "REPLACE", "FLUSH":
+	default:
+		return fmt.Errorf("invalid restore policy %q (supported: APPEND, REPLACE, FLUSH)", policy)
+	}
+
+	var payload bytes.Buffer
+	if err := m.downloadSidecar(ctx, backupName+functionsSuffix, &payload); err != nil {
+		return fmt.Errorf("failed to download functions backup: %w", err)
+	}
+
+	if err := m.redis.Do(ctx, "FUNCTION", "RESTORE", payload.String(), policy).Err(); err != nil {
+		return fmt.Errorf("FUNCTION RESTORE failed: %w", err)
+	}
+
+	log.Printf("Functions restored from %s (policy: %s)", backupName+functionsSuffix, policy)
+	return nil
+}
+
+// isUnknownCommand reports whether Redis rejected a command as unknown
+func isUnknownCommand(err error) bool {
+	var redisErr redis.Error
+	return errors.As(err, &redisErr) && strings.Contains(strings.ToLower(err.Error()), "unknown command")
+}
@@ -0,0 +1,246 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// runHistoryPrefix names the run history objects, one per month, read by the
+// report command
+const runHistoryPrefix = "redis-backup-runs_"
+
+// runHistoryMu serializes the rewrites of the run history objects
+var runHistoryMu sync.Mutex
+
+// RunRecord is a backup run in the run history
+type RunRecord struct {
+	Start    time.Time `json:"start"`
+	Target   string    `json:"target"`
+	Duration float64   `json:"duration_seconds"`
+	Success  bool      `json:"success"`
+	Category string    `json:"category,omitempty"`
+	// Bytes is the size of the backups stored by the run
+	Bytes int64 `json:"bytes,omitempty"`
+	// StorageBytes is the storage usage measured after the run
+	StorageBytes int64  `json:"storage_bytes,omitempty"`
+	Maintenance  string `json:"maintenance,omitempty"`
+	// Verification is the outcome of the sampled verification of the run, if any
+	Verification string `json:"verification,omitempty"`
+}
+
+// newRunRecord describes a run of a target that started at start
+func newRunRecord(cfg *config.Config, start time.Time, runErr error) RunRecord {
+	record := RunRecord{
+		Start:    start.UTC(),
+		Target:   cfg.Target(),
+		Duration: time.Since(start).Seconds(),
+		Success:  runErr == nil,
+	}
+	if runErr != nil {
+		record.Category = ErrorCategory(runErr)
+	}
+	if window := activeMaintenance(record.Target); window != nil {
+		record.Maintenance = window.Reason
+	}
+	return record
+}
+
+// RecordRunHistory adds a run that failed before the manager could record
+// it, e.g. because Redis was unreachable, to the run history
+func RecordRunHistory(ctx context.Context, cfg *config.Config, store storage.Storage, start time.Time, runErr error) {
+	appendRunHistory(ctx, cfg, store, newRunRecord(cfg, start, runErr))
+}
+
+// recordHistory adds the current run to the run history
+func (m *Manager) recordHistory(ctx context.Context, start time.Time, runErr error) {
+	record := newRunRecord(m.cfg, start, runErr)
+	for _, stored := range m.stored {
+		record.Bytes += stored.Bytes
+	}
+	record.StorageBytes = m.lastUsage
+	record.Verification = m.verification
+	appendRunHistory(ctx, m.cfg, m.storage, record)
+}
+
+// appendRunHistory adds a run to the history object of its month and applies
+// HISTORY_RETENTION
+// Objects cannot be appended to, so the object is downloaded and rewritten;
+// failures are only logged
+func appendRunHistory(ctx context.Context, cfg *config.Config, store storage.Storage, record RunRecord) {
+	ctx = context.WithoutCancel(ctx)
+	name := runHistoryPrefix + record.Start.Format("2006-01") + ".jsonl"
+
+	runHistoryMu.Lock()
+	defer runHistoryMu.Unlock()
+
+	var data bytes.Buffer
+	if err := store.Download(ctx, name, &data); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Warning: failed to record the run, failed to download %s: %v", name, err)
+		return
+	}
+	if err := json.NewEncoder(&data).Encode(record); err != nil {
+		log.Printf("Warning: failed to record the run: %v", err)
+		return
+	}
+	if err := uploadData(ctx, store, name, data.Bytes()); err != nil {
+		log.Printf("Warning: failed to record the run: %v", err)
+		return
+	}
+	if err := pruneRunHistory(ctx, cfg, store); err != nil {
+		log.Printf("Warning: failed to apply HISTORY_RETENTION to the run history: %v", err)
+	}
+}
+
+// pruneRunHistory drops the runs older than HISTORY_RETENTION days, or beyond
+// the HISTORY_RETENTION most recent ones, from the run history objects
+// Months left without runs are deleted, the oldest month kept is rewritten
+func pruneRunHistory(ctx context.Context, cfg *config.Config, store storage.Storage) error {
+	if cfg.HistoryRetentionDays == 0 && cfg.HistoryRetentionEntries == 0 {
+		return nil
+	}
+	names, err := runHistoryObjects(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	var cutoff time.Time
+	if cfg.HistoryRetentionDays > 0 {
+		cutoff = time.Now().UTC().AddDate(0, 0, -cfg.HistoryRetentionDays)
+	}
+	kept := 0
+	// Newest month first, to count the runs kept
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		month, _ := time.Parse("2006-01", strings.TrimSuffix(strings.TrimPrefix(name, runHistoryPrefix), ".jsonl"))
+		expired := !cutoff.IsZero() && !month.AddDate(0, 1, 0).After(cutoff)
+		full := cfg.HistoryRetentionEntries > 0 && kept >= cfg.HistoryRetentionEntries
+		if expired || full {
+			if err := store.Delete(ctx, name); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return fmt.Errorf("failed to delete %s: %w", name, err)
+			}
+			continue
+		}
+		if cfg.HistoryRetentionEntries == 0 && !month.Before(cutoff) {
+			// Only the month of the cutoff has runs to drop
+			continue
+		}
+
+		var data bytes.Buffer
+		if err := store.Download(ctx, name, &data); err != nil {
+			return fmt.Errorf("failed to download %s: %w", name, err)
+		}
+		var lines [][]byte
+		dropped := 0
+		for _, line := range bytes.Split(data.Bytes(), []byte("\n")) {
+			var record RunRecord
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			if json.Unmarshal(line, &record) == nil && record.Start.Before(cutoff) {
+				dropped++
+				continue
+			}
+			lines = append(lines, line)
+		}
+		if limit := cfg.HistoryRetentionEntries - kept; cfg.HistoryRetentionEntries > 0 && len(lines) > limit {
+			// Runs are appended in order, the oldest come first
+			dropped += len(lines) - limit
+			lines = lines[len(lines)-limit:]
+		}
+		kept += len(lines)
+
+		switch {
+		case len(lines) == 0:
+			if err := store.Delete(ctx, name); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return fmt.Errorf("failed to delete %s: %w", name, err)
+			}
+		case dropped > 0:
+			if err := uploadData(ctx, store, name, append(bytes.Join(lines, []byte("\n")), '\n')); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runHistoryObjects returns the names of the run history objects, oldest first
+func runHistoryObjects(ctx context.Context, store storage.Storage) ([]string, error) {
+	objects, err := store.ListObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	var names []string
+	for _, obj := range objects {
+		month, ok := strings.CutPrefix(obj.Name, runHistoryPrefix)
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse("2006-01", strings.TrimSuffix(month, ".jsonl")); err != nil {
+			continue
+		}
+		names = append(names, obj.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ReadRunHistory reads the runs recorded since a time, oldest first
+func ReadRunHistory(ctx context.Context, store storage.Storage, since time.Time) ([]RunRecord, error) {
+	objects, err := store.ListObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	var names []string
+	for _, obj := range objects {
+		month, ok := strings.CutPrefix(obj.Name, runHistoryPrefix)
+		if !ok {
+			continue
+		}
+		start, err := time.Parse("2006-01", strings.TrimSuffix(month, ".jsonl"))
+		if err != nil || start.AddDate(0, 1, 0).Before(since) {
+			continue
+		}
+		names = append(names, obj.Name)
+	}
+	sort.Strings(names)
+
+	var records []RunRecord
+	for _, name := range names {
+		var data bytes.Buffer
+		if err := store.Download(ctx, name, &data); err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", name, err)
+		}
+		scanner := bufio.NewScanner(&data)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var record RunRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				return nil, fmt.Errorf("%s: invalid record on line %d: %w", name, line, err)
+			}
+			if !record.Start.Before(since) {
+				records = append(records, record)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Start.Before(records[j].Start) })
+	return records, nil
+}
@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phases of a backup run a hook can be attached to
+const (
+	hookPreBackup  = "pre-backup"
+	hookPostBGSAVE = "post-bgsave"
+	hookPreUpload  = "pre-upload"
+	hookPostUpload = "post-upload"
+	hookPostBackup = "post-backup"
+)
+
+// hookOutputLimit bounds the output of a hook copied to the log
+const hookOutputLimit = 64 << 10
+
+// hookEvent describes the run to a hook, as JSON on its standard input
+type hookEvent struct {
+	Phase   string `json:"phase"`
+	Target  string `json:"target"`
+	Storage string `json:"storage"`
+	Backup  string `json:"backup,omitempty"`
+	File    string `json:"file,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	// Database is the database of a split backup
+	Database *int `json:"database,omitempty"`
+	// Status, Backups and Error are the result of the run, for post-backup
+	Status  string   `json:"status,omitempty"`
+	Backups []string `json:"backups,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// hookCommand returns the command of the hook of a phase
+func (m *Manager) hookCommand(phase string) string {
+	switch phase {
+	case hookPreBackup:
+		return m.cfg.HookPreBackup
+	case hookPostBGSAVE:
+		return m.cfg.HookPostBGSAVE
+	case hookPreUpload:
+		return m.cfg.HookPreUpload
+	case hookPostUpload:
+		return m.cfg.HookPostUpload
+	case hookPostBackup:
+		return m.cfg.HookPostBackup
+	}
+	return ""
+}
+
+// runHook runs the hook of the phase of an event with sh, if one is set
+// The event is passed as environment variables and as JSON on the standard
+// input; a hook exiting with a non-zero status or running longer than
+// HOOK_TIMEOUT fails with ErrHookFailed
+func (m *Manager) runHook(ctx context.Context, event hookEvent) error {
+	command := m.hookCommand(event.Phase)
+	if command == "" {
+		return nil
+	}
+	event.Target = m.cfg.Target()
+	event.Storage = m.storage.Type()
+	if event.File != "" && event.Bytes == 0 {
+		if info, err := os.Stat(event.File); err == nil {
+			event.Bytes = info.Size()
+		}
+	}
+	input, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s hook input: %w", event.Phase, err)
+	}
+
+	if m.cfg.HookTimeout > 0 {
+		timeout := time.Duration(m.cfg.HookTimeout) * time.Second
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("timed out after %s", timeout))
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(), event.env()...)
+	output := &hookOutput{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Processes started by the hook and still holding its output must not
+	// block the run once it is killed
+	cmd.WaitDelay = 5 * time.Second
+
+	log.Printf("Running %s hook...", event.Phase)
+	start := time.Now()
+	err = cmd.Run()
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if line != "" {
+			log.Printf("[%s hook] %s", event.Phase, line)
+		}
+	}
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			err = cause
+		}
+		return &categorizedError{category: ErrHookFailed, err: fmt.Errorf("%s hook failed: %w", event.Phase, err)}
+	}
+	log.Printf("%s hook completed in %s", event.Phase, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// env returns the environment variables describing an event to a hook
+func (e hookEvent) env() []string {
+	env := []string{
+		"REDIS_BACKUP_PHASE=" + e.Phase,
+		"REDIS_BACKUP_TARGET=" + e.Target,
+		"REDIS_BACKUP_STORAGE=" + e.Storage,
+		"REDIS_BACKUP_NAME=" + e.Backup,
+		"REDIS_BACKUP_FILE=" + e.File,
+		"REDIS_BACKUP_BYTES=" + strconv.FormatInt(e.Bytes, 10),
+		"REDIS_BACKUP_STATUS=" + e.Status,
+		"REDIS_BACKUP_BACKUPS=" + strings.Join(e.Backups, " "),
+		"REDIS_BACKUP_ERROR=" + e.Error,
+	}
+	if e.Database != nil {
+		env = append(env, "REDIS_BACKUP_DATABASE="+strconv.Itoa(*e.Database))
+	}
+	return env
+}
+
+// hookOutput keeps the beginning of the output of a hook
+type hookOutput struct {
+	bytes.Buffer
+}
+
+func (o *hookOutput) Write(p []byte) (int, error) {
+	if room := hookOutputLimit - o.Len(); room > 0 {
+		o.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// postBackupHook runs the post-backup hook with the result of a run, a
+// failure of the hook is only logged
+func (m *Manager) postBackupHook(ctx context.Context, runErr error) {
+	event := hookEvent{Phase: hookPostBackup, Status: "success"}
+	for _, stored := range m.stored {
+		event.Backups = append(event.Backups, stored.Name)
+	}
+	if runErr != nil {
+		event.Status = "failure"
+		event.Error = runErr.Error()
+	}
+	if err := m.runHook(context.WithoutCancel(ctx), event); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/buildinfo"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// ownBackupPattern matches the names of backups created by this service
+var ownBackupPattern = regexp.MustCompile(`^redis-backup(-[A-Za-z0-9.-]+)?_\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2}\.rdb`)
+
+// importTimePattern finds a date, optionally followed by a time, in a foreign backup name
+// e.g. dump-2023-01-15.rdb, redis_20230115_0200.rdb, backup-2023-01-15T02:00:00.rdb
+var importTimePattern = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})(?:[T_ .-]?(\d{2})[:-]?(\d{2})(?:[:-]?(\d{2}))?)?`)
+
+// ImportOptions controls how foreign backups are adopted
+type ImportOptions struct {
+	// DryRun only logs what would be imported
+	DryRun bool
+	// DeleteOriginals removes each imported file from the source
+	DeleteOriginals bool
+}
+
+// ImportResult counts the files handled by Import
+type ImportResult struct {
+	Imported int
+	Skipped  int
+	Failed   int
+}
+
+// Import adopts RDB files of the source storage that were not created by this
+// service: each one is stored under the backup naming scheme with a manifest
+// (checksum, RDB version and key statistics), so retention, verify and
+// restore treat it like any other backup. Originals are kept unless requested,
+// except when the source is the configured storage: each file is then renamed,
+// since keeping it would leave a duplicate that retention counts twice
+func (m *Manager) Import(ctx context.Context, src storage.Storage, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+	inPlace := src == m.storage
+
+	srcObjects, err := src.ListObjects(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list source objects: %w", err)
+	}
+	dstObjects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list objects: %w", err)
+	}
+	existing := make(map[string]bool, len(dstObjects))
+	for _, obj := range dstObjects {
+		existing[obj.Name] = true
+	}
+
+	for _, obj := range srcObjects {
+		if !storage.IsBackupName(obj.Name) || ownBackupPattern.MatchString(obj.Name) {
+			continue
+		}
+
+		_, transforms := storage.SplitBackupName(obj.Name)
+		takenAt := importTime(obj.Name, obj.ModTime)
+		name := m.backupNameAt("", takenAt) + strings.Join(transforms, "")
+		if existing[name] {
+			log.Printf("Skipping %s: %s already exists", obj.Name, name)
+			result.Skipped++
+			continue
+		}
+
+		if opts.DryRun {
+			if inPlace {
+				log.Printf("Would rename %s to %s", obj.Name, name)
+			} else {
+				log.Printf("Would import %s as %s", obj.Name, name)
+			}
+			result.Imported++
+			continue
+		}
+
+		if err := m.importBackup(ctx, src, obj.Name, name, takenAt); err != nil {
+			log.Printf("Failed to import %s: %v", obj.Name, err)
+			result.Failed++
+			continue
+		}
+		existing[name] = true
+		result.Imported++
+		log.Printf("Imported %s as %s", obj.Name, name)
+
+		if opts.DeleteOriginals || inPlace {
+			if err := src.Delete(ctx, obj.Name); err != nil {
+				log.Printf("Warning: failed to delete %s: %v", obj.Name, err)
+			}
+		}
+	}
+
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d file(s) could not be imported", result.Failed)
+	}
+	return result, nil
+}
+
+// importBackup validates a foreign file, copies it under its new name and stores its manifest
+func (m *Manager) importBackup(ctx context.Context, src storage.Storage, original, name string, takenAt time.Time) error {
+	file, err := m.downloadFrom(ctx, src, original)
+	if err != nil {
+		return err
+	}
+	defer removeTemp(file)
+
+	keys := newKeyCollector(m.cfg.BigKeysTop)
+	if err := readKeyStats(file.Name(), keys); err != nil {
+		return fmt.Errorf("not a valid RDB file: %w", err)
+	}
+
+	tool := buildinfo.Get()
+	manifest := Manifest{
+		Backup:       name,
+		CreatedAt:    takenAt.UTC(),
+		ImportedFrom: original,
+		Labels:       m.cfg.BackupLabels,
+		Databases:    keys.databases,
+		BigKeys:      keys.bigKeys,
+		Tool:         &tool,
+		Encoding:     nameEncoding(name),
+	}
+	if stat, err := file.Stat(); err == nil {
+		manifest.SizeBytes = stat.Size()
+	}
+	if err := manifest.computeChecksums(file.Name(), m.cfg.ChecksumAlgorithms); err != nil {
+		return fmt.Errorf("failed to compute checksum: %w", err)
+	}
+	if version, err := fileRDBVersion(file.Name()); err == nil {
+		manifest.RDBVersion = version
+	}
+
+	// The stored bytes are copied unchanged, so compressed or encrypted files stay so
+	if err := copyObject(m.work.context(ctx), src, m.storage, original, name); err != nil {
+		return err
+	}
+	if err := m.storeManifest(ctx, &manifest); err != nil {
+		return err
+	}
+	return m.commitSet(ctx, name)
+}
+
+// importTime returns the time a foreign backup was taken, parsed from its
+// name when possible and otherwise its modification time
+func importTime(name string, modTime time.Time) time.Time {
+	for _, match := range importTimePattern.FindAllStringSubmatch(name, -1) {
+		fields := make([]string, 6)
+		for i := range fields {
+			fields[i] = match[i+1]
+			if fields[i] == "" {
+				fields[i] = "00"
+			}
+		}
+		layout := "2006 01 02 15 04 05"
+		if t, err := time.Parse(layout, strings.Join(fields, " ")); err == nil {
+			return t
+		}
+	}
+	return modTime
+}
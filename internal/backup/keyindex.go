@@ -0,0 +1,130 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+
+	"github.com/ermos/docker-redis-backup/internal/rdb"
+)
+
+// keyIndexSuffix is appended to a full backup name for the fingerprints of its keys
+const keyIndexSuffix = ".keyindex"
+
+// keyID identifies a key of a database
+type keyID [16]byte
+
+// keyRecord is one key of a key index
+// Hash fingerprints the value and expiry; it is 0 in lists of deleted keys
+type keyRecord struct {
+	DB   int
+	Key  string
+	Hash uint64
+}
+
+// id returns the identifier of the key of a record
+func (r keyRecord) id() keyID {
+	return makeKeyID(r.DB, r.Key)
+}
+
+// makeKeyID hashes a database index and a key
+func makeKeyID(db int, key string) keyID {
+	h := fnv.New128a()
+	var buf [binary.MaxVarintLen64]byte
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(db))])
+	h.Write([]byte(key))
+
+	var id keyID
+	h.Sum(id[:0])
+	return id
+}
+
+// entryHash fingerprints the type, serialized value and expiry of an RDB entry
+func entryHash(entry *rdb.Entry) uint64 {
+	h := fnv.New64a()
+	var buf [9]byte
+	buf[0] = entry.Type
+	binary.LittleEndian.PutUint64(buf[1:], uint64(entry.ExpireAt))
+	h.Write(buf[:])
+	h.Write(entry.Value)
+	return h.Sum64()
+}
+
+// keyIndexWriter writes gzip-compressed key records
+// Each record is <db varint><key length varint><key><hash uint64 LE>
+type keyIndexWriter struct {
+	gz  *gzip.Writer
+	buf *bufio.Writer
+}
+
+// newKeyIndexWriter creates a key index writer on w
+func newKeyIndexWriter(w io.Writer) *keyIndexWriter {
+	gz := gzip.NewWriter(w)
+	return &keyIndexWriter{gz: gz, buf: bufio.NewWriter(gz)}
+}
+
+// Write appends a record
+func (w *keyIndexWriter) Write(record keyRecord) error {
+	var head [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(head[:], uint64(record.DB))
+	n += binary.PutUvarint(head[n:], uint64(len(record.Key)))
+	if _, err := w.buf.Write(head[:n]); err != nil {
+		return err
+	}
+	if _, err := w.buf.WriteString(record.Key); err != nil {
+		return err
+	}
+	var hash [8]byte
+	binary.LittleEndian.PutUint64(hash[:], record.Hash)
+	_, err := w.buf.Write(hash[:])
+	return err
+}
+
+// Close flushes the records
+func (w *keyIndexWriter) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// readKeyIndex calls fn for every record of a key index
+func readKeyIndex(r io.Reader, fn func(record keyRecord) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("invalid key index: %w", err)
+	}
+	defer gz.Close()
+
+	buf := bufio.NewReader(gz)
+	for {
+		db, err := binary.ReadUvarint(buf)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid key index: %w", err)
+		}
+		length, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return fmt.Errorf("invalid key index: %w", err)
+		}
+		data := make([]byte, length+8)
+		if _, err := io.ReadFull(buf, data); err != nil {
+			return fmt.Errorf("invalid key index: %w", err)
+		}
+
+		record := keyRecord{
+			DB:   int(db),
+			Key:  string(data[:length]),
+			Hash: binary.LittleEndian.Uint64(data[length:]),
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
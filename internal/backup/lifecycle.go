@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// lifecycleInterval is the time between two checks of the lifecycle rules,
+// which restore them when they were changed outside the service
+const lifecycleInterval = 24 * time.Hour
+
+// lifecyclePolicy returns the lifecycle policy configured by LIFECYCLE_*
+func (m *Manager) lifecyclePolicy() storage.LifecyclePolicy {
+	return storage.LifecyclePolicy{
+		TransitionDays:  m.cfg.LifecycleTransitionDays,
+		TransitionClass: m.cfg.LifecycleTransitionClass,
+		ExpireDays:      m.cfg.LifecycleExpireDays,
+	}
+}
+
+// ApplyLifecycle creates or updates the lifecycle rules of the backup prefix
+// from the LIFECYCLE_* configuration and reports whether they changed
+func (m *Manager) ApplyLifecycle(ctx context.Context) (bool, error) {
+	manager, ok := m.storage.(storage.LifecycleManager)
+	if !ok {
+		return false, fmt.Errorf("%s storage has no lifecycle rules", m.storage.Type())
+	}
+
+	policy := m.lifecyclePolicy()
+	changed, err := manager.ApplyLifecycle(ctx, policy)
+	if changed || err != nil {
+		m.audit(ctx, "lifecycle", m.cfg.StorageURI(), describeLifecycle(policy), err)
+	}
+	if err != nil {
+		return false, err
+	}
+	return changed, nil
+}
+
+// ManageLifecycle applies the lifecycle rules now, then checks them every
+// day until ctx is canceled
+func (m *Manager) ManageLifecycle(ctx context.Context) {
+	ticker := time.NewTicker(lifecycleInterval)
+	defer ticker.Stop()
+
+	for {
+		changed, err := m.ApplyLifecycle(ctx)
+		switch {
+		case err != nil:
+			log.Printf("Warning: %v", err)
+		case changed:
+			log.Printf("Lifecycle rules updated: %s", describeLifecycle(m.lifecyclePolicy()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// describeLifecycle returns a readable summary of a lifecycle policy
+func describeLifecycle(policy storage.LifecyclePolicy) string {
+	switch {
+	case policy.TransitionDays > 0 && policy.ExpireDays > 0:
+		return fmt.Sprintf("move to %s after %d days, delete after %d days", policy.TransitionClass, policy.TransitionDays, policy.ExpireDays)
+	case policy.TransitionDays > 0:
+		return fmt.Sprintf("move to %s after %d days", policy.TransitionClass, policy.TransitionDays)
+	case policy.ExpireDays > 0:
+		return fmt.Sprintf("delete after %d days", policy.ExpireDays)
+	}
+	return "no rule"
+}
@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// lockReleaseGrace is how long the lock is kept after a run completes, so
+// replicas whose clocks are slightly behind still skip the same scheduled run
+const lockReleaseGrace = time.Minute
+
+// releaseLockScript shortens the lock TTL only if it is still owned by this instance
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// acquireLock takes the distributed backup lock with SET NX and a TTL
+// It returns the lock token, or an empty token when another instance holds the lock
+// An expired lock (crashed holder) is taken over automatically
+func (m *Manager) acquireLock(ctx context.Context) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate lock token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+
+	ttl := time.Duration(m.cfg.BackupLockTTL) * time.Second
+	ok, err := m.redis.SetNX(ctx, m.cfg.BackupLockKey, token, ttl).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to acquire backup lock: %w", err)
+	}
+	if !ok {
+		return "", nil
+	}
+
+	log.Printf("Backup lock %s acquired (ttl: %s)", m.cfg.BackupLockKey, ttl)
+	return token, nil
+}
+
+// releaseLock lets the lock expire shortly after the run if it is still owned
+func (m *Manager) releaseLock(token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	grace := lockReleaseGrace
+	if ttl := time.Duration(m.cfg.BackupLockTTL) * time.Second; ttl < grace {
+		grace = ttl
+	}
+
+	if err := releaseLockScript.Run(ctx, m.redis, []string{m.cfg.BackupLockKey}, token, grace.Milliseconds()).Err(); err != nil {
+		log.Printf("Warning: failed to release backup lock: %v", err)
+	}
+}
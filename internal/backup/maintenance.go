@@ -0,0 +1,172 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/metrics"
+	"github.com/ermos/docker-redis-backup/internal/notify"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// maintenanceObject holds the maintenance window of the storage, so the
+// service sees the windows opened by the maintenance command
+const maintenanceObject = "redis-backup-maintenance.json"
+
+// maintenanceAlerts are the failure alerts not sent during maintenance
+var maintenanceAlerts = map[string]bool{
+	notify.EventBackupFailed:      true,
+	notify.EventWindowExceeded:    true,
+	notify.EventStandbySeedFailed: true,
+	notify.EventReplicaLagging:    true,
+}
+
+// Maintenance is a planned maintenance of a target, during which backups run
+// but their failures are not alerted
+type Maintenance struct {
+	Reason string    `json:"reason"`
+	Start  time.Time `json:"start"`
+	Until  time.Time `json:"until"`
+}
+
+var (
+	maintenanceMu sync.Mutex
+	maintenances  = make(map[string]*Maintenance)
+)
+
+// StartMaintenance opens a maintenance window of the given duration, bounded
+// by MAINTENANCE_MAX_DURATION, replacing the current one
+func StartMaintenance(ctx context.Context, cfg *config.Config, store storage.Storage, reason string, duration time.Duration) (*Maintenance, error) {
+	if reason == "" {
+		return nil, errors.New("a maintenance needs a reason")
+	}
+	if limit := time.Duration(cfg.MaintenanceMaxDuration) * time.Second; duration <= 0 || duration > limit {
+		return nil, fmt.Errorf("the maintenance duration must be between 0 and MAINTENANCE_MAX_DURATION (%s)", limit)
+	}
+
+	now := time.Now().UTC()
+	window := &Maintenance{Reason: reason, Start: now, Until: now.Add(duration)}
+	data, err := json.MarshalIndent(window, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode maintenance: %w", err)
+	}
+	if err := uploadData(ctx, store, maintenanceObject, data); err != nil {
+		return nil, fmt.Errorf("failed to store maintenance: %w", err)
+	}
+	setMaintenance(cfg.Target(), window)
+	return window, nil
+}
+
+// EndMaintenance closes the maintenance window of the storage, if any
+func EndMaintenance(ctx context.Context, cfg *config.Config, store storage.Storage) error {
+	err := store.Delete(ctx, maintenanceObject)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to delete maintenance: %w", err)
+	}
+	setMaintenance(cfg.Target(), nil)
+	return nil
+}
+
+// LoadMaintenance returns the maintenance window of the storage, nil when
+// there is none or it is over
+func LoadMaintenance(ctx context.Context, store storage.Storage) (*Maintenance, error) {
+	var data bytes.Buffer
+	err := store.Download(ctx, maintenanceObject, &data)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance: %w", err)
+	}
+	var window Maintenance
+	if err := json.Unmarshal(data.Bytes(), &window); err != nil {
+		return nil, fmt.Errorf("failed to decode maintenance: %w", err)
+	}
+	if !window.active() {
+		return nil, nil
+	}
+	return &window, nil
+}
+
+// RefreshMaintenance reads the maintenance window of a target from its
+// storage before a run, so its result is annotated and alerted accordingly
+// A window that cannot be read is kept as it was
+func RefreshMaintenance(ctx context.Context, cfg *config.Config, store storage.Storage) {
+	window, err := LoadMaintenance(ctx, store)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	setMaintenance(cfg.Target(), window)
+}
+
+// active reports whether a maintenance window is not over
+func (w *Maintenance) active() bool {
+	return w != nil && time.Now().Before(w.Until)
+}
+
+// setMaintenance records the maintenance window of a target and publishes it
+func setMaintenance(target string, window *Maintenance) {
+	maintenanceMu.Lock()
+	if window == nil {
+		delete(maintenances, target)
+	} else {
+		maintenances[target] = window
+	}
+	maintenanceMu.Unlock()
+
+	value := 0.0
+	if window != nil {
+		value = 1
+	}
+	metrics.SetGauge("redis_backup_maintenance", "Whether the target is in a maintenance window (1) or not (0)",
+		map[string]string{"target": target}, value)
+}
+
+// activeMaintenance returns the maintenance window a target is in, if any
+func activeMaintenance(target string) *Maintenance {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	window := maintenances[target]
+	if !window.active() {
+		return nil
+	}
+	copied := *window
+	return &copied
+}
+
+// maintenanceNotifier drops the failure alerts of targets in maintenance
+type maintenanceNotifier struct {
+	notify.Notifier
+	target string
+}
+
+// newNotifier creates the notifier of a target, muted during its maintenance
+func newNotifier(cfg *config.Config) (notify.Notifier, error) {
+	notifier, err := notify.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return maintenanceNotifier{Notifier: notifier, target: cfg.Target()}, nil
+}
+
+// Notify sends an event unless it is a failure alert of a target in maintenance
+func (n maintenanceNotifier) Notify(ctx context.Context, event notify.Event) error {
+	target := event.Target
+	if target == "" {
+		target = n.target
+	}
+	if window := activeMaintenance(target); window != nil && maintenanceAlerts[event.Type] {
+		log.Printf("Notification [%s] %s not sent, in maintenance until %s: %s",
+			event.Type, target, window.Until.Format(time.RFC3339), window.Reason)
+		return nil
+	}
+	return n.Notifier.Notify(ctx, event)
+}
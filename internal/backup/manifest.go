@@ -0,0 +1,356 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/buildinfo"
+	"github.com/ermos/docker-redis-backup/internal/checksum"
+	"github.com/ermos/docker-redis-backup/internal/crypt"
+	"github.com/ermos/docker-redis-backup/internal/rdb"
+	"github.com/ermos/docker-redis-backup/internal/redisinfo"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// manifestSuffix is appended to a backup name for its manifest sidecar
+const manifestSuffix = ".manifest.json"
+
+// Manifest describes a backup and its content
+type Manifest struct {
+	Backup        string            `json:"backup"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Engine        string            `json:"engine"`
+	ServerVersion string            `json:"server_version,omitempty"`
+	RDBVersion    int               `json:"rdb_version,omitempty"`
+	KeyID         string            `json:"key_id,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	SizeBytes     int64             `json:"size_bytes"`
+	// DatasetMemory is the memory the keys took on the source, read by restore estimates
+	DatasetMemory int64             `json:"dataset_memory,omitempty"`
+	SHA256        string            `json:"sha256,omitempty"`
+	Checksums     map[string]string `json:"checksums,omitempty"`
+	ImportedFrom  string            `json:"imported_from,omitempty"`
+	Type          string            `json:"type,omitempty"`
+	Base          string            `json:"base,omitempty"`
+	DeletedKeys   int64             `json:"deleted_keys,omitempty"`
+	AOFMarker     string            `json:"aof_marker,omitempty"`
+	Databases     map[int]*KeyStats `json:"databases"`
+	BigKeys       []BigKey          `json:"big_keys,omitempty"`
+	Fork          *ForkStats        `json:"fork,omitempty"`
+	// ClockSkew is the offset of the Redis clock, recorded when it exceeded
+	// CLOCK_SKEW_THRESHOLD: CreatedAt is then off by as much on the server
+	ClockSkew float64 `json:"clock_skew_seconds,omitempty"`
+	// Tool is the build that stored the backup, and Encoding how it is stored,
+	// so it can be decoded with the right tool years later
+	Tool     *buildinfo.Info `json:"tool,omitempty"`
+	Encoding *Encoding       `json:"encoding,omitempty"`
+	// Encrypted holds the whole manifest encrypted with ENCRYPTION_METADATA
+	// (base64); only the fields of sealedManifest are then in plaintext
+	Encrypted string `json:"encrypted,omitempty"`
+}
+
+// sealedManifest is the plaintext part of an encrypted manifest: what
+// retention, rekey and doctor need without the key
+type sealedManifest struct {
+	Backup    string          `json:"backup"`
+	CreatedAt time.Time       `json:"created_at"`
+	KeyID     string          `json:"key_id,omitempty"`
+	Type      string          `json:"type,omitempty"`
+	Base      string          `json:"base,omitempty"`
+	Tool      *buildinfo.Info `json:"tool,omitempty"`
+	Encoding  *Encoding       `json:"encoding,omitempty"`
+	Encrypted string          `json:"encrypted"`
+}
+
+// Encoding describes how a stored backup is compressed and encrypted
+type Encoding struct {
+	// Compression is "none" or the compression of an imported backup
+	Compression string `json:"compression"`
+	// Encryption is "none", "builtin" (ENCRYPTION_KEY or ENCRYPTION_KMS_KEY),
+	// "openpgp" (GPG_RECIPIENT_KEYS) or the encryption of an imported backup
+	Encryption string `json:"encryption"`
+	// EncryptionFormat is the version of the built-in encryption format
+	EncryptionFormat int               `json:"encryption_format,omitempty"`
+	Params           map[string]string `json:"params,omitempty"`
+}
+
+// transformEncodings names the compression or encryption of each name suffix
+var transformEncodings = map[string]struct{ compression, encryption string }{
+	".gz":           {compression: "gzip"},
+	".zst":          {compression: "zstd"},
+	".lz4":          {compression: "lz4"},
+	".age":          {encryption: "age"},
+	crypt.GPGSuffix: {encryption: "openpgp"},
+	".enc":          {encryption: "unknown"},
+}
+
+// encoding describes how uploadBackup stores new backups
+func (m *Manager) encoding() *Encoding {
+	encoding := &Encoding{Compression: "none", Encryption: "none"}
+	switch {
+	case m.gpg.Enabled():
+		encoding.Encryption = "openpgp"
+		encoding.Params = m.gpg.Params()
+	case m.keyring.CurrentKeyID() != "":
+		encoding.Encryption = "builtin"
+		encoding.EncryptionFormat = crypt.FormatVersion
+		encoding.Params = m.keyring.Params()
+	}
+	return encoding
+}
+
+// nameEncoding describes the encoding of a backup from its name suffixes, for
+// files stored by other tools
+func nameEncoding(backupName string) *Encoding {
+	encoding := &Encoding{Compression: "none", Encryption: "none"}
+	_, transforms := storage.SplitBackupName(backupName)
+	for _, suffix := range transforms {
+		if t, ok := transformEncodings[suffix]; ok {
+			if t.compression != "" {
+				encoding.Compression = t.compression
+			}
+			if t.encryption != "" {
+				encoding.Encryption = t.encryption
+			}
+		}
+	}
+	return encoding
+}
+
+// KeyStats counts the keys of a database
+type KeyStats struct {
+	Keys    int64            `json:"keys"`
+	Expires int64            `json:"expires"`
+	Types   map[string]int64 `json:"types,omitempty"`
+}
+
+// add counts a key of the given RDB type
+func (s *KeyStats) add(valueType byte, expires bool) {
+	s.Keys++
+	if expires {
+		s.Expires++
+	}
+	if s.Types == nil {
+		s.Types = make(map[string]int64)
+	}
+	s.Types[rdb.TypeName(valueType)]++
+}
+
+// TotalKeys returns the number of keys across every database
+func (m *Manifest) TotalKeys() int64 {
+	var total int64
+	for _, stats := range m.Databases {
+		total += stats.Keys
+	}
+	return total
+}
+
+// countedFromRDB reports whether the key counts were read from the snapshot itself
+func (m *Manifest) countedFromRDB() bool {
+	for _, stats := range m.Databases {
+		if stats.Keys > 0 && stats.Types == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// writeManifest stores the manifest of a completed backup
+// Failures are logged but do not fail the backup itself
+func (m *Manager) writeManifest(ctx context.Context, backupName, localPath string, keys *keyCollector) {
+	m.storeBackupManifest(ctx, m.newManifest(ctx, backupName, localPath, keys))
+}
+
+// newManifest describes a backup from its local file and key statistics
+func (m *Manager) newManifest(ctx context.Context, backupName, localPath string, keys *keyCollector) *Manifest {
+	tool := buildinfo.Get()
+	manifest := &Manifest{
+		Backup:    backupName,
+		CreatedAt: time.Now().UTC(),
+		Engine:    m.engine,
+		KeyID:     m.keyring.CurrentKeyID(),
+		Labels:    m.cfg.BackupLabels,
+		Databases: keys.databases,
+		BigKeys:   keys.bigKeys,
+		Tool:      &tool,
+		Encoding:  m.encoding(),
+	}
+	if m.clockSkewed() {
+		manifest.ClockSkew = m.clockSkew.Round(time.Millisecond).Seconds()
+	}
+	if stat, err := os.Stat(localPath); err == nil {
+		manifest.SizeBytes = stat.Size()
+	}
+	if err := manifest.computeChecksums(localPath, m.cfg.ChecksumAlgorithms); err != nil {
+		log.Printf("Warning: failed to compute backup checksum: %v", err)
+	}
+	if version, err := fileRDBVersion(localPath); err == nil {
+		manifest.RDBVersion = version
+	}
+	if version, err := m.serverVersion(ctx); err == nil {
+		manifest.ServerVersion = version
+	}
+	m.fillMemoryUsage(ctx, manifest.BigKeys)
+	return manifest
+}
+
+// storeBackupManifest stores the manifest of a completed backup and logs its summary
+// Failures are logged but do not fail the backup itself
+func (m *Manager) storeBackupManifest(ctx context.Context, manifest *Manifest) {
+	if err := m.storeManifest(ctx, manifest); err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	log.Printf("Manifest stored: %s (%d keys)", manifest.Backup+manifestSuffix, manifest.TotalKeys())
+	if len(manifest.BigKeys) > 0 {
+		biggest := manifest.BigKeys[0]
+		log.Printf("Largest key: %q in db %d (%s, %d bytes serialized)", biggest.Key, biggest.DB, biggest.Type, biggest.SerializedBytes)
+	}
+}
+
+// storeManifest uploads the manifest sidecar of a backup
+// With ENCRYPTION_METADATA, it is stored encrypted inside a sealedManifest
+func (m *Manager) storeManifest(ctx context.Context, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	if m.cfg.EncryptMetadata {
+		var encrypted bytes.Buffer
+		if err := m.keyring.Encrypt(ctx, &encrypted, bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("failed to encrypt manifest: %w", err)
+		}
+		data, err = json.MarshalIndent(sealedManifest{
+			Backup:    manifest.Backup,
+			CreatedAt: manifest.CreatedAt,
+			KeyID:     manifest.KeyID,
+			Type:      manifest.Type,
+			Base:      manifest.Base,
+			Tool:      manifest.Tool,
+			Encoding:  manifest.Encoding,
+			Encrypted: base64.StdEncoding.EncodeToString(encrypted.Bytes()),
+		}, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode manifest: %w", err)
+		}
+	}
+
+	if err := uploadData(m.work.context(ctx), m.storage, manifest.Backup+manifestSuffix, data); err != nil {
+		return fmt.Errorf("failed to store manifest: %w", err)
+	}
+	return nil
+}
+
+// computeChecksums records the digests of the backup file with each algorithm
+// The SHA-256 is also kept in its own field, read by older versions
+func (m *Manifest) computeChecksums(path string, algorithms []string) error {
+	sums, err := checksum.File(path, algorithms)
+	if err != nil {
+		return err
+	}
+	m.Checksums = sums
+	m.SHA256 = sums[checksum.SHA256]
+	return nil
+}
+
+// fileRDBVersion reads the RDB version from the header of a file
+func fileRDBVersion(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return rdb.ReadVersion(file)
+}
+
+// LoadManifest downloads the manifest of a backup, decrypting it with keyring
+// when it was stored with ENCRYPTION_METADATA
+// Without keyring, only the plaintext fields of an encrypted manifest are set
+func LoadManifest(ctx context.Context, store storage.Storage, backupName string, keyring *crypt.Keyring) (*Manifest, error) {
+	var data bytes.Buffer
+	if err := store.Download(ctx, backupName+manifestSuffix, &data); err != nil {
+		return nil, fmt.Errorf("failed to download manifest: %w", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data.Bytes(), &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if manifest.Encrypted == "" || keyring == nil {
+		return &manifest, nil
+	}
+
+	encrypted, err := base64.StdEncoding.DecodeString(manifest.Encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	var decrypted bytes.Buffer
+	if _, err := keyring.Decrypt(ctx, &decrypted, bytes.NewReader(encrypted)); err != nil {
+		return nil, fmt.Errorf("failed to decrypt manifest: %w", err)
+	}
+	var sealed Manifest
+	if err := json.Unmarshal(decrypted.Bytes(), &sealed); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return &sealed, nil
+}
+
+// snapshotKeyStats counts keys per database and type by reading an RDB file
+// When the file cannot be parsed (unsupported module types, ...), the counts
+// reported by INFO keyspace are used instead, without the type breakdown
+func (m *Manager) snapshotKeyStats(ctx context.Context, rdbPath string) *keyCollector {
+	keys := newKeyCollector(m.cfg.BigKeysTop)
+	err := readKeyStats(rdbPath, keys)
+	if err == nil {
+		return keys
+	}
+	log.Printf("Warning: failed to read key statistics from RDB file, using INFO keyspace: %v", err)
+
+	keys = newKeyCollector(0)
+	info, err := m.info(ctx, "keyspace")
+	if err != nil {
+		log.Printf("Warning: failed to get keyspace info: %v", err)
+		return keys
+	}
+	keys.databases = parseKeyspace(info)
+	return keys
+}
+
+// readKeyStats reads every key of an RDB file into a collector
+func readKeyStats(rdbPath string, keys *keyCollector) error {
+	file, err := os.Open(rdbPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := rdb.NewReader(file)
+	for {
+		entry, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		keys.add(entry.DB, entry.Key, entry.Type, entry.ExpireAt > 0, int64(len(entry.Value)))
+	}
+}
+
+// parseKeyspace returns the key counts of each database in INFO keyspace
+func parseKeyspace(info *redisinfo.Info) map[int]*KeyStats {
+	stats := make(map[int]*KeyStats)
+	for db, keyspace := range info.Keyspace() {
+		stats[db] = &KeyStats{Keys: keyspace.Keys, Expires: keyspace.Expires}
+	}
+	return stats
+}
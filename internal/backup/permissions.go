@@ -0,0 +1,196 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// aclCheckKey is the key name used to check key permissions with ACL DRYRUN
+const aclCheckKey = "redis-backup:acl-check"
+
+// permission is a command run by an enabled feature
+type permission struct {
+	// args are the command, in its original name, and example arguments
+	args []string
+	// feature is what the command is needed for
+	feature string
+	// optional commands are only needed for a part of the feature, which is
+	// skipped with a warning without them
+	optional bool
+}
+
+// rule returns the ACL rule granting the command
+func (p permission) rule() string {
+	name := strings.ToLower(p.args[0])
+	if containerCommands[name] {
+		name += "|" + strings.ToLower(p.args[1])
+	}
+	return "+" + name
+}
+
+// requiredPermissions returns the commands the enabled features run, for
+// backups or, with restore, for the restore commands
+func (m *Manager) requiredPermissions(restore bool) []permission {
+	if restore {
+		perms := []permission{
+			{args: []string{"SELECT", "0"}, feature: "restore"},
+			{args: []string{"RESTORE", aclCheckKey, "0", "payload", "REPLACE"}, feature: "restore"},
+			{args: []string{"DEL", aclCheckKey}, feature: "differential restore"},
+			{args: []string{"INFO", "server"}, feature: "RDB version check", optional: true},
+		}
+		if m.cfg.BackupFunctions {
+			perms = append(perms, permission{args: []string{"FUNCTION", "RESTORE", "payload"}, feature: "restore-functions", optional: true})
+		}
+		return perms
+	}
+
+	perms := []permission{
+		{args: []string{"INFO", "persistence"}, feature: "snapshots"},
+		{args: []string{"BGSAVE"}, feature: "snapshots"},
+		{args: []string{"CONFIG", "GET", "dbfilename"}, feature: "RDB file name discovery", optional: true},
+	}
+	if m.disabled("INFO") {
+		perms = append(perms, permission{args: []string{"LASTSAVE"}, feature: "snapshots without INFO"})
+	}
+	if m.cfg.ClockSkewThreshold > 0 {
+		perms = append(perms, permission{args: []string{"TIME"}, feature: "clock skew check", optional: true})
+	}
+	if m.cfg.FallbackSave {
+		perms = append(perms, permission{args: []string{"SAVE"}, feature: "FALLBACK_SAVE"})
+	}
+	if m.cfg.BackupLock {
+		key := m.cfg.BackupLockKey
+		perms = append(perms,
+			permission{args: []string{"SET", key, "token", "NX", "PX", "1"}, feature: "BACKUP_LOCK"},
+			permission{args: []string{"EVALSHA", strings.Repeat("0", 40), "1", key}, feature: "BACKUP_LOCK"},
+			permission{args: []string{"EVAL", "return 0", "1", key}, feature: "BACKUP_LOCK"},
+			permission{args: []string{"GET", key}, feature: "BACKUP_LOCK"},
+			permission{args: []string{"PEXPIRE", key, "1"}, feature: "BACKUP_LOCK"},
+		)
+	}
+	if m.cfg.AOFShipping {
+		perms = append(perms,
+			permission{args: []string{"MULTI"}, feature: "AOF_SHIPPING"},
+			permission{args: []string{"EXEC"}, feature: "AOF_SHIPPING"},
+			permission{args: []string{"SET", aofMarkerKey, "marker"}, feature: "AOF_SHIPPING"},
+			permission{args: []string{"CONFIG", "GET", "appenddirname"}, feature: "AOF_SHIPPING", optional: true},
+		)
+	}
+	for name, value := range m.cfg.BGSAVEConfig {
+		perms = append(perms,
+			permission{args: []string{"CONFIG", "GET", name}, feature: "BGSAVE_CONFIG", optional: true},
+			permission{args: []string{"CONFIG", "SET", name, value}, feature: "BGSAVE_CONFIG", optional: true},
+		)
+	}
+	if m.cfg.BackupSplitDatabases {
+		perms = append(perms,
+			permission{args: []string{"SELECT", "0"}, feature: "BACKUP_SPLIT_DATABASES"},
+			permission{args: []string{"SCAN", "0"}, feature: "BACKUP_SPLIT_DATABASES"},
+			permission{args: []string{"DUMP", aclCheckKey}, feature: "BACKUP_SPLIT_DATABASES"},
+			permission{args: []string{"PTTL", aclCheckKey}, feature: "BACKUP_SPLIT_DATABASES"},
+		)
+	}
+	if m.cfg.BackupFunctions {
+		perms = append(perms, permission{args: []string{"FUNCTION", "DUMP"}, feature: "BACKUP_FUNCTIONS"})
+	}
+	if m.cfg.BackupServerConfig {
+		perms = append(perms,
+			permission{args: []string{"CONFIG", "GET", "*"}, feature: "BACKUP_SERVER_CONFIG", optional: true},
+			permission{args: []string{"ACL", "LIST"}, feature: "BACKUP_SERVER_CONFIG", optional: true},
+		)
+	}
+	if m.cfg.BigKeysTop > 0 {
+		perms = append(perms,
+			permission{args: []string{"SELECT", "0"}, feature: "BIG_KEYS_TOP", optional: true},
+			permission{args: []string{"MEMORY", "USAGE", aclCheckKey}, feature: "BIG_KEYS_TOP", optional: true},
+		)
+	}
+	if m.cfg.WriteTriggerThreshold > 0 && m.cfg.WriteTriggerSource == "notifications" {
+		perms = append(perms, permission{args: []string{"PSUBSCRIBE", "__keyevent@*__:*"}, feature: "WRITE_TRIGGER_SOURCE=notifications"})
+	}
+	if m.cfg.ControlChannel != "" {
+		perms = append(perms,
+			permission{args: []string{"SUBSCRIBE", m.cfg.ControlChannel}, feature: "CONTROL_CHANNEL"},
+			permission{args: []string{"PUBLISH", m.cfg.ControlChannel + controlReplySuffix, "reply"}, feature: "CONTROL_CHANNEL"},
+		)
+	}
+	return perms
+}
+
+// CheckPermissions verifies with ACL DRYRUN that the connected user may run
+// the commands of the enabled features (those of the restore commands with
+// restore), and returns an error listing the ACL rules missing for required
+// ones; missing optional ones are logged
+// The check is skipped when the server or the user cannot run ACL DRYRUN
+// (Redis < 7, or a user without +acl|whoami and +acl|dryrun)
+func (m *Manager) CheckPermissions(ctx context.Context, restore bool) error {
+	user, err := m.redis.Do(ctx, "ACL", "WHOAMI").Text()
+	if err != nil {
+		log.Printf("Permission check skipped, ACL WHOAMI failed: %v", err)
+		return nil
+	}
+
+	// Required commands first, so a rule missing for both is reported as required
+	perms := m.requiredPermissions(restore)
+	slices.SortStableFunc(perms, func(a, b permission) int {
+		switch {
+		case a.optional == b.optional:
+			return 0
+		case b.optional:
+			return -1
+		}
+		return 1
+	})
+
+	var missing, missingOptional []string
+	reported := make(map[string]bool)
+	for _, perm := range perms {
+		if m.disabled(perm.args[0]) {
+			continue
+		}
+
+		args := []any{"ACL", "DRYRUN", user, m.command(perm.args[0])}
+		for _, arg := range perm.args[1:] {
+			args = append(args, arg)
+		}
+		reply, err := m.redis.Do(ctx, args...).Text()
+		if err != nil {
+			log.Printf("Permission check skipped, ACL DRYRUN failed: %v", err)
+			return nil
+		}
+		if reply == "OK" {
+			continue
+		}
+
+		rule := perm.rule()
+		switch {
+		case strings.Contains(reply, "channel"):
+			rule = "&*"
+		case strings.Contains(reply, "key"):
+			rule = "~*"
+		}
+		if reported[rule] {
+			continue
+		}
+		reported[rule] = true
+
+		entry := fmt.Sprintf("%s (%s)", rule, perm.feature)
+		if perm.optional {
+			missingOptional = append(missingOptional, entry)
+		} else {
+			missing = append(missing, entry)
+		}
+	}
+
+	if len(missingOptional) > 0 {
+		log.Printf("Warning: user %s lacks optional permissions, the features are degraded: %s", user, strings.Join(missingOptional, ", "))
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("user %s lacks the ACL rules: %s", user, strings.Join(missing, ", "))
+	}
+	log.Printf("Permission check passed for user %s", user)
+	return nil
+}
@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// pinSuffix is appended to a backup name for the marker that pins it
+const pinSuffix = ".pin"
+
+// Pin is the content of a pin marker
+type Pin struct {
+	Backup   string    `json:"backup"`
+	PinnedAt time.Time `json:"pinned_at"`
+	Reason   string    `json:"reason,omitempty"`
+	// Until is when the pin expires, nil for a pin kept until it is removed
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// PinBackup pins a backup so the retention policy doesn't delete it, until
+// the given time unless it is zero
+func PinBackup(ctx context.Context, store storage.Storage, backupName, reason string, until time.Time) error {
+	if _, err := store.Stat(ctx, backupName); err != nil {
+		return err
+	}
+
+	pin := Pin{Backup: backupName, PinnedAt: time.Now().UTC(), Reason: reason}
+	if !until.IsZero() {
+		until = until.UTC()
+		pin.Until = &until
+	}
+	data, err := json.Marshal(pin)
+	if err != nil {
+		return fmt.Errorf("failed to encode pin: %w", err)
+	}
+	return uploadData(ctx, store, backupName+pinSuffix, data)
+}
+
+// UnpinBackup removes the pin marker of a backup
+// Backups pinned with PIN_TAG stay pinned until the tag is removed
+func UnpinBackup(ctx context.Context, store storage.Storage, backupName string) error {
+	err := store.Delete(ctx, backupName+pinSuffix)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to delete pin: %w", err)
+	}
+	return nil
+}
+
+// PinnedBackups returns the backups among objects pinned by a marker that
+// has not expired or, when tag (PIN_TAG) is set, by an object tag
+// Backups whose marker or tags cannot be read are reported as pinned
+func PinnedBackups(ctx context.Context, store storage.Storage, objects []storage.ObjectInfo, tag string) map[string]bool {
+	pinned := make(map[string]bool)
+	for _, obj := range objects {
+		if name, ok := strings.CutSuffix(obj.Name, pinSuffix); ok && storage.IsBackupName(name) && !pinExpired(ctx, store, obj.Name) {
+			pinned[name] = true
+		}
+	}
+
+	tagger, ok := store.(storage.Tagger)
+	if tag == "" || !ok {
+		return pinned
+	}
+	key, value, exact := strings.Cut(tag, "=")
+	for _, obj := range objects {
+		if !storage.IsBackupName(obj.Name) || pinned[obj.Name] {
+			continue
+		}
+		tags, err := tagger.Tags(ctx, obj.Name)
+		if err != nil {
+			log.Printf("Warning: failed to read the tags of %s, keeping it: %v", obj.Name, err)
+			pinned[obj.Name] = true
+			continue
+		}
+		if current, ok := tags[key]; ok && (!exact || current == value) {
+			pinned[obj.Name] = true
+		}
+	}
+	return pinned
+}
+
+// pinExpired reports whether a pin marker has an expiry in the past
+func pinExpired(ctx context.Context, store storage.Storage, markerName string) bool {
+	var data bytes.Buffer
+	if err := store.Download(ctx, markerName, &data); err != nil {
+		log.Printf("Warning: failed to read %s, keeping the backup pinned: %v", markerName, err)
+		return false
+	}
+	var pin Pin
+	if err := json.Unmarshal(data.Bytes(), &pin); err != nil {
+		// An unreadable marker keeps the backup pinned
+		return false
+	}
+	return pin.Until != nil && time.Now().After(*pin.Until)
+}
+
+// pinnedBackups returns the pinned backups of the storage
+func (m *Manager) pinnedBackups(ctx context.Context) (map[string]bool, error) {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pinned backups: %w", err)
+	}
+	return PinnedBackups(ctx, m.storage, objects, m.cfg.PinTag), nil
+}
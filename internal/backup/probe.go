@@ -0,0 +1,66 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// probeObjectPrefix starts the name of the objects written by the storage probe
+const probeObjectPrefix = "redis-backup-probe_"
+
+// ProbeStorage checks that the storage can be listed, written, read and
+// deleted with a small temporary object
+// With listOnly, nothing is written (e.g. in dry-run mode)
+func ProbeStorage(ctx context.Context, store storage.Storage, listOnly bool) error {
+	if _, err := store.ListObjects(ctx); err != nil {
+		return fmt.Errorf("list probe failed: %w", err)
+	}
+	if listOnly {
+		return nil
+	}
+
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%s%s_%d.tmp", probeObjectPrefix, host, time.Now().UnixNano())
+	data := []byte("redis-backup storage probe, safe to delete\n")
+
+	if err := uploadData(ctx, store, name, data); err != nil {
+		return fmt.Errorf("write probe failed: %w", err)
+	}
+
+	// Try to delete the probe object whatever happens next
+	deleted := false
+	defer func() {
+		if !deleted {
+			_ = store.Delete(context.WithoutCancel(ctx), name)
+		}
+	}()
+
+	objects, err := store.ListObjects(ctx)
+	if err != nil {
+		return fmt.Errorf("list probe failed: %w", err)
+	}
+	if !slices.ContainsFunc(objects, func(obj storage.ObjectInfo) bool { return obj.Name == name }) {
+		return fmt.Errorf("list probe failed: %s was written but is not listed", name)
+	}
+
+	var read bytes.Buffer
+	if err := store.Download(ctx, name, &read); err != nil {
+		return fmt.Errorf("read probe failed: %w", err)
+	}
+	if !bytes.Equal(read.Bytes(), data) {
+		return errors.New("read probe failed: the object read back differs from the one written")
+	}
+
+	deleted = true
+	if err := store.Delete(ctx, name); err != nil {
+		return fmt.Errorf("delete probe failed (retention could not delete old backups): %w", err)
+	}
+	return nil
+}
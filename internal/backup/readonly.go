@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrReadOnly is returned for operations that would write to Redis in READ_ONLY mode
+var ErrReadOnly = errors.New("not allowed in READ_ONLY mode")
+
+// readOnlyCommands are the only commands sent in READ_ONLY mode, with their
+// subcommand for container commands
+var readOnlyCommands = map[string]bool{
+	"ping": true, "info": true, "bgsave": true, "save": true, "lastsave": true,
+	"select": true, "scan": true, "dump": true, "pttl": true, "type": true, "dbsize": true, "time": true,
+	"config|get": true, "memory|usage": true, "function|dump": true,
+	"acl|list": true, "acl|whoami": true, "acl|dryrun": true,
+}
+
+// containerCommands are the commands whose subcommand decides what they do
+var containerCommands = map[string]bool{"config": true, "memory": true, "function": true, "acl": true}
+
+// readOnlyHook rejects every command that is not in readOnlyCommands before
+// it is sent, so no code path can write to Redis in READ_ONLY mode
+type readOnlyHook struct {
+	// aliases maps the lowercase COMMAND_ALIASES names back to the commands
+	aliases map[string]string
+}
+
+func newReadOnlyHook(aliases map[string]string) readOnlyHook {
+	h := readOnlyHook{aliases: make(map[string]string)}
+	for command, alias := range aliases {
+		if alias != "" {
+			h.aliases[strings.ToLower(alias)] = strings.ToLower(command)
+		}
+	}
+	return h
+}
+
+// check returns an ErrReadOnly error for a command that is not allowed
+func (h readOnlyHook) check(cmd redis.Cmder) error {
+	args := cmd.Args()
+	if len(args) == 0 {
+		return nil
+	}
+	name := strings.ToLower(fmt.Sprint(args[0]))
+	if command, ok := h.aliases[name]; ok {
+		name = command
+	}
+	if containerCommands[name] && len(args) > 1 {
+		name += "|" + strings.ToLower(fmt.Sprint(args[1]))
+	}
+	if readOnlyCommands[name] {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", strings.ToUpper(name), ErrReadOnly)
+}
+
+func (h readOnlyHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (h readOnlyHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := h.check(cmd); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h readOnlyHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			if err := h.check(cmd); err != nil {
+				for _, cmd := range cmds {
+					cmd.SetErr(err)
+				}
+				return err
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// checkWritable returns an ErrReadOnly error for an operation writing to
+// Redis in READ_ONLY mode, so it fails with a clear message before starting
+func (m *Manager) checkWritable(operation string) error {
+	if m.cfg.ReadOnly {
+		return fmt.Errorf("%s: %w", operation, ErrReadOnly)
+	}
+	return nil
+}
+
+// conn returns a dedicated connection to Redis
+// Connections do not inherit the hooks of the client, so the READ_ONLY hook is added again
+func (m *Manager) conn() *redis.Conn {
+	conn := m.redis.Conn()
+	if m.cfg.ReadOnly {
+		conn.AddHook(newReadOnlyHook(m.cfg.CommandAliases))
+	}
+	return conn
+}
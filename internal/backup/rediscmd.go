@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrCommandDisabled is returned when a Redis command is disabled with
+// rename-command, or renamed without a matching COMMAND_ALIASES entry
+var ErrCommandDisabled = errors.New("redis command disabled")
+
+// disabled reports whether COMMAND_ALIASES marks a command as disabled (empty alias)
+func (m *Manager) disabled(name string) bool {
+	alias, ok := m.cfg.CommandAliases[name]
+	return ok && alias == ""
+}
+
+// commandError tags the error of a command rejected as unknown with
+// ErrCommandDisabled and explains how to fix it
+func commandError(name string, err error) error {
+	if err == nil || errors.Is(err, ErrCommandDisabled) || !isUnknownCommand(err) {
+		return err
+	}
+	return &categorizedError{
+		category: ErrCommandDisabled,
+		err:      fmt.Errorf("%s is disabled or renamed on the server, set its name in COMMAND_ALIASES: %w", name, err),
+	}
+}
+
+// do runs a command under its COMMAND_ALIASES name
+// Commands marked as disabled fail without being sent
+func (m *Manager) do(ctx context.Context, name string, args ...any) *redis.Cmd {
+	if m.disabled(name) {
+		cmd := redis.NewCmd(ctx, name)
+		cmd.SetErr(&categorizedError{
+			category: ErrCommandDisabled,
+			err:      fmt.Errorf("%s is disabled in COMMAND_ALIASES", name),
+		})
+		return cmd
+	}
+
+	cmd := m.redis.Do(ctx, append([]any{m.command(name)}, args...)...)
+	if err := commandError(name, cmd.Err()); err != cmd.Err() {
+		cmd.SetErr(err)
+	}
+	return cmd
+}
+
+// configGet returns the parameters matching a CONFIG GET pattern
+// Both the RESP2 list and the RESP3 map replies are accepted
+func (m *Manager) configGet(ctx context.Context, pattern string) (map[string]string, error) {
+	if m.disabled("CONFIG") {
+		return nil, m.do(ctx, "CONFIG").Err()
+	}
+
+	cmd := redis.NewMapStringStringCmd(ctx, m.command("CONFIG"), "GET", pattern)
+	_ = m.redis.Process(ctx, cmd)
+	result, err := cmd.Result()
+	if err != nil {
+		return nil, commandError("CONFIG", err)
+	}
+	return result, nil
+}
+
+// saveWithoutInfo takes a snapshot when INFO is disabled: the end of BGSAVE
+// is detected by LASTSAVE changing, polled like INFO in waitForBGSAVE
+// A BGSAVE failing in the background cannot be told apart from a slow one,
+// only BGSAVE_TIMEOUT ends the wait then
+func (m *Manager) saveWithoutInfo(ctx context.Context, infoErr error) (bool, error) {
+	log.Printf("Warning: %v, waiting for BGSAVE with LASTSAVE instead", infoErr)
+
+	before, err := m.do(ctx, "LASTSAVE").Int64()
+	if err != nil {
+		return false, fmt.Errorf("INFO and LASTSAVE are both unavailable, the end of BGSAVE cannot be detected: %w", err)
+	}
+
+	saved, err := m.startBGSAVE(ctx)
+	if err != nil {
+		if m.cfg.AOFShipping || !strings.Contains(err.Error(), "already in progress") {
+			return false, err
+		}
+		log.Println("BGSAVE already in progress, waiting...")
+	}
+	if saved {
+		return true, nil
+	}
+
+	err = m.pollSave(ctx, func(waited time.Duration) (bool, error) {
+		last, err := m.do(ctx, "LASTSAVE").Int64()
+		if err != nil {
+			return false, fmt.Errorf("LASTSAVE failed: %w", err)
+		}
+		if last == before {
+			return false, nil
+		}
+		log.Printf("BGSAVE completed (waited %s)", waited.Round(time.Second))
+		return true, nil
+	})
+	return err == nil, err
+}
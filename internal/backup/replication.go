@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/notify"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// newReplica creates the offline manager of REPLICA_STORAGE
+func newReplica(m *Manager) (*Manager, error) {
+	cfg, err := m.cfg.ForReplica()
+	if err != nil {
+		return nil, err
+	}
+	store, err := storage.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize replica storage: %w", err)
+	}
+	return NewOffline(cfg, store)
+}
+
+// startReplication copies the new backups to the replica in the background
+func (m *Manager) startReplication(ctx context.Context) {
+	m.replication.Add(1)
+	go func() {
+		defer m.replication.Done()
+		// The directory of the run is removed when the run ends
+		ctx := context.WithValue(context.WithoutCancel(ctx), workDirKey{}, "")
+		m.replicate(m.work.context(ctx))
+	}()
+}
+
+// replicate copies the backups missing in the replica, oldest first, and
+// alerts when it misses more than REPLICA_MAX_LAG backups
+func (m *Manager) replicate(ctx context.Context) {
+	m.replicating.Lock()
+	defer m.replicating.Unlock()
+
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		log.Printf("Warning: replication skipped, failed to list objects: %v", err)
+		return
+	}
+	replicaObjects, err := m.replica.storage.ListObjects(ctx)
+	if err != nil {
+		log.Printf("Warning: replication skipped, failed to list replica objects: %v", err)
+		return
+	}
+
+	inPrimary := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		inPrimary[obj.Name] = true
+	}
+	inReplica := make(map[string]bool, len(replicaObjects))
+	status := ReplicationStatus{Storage: m.replica.storage.Type()}
+	for _, obj := range replicaObjects {
+		inReplica[obj.Name] = true
+		if storage.IsBackupName(obj.Name) && !inPrimary[obj.Name] {
+			status.ReplicaOnly++
+		}
+	}
+
+	// Backups still being stored are copied by the next replication
+	complete, _ := BackupSets(objects)
+	var missing []storage.ObjectInfo
+	for _, obj := range objects {
+		if slices.Contains(complete, obj.Name) && !inReplica[obj.Name] {
+			missing = append(missing, obj)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Name < missing[j].Name })
+
+	status.Pending = len(missing)
+	for _, obj := range missing {
+		if err := copyBackup(ctx, m.storage, m.replica.storage, objects, obj.Name); err != nil {
+			// The next run retries, in order
+			log.Printf("Warning: failed to replicate %s: %v", obj.Name, err)
+			break
+		}
+		status.Pending--
+		status.LastBackup = obj.Name
+		status.LagSeconds = time.Since(obj.ModTime).Seconds()
+		log.Printf("Replicated %s to %s, %s after its upload", obj.Name, status.Storage, time.Since(obj.ModTime).Round(time.Second))
+	}
+	if status.ReplicaOnly > 0 {
+		log.Printf("Warning: %d backup(s) exist in the replica but not in the primary storage", status.ReplicaOnly)
+	}
+
+	RecordReplication(m.cfg, status)
+	m.checkReplicaLag(ctx, status.Pending)
+}
+
+// checkReplicaLag notifies when the replica starts or stops missing more
+// than REPLICA_MAX_LAG backups
+func (m *Manager) checkReplicaLag(ctx context.Context, pending int) {
+	lagging := pending > m.cfg.ReplicaMaxLag
+	if lagging == m.replicaLagging {
+		if lagging {
+			log.Printf("WARNING: the replica still misses %d backup(s)", pending)
+		}
+		return
+	}
+	m.replicaLagging = lagging
+
+	event := notify.Event{
+		Type:    notify.EventReplicaLagging,
+		Message: fmt.Sprintf("Replica %s misses %d backup(s), more than REPLICA_MAX_LAG (%d)", m.replica.storage.Type(), pending, m.cfg.ReplicaMaxLag),
+		Details: map[string]interface{}{
+			"replica":         m.cfg.ReplicaStorage,
+			"pending_backups": pending,
+			"max_lag":         m.cfg.ReplicaMaxLag,
+		},
+	}
+	if !lagging {
+		event.Type = notify.EventReplicaRecovered
+		event.Message = fmt.Sprintf("Replica %s caught up, %d backup(s) missing", m.replica.storage.Type(), pending)
+	}
+	log.Printf("WARNING: %s", event.Message)
+
+	if err := m.notifier.Notify(ctx, event); err != nil {
+		log.Printf("Warning: failed to send %s notification: %v", event.Type, err)
+	}
+}
+
+// deleteFromReplica deletes backups deleted from the primary storage from the
+// replica too, so retention applies to both
+func (m *Manager) deleteFromReplica(ctx context.Context, backupNames []string, reason, unlock string) {
+	// Wait for a replication in progress, it could copy them again
+	m.replicating.Lock()
+	defer m.replicating.Unlock()
+
+	backups, err := m.replica.storage.List(ctx)
+	if err != nil {
+		log.Printf("Warning: failed to list replica backups: %v", err)
+		return
+	}
+	inReplica := make(map[string]bool, len(backups))
+	for _, name := range backups {
+		inReplica[name] = true
+	}
+
+	var names []string
+	for _, name := range backupNames {
+		if inReplica[name] {
+			names = append(names, name)
+		}
+	}
+	if _, err := m.replica.deleteBackups(ctx, names, reason+" on the replica", unlock); err != nil {
+		log.Printf("Warning: failed to delete from the replica: %v", err)
+	}
+}
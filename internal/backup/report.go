@@ -0,0 +1,213 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// reportPeriods are the periods covered by a report, in days
+var reportPeriods = []int{30, 90}
+
+// maxProjectionDays bounds the projection of the storage usage, a quota
+// reached later is reported as not reached
+const maxProjectionDays = 10 * 365
+
+// Report sums up the trends of the backups of a storage
+type Report struct {
+	Target      string         `json:"target"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	Periods     []ReportPeriod `json:"periods"`
+	Storage     ReportStorage  `json:"storage"`
+}
+
+// ReportPeriod holds the trends over the last days of the run history
+type ReportPeriod struct {
+	Days            int     `json:"days"`
+	Runs            int     `json:"runs"`
+	Failures        int     `json:"failures"`
+	FailureRate     float64 `json:"failure_rate"`
+	AverageDuration float64 `json:"average_duration_seconds"`
+	AverageBytes    int64   `json:"average_backup_bytes"`
+	// SizeGrowth is the trend of the size of the backups, in bytes per day
+	SizeGrowth float64 `json:"size_growth_bytes_per_day"`
+	// SizeBasis is "history" when the sizes come from the run history, or
+	// "catalog" when they come from the stored backups
+	SizeBasis string `json:"size_basis,omitempty"`
+}
+
+// ReportStorage is the usage of the storage and its projection
+type ReportStorage struct {
+	Bytes int64 `json:"bytes"`
+	Quota int64 `json:"quota_bytes,omitempty"`
+	// Growth is the trend of the usage over the first period, in bytes per
+	// day, only known once the run history holds a measure
+	Growth      float64 `json:"growth_bytes_per_day"`
+	GrowthKnown bool    `json:"growth_known"`
+	// FullAt is when the usage reaches STORAGE_QUOTA at the current growth
+	FullAt *time.Time `json:"full_at,omitempty"`
+}
+
+// sizePoint is the size of the backups of a run at a time
+type sizePoint struct {
+	time  time.Time
+	bytes int64
+}
+
+// Report computes the trends of the backups from the run history and, for
+// the sizes of the backups older than the history, the catalog of the storage
+func (m *Manager) Report(ctx context.Context) (*Report, error) {
+	now := time.Now().UTC()
+	longest := reportPeriods[len(reportPeriods)-1]
+	records, err := ReadRunHistory(ctx, m.storage, now.AddDate(0, 0, -longest))
+	if err != nil {
+		return nil, err
+	}
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	catalog := catalogSizes(objects, m.diffSeriesKey())
+
+	report := &Report{Target: m.cfg.Target(), GeneratedAt: now}
+	for _, days := range reportPeriods {
+		report.Periods = append(report.Periods, reportPeriod(records, catalog, now, days))
+	}
+
+	report.Storage.Quota = m.cfg.StorageQuota
+	var usage []sizePoint
+	since := now.AddDate(0, 0, -reportPeriods[0])
+	for _, record := range records {
+		if record.StorageBytes > 0 && !record.Start.Before(since) {
+			usage = append(usage, sizePoint{record.Start, record.StorageBytes})
+		}
+	}
+	for _, obj := range objects {
+		report.Storage.Bytes += obj.Size
+	}
+	usage = append(usage, sizePoint{now, report.Storage.Bytes})
+	if report.Storage.Growth, report.Storage.GrowthKnown = trend(usage); report.Storage.GrowthKnown {
+		free := report.Storage.Quota - report.Storage.Bytes
+		if report.Storage.Quota > 0 && free > 0 && report.Storage.Growth > 0 {
+			if days := float64(free) / report.Storage.Growth; days <= maxProjectionDays {
+				full := now.Add(time.Duration(days * float64(24*time.Hour)))
+				report.Storage.FullAt = &full
+			}
+		}
+	}
+	return report, nil
+}
+
+// reportPeriod computes the trends of the last days
+func reportPeriod(records []RunRecord, catalog []sizePoint, now time.Time, days int) ReportPeriod {
+	since := now.AddDate(0, 0, -days)
+	period := ReportPeriod{Days: days}
+	var duration float64
+	var sizes []sizePoint
+	for _, record := range records {
+		if record.Start.Before(since) {
+			continue
+		}
+		period.Runs++
+		duration += record.Duration
+		if !record.Success {
+			period.Failures++
+		} else if record.Bytes > 0 {
+			sizes = append(sizes, sizePoint{record.Start, record.Bytes})
+		}
+	}
+	if period.Runs > 0 {
+		period.FailureRate = float64(period.Failures) / float64(period.Runs)
+		period.AverageDuration = duration / float64(period.Runs)
+	}
+
+	period.SizeBasis = "history"
+	if len(sizes) < 2 {
+		// No history yet, the backups kept by the retention policy still show a trend
+		sizes = sizes[:0]
+		for _, point := range catalog {
+			if !point.time.Before(since) {
+				sizes = append(sizes, point)
+			}
+		}
+		period.SizeBasis = "catalog"
+	}
+	if len(sizes) == 0 {
+		period.SizeBasis = ""
+		return period
+	}
+	var total int64
+	for _, point := range sizes {
+		total += point.bytes
+	}
+	period.AverageBytes = total / int64(len(sizes))
+	period.SizeGrowth, _ = trend(sizes)
+	return period
+}
+
+// catalogSizes returns the size of the full backups of each run in the
+// storage, summing the databases of split backups, oldest first
+// Differential backups, in the diffKey series, are left out
+func catalogSizes(objects []storage.ObjectInfo, diffKey string) []sizePoint {
+	complete, _ := BackupSets(objects)
+	isComplete := make(map[string]bool, len(complete))
+	for _, name := range complete {
+		isComplete[name] = true
+	}
+
+	runs := make(map[string]*sizePoint)
+	var order []string
+	for _, obj := range objects {
+		series := backupSeries(obj.Name)
+		if !isComplete[obj.Name] || (diffKey != "" && series == diffKey) {
+			continue
+		}
+		// Backups of the same run share their timestamp
+		run := strings.TrimPrefix(obj.Name, series)
+		point, ok := runs[run]
+		if !ok {
+			point = &sizePoint{time: obj.ModTime}
+			runs[run] = point
+			order = append(order, run)
+		}
+		point.bytes += obj.Size
+		if obj.ModTime.Before(point.time) {
+			point.time = obj.ModTime
+		}
+	}
+
+	points := make([]sizePoint, 0, len(order))
+	for _, run := range order {
+		points = append(points, *runs[run])
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].time.Before(points[j].time) })
+	return points
+}
+
+// trend returns the least squares slope of sizes over time, in bytes per
+// day, and whether the points span enough time to compute it
+func trend(points []sizePoint) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	origin := points[0].time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, point := range points {
+		x := point.time.Sub(origin).Hours() / 24
+		y := float64(point.bytes)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(points))
+	denominator := n*sumXX - sumX*sumX
+	if denominator <= 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
@@ -0,0 +1,406 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/rdb"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+	"github.com/redis/go-redis/v9"
+)
+
+// restoreBatchSize is the number of RESTORE commands sent per round trip
+const restoreBatchSize = 100
+
+// Policies for the keys of a restore that already exist in the target
+const (
+	// ConflictReplace overwrites them with RESTORE REPLACE
+	ConflictReplace = "replace"
+	// ConflictSkip keeps them and restores the other keys
+	ConflictSkip = "skip"
+	// ConflictFail stops the restore before the batch holding the first of them
+	ConflictFail = "fail"
+)
+
+// ErrRestoreConflict is returned when a key to restore already exists with
+// the fail conflict policy
+var ErrRestoreConflict = errors.New("key already exists")
+
+// RestoreOptions selects what a restore writes into Redis
+type RestoreOptions struct {
+	// Patterns are glob-style key patterns (as in SCAN MATCH); at least one is required
+	Patterns []string
+
+	// DB is the database keys are restored into, -1 keeps the database of each key
+	DB int
+
+	// Force restores even when the target server is older than the backup
+	Force bool
+
+	// ReplayAOF replays the AOF segments shipped after the backup; it requires the "*" pattern
+	ReplayAOF bool
+
+	// KeysPerSecond and BytesPerSecond limit the RESTORE rate, 0 = unlimited
+	KeysPerSecond  int
+	BytesPerSecond int64
+
+	// Progress is the interval between progress logs, 0 disables them
+	Progress time.Duration
+
+	// Resume continues an interrupted restore from its cursor
+	Resume *RestoreCursor
+
+	// Conflict is the policy for existing keys, ConflictReplace when empty
+	Conflict string
+
+	// Flush empties the target with FLUSHALL before restoring, once every
+	// database is saved in a safety backup; FlushConfirm must be the address
+	// of the target (see FlushTarget)
+	Flush        bool
+	FlushConfirm string
+}
+
+// checkConflict validates the conflict policy of a restore
+func (opts RestoreOptions) checkConflict() error {
+	switch opts.Conflict {
+	case "", ConflictReplace:
+		return nil
+	case ConflictSkip, ConflictFail:
+		if opts.ReplayAOF {
+			return fmt.Errorf("AOF replay overwrites keys, it cannot be combined with the %s conflict policy", opts.Conflict)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid conflict policy %q (supported: replace, skip, fail)", opts.Conflict)
+	}
+}
+
+// RestoreResult summarizes a restore
+type RestoreResult struct {
+	Restored int
+	Expired  int
+	// Skipped counts the existing keys kept by the skip conflict policy
+	Skipped int
+	// Conflicts counts the existing keys that stopped a restore with the fail conflict policy
+	Conflicts int
+	// Deleted counts the keys deleted since the full backup of a differential backup
+	Deleted int
+	// Replayed counts the AOF commands replayed after the backup
+	Replayed int
+	// Bytes is the size of the RDB data read
+	Bytes int64
+	// Cursor resumes an interrupted restore, nil once the backup files are restored
+	Cursor *RestoreCursor
+}
+
+// Restore replays the keys of a backup matching the options into Redis with RESTORE REPLACE
+// Full snapshots, split (per-database) and differential backups are supported
+func (m *Manager) Restore(ctx context.Context, backupName string, opts RestoreOptions) (result RestoreResult, err error) {
+	start := time.Now()
+	defer func() {
+		if err == nil && measurable(opts) {
+			m.recordRestore(ctx, backupName, result, time.Since(start))
+		}
+		m.audit(ctx, "restore", backupName, m.restoreDetails(opts, result), err)
+	}()
+
+	if err := m.checkWritable("restore"); err != nil {
+		return RestoreResult{}, err
+	}
+	if len(opts.Patterns) == 0 {
+		return RestoreResult{}, errors.New("at least one key pattern is required")
+	}
+	if opts.ReplayAOF && !slices.Contains(opts.Patterns, "*") {
+		return RestoreResult{}, errors.New("AOF replay restores every key, use the \"*\" pattern")
+	}
+	if err := opts.checkConflict(); err != nil {
+		return RestoreResult{}, err
+	}
+	if err := m.checkFlush(opts); err != nil {
+		return RestoreResult{}, err
+	}
+
+	if err := m.checkSet(ctx, backupName); err != nil {
+		return RestoreResult{}, err
+	}
+	manifest, err := LoadManifest(ctx, m.storage, backupName, m.keyring)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return RestoreResult{}, err
+	}
+	if opts.ReplayAOF && (manifest == nil || manifest.AOFMarker == "") {
+		return RestoreResult{}, fmt.Errorf("%s has no AOF marker, it was not taken with AOF_SHIPPING", backupName)
+	}
+	if opts.Resume != nil && opts.Resume.Backup != backupName && (manifest == nil || manifest.Base != opts.Resume.Backup) {
+		return RestoreResult{}, fmt.Errorf("the resume token is for %s, not %s", opts.Resume.Backup, backupName)
+	}
+
+	isDiff := manifest != nil && manifest.Type == manifestTypeDiff
+	if isDiff && opts.Conflict != "" && opts.Conflict != ConflictReplace {
+		// The changed keys overwrite the keys of the full backup
+		return RestoreResult{}, fmt.Errorf("%s is a differential backup, which only supports the replace conflict policy", backupName)
+	}
+
+	if opts.Flush {
+		// A backup the target cannot load must be refused before flushing
+		if manifest != nil && manifest.RDBVersion > 0 {
+			if err := m.checkRestoreCompatibility(ctx, manifest.RDBVersion, opts.Force); err != nil {
+				return RestoreResult{}, err
+			}
+		}
+		if err := m.flushTarget(ctx, backupName); err != nil {
+			return RestoreResult{}, err
+		}
+	}
+
+	if isDiff {
+		result, err = m.restoreDiff(ctx, manifest, opts)
+	} else {
+		result, err = m.restoreBackup(ctx, backupName, opts)
+	}
+	if err != nil || !opts.ReplayAOF {
+		return result, err
+	}
+
+	result.Replayed, err = m.replayAOF(ctx, backupName, manifest.AOFMarker, opts)
+	return result, err
+}
+
+// restoreDetails describes a restore in the audit log
+func (m *Manager) restoreDetails(opts RestoreOptions, result RestoreResult) string {
+	details := fmt.Sprintf("into %s, keys %s, %d restored", m.cfg.Target(), strings.Join(opts.Patterns, " "), result.Restored)
+	if opts.Conflict != "" {
+		details += fmt.Sprintf(", on conflict %s: %d skipped, %d conflicts", opts.Conflict, result.Skipped, result.Conflicts)
+	}
+	return details
+}
+
+// restoreBackup restores the keys of a single backup file
+func (m *Manager) restoreBackup(ctx context.Context, backupName string, opts RestoreOptions) (RestoreResult, error) {
+	tmp, _, err := m.downloadVerified(ctx, backupName)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	defer removeTemp(tmp)
+	return m.restoreFile(ctx, tmp, backupName, opts)
+}
+
+// restoreFile restores the keys of a decoded backup file
+func (m *Manager) restoreFile(ctx context.Context, tmp *os.File, name string, opts RestoreOptions) (RestoreResult, error) {
+	stat, err := tmp.Stat()
+	if err != nil {
+		return RestoreResult{}, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	version, err := rdb.ReadVersion(tmp)
+	if err != nil {
+		return RestoreResult{}, fmt.Errorf("failed to read backup: %w", err)
+	}
+	if err := m.checkRestoreCompatibility(ctx, version, opts.Force); err != nil {
+		return RestoreResult{}, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return RestoreResult{}, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	result, err := m.restoreRDB(ctx, tmp, name, stat.Size(), opts)
+	result.Bytes = stat.Size()
+	return result, err
+}
+
+// restoreRDB reads an RDB stream and restores the matching keys
+// On failure, the result holds the cursor to resume from, if any key was restored
+func (m *Manager) restoreRDB(ctx context.Context, r io.Reader, name string, size int64, opts RestoreOptions) (result RestoreResult, err error) {
+	conn := m.conn()
+	defer conn.Close()
+
+	var skip int64
+	if opts.Resume != nil && opts.Resume.Backup == name {
+		skip = opts.Resume.Entries
+		log.Printf("Resuming the restore of %s after %d entries", name, skip)
+	}
+
+	counter := &countingReader{r: r}
+	reader := rdb.NewReader(counter)
+	batchSize := restoreBatchSize
+	if opts.KeysPerSecond > 0 && opts.KeysPerSecond < batchSize {
+		batchSize = opts.KeysPerSecond
+	}
+	batch := make([]*rdb.Entry, 0, batchSize)
+	// batchEnd is the number of entries read up to the last of the batch
+	var batchBytes, batchEnd int64
+	db := -1
+	throttle := newThrottle(opts)
+	progress := newRestoreProgress(name, size, opts.Progress)
+
+	var entries int64
+	cursor := opts.Resume
+	defer func() {
+		if err != nil && cursor != nil && cursor.Backup == name {
+			result.Cursor = cursor
+		}
+	}()
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if batch[0].DB != db {
+			if err := conn.Select(ctx, batch[0].DB).Err(); err != nil {
+				return fmt.Errorf("failed to select database %d: %w", batch[0].DB, err)
+			}
+			db = batch[0].DB
+		}
+
+		restored, err := restoreEntries(ctx, conn, batch, reader.Version(), opts.Conflict, &result)
+		if err != nil {
+			return err
+		}
+		cursor = &RestoreCursor{Backup: name, Entries: batchEnd, Key: batch[len(batch)-1].Key}
+		progress.update(result.Restored, counter.n, cursor)
+		if err := throttle.wait(ctx, restored, batchBytes); err != nil {
+			return err
+		}
+		batch, batchBytes = batch[:0], 0
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	for {
+		entry, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read backup: %w", err)
+		}
+		entries++
+		if entries < skip {
+			continue
+		}
+		if entries == skip {
+			if entry.Key != opts.Resume.Key {
+				cursor = nil
+				return result, fmt.Errorf("the resume token does not match %s: entry %d is %q, not %q", name, skip, entry.Key, opts.Resume.Key)
+			}
+			continue
+		}
+
+		if !matchAny(opts.Patterns, entry.Key) {
+			continue
+		}
+		if opts.DB >= 0 {
+			entry.DB = opts.DB
+		}
+		if entry.ExpireAt > 0 && entry.ExpireAt <= now {
+			result.Expired++
+			continue
+		}
+
+		if len(batch) > 0 && (batch[0].DB != entry.DB || len(batch) == batchSize) {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+		batch = append(batch, entry)
+		batchBytes += int64(len(entry.Value))
+		batchEnd = entries
+	}
+	if entries < skip {
+		cursor = nil
+		return result, fmt.Errorf("the resume token does not match %s: it has %d entries, not %d", name, entries, skip)
+	}
+
+	if err := flush(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// restoreEntries sends RESTORE for a batch of keys of the selected database,
+// handling the keys that already exist with the conflict policy, and returns
+// how many were restored
+// With the fail policy, existing keys are looked up with EXISTS first to fail
+// before writing any key of the batch; the other policies need no lookup
+func restoreEntries(ctx context.Context, conn *redis.Conn, entries []*rdb.Entry, version int, policy string, result *RestoreResult) (int, error) {
+	if policy == ConflictFail {
+		cmds, err := conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, entry := range entries {
+				pipe.Exists(ctx, entry.Key)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to check existing keys: %w", err)
+		}
+		var first string
+		for i, cmd := range cmds {
+			if cmd.(*redis.IntCmd).Val() > 0 {
+				if first == "" {
+					first = entries[i].Key
+				}
+				result.Conflicts++
+			}
+		}
+		if first != "" {
+			return 0, fmt.Errorf("%w: %q in db %d (%d key(s) of the batch exist)", ErrRestoreConflict, first, entries[0].DB, result.Conflicts)
+		}
+	}
+
+	cmds, err := conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, entry := range entries {
+			args := []interface{}{"RESTORE", entry.Key, entry.ExpireAt, entry.Payload(version)}
+			if policy == "" || policy == ConflictReplace {
+				args = append(args, "REPLACE")
+			}
+			if entry.ExpireAt > 0 {
+				args = append(args, "ABSTTL")
+			}
+			pipe.Do(ctx, args...)
+		}
+		return nil
+	})
+
+	restored := 0
+	for i, cmd := range cmds {
+		switch err := cmd.Err(); {
+		case err == nil:
+			restored++
+			result.Restored++
+		case isBusyKey(err) && policy == ConflictSkip:
+			result.Skipped++
+		case isBusyKey(err):
+			// Created since it was looked up
+			result.Conflicts++
+			return restored, fmt.Errorf("%w: %q in db %d", ErrRestoreConflict, entries[i].Key, entries[i].DB)
+		default:
+			return restored, fmt.Errorf("RESTORE failed for key %q: %w", entries[i].Key, err)
+		}
+	}
+	if err != nil && len(cmds) == 0 {
+		return restored, fmt.Errorf("RESTORE failed: %w", err)
+	}
+	return restored, nil
+}
+
+// isBusyKey reports whether RESTORE failed because the key exists
+func isBusyKey(err error) bool {
+	var redisErr redis.Error
+	return errors.As(err, &redisErr) && strings.HasPrefix(redisErr.Error(), "BUSYKEY")
+}
+
+// matchAny reports whether key matches one of the patterns
+func matchAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+)
+
+// RestoreCursor is the position of an interrupted restore in a backup file:
+// the number of entries read up to the last restored key (0 and no key for
+// the start of the file)
+// RESTORE REPLACE is idempotent, so keys restored after it are written again
+type RestoreCursor struct {
+	Backup  string `json:"backup"`
+	Entries int64  `json:"entries"`
+	Key     string `json:"key"`
+}
+
+// Token encodes the cursor for the -resume flag
+func (c *RestoreCursor) Token() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseRestoreCursor decodes a cursor from its token
+func ParseRestoreCursor(token string) (*RestoreCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resume token: %w", err)
+	}
+	var cursor RestoreCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid resume token: %w", err)
+	}
+	if cursor.Backup == "" || cursor.Entries < 0 {
+		return nil, errors.New("invalid resume token: no position")
+	}
+	return &cursor, nil
+}
+
+// throttle paces a restore under the keys and bytes per second limits
+type throttle struct {
+	keysPerSecond  float64
+	bytesPerSecond float64
+	start          time.Time
+	keys           int64
+	bytes          int64
+}
+
+func newThrottle(opts RestoreOptions) *throttle {
+	return &throttle{
+		keysPerSecond:  float64(opts.KeysPerSecond),
+		bytesPerSecond: float64(opts.BytesPerSecond),
+		start:          time.Now(),
+	}
+}
+
+// wait accounts for restored keys and sleeps until the limits allow more
+func (t *throttle) wait(ctx context.Context, keys int, bytes int64) error {
+	t.keys += int64(keys)
+	t.bytes += bytes
+
+	var due time.Duration
+	if t.keysPerSecond > 0 {
+		due = max(due, time.Duration(float64(t.keys)/t.keysPerSecond*float64(time.Second)))
+	}
+	if t.bytesPerSecond > 0 {
+		due = max(due, time.Duration(float64(t.bytes)/t.bytesPerSecond*float64(time.Second)))
+	}
+	delay := due - time.Since(t.start)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// restoreProgress logs the progress of a restore every interval
+type restoreProgress struct {
+	name     string
+	total    int64
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+}
+
+func newRestoreProgress(name string, total int64, interval time.Duration) *restoreProgress {
+	now := time.Now()
+	return &restoreProgress{name: name, total: total, interval: interval, start: now, last: now}
+}
+
+// update logs the progress when the interval has elapsed since the last log
+func (p *restoreProgress) update(restored int, read int64, cursor *RestoreCursor) {
+	if p.interval <= 0 || time.Since(p.last) < p.interval {
+		return
+	}
+	p.last = time.Now()
+
+	percent := ""
+	if p.total > 0 {
+		percent = fmt.Sprintf(" (%.1f%%)", float64(min(read, p.total))*100/float64(p.total))
+	}
+	rate := float64(restored) / time.Since(p.start).Seconds()
+	log.Printf("Restoring %s: %d key(s) restored, %s of %s read%s, %.0f keys/s, resume token %s",
+		p.name, restored, config.FormatSize(read), config.FormatSize(p.total), percent, rate, cursor.Token())
+}
@@ -0,0 +1,120 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/rdb"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// streamName is the name given to a streamed backup whose name is unknown
+const streamName = "stdin.rdb"
+
+// RestoreStream restores the keys of a backup read from r (e.g. piped on
+// stdin) without going through the storage
+// The suffixes of name tell how the backup was compressed and encrypted, like
+// for a stored backup; without a name, gzip compression and the built-in
+// encryption are detected from the header
+func (m *Manager) RestoreStream(ctx context.Context, r io.Reader, name string, opts RestoreOptions) (result RestoreResult, err error) {
+	target := name
+	if target == "" {
+		target = "stdin"
+	}
+	start := time.Now()
+	defer func() {
+		if err == nil && measurable(opts) {
+			m.recordRestore(ctx, target, result, time.Since(start))
+		}
+		m.audit(ctx, "restore", target, m.restoreDetails(opts, result), err)
+	}()
+
+	if err := m.checkWritable("restore"); err != nil {
+		return RestoreResult{}, err
+	}
+	if len(opts.Patterns) == 0 {
+		return RestoreResult{}, errors.New("at least one key pattern is required")
+	}
+	if opts.ReplayAOF {
+		return RestoreResult{}, errors.New("AOF replay needs the segments of a stored backup")
+	}
+	if err := opts.checkConflict(); err != nil {
+		return RestoreResult{}, err
+	}
+	if err := m.checkFlush(opts); err != nil {
+		return RestoreResult{}, err
+	}
+	if name != "" && !storage.IsBackupName(name) {
+		return RestoreResult{}, fmt.Errorf("%s is not a backup name, e.g. %s.gz", name, streamName)
+	}
+
+	tmp, err := m.createTemp(ctx, "redis-restore-*.rdb")
+	if err != nil {
+		return RestoreResult{}, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	buf := bufio.NewWriter(tmp)
+	n, err := io.Copy(buf, r)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil && n == 0 {
+		err = errors.New("no data received")
+	}
+	if err != nil {
+		removeTemp(tmp)
+		return RestoreResult{}, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	if name == "" {
+		if name, err = detectStreamName(tmp); err != nil {
+			removeTemp(tmp)
+			return RestoreResult{}, fmt.Errorf("failed to read backup: %w", err)
+		}
+	}
+	tmp, err = m.decodeBackup(ctx, tmp, name)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	defer removeTemp(tmp)
+
+	if opts.Flush {
+		version, err := rdb.ReadVersion(tmp)
+		if err != nil {
+			return RestoreResult{}, fmt.Errorf("failed to read backup: %w", err)
+		}
+		if err := m.checkRestoreCompatibility(ctx, version, opts.Force); err != nil {
+			return RestoreResult{}, err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return RestoreResult{}, fmt.Errorf("failed to read backup: %w", err)
+		}
+		if err := m.flushTarget(ctx, target); err != nil {
+			return RestoreResult{}, err
+		}
+	}
+	return m.restoreFile(ctx, tmp, target, opts)
+}
+
+// detectStreamName names a streamed backup after its header, adding the .gz
+// suffix to gzip-compressed backups, and rewinds it
+func detectStreamName(file io.ReadSeeker) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	header := make([]byte, 2)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if n == 2 && header[0] == 0x1f && header[1] == 0x8b {
+		return streamName + ".gz", nil
+	}
+	return streamName, nil
+}
@@ -0,0 +1,310 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/notify"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// backupSeries returns the series part of a backup name (everything before the timestamp)
+func backupSeries(backupName string) string {
+	series, _, _ := strings.Cut(backupName, "_")
+	return series
+}
+
+// applyRetention removes old backups beyond retention count, then the oldest
+// backups while the volume has less than RETENTION_MIN_FREE free
+// The retention count applies to each backup series separately
+func (m *Manager) applyRetention(ctx context.Context) error {
+	if m.cfg.RetentionCount > 0 {
+		log.Printf("Applying retention policy (keeping %d backups)...", m.cfg.RetentionCount)
+
+		backups, err := m.listBackups(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list backups: %w", err)
+		}
+
+		deleted, err := m.deleteBackups(ctx, m.retentionPlan(ctx, backups), "retention", m.cfg.ComplianceUnlockToken)
+		if err != nil {
+			log.Printf("Warning: old backups kept: %v", err)
+		}
+
+		log.Printf("Retention policy applied, deleted %d old backup(s)", deleted)
+	}
+
+	if m.cfg.RetentionMinFree > 0 {
+		if err := m.applyFreeSpaceRetention(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retentionPlan returns the backups the retention policy removes from a list sorted oldest first
+func (m *Manager) retentionPlan(ctx context.Context, backups []string) []string {
+	// Differential backups are not counted: they are removed with their full backup
+	diffKey := m.diffSeriesKey()
+	pinned, diffs, err := m.retentionScope(ctx, backups)
+	if err != nil {
+		log.Printf("Warning: %v, no backup will be deleted", err)
+		return nil
+	}
+
+	// Group backups by series (list is sorted oldest first)
+	// Pinned backups are kept and not counted
+	series := make(map[string][]string)
+	var order []string
+	kept := 0
+	for _, backup := range backups {
+		key := backupSeries(backup)
+		if key == diffKey {
+			continue
+		}
+		if pinned[backup] {
+			kept++
+			continue
+		}
+		if _, ok := series[key]; !ok {
+			order = append(order, key)
+		}
+		series[key] = append(series[key], backup)
+	}
+
+	var toDelete []string
+	for _, key := range order {
+		group := series[key]
+		if len(group) <= m.cfg.RetentionCount {
+			log.Printf("Current backup count for %s (%d) within retention limit", key, len(group))
+			continue
+		}
+
+		// Delete oldest backups of the series
+		toDelete = append(toDelete, group[:len(group)-m.cfg.RetentionCount]...)
+	}
+
+	if kept > 0 {
+		log.Printf("Keeping %d pinned backup(s)", kept)
+	}
+
+	for _, diff := range m.orphanedDiffs(ctx, backups, toDelete, diffs) {
+		if !pinned[diff] {
+			toDelete = append(toDelete, diff)
+		}
+	}
+	return toDelete
+}
+
+// diffSeriesKey returns the series of differential backups, empty when they are disabled
+func (m *Manager) diffSeriesKey() string {
+	if !m.cfg.BackupDifferential {
+		return ""
+	}
+	return backupSeries(m.backupNameAt(diffSeries, time.Now()))
+}
+
+// retentionScope returns the pinned backups and the differential backups
+// among backups
+// The full backup of a pinned differential backup is pinned too, it cannot
+// be restored without it
+func (m *Manager) retentionScope(ctx context.Context, backups []string) (map[string]bool, []string, error) {
+	pinned, err := m.pinnedBackups(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	diffKey := m.diffSeriesKey()
+	var diffs, pinnedDiffs []string
+	for _, backup := range backups {
+		if diffKey == "" || backupSeries(backup) != diffKey {
+			continue
+		}
+		diffs = append(diffs, backup)
+		if pinned[backup] {
+			pinnedDiffs = append(pinnedDiffs, backup)
+		}
+	}
+	for _, base := range m.diffBases(ctx, pinnedDiffs) {
+		if base != "" {
+			pinned[base] = true
+		}
+	}
+	return pinned, diffs, nil
+}
+
+// orphanedDiffs returns the differential backups whose full backup is being
+// deleted or no longer exists
+func (m *Manager) orphanedDiffs(ctx context.Context, backups, toDelete, diffs []string) []string {
+	if len(diffs) == 0 {
+		return nil
+	}
+
+	kept := make(map[string]bool, len(backups))
+	for _, backup := range backups {
+		kept[backup] = true
+	}
+	for _, backup := range toDelete {
+		delete(kept, backup)
+	}
+
+	var orphaned []string
+	for diff, base := range m.diffBases(ctx, diffs) {
+		if base != "" && !kept[base] {
+			orphaned = append(orphaned, diff)
+		}
+	}
+	sort.Strings(orphaned)
+	return orphaned
+}
+
+// notifyDeleted sends the list of the backups deleted together, e.g. by a
+// retention run, as one backups_deleted event
+func (m *Manager) notifyDeleted(ctx context.Context, deleted []string, reason string) {
+	err := m.notifier.Notify(ctx, notify.Event{
+		Type:    notify.EventBackupsDeleted,
+		Message: fmt.Sprintf("%d backup(s) deleted from %s (%s)", len(deleted), m.storage.Type(), reason),
+		Details: map[string]interface{}{
+			"backups": deleted,
+			"reason":  reason,
+			"storage": m.storage.Type(),
+		},
+	})
+	if err != nil {
+		log.Printf("Warning: failed to send %s notification: %v", notify.EventBackupsDeleted, err)
+	}
+}
+
+// deleteBackups removes backups and their sidecars, returning how many backups were deleted
+// The set manifests are deleted first, so a backup is never used half deleted
+// Storages with a batch API delete everything in as few requests as possible
+// In compliance mode, unlock must be the unlock token and every deletion is audited
+func (m *Manager) deleteBackups(ctx context.Context, backupNames []string, reason, unlock string) (int, error) {
+	if len(backupNames) == 0 {
+		return 0, nil
+	}
+
+	if err := m.checkUnlock(unlock); err != nil {
+		refused := make(map[string]error, len(backupNames))
+		for _, name := range backupNames {
+			refused[name] = err
+		}
+		if auditErr := m.auditDeletes(ctx, backupNames, reason, "refused", refused); auditErr != nil {
+			log.Printf("Warning: %v", auditErr)
+		}
+		return 0, err
+	}
+	// In compliance mode, nothing is deleted unless the deletions can be audited
+	if m.cfg.ComplianceMode {
+		if err := m.auditDeletes(ctx, backupNames, reason, "started", nil); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, name := range backupNames {
+		log.Printf("Deleting backup %s (%s)", name, reason)
+	}
+
+	// AOF segments shipped after each backup go with it
+	var objects []storage.ObjectInfo
+	if m.cfg.AOFShipping {
+		var err error
+		if objects, err = m.storage.ListObjects(ctx); err != nil {
+			log.Printf("Warning: failed to list AOF segments: %v", err)
+		}
+	}
+
+	failed := make(map[string]error)
+	batch, ok := m.storage.(storage.BatchDeleter)
+	if !ok {
+		for _, name := range backupNames {
+			// Without its set manifest, a backup left half deleted is not used
+			if err := m.storage.Delete(ctx, name+setSuffix); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Warning: failed to delete %s: %v", name+setSuffix, err)
+				failed[name] = err
+				continue
+			}
+			if err := m.storage.Delete(ctx, name); err != nil {
+				log.Printf("Warning: failed to delete %s: %v", name, err)
+				failed[name] = err
+				continue
+			}
+			m.deleteSidecars(ctx, name)
+			// The pin of a backup deleted once it expired
+			if err := m.storage.Delete(ctx, name+pinSuffix); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Warning: failed to delete %s: %v", name+pinSuffix, err)
+			}
+			for _, segment := range aofSegments(objects, name) {
+				if err := m.storage.Delete(ctx, segment); err != nil {
+					log.Printf("Warning: failed to delete %s: %v", segment, err)
+				}
+			}
+		}
+	} else {
+		sets := make([]string, 0, len(backupNames))
+		for _, name := range backupNames {
+			sets = append(sets, name+setSuffix)
+		}
+		for set, err := range batch.DeleteBatch(ctx, sets) {
+			if !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Warning: failed to delete %s: %v", set, err)
+				failed[strings.TrimSuffix(set, setSuffix)] = err
+			}
+		}
+
+		var backups []string
+		for _, name := range backupNames {
+			if _, ok := failed[name]; !ok {
+				backups = append(backups, name)
+			}
+		}
+		for name, err := range batch.DeleteBatch(ctx, backups) {
+			log.Printf("Warning: failed to delete %s: %v", name, err)
+			failed[name] = err
+		}
+
+		// Sidecars, pins and AOF segments only go once their backup is gone,
+		// so a backup that failed to delete keeps its manifest, signature and pin
+		var names []string
+		for _, name := range backups {
+			if _, ok := failed[name]; ok {
+				continue
+			}
+			for _, suffix := range sidecarSuffixes {
+				names = append(names, name+suffix)
+			}
+			// The pin of a backup deleted once it expired
+			names = append(names, name+pinSuffix)
+			names = append(names, aofSegments(objects, name)...)
+		}
+		for name, err := range batch.DeleteBatch(ctx, names) {
+			// Sidecars only exist when their feature was enabled
+			if !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Warning: failed to delete %s: %v", name, err)
+			}
+		}
+	}
+
+	if err := m.auditDeletes(ctx, backupNames, reason, "success", failed); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	var deleted []string
+	for _, name := range backupNames {
+		if _, ok := failed[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+	if len(deleted) > 0 {
+		m.notifyDeleted(ctx, deleted, reason)
+	}
+	if m.replica != nil {
+		m.deleteFromReplica(ctx, deleted, reason, unlock)
+	}
+	return len(backupNames) - len(failed), nil
+}
@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/redisinfo"
+)
+
+// logSavePoints logs the save points of the server, which may already write
+// snapshots on their own
+func (m *Manager) logSavePoints(ctx context.Context) {
+	result, err := m.configGet(ctx, "save")
+	if err != nil {
+		return
+	}
+	save, ok := result["save"]
+	if !ok {
+		return
+	}
+	if strings.TrimSpace(save) == "" {
+		log.Println("Redis save points: none, snapshots are only written by backups")
+		return
+	}
+
+	fields := strings.Fields(save)
+	points := make([]string, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		points = append(points, fmt.Sprintf("%s change(s) in %ss", fields[i+1], fields[i]))
+	}
+	log.Printf("Redis save points: %s", strings.Join(points, ", "))
+}
+
+// rdbFileTolerance is how much older than the last save its file may be: the
+// file is written before the save is stamped, and the skew is an estimate
+const rdbFileTolerance = time.Minute
+
+// reusableSnapshot reports whether the RDB file of the last save is recent
+// enough to be uploaded without a new BGSAVE (RDB_REUSE_MAX_AGE), and why
+// After a restart from the AOF, INFO reports a recent save without changes
+// while the file can be days old, so the file itself must be as recent
+func (m *Manager) reusableSnapshot(ctx context.Context, info *redisinfo.Info) (bool, string) {
+	if m.cfg.RDBReuseMaxAge <= 0 || m.cfg.AOFShipping || m.engine == EngineDragonfly {
+		return false, ""
+	}
+	// The file in the container cannot be checked without copying it
+	if m.cfg.RDBSource == "docker" {
+		return false, ""
+	}
+	if info.LastBGSAVEStatus() != "ok" {
+		return false, ""
+	}
+	lastSave := info.LastSaveTime()
+	if lastSave.IsZero() {
+		return false, ""
+	}
+
+	// The last save is stamped by the Redis clock
+	savedAt := lastSave.Add(-m.clockSkew)
+	age := time.Since(savedAt).Round(time.Second)
+	if age > time.Duration(m.cfg.RDBReuseMaxAge)*time.Second {
+		return false, ""
+	}
+
+	rdbFile, err := m.rdbFileName(ctx)
+	if err != nil {
+		return false, ""
+	}
+	stat, err := os.Stat(filepath.Join(m.cfg.RedisDataPath, rdbFile))
+	if err != nil {
+		return false, ""
+	}
+	if stat.ModTime().Before(savedAt.Add(-rdbFileTolerance)) {
+		log.Printf("Not reusing %s: written %s, before the last save %s ago", rdbFile, stat.ModTime().Format(time.RFC3339), age)
+		return false, ""
+	}
+
+	return true, fmt.Sprintf("last save %s ago, within RDB_REUSE_MAX_AGE (%ds)", age, m.cfg.RDBReuseMaxAge)
+}
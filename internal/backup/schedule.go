@@ -0,0 +1,181 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+)
+
+// Bounds of the number of runs listed by the schedule
+const (
+	DefaultScheduleRuns = 20
+	maxScheduleRuns     = 1000
+)
+
+// ScheduledRun is an upcoming run of BACKUP_CRON
+type ScheduledRun struct {
+	Start time.Time `json:"start"`
+	// End is the latest the run may last, see runWindow
+	End     time.Time `json:"end"`
+	Targets []string  `json:"targets"`
+}
+
+// Schedule returns the next count runs of BACKUP_CRON after from, each backing
+// up every target
+func Schedule(cfg *config.Config, from time.Time, count int, targets []string) ([]ScheduledRun, error) {
+	schedule, err := config.CronParser.Parse(cfg.BackupCron)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BACKUP_CRON %q: %w", cfg.BackupCron, err)
+	}
+	if count < 1 || count > maxScheduleRuns {
+		return nil, fmt.Errorf("the number of runs must be between 1 and %d", maxScheduleRuns)
+	}
+
+	window := runWindow(cfg)
+	runs := make([]ScheduledRun, 0, count)
+	next := from
+	for len(runs) < count {
+		next = schedule.Next(next)
+		if next.IsZero() {
+			// The expression has no more occurrences (e.g. February 30)
+			break
+		}
+		runs = append(runs, ScheduledRun{
+			Start:   next.UTC(),
+			End:     next.Add(window).UTC(),
+			Targets: targets,
+		})
+	}
+	return runs, nil
+}
+
+// runWindow is the time a run may last: MAX_BACKUP_DURATION, or without it
+// the longest run recorded by this process, at least a minute
+func runWindow(cfg *config.Config) time.Duration {
+	if cfg.MaxBackupDuration > 0 {
+		return time.Duration(cfg.MaxBackupDuration) * time.Second
+	}
+	window := time.Minute
+	for _, status := range Statuses() {
+		for _, run := range status.History {
+			if duration := time.Duration(run.Duration * float64(time.Second)); duration > window {
+				window = duration
+			}
+		}
+	}
+	return window.Round(time.Minute)
+}
+
+// WriteICal writes the runs as an iCalendar (RFC 5545) with one event per run
+func WriteICal(w io.Writer, runs []ScheduledRun, now time.Time) error {
+	const stamp = "20060102T150405Z"
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//ermos//redis-backup//EN",
+		"CALSCALE:GREGORIAN",
+		"X-WR-CALNAME:Redis backups",
+	}
+	for _, run := range runs {
+		summary := "Redis backup"
+		if len(run.Targets) == 1 {
+			summary += " of " + run.Targets[0]
+		} else if len(run.Targets) > 1 {
+			summary += fmt.Sprintf(" (%d targets)", len(run.Targets))
+		}
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:%d@redis-backup", run.Start.Unix()),
+			"DTSTAMP:"+now.UTC().Format(stamp),
+			"DTSTART:"+run.Start.UTC().Format(stamp),
+			"DTEND:"+run.End.UTC().Format(stamp),
+			"SUMMARY:"+icalText(summary),
+		)
+		if len(run.Targets) > 0 {
+			lines = append(lines, "DESCRIPTION:"+icalText("Targets: "+strings.Join(run.Targets, ", ")))
+		}
+		lines = append(lines, "TRANSP:OPAQUE", "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(icalFold(line))
+		b.WriteString("\r\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// icalText escapes a TEXT value of an iCalendar property
+func icalText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(text)
+}
+
+// icalFold folds a content line longer than 75 octets, continuation lines
+// starting with a space
+func icalFold(line string) string {
+	const limit = 75
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > limit {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	return b.String()
+}
+
+// ScheduleHandler serves the next runs as JSON, or as an iCalendar when the
+// path ends with .ics; ?count= sets the number of runs
+// targets lists the targets backed up on each run
+func ScheduleHandler(cfg *config.Config, targets func(ctx context.Context) ([]string, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := DefaultScheduleRuns
+		if value := r.URL.Query().Get("count"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "invalid count", http.StatusBadRequest)
+				return
+			}
+			count = n
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		names, err := targets(ctx)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list targets: %v", err), http.StatusBadGateway)
+			return
+		}
+		now := time.Now()
+		runs, err := Schedule(cfg, now, count, names)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, ".ics") {
+			w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+			err = WriteICal(w, runs, now)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(runs)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to encode schedule: %v", err)
+		}
+	})
+}
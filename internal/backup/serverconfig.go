@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serverConfigSuffix is appended to a backup name for its CONFIG/ACL sidecar
+const serverConfigSuffix = ".config.json"
+
+// redactedValue replaces sensitive configuration values
+const redactedValue = "[REDACTED]"
+
+// sensitiveConfigKeys lists CONFIG parameters that hold secrets
+var sensitiveConfigKeys = map[string]bool{
+	"requirepass":               true,
+	"masterauth":                true,
+	"tls-key-file-pass":         true,
+	"tls-client-key-file-pass":  true,
+	"sentinel-auth-pass":        true,
+	"sentinel-sentinel-pass":    true,
+	"cluster-announce-password": true,
+}
+
+// serverConfig is the content of the CONFIG/ACL sidecar
+type serverConfig struct {
+	CapturedAt time.Time         `json:"captured_at"`
+	Config     map[string]string `json:"config,omitempty"`
+	ACL        []string          `json:"acl,omitempty"`
+}
+
+// backupServerConfig stores the sanitized CONFIG GET * and ACL LIST output next to a backup
+// ACL rules only contain password hashes, never plaintext passwords
+func (m *Manager) backupServerConfig(ctx context.Context, backupName string) error {
+	snapshot := serverConfig{CapturedAt: time.Now().UTC()}
+
+	cfg, err := m.configGet(ctx, "*")
+	if err != nil {
+		if !errors.Is(err, ErrCommandDisabled) {
+			return fmt.Errorf("CONFIG GET failed: %w", err)
+		}
+		log.Println("Warning: CONFIG command not available, server configuration not captured")
+	} else {
+		snapshot.Config = sanitizeConfig(cfg)
+	}
+
+	acl, err := m.redis.Do(ctx, "ACL", "LIST").StringSlice()
+	if err != nil {
+		if !isUnknownCommand(err) {
+			return fmt.Errorf("ACL LIST failed: %w", err)
+		}
+		log.Println("Warning: ACL command not available (Redis >= 6.0 required), users not captured")
+	} else {
+		sort.Strings(acl)
+		snapshot.ACL = acl
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode server configuration: %w", err)
+	}
+
+	sidecarName := backupName + serverConfigSuffix
+	if err := m.uploadSidecar(ctx, sidecarName, data); err != nil {
+		return err
+	}
+
+	log.Printf("Server configuration captured: %s", sidecarName)
+	return nil
+}
+
+// sanitizeConfig redacts secrets from a CONFIG GET result
+func sanitizeConfig(cfg map[string]string) map[string]string {
+	sanitized := make(map[string]string, len(cfg))
+	for key, value := range cfg {
+		if value != "" && (sensitiveConfigKeys[key] || strings.Contains(key, "password")) {
+			value = redactedValue
+		}
+		sanitized[key] = value
+	}
+	return sanitized
+}
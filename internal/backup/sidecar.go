@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ermos/docker-redis-backup/internal/crypt"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// sidecarSuffixes lists the extra objects that may be stored next to a backup
+// They are removed together with the backup by the retention policy
+var sidecarSuffixes = []string{
+	manifestSuffix,
+	functionsSuffix,
+	serverConfigSuffix,
+	keyIndexSuffix,
+	deletedKeysSuffix,
+	crypt.MinisignSuffix,
+	crypt.CosignSuffix,
+}
+
+// backupSidecars stores the optional extra objects for a completed backup
+// Failures are logged but do not fail the backup itself
+func (m *Manager) backupSidecars(ctx context.Context, backupName string) {
+	if m.cfg.BackupFunctions {
+		if err := m.backupFunctions(ctx, backupName); err != nil {
+			log.Printf("Warning: failed to back up functions: %v", err)
+		}
+	}
+
+	if m.cfg.BackupServerConfig {
+		if err := m.backupServerConfig(ctx, backupName); err != nil {
+			log.Printf("Warning: failed to capture server configuration: %v", err)
+		}
+	}
+}
+
+// sidecarEncrypted reports whether a sidecar is stored encrypted
+// Key indexes list every key name, so they are encrypted whenever backups are
+func (m *Manager) sidecarEncrypted(sidecarName string) bool {
+	if m.cfg.EncryptMetadata {
+		return true
+	}
+	return strings.HasSuffix(sidecarName, keyIndexSuffix) && m.keyring.CurrentKeyID() != ""
+}
+
+// uploadSidecar writes data to a temporary file and uploads it under sidecarName
+// With ENCRYPTION_METADATA, the data is encrypted first
+func (m *Manager) uploadSidecar(ctx context.Context, sidecarName string, data []byte) error {
+	if m.sidecarEncrypted(sidecarName) {
+		var sealed bytes.Buffer
+		if err := m.keyring.Encrypt(ctx, &sealed, bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", sidecarName, err)
+		}
+		data = sealed.Bytes()
+	}
+	return uploadData(m.work.context(ctx), m.storage, sidecarName, data)
+}
+
+// uploadSidecarFile uploads a local file under sidecarName, encrypted with
+// ENCRYPTION_METADATA, and key indexes whenever backups are encrypted
+func (m *Manager) uploadSidecarFile(ctx context.Context, localPath, sidecarName string) error {
+	if !m.sidecarEncrypted(sidecarName) {
+		return m.storage.Upload(ctx, localPath, sidecarName)
+	}
+
+	encrypted, err := encryptFile(m.work.context(ctx), localPath, func(dst io.Writer, src io.Reader) error {
+		return m.keyring.Encrypt(ctx, dst, src)
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(encrypted)
+	return m.storage.Upload(ctx, encrypted, sidecarName)
+}
+
+// downloadSidecar downloads a sidecar into dst, decrypting it when it was
+// stored with ENCRYPTION_METADATA
+func (m *Manager) downloadSidecar(ctx context.Context, sidecarName string, dst io.Writer) error {
+	tmp, err := m.createTemp(ctx, "redis-backup-sidecar-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer removeTemp(tmp)
+
+	if err := m.storage.Download(ctx, sidecarName, tmp); err != nil {
+		return err
+	}
+	encrypted, err := isEncryptedFile(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", sidecarName, err)
+	}
+	if !encrypted {
+		_, err = io.Copy(dst, tmp)
+		return err
+	}
+	if _, err := m.keyring.Decrypt(ctx, dst, tmp); err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", sidecarName, err)
+	}
+	return nil
+}
+
+// uploadData writes data to a temporary file and uploads it to store under objectName
+func uploadData(ctx context.Context, store storage.Storage, objectName string, data []byte) error {
+	tmp, err := createTemp(ctx, "redis-backup-sidecar-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	if err := store.Upload(ctx, tmp.Name(), objectName); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", objectName, err)
+	}
+	return nil
+}
+
+// deleteSidecars removes every sidecar object belonging to a backup
+func (m *Manager) deleteSidecars(ctx context.Context, backupName string) {
+	for _, suffix := range sidecarSuffixes {
+		err := m.storage.Delete(ctx, backupName+suffix)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Warning: failed to delete %s: %v", backupName+suffix, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/ermos/docker-redis-backup/internal/crypt"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// signBackup stores the detached signature of a backup, computed over the
+// file as stored at localPath, when SIGNING_KEY_FILE is set
+// AOF segments are not signed
+func (m *Manager) signBackup(ctx context.Context, localPath, backupName string) error {
+	if !m.signer.CanSign() || !storage.IsBackupName(backupName) {
+		return nil
+	}
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to sign %s: %w", backupName, err)
+	}
+	defer file.Close()
+
+	signature, err := m.signer.Sign(bufio.NewReader(file), backupName)
+	if err != nil {
+		return fmt.Errorf("failed to sign %s: %w", backupName, err)
+	}
+	return uploadData(m.work.context(ctx), m.storage, backupName+m.signer.Suffix(), signature)
+}
+
+// checkSignature checks the signature of a backup against the file as stored,
+// and returns the key that signed it
+// An unsigned backup is only logged, unless SIGNATURE_REQUIRED is set; an
+// empty key is returned when it is or no key is configured
+func (m *Manager) checkSignature(ctx context.Context, backupName string, stored *os.File) (string, error) {
+	if m.signer == nil {
+		return "", nil
+	}
+	var signature bytes.Buffer
+	err := m.storage.Download(ctx, backupName+m.signer.Suffix(), &signature)
+	if errors.Is(err, storage.ErrNotFound) {
+		if m.cfg.SignatureRequired {
+			return "", fmt.Errorf("%w: %s is not signed and SIGNATURE_REQUIRED is set", crypt.ErrBadSignature, backupName)
+		}
+		log.Printf("Warning: %s is not signed", backupName)
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to download the signature of %s: %w", backupName, err)
+	}
+
+	if _, err := stored.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to read backup: %w", err)
+	}
+	if err := m.signer.Verify(bufio.NewReader(stored), signature.Bytes()); err != nil {
+		return "", fmt.Errorf("%s: %w", backupName, err)
+	}
+	log.Printf("Signature of %s verified with %s", backupName, m.signer)
+	return m.signer.String(), nil
+}
+
+// downloadVerified is like downloadBackup, checking the signature of the
+// backup before decoding it, and also returns the key that signed it
+func (m *Manager) downloadVerified(ctx context.Context, backupName string) (*os.File, string, error) {
+	tmp, err := m.downloadStored(ctx, m.storage, backupName)
+	if err != nil {
+		return nil, "", err
+	}
+	signedBy, err := m.checkSignature(ctx, backupName, tmp)
+	if err != nil {
+		removeTemp(tmp)
+		return nil, "", err
+	}
+	file, err := m.decodeBackup(ctx, tmp, backupName)
+	return file, signedBy, err
+}
+
+// Sign signs backups that have no signature yet, e.g. stored before
+// SIGNING_KEY_FILE was set or imported, every complete backup by default
+// It returns how many were signed
+func (m *Manager) Sign(ctx context.Context, backupNames []string) (int, error) {
+	if !m.signer.CanSign() {
+		return 0, errors.New("SIGNING_KEY_FILE must be set to sign backups")
+	}
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list objects: %w", err)
+	}
+	if len(backupNames) == 0 {
+		backupNames, _ = BackupSets(objects)
+	}
+	stored := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		stored[obj.Name] = true
+	}
+
+	signed := 0
+	for _, name := range backupNames {
+		if !stored[name] {
+			return signed, fmt.Errorf("%w: %s", storage.ErrNotFound, name)
+		}
+		if stored[name+m.signer.Suffix()] {
+			continue
+		}
+
+		file, err := m.downloadStored(ctx, m.storage, name)
+		if err != nil {
+			return signed, err
+		}
+		err = m.signBackup(ctx, file.Name(), name)
+		removeTemp(file)
+		if err != nil {
+			return signed, err
+		}
+		// The set lists the signature; backups stored before sets keep none
+		if stored[name+setSuffix] {
+			if err := m.commitSet(ctx, name); err != nil {
+				return signed, err
+			}
+		}
+		log.Printf("Signed %s with %s", name, m.signer)
+		signed++
+	}
+	return signed, nil
+}
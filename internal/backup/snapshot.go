@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Snapshot takes a backup right away, e.g. as a rollback point before a
+// deployment, and pins the backups it stores for pinDays days (0 = until
+// unpinned) with reason
+func (m *Manager) Snapshot(ctx context.Context, reason string, pinDays int) (stored []StoredBackup, err error) {
+	var until time.Time
+	if pinDays > 0 {
+		until = time.Now().AddDate(0, 0, pinDays)
+	}
+	defer func() {
+		names := make([]string, 0, len(stored))
+		for _, backup := range stored {
+			names = append(names, backup.Name)
+		}
+		details := strings.Join(names, " ")
+		if !until.IsZero() {
+			details += ", pinned until " + until.UTC().Format(time.RFC3339)
+		}
+		Audit(context.WithoutCancel(ctx), m.cfg, m.storage, AuditEntry{Operation: "snapshot", Target: m.cfg.Target(), Details: details, Reason: reason}, err)
+	}()
+
+	if reason == "" {
+		return nil, errors.New("a snapshot needs a reason")
+	}
+	if m.cfg.DryRun {
+		return nil, errors.New("snapshots are not taken in DRY_RUN mode")
+	}
+
+	log.Printf("Taking a snapshot: %s", reason)
+	stored, err = m.run(ctx)
+	if err != nil {
+		return stored, err
+	}
+	if len(stored) == 0 {
+		return nil, errors.New("no backup was stored, another backup is running")
+	}
+
+	for _, backup := range stored {
+		if err := PinBackup(ctx, m.storage, backup.Name, reason, until); err != nil {
+			return stored, fmt.Errorf("failed to pin %s: %w", backup.Name, err)
+		}
+	}
+	if until.IsZero() {
+		log.Printf("Snapshot stored and pinned until unpinned")
+	} else {
+		log.Printf("Snapshot stored and pinned until %s", until.UTC().Format(time.RFC3339))
+	}
+	return stored, nil
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/docker"
+)
+
+// localRDBPath returns a local path to the RDB file to upload
+// In docker mode the file is copied out of the Redis container into a temporary
+// file, otherwise it is snapshotted as set by RDB_SNAPSHOT; the returned
+// cleanup function removes the temporary file
+func (m *Manager) localRDBPath(ctx context.Context, rdbFile string) (string, func(), error) {
+	if m.cfg.RDBSource != "docker" {
+		rdbPath := filepath.Join(m.cfg.RedisDataPath, rdbFile)
+		if _, err := os.Stat(rdbPath); errors.Is(err, os.ErrNotExist) {
+			return "", nil, fmt.Errorf("%w: %s (is REDIS_DATA_PATH the Redis data directory?)", ErrRDBMissing, rdbPath)
+		}
+		return m.snapshotRDB(ctx, rdbPath)
+	}
+
+	client, err := docker.NewClient(m.cfg.DockerHost)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmp, err := m.createTemp(ctx, "redis-backup-docker-*.rdb")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	cleanup := func() { _ = os.Remove(tmp.Name()) }
+
+	containerPath := path.Join(m.cfg.RedisDataPath, rdbFile)
+	log.Printf("Copying %s out of container %s...", containerPath, m.cfg.DockerContainer)
+
+	n, err := client.CopyFile(ctx, m.cfg.DockerContainer, containerPath, tmp)
+	if closeErr := tmp.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write temporary file: %w", closeErr)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	log.Printf("Copied %d bytes from container %s", n, m.cfg.DockerContainer)
+	return tmp.Name(), cleanup, nil
+}
+
+// snapshotRDB links or copies the RDB file into the work directory, so the
+// backup reads the same bytes from start to end
+// Redis replaces the file with rename(), which leaves a hard link or an open
+// file on the previous snapshot untouched
+func (m *Manager) snapshotRDB(ctx context.Context, rdbPath string) (string, func(), error) {
+	// A dry run only reads the size of the file
+	if m.cfg.RDBSnapshot == "off" || m.cfg.DryRun {
+		return rdbPath, func() {}, nil
+	}
+
+	src, err := os.Open(rdbPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open RDB file: %w", err)
+	}
+	defer src.Close()
+
+	tmp, err := m.createTemp(ctx, "redis-backup-snapshot-*.rdb")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	cleanup := func() { _ = os.Remove(tmp.Name()) }
+
+	if m.cfg.RDBSnapshot != "copy" {
+		// A BGSAVE may have replaced the path since it was opened, the link
+		// is only kept when it points at the open file
+		tmp.Close()
+		err := os.Remove(tmp.Name())
+		if err == nil {
+			err = os.Link(rdbPath, tmp.Name())
+		}
+		if err == nil && !sameFile(src, tmp.Name()) {
+			err = errors.New("RDB file replaced while it was linked")
+			_ = os.Remove(tmp.Name())
+		}
+		if err == nil {
+			log.Printf("RDB file linked into the work directory")
+			return tmp.Name(), cleanup, nil
+		}
+		if m.cfg.RDBSnapshot == "link" {
+			cleanup()
+			return "", nil, fmt.Errorf("failed to link RDB file into the work directory (RDB_SNAPSHOT=link requires WORK_DIR on the same filesystem as REDIS_DATA_PATH): %w", err)
+		}
+		if tmp, err = os.Create(tmp.Name()); err != nil {
+			return "", nil, fmt.Errorf("failed to create temporary file: %w", err)
+		}
+	}
+
+	start := time.Now()
+	before, err := src.Stat()
+	if err != nil {
+		tmp.Close()
+		cleanup()
+		return "", nil, fmt.Errorf("failed to read RDB file: %w", err)
+	}
+	n, err := io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to copy RDB file: %w", err)
+	}
+
+	// Only a writer modifying the file in place (not Redis) changes the open file
+	after, err := src.Stat()
+	if err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) || n != before.Size() {
+		cleanup()
+		return "", nil, errors.New("RDB file changed while it was copied")
+	}
+
+	log.Printf("RDB file copied into the work directory (%s in %s)", config.FormatSize(n), time.Since(start).Round(time.Millisecond))
+	return tmp.Name(), cleanup, nil
+}
+
+// sameFile reports whether path is a link to the open file
+func sameFile(file *os.File, path string) bool {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	return err == nil && os.SameFile(fileInfo, pathInfo)
+}
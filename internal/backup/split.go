@@ -0,0 +1,232 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/rdb"
+	"github.com/redis/go-redis/v9"
+)
+
+// scanBatchSize is the SCAN COUNT hint used when dumping a database
+const scanBatchSize = 1000
+
+// runSplit creates one logical backup per Redis database
+// Each database is dumped with SCAN/DUMP/PTTL into its own RDB file, so a
+// single database can be restored without touching the others
+func (m *Manager) runSplit(ctx context.Context) error {
+	dbs := m.cfg.BackupDatabaseList
+	if len(dbs) == 0 {
+		var err error
+		dbs, err = m.nonEmptyDatabases(ctx)
+		if err != nil {
+			return withStage(StageRedis, fmt.Errorf("failed to list databases: %w", redisError(err)))
+		}
+	}
+
+	if len(dbs) == 0 {
+		log.Println("No non-empty databases found, nothing to back up")
+		return nil
+	}
+
+	var failed []int
+	var firstErr error
+	for _, db := range dbs {
+		if _, err := m.backupDatabase(ctx, db, fmt.Sprintf("db%d", db)); err != nil {
+			log.Printf("Backup of database %d failed: %v", db, err)
+			failed = append(failed, db)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	// A failed verification keeps the previous backups
+	verifyErr := m.verifySample(m.phaseContext(ctx, phaseVerify))
+	ctx = m.phaseContext(ctx, phaseRetention)
+	if verifyErr == nil && (m.cfg.RetentionCount > 0 || m.cfg.RetentionMinFree > 0) {
+		if err := m.applyRetention(ctx); err != nil {
+			log.Printf("Warning: failed to apply retention policy: %v", err)
+		}
+	}
+
+	m.reportUsage(ctx)
+
+	// The first error keeps its stage and category
+	if len(failed) > 0 {
+		return fmt.Errorf("backup failed for database(s) %v: %w", failed, firstErr)
+	}
+	return verifyErr
+}
+
+// backupDatabase dumps a single database to a temporary RDB file and uploads
+// it as a backup of the series, whose name it returns
+func (m *Manager) backupDatabase(ctx context.Context, db int, series string) (string, error) {
+	tmp, err := m.createTemp(ctx, fmt.Sprintf("redis-backup-db%d-*.rdb", db))
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	log.Printf("Dumping database %d...", db)
+	keys, err := m.dumpDatabase(m.phaseContext(ctx, phaseSnapshot), db, tmp)
+	if err != nil {
+		return "", withStage(StageRedis, redisError(err))
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := m.runHook(ctx, hookEvent{Phase: hookPostBGSAVE, File: tmp.Name(), Database: &db}); err != nil {
+		return "", err
+	}
+
+	ctx = m.phaseContext(ctx, phaseUpload)
+	backupName := m.generateBackupName(series)
+	if err := m.checkMaxSize(ctx, backupName, tmp.Name()); err != nil {
+		return "", err
+	}
+
+	if err := m.runHook(ctx, hookEvent{Phase: hookPreUpload, Backup: backupName, File: tmp.Name(), Database: &db}); err != nil {
+		return "", err
+	}
+	if err := m.uploadBackup(ctx, tmp.Name(), backupName); err != nil {
+		return "", withStage(StageUpload, fmt.Errorf("failed to upload backup: %w", err))
+	}
+	m.recordStored(backupName, tmp.Name())
+
+	log.Printf("Backup of database %d completed successfully: %s (%d keys, storage: %s)", db, backupName, keys.databases[db].Keys, m.storage.Type())
+	m.checkSizeAnomaly(ctx, backupName, tmp.Name())
+
+	m.writeManifest(ctx, backupName, tmp.Name(), keys)
+	m.backupSidecars(ctx, backupName)
+	if err := m.commitSet(ctx, backupName); err != nil {
+		return backupName, withStage(StageUpload, err)
+	}
+	return backupName, m.runHook(ctx, hookEvent{Phase: hookPostUpload, Backup: backupName, File: tmp.Name(), Database: &db})
+}
+
+// dumpDatabase writes every key of a database into an RDB file and returns its key statistics
+func (m *Manager) dumpDatabase(ctx context.Context, db int, file *os.File) (*keyCollector, error) {
+	conn := m.conn()
+	defer conn.Close()
+
+	if err := conn.Select(ctx, db).Err(); err != nil {
+		return nil, fmt.Errorf("failed to select database %d: %w", db, err)
+	}
+
+	buf := bufio.NewWriter(file)
+	writer := rdb.NewWriter(buf, db)
+	keys := newKeyCollector(m.cfg.BigKeysTop)
+	keys.databases[db] = &KeyStats{}
+
+	var cursor uint64
+	for {
+		batch, next, err := conn.Scan(ctx, cursor, "*", scanBatchSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("SCAN failed on database %d: %w", db, err)
+		}
+
+		batch = m.skipInternalKeys(db, batch)
+		if err := dumpKeys(ctx, conn, writer, db, batch, keys); err != nil {
+			return nil, err
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize RDB file: %w", err)
+	}
+	if err := buf.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to write RDB file: %w", err)
+	}
+
+	return keys, nil
+}
+
+// skipInternalKeys removes keys written by the backup service itself (backup lock)
+func (m *Manager) skipInternalKeys(db int, keys []string) []string {
+	if !m.cfg.BackupLock || db != m.cfg.RedisDB {
+		return keys
+	}
+
+	filtered := keys[:0]
+	for _, key := range keys {
+		if key != m.cfg.BackupLockKey {
+			filtered = append(filtered, key)
+		}
+	}
+	return filtered
+}
+
+// dumpKeys fetches DUMP payloads and TTLs for a batch of keys in one round trip
+// Written keys are counted in the collector
+func dumpKeys(ctx context.Context, conn *redis.Conn, writer *rdb.Writer, db int, keys []string, collector *keyCollector) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	dumps := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	_, err := conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			dumps[i] = pipe.Dump(ctx, key)
+			ttls[i] = pipe.PTTL(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("DUMP failed: %w", err)
+	}
+
+	now := time.Now()
+	for i, key := range keys {
+		payload, err := dumps[i].Result()
+		if errors.Is(err, redis.Nil) {
+			// Key expired or was deleted between SCAN and DUMP
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("DUMP failed for key %q: %w", key, err)
+		}
+
+		var expireAt int64
+		if ttl := ttls[i].Val(); ttl > 0 {
+			expireAt = now.Add(ttl).UnixMilli()
+		}
+
+		if err := writer.WriteDump(key, expireAt, []byte(payload)); err != nil {
+			return err
+		}
+		// The payload is <type><value><version:2><crc:8>
+		collector.add(db, key, payload[0], expireAt > 0, int64(len(payload)-11))
+	}
+
+	return nil
+}
+
+// nonEmptyDatabases returns the DB indexes listed in INFO keyspace
+func (m *Manager) nonEmptyDatabases(ctx context.Context) ([]int, error) {
+	info, err := m.info(ctx, "keyspace")
+	if err != nil {
+		return nil, err
+	}
+
+	var dbs []int
+	for db := range parseKeyspace(info) {
+		dbs = append(dbs, db)
+	}
+
+	sort.Ints(dbs)
+	return dbs, nil
+}
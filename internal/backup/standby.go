@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/notify"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// startSeeding restores the backups of the run into the warm standby in the background
+// A run finishing while the previous seeding is still going on is not seeded,
+// the next one brings the standby up to date
+func (m *Manager) startSeeding(ctx context.Context) {
+	if len(m.stored) == 0 {
+		return
+	}
+	if !m.seeding.TryLock() {
+		log.Println("Warning: the standby is still being seeded with a previous backup, skipping this one")
+		return
+	}
+
+	names := make([]string, 0, len(m.stored))
+	for _, stored := range m.stored {
+		names = append(names, stored.Name)
+	}
+	m.seeds.Add(1)
+	go func() {
+		defer m.seeds.Done()
+		defer m.seeding.Unlock()
+		// The directory of the run is removed when the run ends
+		ctx := context.WithValue(context.WithoutCancel(ctx), workDirKey{}, "")
+		m.seedStandby(m.work.context(ctx), names)
+	}()
+}
+
+// seedStandby flushes the standby and restores the backups of a run into it,
+// then records the outcome and notifies on failure
+func (m *Manager) seedStandby(ctx context.Context, names []string) {
+	start := time.Now()
+	seed := StandbySeed{
+		Standby: m.cfg.StandbyRedisHost + ":" + m.cfg.StandbyRedisPort,
+		Time:    start.UTC(),
+		Backups: names,
+	}
+	keys, err := m.restoreStandby(ctx, names)
+	seed.Duration = time.Since(start).Seconds()
+	seed.Keys = keys
+	seed.Success = err == nil
+	if err != nil {
+		seed.Error = err.Error()
+	}
+	RecordStandbySeed(m.cfg, seed)
+
+	if err == nil {
+		log.Printf("Standby %s seeded with %d key(s) in %s", seed.Standby, keys, time.Since(start).Round(time.Second))
+		return
+	}
+	log.Printf("WARNING: failed to seed standby %s: %v", seed.Standby, err)
+	event := notify.Event{
+		Type:    notify.EventStandbySeedFailed,
+		Message: fmt.Sprintf("Seeding standby %s failed: %v", seed.Standby, err),
+		Details: map[string]interface{}{
+			"standby": seed.Standby,
+			"backups": names,
+			"error":   err.Error(),
+		},
+	}
+	if err := m.notifier.Notify(ctx, event); err != nil {
+		log.Printf("Warning: failed to send %s notification: %v", event.Type, err)
+	}
+}
+
+// restoreStandby connects to the standby if needed, flushes it and restores
+// every key of the backups, and returns the number of keys restored
+func (m *Manager) restoreStandby(ctx context.Context, names []string) (int, error) {
+	if m.standby == nil {
+		standby, err := New(m.cfg.ForStandby(), m.storage)
+		if err != nil {
+			return 0, fmt.Errorf("failed to connect to the standby: %w", err)
+		}
+		m.standby = standby
+	}
+
+	// Keys deleted since the previous seeding must not survive in the standby
+	if err := m.standby.do(ctx, "FLUSHALL").Err(); err != nil {
+		return 0, fmt.Errorf("failed to flush the standby: %w", redisError(err))
+	}
+
+	keys := 0
+	for _, name := range names {
+		result, err := m.standby.Restore(ctx, name, RestoreOptions{Patterns: []string{"*"}, DB: -1})
+		keys += result.Restored
+		if err != nil {
+			return keys, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+		if m.cfg.BackupFunctions {
+			// Servers without functions stored no functions sidecar
+			err := m.standby.RestoreFunctions(ctx, name, "REPLACE")
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return keys, fmt.Errorf("failed to restore the functions of %s: %w", name, err)
+			}
+		}
+	}
+	return keys, nil
+}
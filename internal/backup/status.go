@@ -0,0 +1,366 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/metrics"
+	"github.com/ermos/docker-redis-backup/internal/notify"
+)
+
+// statusHistorySize is the number of runs kept per target
+const statusHistorySize = 10
+
+// RunResult is the outcome of one backup run
+type RunResult struct {
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+	Category string    `json:"category,omitempty"`
+	// Verification is "passed" or "failed" when the run verified its backups
+	Verification string `json:"verification,omitempty"`
+	// Maintenance is the reason of the maintenance window the run happened in
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// VerificationResult is the outcome of the last sampled verification of a target
+type VerificationResult struct {
+	Time    time.Time `json:"time"`
+	Backups []string  `json:"backups"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// TargetStatus is the backup status of one Redis target
+type TargetStatus struct {
+	Target              string              `json:"target"`
+	LastRun             *RunResult          `json:"last_run,omitempty"`
+	LastSuccess         *time.Time          `json:"last_success,omitempty"`
+	LastSuccessAge      float64             `json:"last_success_age_seconds,omitempty"`
+	NextRun             *time.Time          `json:"next_run,omitempty"`
+	RunningSince        *time.Time          `json:"running_since,omitempty"`
+	ConsecutiveFailures int                 `json:"consecutive_failures"`
+	History             []RunResult         `json:"history"`
+	Replication         *ReplicationStatus  `json:"replication,omitempty"`
+	LastVerification    *VerificationResult `json:"last_verification,omitempty"`
+	Standby             *StandbySeed        `json:"standby,omitempty"`
+	Maintenance         *Maintenance        `json:"maintenance,omitempty"`
+
+	// failuresAlerted is set once a failure of the current series was alerted,
+	// so failures muted by a maintenance window do not end with a recovery
+	failuresAlerted bool
+}
+
+// StandbySeed is the outcome of the last seeding of the warm standby
+type StandbySeed struct {
+	Standby  string    `json:"standby"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds"`
+	Backups  []string  `json:"backups"`
+	Keys     int       `json:"keys"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// ReplicationStatus is the state of the copies in REPLICA_STORAGE after the last replication
+type ReplicationStatus struct {
+	Storage     string    `json:"storage"`
+	CheckedAt   time.Time `json:"checked_at"`
+	Pending     int       `json:"pending_backups"`
+	ReplicaOnly int       `json:"replica_only_backups"`
+	LastBackup  string    `json:"last_backup,omitempty"`
+	LagSeconds  float64   `json:"lag_seconds,omitempty"`
+}
+
+var (
+	statusMu sync.Mutex
+	statuses = make(map[string]*TargetStatus)
+	// nextRun returns the next run of the scheduler, nil outside of it
+	nextRun func() time.Time
+)
+
+// SetNextRun registers the function returning the next scheduled run, shown
+// on /status for every target
+func SetNextRun(next func() time.Time) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	nextRun = next
+}
+
+// RegisterTarget adds a target to the status before its first run, so its
+// next run is shown from the start
+func RegisterTarget(target string) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	if _, ok := statuses[target]; !ok {
+		statuses[target] = &TargetStatus{Target: target}
+	}
+}
+
+// startRun marks a run of a target in flight and returns the function marking
+// its end
+func startRun(target string, start time.Time) func() {
+	start = start.UTC()
+	statusMu.Lock()
+	status, ok := statuses[target]
+	if !ok {
+		status = &TargetStatus{Target: target}
+		statuses[target] = status
+	}
+	status.RunningSince = &start
+	statusMu.Unlock()
+
+	labels := map[string]string{"target": target}
+	metrics.SetGauge("redis_backup_running", "Whether a backup of the target is in flight (1) or not (0)", labels, 1)
+	return func() {
+		statusMu.Lock()
+		status.RunningSince = nil
+		statusMu.Unlock()
+		metrics.SetGauge("redis_backup_running", "Whether a backup of the target is in flight (1) or not (0)", labels, 0)
+	}
+}
+
+// RecordRun records the result of a backup run of a target, publishes its metrics
+// and notifies when the target fails or recovers
+func RecordRun(ctx context.Context, cfg *config.Config, start time.Time, runErr error) {
+	recordRun(ctx, cfg, start, runErr, "")
+}
+
+// recordRun records a backup run with the outcome of its verification, if any
+func recordRun(ctx context.Context, cfg *config.Config, start time.Time, runErr error, verification string) {
+	target := cfg.Target()
+	result := RunResult{
+		Start:        start.UTC(),
+		Duration:     time.Since(start).Seconds(),
+		Success:      runErr == nil,
+		Verification: verification,
+	}
+	if runErr != nil {
+		result.Error = runErr.Error()
+		result.Category = ErrorCategory(runErr)
+	}
+	window := activeMaintenance(target)
+	if window != nil {
+		result.Maintenance = window.Reason
+	}
+
+	statusMu.Lock()
+	status, ok := statuses[target]
+	if !ok {
+		status = &TargetStatus{Target: target}
+		statuses[target] = status
+	}
+	previousFailures := status.ConsecutiveFailures
+	alerted := status.failuresAlerted
+	status.LastRun = &result
+	if result.Success {
+		status.LastSuccess = &result.Start
+		status.ConsecutiveFailures = 0
+		status.failuresAlerted = false
+	} else {
+		status.ConsecutiveFailures++
+		status.failuresAlerted = status.failuresAlerted || window == nil
+	}
+	status.History = append(status.History, result)
+	if len(status.History) > statusHistorySize {
+		status.History = status.History[len(status.History)-statusHistorySize:]
+	}
+	failures := status.ConsecutiveFailures
+	statusMu.Unlock()
+
+	labels := map[string]string{"target": target}
+	success := 0.0
+	if result.Success {
+		success = 1
+		metrics.SetGauge("redis_backup_last_success_timestamp_seconds", "Start time of the last successful backup", labels, float64(start.Unix()))
+	}
+	metrics.SetGauge("redis_backup_last_run_success", "Whether the last backup succeeded (1) or failed (0)", labels, success)
+	metrics.SetGauge("redis_backup_last_run_timestamp_seconds", "Start time of the last backup run", labels, float64(start.Unix()))
+	metrics.SetGauge("redis_backup_last_run_duration_seconds", "Duration of the last backup run", labels, result.Duration)
+	metrics.SetGauge("redis_backup_consecutive_failures", "Number of backup runs failed in a row", labels, float64(failures))
+
+	var event *notify.Event
+	switch {
+	case !result.Success:
+		event = &notify.Event{
+			Type:    notify.EventBackupFailed,
+			Message: fmt.Sprintf("Backup of %s failed (%d in a row): %v", target, failures, runErr),
+			Details: map[string]interface{}{
+				"error":                runErr.Error(),
+				"consecutive_failures": failures,
+			},
+		}
+		if result.Category != "" {
+			event.Details["category"] = result.Category
+		}
+	case previousFailures > 0 && alerted:
+		event = &notify.Event{
+			Type:    notify.EventRecovered,
+			Message: fmt.Sprintf("Backup of %s succeeded after %d failed run(s)", target, previousFailures),
+			Details: map[string]interface{}{
+				"previous_failures": previousFailures,
+			},
+		}
+	default:
+		event = &notify.Event{
+			Type:    notify.EventBackupSucceeded,
+			Message: fmt.Sprintf("Backup of %s succeeded in %.1fs", target, result.Duration),
+			Details: map[string]interface{}{
+				"duration_seconds": result.Duration,
+			},
+		}
+	}
+	if event == nil {
+		return
+	}
+
+	notifier, err := newNotifier(cfg)
+	if err == nil {
+		err = notifier.Notify(ctx, *event)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to send %s notification: %v", event.Type, err)
+	}
+}
+
+// RecordReplication records the state of the replica of a target and publishes its metrics
+func RecordReplication(cfg *config.Config, replication ReplicationStatus) {
+	target := cfg.Target()
+	replication.CheckedAt = time.Now().UTC()
+
+	statusMu.Lock()
+	status, ok := statuses[target]
+	if !ok {
+		status = &TargetStatus{Target: target}
+		statuses[target] = status
+	}
+	status.Replication = &replication
+	statusMu.Unlock()
+
+	labels := map[string]string{"target": target}
+	metrics.SetGauge("redis_backup_replication_pending_backups", "Backups not yet copied to the replica", labels, float64(replication.Pending))
+	if replication.LastBackup != "" {
+		metrics.SetGauge("redis_backup_replication_lag_seconds", "Delay between the upload of the last replicated backup and its copy", labels, replication.LagSeconds)
+	}
+}
+
+// RecordVerification records the outcome of a sampled verification and publishes its metrics
+func RecordVerification(cfg *config.Config, verification VerificationResult) {
+	target := cfg.Target()
+
+	statusMu.Lock()
+	status, ok := statuses[target]
+	if !ok {
+		status = &TargetStatus{Target: target}
+		statuses[target] = status
+	}
+	status.LastVerification = &verification
+	statusMu.Unlock()
+
+	labels := map[string]string{"target": target}
+	success := 0.0
+	if verification.Success {
+		success = 1
+	}
+	metrics.SetGauge("redis_backup_last_verification_success", "Whether the last sampled verification passed (1) or failed (0)", labels, success)
+	metrics.SetGauge("redis_backup_last_verification_timestamp_seconds", "Time of the last sampled verification", labels, float64(verification.Time.Unix()))
+}
+
+// RecordStandbySeed records the outcome of a seeding of the warm standby and publishes its metrics
+func RecordStandbySeed(cfg *config.Config, seed StandbySeed) {
+	target := cfg.Target()
+
+	statusMu.Lock()
+	status, ok := statuses[target]
+	if !ok {
+		status = &TargetStatus{Target: target}
+		statuses[target] = status
+	}
+	status.Standby = &seed
+	statusMu.Unlock()
+
+	labels := map[string]string{"target": target}
+	success := 0.0
+	if seed.Success {
+		success = 1
+		metrics.SetGauge("redis_backup_standby_last_seed_timestamp_seconds", "Time of the last successful seeding of the standby", labels, float64(seed.Time.Unix()))
+		metrics.SetGauge("redis_backup_standby_keys", "Keys restored into the standby by the last seeding", labels, float64(seed.Keys))
+	}
+	metrics.SetGauge("redis_backup_standby_last_seed_success", "Whether the last seeding of the standby succeeded (1) or failed (0)", labels, success)
+	metrics.SetGauge("redis_backup_standby_last_seed_duration_seconds", "Duration of the last seeding of the standby", labels, seed.Duration)
+}
+
+// lastVerification returns the time of the last sampled verification of a target
+func lastVerification(target string) (time.Time, bool) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	status, ok := statuses[target]
+	if !ok || status.LastVerification == nil {
+		return time.Time{}, false
+	}
+	return status.LastVerification.Time, true
+}
+
+// Statuses returns the status of every target backed up by this process, sorted by target
+func Statuses() []TargetStatus {
+	statusMu.Lock()
+	next := nextRun
+	statusMu.Unlock()
+	var nextTime *time.Time
+	if next != nil {
+		if t := next(); !t.IsZero() {
+			t = t.UTC()
+			nextTime = &t
+		}
+	}
+
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	list := make([]TargetStatus, 0, len(statuses))
+	for _, status := range statuses {
+		copied := *status
+		copied.History = append([]RunResult{}, status.History...)
+		copied.NextRun = nextTime
+		if status.LastSuccess != nil {
+			copied.LastSuccessAge = time.Since(*status.LastSuccess).Seconds()
+		}
+		copied.Maintenance = activeMaintenance(status.Target)
+		if status.Replication != nil {
+			replication := *status.Replication
+			copied.Replication = &replication
+		}
+		if status.LastVerification != nil {
+			verification := *status.LastVerification
+			verification.Backups = append([]string(nil), status.LastVerification.Backups...)
+			copied.LastVerification = &verification
+		}
+		if status.Standby != nil {
+			seed := *status.Standby
+			seed.Backups = append([]string(nil), status.Standby.Backups...)
+			copied.Standby = &seed
+		}
+		list = append(list, copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Target < list[j].Target })
+	return list
+}
+
+// StatusHandler serves the status of every target as JSON
+func StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(Statuses()); err != nil {
+			log.Printf("Warning: failed to encode status: %v", err)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writeCheckInterval is how often the accumulated writes are checked
+const writeCheckInterval = 10 * time.Second
+
+// writeCounter counts the writes since the last successful backup
+type writeCounter struct {
+	mu         sync.Mutex
+	writes     int64
+	lastBackup time.Time
+}
+
+// add counts writes and returns the total since the last backup
+func (c *writeCounter) add(n int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes += n
+	return c.writes
+}
+
+// reset starts counting again after a successful backup
+func (c *writeCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes = 0
+	c.lastBackup = time.Now()
+}
+
+// due reports whether enough writes accumulated and the minimum interval
+// since the last backup elapsed
+func (c *writeCounter) due(threshold int64, minInterval time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes >= threshold && time.Since(c.lastBackup) >= minInterval
+}
+
+// WatchWrites runs an extra backup whenever WRITE_TRIGGER_THRESHOLD writes
+// accumulated since the last backup, at most once per WRITE_TRIGGER_MIN_INTERVAL
+// It returns when ctx is canceled
+func (m *Manager) WatchWrites(ctx context.Context) error {
+	counted := make(chan struct{}, 1)
+	var err error
+	if m.cfg.WriteTriggerSource == "notifications" {
+		err = m.countNotifications(ctx, counted)
+	} else {
+		err = m.countDirty(ctx, counted)
+	}
+	if err != nil {
+		return err
+	}
+
+	minInterval := time.Duration(m.cfg.WriteTriggerMinInterval) * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-counted:
+		}
+		if !m.writes.due(m.cfg.WriteTriggerThreshold, minInterval) {
+			continue
+		}
+
+		log.Printf("%d write(s) since the last backup, starting an extra backup", m.writes.add(0))
+		if err := m.Run(ctx); err != nil {
+			log.Printf("Write-triggered backup failed: %v", err)
+		}
+	}
+}
+
+// countDirty polls the number of changes since the last save reported in INFO
+// Saves reset the counter, so a lower value counts as that many new writes
+func (m *Manager) countDirty(ctx context.Context, counted chan<- struct{}) error {
+	read := func() (int64, error) {
+		info, err := m.info(ctx, "persistence")
+		if err != nil {
+			return 0, fmt.Errorf("failed to get persistence info: %w", err)
+		}
+		changes, ok := info.ChangesSinceLastSave()
+		if !ok {
+			return 0, fmt.Errorf("the server does not report rdb_changes_since_last_save, use WRITE_TRIGGER_SOURCE=notifications")
+		}
+		return changes, nil
+	}
+
+	last, err := read()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(writeCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			changes, err := read()
+			if err != nil {
+				log.Printf("Warning: failed to count writes: %v", err)
+				continue
+			}
+			if changes >= last {
+				m.writes.add(changes - last)
+			} else {
+				m.writes.add(changes)
+			}
+			last = changes
+			notifyCounted(counted)
+		}
+	}()
+	return nil
+}
+
+// countNotifications counts the keyspace events published by the server
+// The events counted are those enabled by notify-keyspace-events
+func (m *Manager) countNotifications(ctx context.Context, counted chan<- struct{}) error {
+	result, err := m.configGet(ctx, "notify-keyspace-events")
+	if events, ok := result["notify-keyspace-events"]; err == nil && ok && !strings.Contains(events, "E") {
+		log.Printf("Warning: keyevent notifications are disabled (notify-keyspace-events=%q), enable them e.g. with \"E$lshzxt\"", events)
+	}
+
+	pubsub := m.redis.PSubscribe(ctx, "__keyevent@*__:*")
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("failed to subscribe to keyspace notifications: %w", err)
+	}
+
+	go func() {
+		defer pubsub.Close()
+		ticker := time.NewTicker(writeCheckInterval)
+		defer ticker.Stop()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-messages:
+				m.writes.add(1)
+			case <-ticker.C:
+				notifyCounted(counted)
+			}
+		}
+	}()
+	return nil
+}
+
+// notifyCounted wakes the trigger loop without blocking the counter
+func notifyCounted(counted chan<- struct{}) {
+	select {
+	case counted <- struct{}{}:
+	default:
+	}
+}
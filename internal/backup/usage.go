@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/metrics"
+	"github.com/ermos/docker-redis-backup/internal/notify"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// Usage is the space used by backups in the storage
+type Usage struct {
+	Bytes   int64
+	Objects int
+	Backups int
+}
+
+// StorageUsage computes the total size of every object in the storage
+func (m *Manager) StorageUsage(ctx context.Context) (Usage, error) {
+	objects, err := m.storage.ListObjects(ctx)
+	if err != nil {
+		return Usage{}, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	var usage Usage
+	for _, obj := range objects {
+		usage.Bytes += obj.Size
+		usage.Objects++
+		if storage.IsBackupName(obj.Name) {
+			usage.Backups++
+		}
+	}
+	return usage, nil
+}
+
+// reportUsage publishes storage usage metrics and alerts when STORAGE_QUOTA is exceeded
+func (m *Manager) reportUsage(ctx context.Context) {
+	usage, err := m.StorageUsage(ctx)
+	if err != nil {
+		log.Printf("Warning: failed to compute storage usage: %v", err)
+		return
+	}
+	m.lastUsage = usage.Bytes
+
+	labels := map[string]string{"storage": m.storage.Type(), "target": m.cfg.Target()}
+	metrics.SetGauge("redis_backup_storage_bytes", "Total bytes stored in the backup destination", labels, float64(usage.Bytes))
+	metrics.SetGauge("redis_backup_storage_objects", "Number of objects stored in the backup destination", labels, float64(usage.Objects))
+	metrics.SetGauge("redis_backup_storage_backups", "Number of backups stored in the backup destination", labels, float64(usage.Backups))
+
+	log.Printf("Storage usage: %s in %d backup(s), %d object(s)", config.FormatSize(usage.Bytes), usage.Backups, usage.Objects)
+
+	if m.cfg.StorageQuota <= 0 {
+		return
+	}
+	metrics.SetGauge("redis_backup_storage_quota_bytes", "Configured storage quota", labels, float64(m.cfg.StorageQuota))
+
+	if usage.Bytes > m.cfg.StorageQuota {
+		err := m.notifier.Notify(ctx, notify.Event{
+			Type: notify.EventQuotaExceeded,
+			Message: fmt.Sprintf("Backup storage usage %s exceeds quota %s (%s)",
+				config.FormatSize(usage.Bytes), config.FormatSize(m.cfg.StorageQuota), m.storage.Type()),
+			Details: map[string]interface{}{
+				"storage":     m.storage.Type(),
+				"usage_bytes": usage.Bytes,
+				"quota_bytes": m.cfg.StorageQuota,
+			},
+		})
+		if err != nil {
+			log.Printf("Warning: failed to send quota notification: %v", err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/checksum"
+	"github.com/ermos/docker-redis-backup/internal/rdb"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// VerifyResult describes a verified backup
+type VerifyResult struct {
+	Backup    string
+	SizeBytes int64
+	SHA256    string
+	// Checksums holds the digest of each algorithm recorded in the manifest
+	Checksums map[string]string
+	Keys      int64
+	// Manifest is false when the backup has no manifest to compare with
+	Manifest bool
+	// Signature is the key that signed the backup, empty when no signature
+	// was checked
+	Signature string
+}
+
+// Verify downloads a backup, checks its signature, decrypts and decompresses
+// it, validates the RDB structure and checksum, and compares its size,
+// checksums and key count with the manifest
+// Backups whose set is incomplete are refused
+func (m *Manager) Verify(ctx context.Context, backupName string) (VerifyResult, error) {
+	if err := m.checkSet(ctx, backupName); err != nil {
+		return VerifyResult{Backup: backupName}, err
+	}
+	return m.verifyBackup(ctx, backupName)
+}
+
+// verifyBackup verifies a backup without checking its set
+func (m *Manager) verifyBackup(ctx context.Context, backupName string) (VerifyResult, error) {
+	result := VerifyResult{Backup: backupName}
+
+	manifest, err := LoadManifest(ctx, m.storage, backupName, m.keyring)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return result, err
+	}
+	if manifest == nil {
+		log.Printf("Warning: %s has no manifest, only the RDB structure is checked", backupName)
+	}
+	result.Manifest = manifest != nil
+
+	file, signedBy, err := m.downloadVerified(ctx, backupName)
+	if err != nil {
+		return result, err
+	}
+	defer removeTemp(file)
+	result.Signature = signedBy
+
+	sums, err := checksum.NewSet(verifyAlgorithms(manifest))
+	if err != nil {
+		return result, err
+	}
+	counter := &countingReader{r: io.TeeReader(bufio.NewReader(file), sums)}
+	reader := rdb.NewReader(counter)
+	for {
+		_, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("invalid RDB file: %w", err)
+		}
+		result.Keys++
+	}
+	// Hash trailing bytes the reader did not consume
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return result, fmt.Errorf("failed to read backup: %w", err)
+	}
+	result.SizeBytes = counter.n
+	result.Checksums = sums.Sums()
+	result.SHA256 = result.Checksums[checksum.SHA256]
+
+	if manifest == nil {
+		return result, nil
+	}
+
+	var mismatches []string
+	if manifest.SizeBytes != 0 && manifest.SizeBytes != result.SizeBytes {
+		mismatches = append(mismatches, fmt.Sprintf("size is %d bytes, manifest says %d", result.SizeBytes, manifest.SizeBytes))
+	}
+	recorded := manifestChecksums(manifest)
+	for _, name := range slices.Sorted(maps.Keys(recorded)) {
+		if sum, ok := result.Checksums[name]; ok && sum != recorded[name] {
+			mismatches = append(mismatches, fmt.Sprintf("%s is %s, manifest says %s", name, sum, recorded[name]))
+		}
+	}
+	if len(recorded) == 0 {
+		log.Printf("Warning: manifest of %s has no checksum (backup made by an older version)", backupName)
+	}
+	// Counts taken from INFO keyspace (no type breakdown) are only approximate
+	if total := manifest.TotalKeys(); manifest.countedFromRDB() && total != result.Keys {
+		mismatches = append(mismatches, fmt.Sprintf("contains %d keys, manifest says %d", result.Keys, total))
+	}
+	if len(mismatches) > 0 {
+		return result, fmt.Errorf("backup does not match its manifest: %s", strings.Join(mismatches, "; "))
+	}
+	return result, nil
+}
+
+// manifestChecksums returns the digests recorded in a manifest, including the
+// SHA-256 of manifests written before CHECKSUM_ALGORITHMS
+func manifestChecksums(manifest *Manifest) map[string]string {
+	recorded := make(map[string]string, len(manifest.Checksums)+1)
+	for name, sum := range manifest.Checksums {
+		recorded[name] = strings.ToLower(sum)
+	}
+	if manifest.SHA256 != "" {
+		recorded[checksum.SHA256] = manifest.SHA256
+	}
+	return recorded
+}
+
+// verifyAlgorithms returns the algorithms to compute to verify a backup:
+// SHA-256 and every supported algorithm recorded in its manifest
+func verifyAlgorithms(manifest *Manifest) []string {
+	algorithms := []string{checksum.SHA256}
+	if manifest == nil {
+		return algorithms
+	}
+	for name := range manifest.Checksums {
+		if name == checksum.SHA256 {
+			continue
+		}
+		if !checksum.Supported(name) {
+			log.Printf("Warning: manifest of %s has a %s checksum, which is not supported", manifest.Backup, name)
+			continue
+		}
+		algorithms = append(algorithms, name)
+	}
+	return algorithms
+}
+
+// LatestBackup returns the most recent complete backup across every series
+func (m *Manager) LatestBackup(ctx context.Context) (string, error) {
+	backups, err := m.listBackups(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	latest := ""
+	for _, name := range backups {
+		if latest == "" || backupTimestamp(name) >= backupTimestamp(latest) {
+			latest = name
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("%w: the storage holds no backup", storage.ErrNotFound)
+	}
+	return latest, nil
+}
+
+// backupTimestamp returns the timestamp part of a backup name, which sorts chronologically
+func backupTimestamp(backupName string) string {
+	_, timestamp, _ := strings.Cut(backupName, "_")
+	return timestamp
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// verifySample verifies the backups stored by the run when it is sampled:
+// a VERIFY_SAMPLE_RATE fraction of the runs, and the first run of each UTC
+// day so that at least one backup a day is known to be restorable
+func (m *Manager) verifySample(ctx context.Context) error {
+	if m.cfg.VerifySampleRate == 0 || len(m.stored) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if m.verifiedToday(ctx, now) && rand.Float64() >= m.cfg.VerifySampleRate {
+		return nil
+	}
+
+	result := VerificationResult{Time: now, Success: true}
+	var err error
+	for _, stored := range m.stored {
+		result.Backups = append(result.Backups, stored.Name)
+		if _, verifyErr := m.Verify(ctx, stored.Name); verifyErr != nil {
+			err = withStage(StageVerify, &categorizedError{
+				category: ErrVerifyFailed,
+				err:      fmt.Errorf("verification of %s failed: %w", stored.Name, verifyErr),
+			})
+			break
+		}
+		log.Printf("%s verified", stored.Name)
+	}
+
+	m.verification = "passed"
+	if err != nil {
+		m.verification = "failed"
+		result.Success = false
+		result.Error = err.Error()
+	}
+	RecordVerification(m.cfg, result)
+	return err
+}
+
+// verifiedToday reports whether a run of the target was verified on the UTC
+// day of now, read from the run history after a restart
+func (m *Manager) verifiedToday(ctx context.Context, now time.Time) bool {
+	if last, ok := lastVerification(m.cfg.Target()); ok {
+		return last.Format(time.DateOnly) == now.Format(time.DateOnly)
+	}
+
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	records, err := ReadRunHistory(ctx, m.storage, day)
+	if err != nil {
+		log.Printf("Warning: failed to read the run history, verifying this run: %v", err)
+		return false
+	}
+	for _, record := range records {
+		if record.Target == m.cfg.Target() && record.Verification != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/notify"
+)
+
+// Phases of a backup run, reported when the run exceeds MAX_BACKUP_DURATION
+const (
+	phaseSnapshot  = "snapshot"
+	phaseUpload    = "upload"
+	phaseRetention = "retention"
+	phaseVerify    = "verification"
+)
+
+// windowKey holds, in the context of a run, the context it was started with
+type windowKey struct{}
+
+// startWindow bounds the context of a run by MAX_BACKUP_DURATION
+func (m *Manager) startWindow(ctx context.Context, start time.Time) (context.Context, context.CancelFunc) {
+	m.phase = phaseSnapshot
+	if m.cfg.MaxBackupDuration == 0 {
+		return ctx, func() {}
+	}
+	deadline := start.Add(time.Duration(m.cfg.MaxBackupDuration) * time.Second)
+	return context.WithDeadlineCause(context.WithValue(ctx, windowKey{}, ctx), deadline, ErrWindowExceeded)
+}
+
+// phaseContext enters a phase of the run and returns its context
+// The snapshot is always bounded by the window; with
+// MAX_BACKUP_DURATION_ACTION=finish, the phases after it are not
+func (m *Manager) phaseContext(ctx context.Context, phase string) context.Context {
+	m.phase = phase
+	if phase == phaseSnapshot || m.cfg.MaxBackupDurationAction != "finish" {
+		return ctx
+	}
+	if unbounded, ok := ctx.Value(windowKey{}).(context.Context); ok {
+		return unbounded
+	}
+	return ctx
+}
+
+// endWindow handles a run that exceeded MAX_BACKUP_DURATION and returns its error
+// A run interrupted while taking the snapshot or uploading is abandoned and
+// what it stored deleted, one interrupted later keeps its backups, one let
+// past the window by MAX_BACKUP_DURATION_ACTION=finish keeps its result
+// All are notified
+func (m *Manager) endWindow(ctx context.Context, start time.Time, runErr error) error {
+	window := time.Duration(m.cfg.MaxBackupDuration) * time.Second
+	elapsed := time.Since(start)
+	if window == 0 || elapsed < window {
+		return runErr
+	}
+	// The notification and the cleanup must outlive the run
+	ctx = context.WithoutCancel(ctx)
+
+	interrupted := m.phase == phaseSnapshot || m.cfg.MaxBackupDurationAction != "finish"
+	var message string
+	switch {
+	case !interrupted:
+		message = fmt.Sprintf("Backup of %s exceeded MAX_BACKUP_DURATION (%s) during the %s phase and ran for %s",
+			m.cfg.Target(), window, m.phase, elapsed.Round(time.Second))
+	case m.phase == phaseSnapshot || m.phase == phaseUpload:
+		message = fmt.Sprintf("Backup of %s exceeded MAX_BACKUP_DURATION (%s) during the %s phase and was abandoned",
+			m.cfg.Target(), window, m.phase)
+		if m.cfg.MaxBackupDurationAction != "finish" {
+			m.abandonStored(ctx)
+		}
+		err := errors.New(message)
+		if runErr != nil {
+			err = fmt.Errorf("%s: %w", message, runErr)
+		}
+		runErr = &categorizedError{category: ErrWindowExceeded, err: err}
+	default:
+		message = fmt.Sprintf("Backup of %s was stored but exceeded MAX_BACKUP_DURATION (%s), its %s was interrupted",
+			m.cfg.Target(), window, m.phase)
+	}
+
+	event := notify.Event{
+		Type:    notify.EventWindowExceeded,
+		Message: message,
+		Details: map[string]interface{}{
+			"phase":                m.phase,
+			"action":               m.cfg.MaxBackupDurationAction,
+			"max_duration_seconds": m.cfg.MaxBackupDuration,
+			"elapsed_seconds":      int(elapsed.Seconds()),
+			"interrupted":          interrupted,
+		},
+	}
+	log.Printf("WARNING: %s", event.Message)
+	if err := m.notifier.Notify(ctx, event); err != nil {
+		log.Printf("Warning: failed to send %s notification: %v", event.Type, err)
+	}
+	return runErr
+}
+
+// abandonStored deletes the backups stored by an abandoned run with their sidecars
+func (m *Manager) abandonStored(ctx context.Context) {
+	if len(m.stored) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(m.stored))
+	for _, stored := range m.stored {
+		names = append(names, stored.Name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	if _, err := m.deleteBackups(ctx, names, "backup window exceeded", m.cfg.ComplianceUnlockToken); err != nil {
+		log.Printf("Warning: failed to delete the backups of the abandoned run: %v", err)
+		return
+	}
+	log.Printf("Deleted the backups of the abandoned run: %v", names)
+	m.stored = nil
+}
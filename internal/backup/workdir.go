@@ -0,0 +1,238 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/metrics"
+)
+
+const (
+	// workLockName is the lock file held in each directory in use
+	workLockName = ".lock"
+	// workOrphanAge protects directories being created from the orphan cleanup
+	workOrphanAge = time.Minute
+	// workSampleInterval is how often the size of a run directory is measured
+	workSampleInterval = time.Second
+)
+
+// workDirKey is the context key of the directory temporary files are created in
+type workDirKey struct{}
+
+// workDir manages the scratch space below WORK_DIR
+// Each backup run gets its own subdirectory, removed when the run ends; other
+// operations of the process share a session subdirectory removed on Close
+// Directories are locked while in use, so those left by a crashed process
+// are recognized and removed at startup
+type workDir struct {
+	root string
+
+	mu          sync.Mutex
+	session     string
+	sessionLock *os.File
+}
+
+// newWorkDir creates WORK_DIR and removes the directories left by crashed processes
+func newWorkDir(cfg *config.Config) (*workDir, error) {
+	root := cfg.WorkDir
+	if root == "" {
+		root = filepath.Join(os.TempDir(), "redis-backup")
+	}
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+
+	w := &workDir{root: root}
+	w.removeOrphans()
+	return w, nil
+}
+
+// removeOrphans removes the subdirectories that no running process holds
+func (w *workDir) removeOrphans() {
+	entries, err := os.ReadDir(w.root)
+	if err != nil {
+		log.Printf("Warning: failed to read work directory: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || (!strings.HasPrefix(entry.Name(), "run-") && !strings.HasPrefix(entry.Name(), "session-")) {
+			continue
+		}
+		dir := filepath.Join(w.root, entry.Name())
+		if info, err := entry.Info(); err != nil || time.Since(info.ModTime()) < workOrphanAge {
+			continue
+		}
+		lock, err := lockDir(dir)
+		if err != nil {
+			// Held by a running process
+			continue
+		}
+
+		size := dirSize(dir)
+		err = os.RemoveAll(dir)
+		lock.Close()
+		if err != nil {
+			log.Printf("Warning: failed to remove orphaned work directory %s: %v", dir, err)
+			continue
+		}
+		log.Printf("Removed orphaned work directory %s (%s) left by an interrupted process", dir, config.FormatSize(size))
+	}
+}
+
+// startRun creates the directory of a backup run and returns a context whose
+// temporary files go there, and the function that reports its peak size and
+// removes it
+func (w *workDir) startRun(ctx context.Context, cfg *config.Config) (context.Context, func(), error) {
+	dir, lock, err := w.create("run-" + time.Now().UTC().Format("20060102-150405") + "-")
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	// Temporary files are short-lived, so the size is sampled during the run
+	var peak int64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(workSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				peak = max(peak, dirSize(dir))
+			}
+		}
+	}()
+
+	finish := func() {
+		close(stop)
+		<-sampled
+		peak = max(peak, dirSize(dir))
+		metrics.SetGauge("redis_backup_work_dir_peak_bytes", "Peak size of the work directory during the last backup run",
+			map[string]string{"target": cfg.Target()}, float64(peak))
+		log.Printf("Work directory peak usage: %s", config.FormatSize(peak))
+
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning: failed to remove work directory %s: %v", dir, err)
+		}
+		lock.Close()
+	}
+	return context.WithValue(ctx, workDirKey{}, dir), finish, nil
+}
+
+// sessionDir returns the directory of the operations that are not part of a
+// backup run, creating it on first use
+func (w *workDir) sessionDir() (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.session == "" {
+		dir, lock, err := w.create(fmt.Sprintf("session-%d-", os.Getpid()))
+		if err != nil {
+			return "", err
+		}
+		w.session, w.sessionLock = dir, lock
+	}
+	return w.session, nil
+}
+
+// context returns ctx with the session directory, unless it already has one
+func (w *workDir) context(ctx context.Context) context.Context {
+	if dir, _ := ctx.Value(workDirKey{}).(string); dir != "" {
+		return ctx
+	}
+	dir, err := w.sessionDir()
+	if err != nil {
+		log.Printf("Warning: %v, using the system temporary directory", err)
+		return ctx
+	}
+	return context.WithValue(ctx, workDirKey{}, dir)
+}
+
+// close removes the session directory
+func (w *workDir) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.session == "" {
+		return
+	}
+	if err := os.RemoveAll(w.session); err != nil {
+		log.Printf("Warning: failed to remove work directory %s: %v", w.session, err)
+	}
+	w.sessionLock.Close()
+	w.session, w.sessionLock = "", nil
+}
+
+// create creates and locks a new subdirectory
+func (w *workDir) create(prefix string) (string, *os.File, error) {
+	dir, err := os.MkdirTemp(w.root, prefix+"*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("failed to lock work directory: %w", err)
+	}
+	return dir, lock, nil
+}
+
+// lockDir takes the lock of a work subdirectory without waiting
+// The lock is released when the returned file is closed or the process exits
+func lockDir(dir string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(dir, workLockName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// dirSize returns the total size of the files below dir
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may be removed while walking
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if info, err := entry.Info(); err == nil && !entry.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// createTemp creates a temporary file in the work directory of ctx, or in
+// the system temporary directory when ctx has none
+func createTemp(ctx context.Context, pattern string) (*os.File, error) {
+	dir, _ := ctx.Value(workDirKey{}).(string)
+	return os.CreateTemp(dir, pattern)
+}
+
+// createTemp creates a temporary file in the directory of the current run,
+// or in the session directory
+func (m *Manager) createTemp(ctx context.Context, pattern string) (*os.File, error) {
+	return createTemp(m.work.context(ctx), pattern)
+}
@@ -0,0 +1,125 @@
+package buildinfo
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Name is the name of the tool recorded in manifests
+const Name = "docker-redis-backup"
+
+// Version, Commit and Date (RFC 3339) are set at build time with
+// -ldflags "-X github.com/ermos/docker-redis-backup/internal/buildinfo.Version=<version> -X ...Commit=<sha> -X ...Date=<date>"
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes a build of the tool
+type Info struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version,omitempty"`
+}
+
+// Get returns the build of the running tool
+// Without -ldflags, the version, commit and date are read from the module and
+// VCS information stamped by go build, when available
+func Get() Info {
+	info := Info{Name: Name, Version: Version, Commit: Commit, BuildDate: Date}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.GoVersion = build.GoVersion
+	if info.Version == "dev" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+		info.Version = build.Main.Version
+	}
+	if info.Commit == "" {
+		modified := false
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Commit = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			case "vcs.time":
+				// The commit time is the closest to a build date go build records
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			}
+		}
+		if info.Commit != "" && modified {
+			info.Commit += "-dirty"
+		}
+	}
+	return info
+}
+
+// Handler serves the build of the running tool as JSON
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(Get()); err != nil {
+			log.Printf("Warning: failed to encode version: %v", err)
+		}
+	})
+}
+
+// String returns the version with the start of the commit, e.g. "1.4.0 (3f2c1ab)"
+func (i Info) String() string {
+	if i.Commit == "" {
+		return i.Version
+	}
+	return i.Version + " (" + i.Commit[:min(len(i.Commit), 7)] + ")"
+}
+
+// Compare compares two release versions such as "1.4.0" or "v1.4.0", and
+// reports whether both are releases: development builds and pre-releases
+// (including Go pseudo-versions) are not compared
+func Compare(a, b string) (int, bool) {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			if va[i] < vb[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+// parseVersion parses the major, minor and patch numbers of a release
+// version, ignoring any build metadata
+func parseVersion(version string) ([3]int, bool) {
+	var parsed [3]int
+	version, _, _ = strings.Cut(strings.TrimPrefix(version, "v"), "+")
+	if strings.Contains(version, "-") {
+		return parsed, false
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
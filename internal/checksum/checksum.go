@@ -0,0 +1,98 @@
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Supported algorithms
+const (
+	SHA256 = "sha256"
+	SHA512 = "sha512"
+	XXHash = "xxhash64"
+	CRC32C = "crc32c"
+	MD5    = "md5"
+)
+
+// constructors creates the hash of each supported algorithm
+var constructors = map[string]func() hash.Hash{
+	SHA256: sha256.New,
+	SHA512: sha512.New,
+	XXHash: func() hash.Hash { return xxhash.New() },
+	CRC32C: func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	MD5:    md5.New,
+}
+
+// Supported reports whether an algorithm name is supported
+func Supported(name string) bool {
+	_, ok := constructors[name]
+	return ok
+}
+
+// Set computes the digests of several algorithms in a single pass
+// It is an io.Writer
+type Set struct {
+	names  []string
+	hashes []hash.Hash
+	writer io.Writer
+}
+
+// NewSet creates a Set for the named algorithms
+func NewSet(names []string) (*Set, error) {
+	set := &Set{}
+	writers := make([]io.Writer, 0, len(names))
+	for _, name := range names {
+		constructor, ok := constructors[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported checksum algorithm %q", name)
+		}
+		h := constructor()
+		set.names = append(set.names, name)
+		set.hashes = append(set.hashes, h)
+		writers = append(writers, h)
+	}
+	set.writer = io.MultiWriter(writers...)
+	return set, nil
+}
+
+// Write adds data to every digest
+func (s *Set) Write(p []byte) (int, error) {
+	return s.writer.Write(p)
+}
+
+// Sums returns the hex-encoded digest of each algorithm
+func (s *Set) Sums() map[string]string {
+	sums := make(map[string]string, len(s.names))
+	for i, name := range s.names {
+		sums[name] = hex.EncodeToString(s.hashes[i].Sum(nil))
+	}
+	return sums
+}
+
+// File returns the hex-encoded digests of a file
+func File(path string, names []string) (map[string]string, error) {
+	set, err := NewSet(names)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(set, file); err != nil {
+		return nil, err
+	}
+	return set.Sums(), nil
+}
@@ -1,38 +1,324 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/ermos/docker-redis-backup/internal/checksum"
 	"github.com/ermos/dotenv"
+	"github.com/robfig/cron/v3"
+)
+
+// CronParser parses BACKUP_CRON: standard expressions with optional seconds,
+// and descriptors such as @daily or @every 6h
+var CronParser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
 )
 
 type Config struct {
+	// Bundle of defaults (minimal, paranoid, cost-optimized), see profiles
+	Profile string `env:"PROFILE"`
+
 	// Redis configuration
 	RedisHost     string `env:"REDIS_HOST" default:"localhost"`
 	RedisPort     string `env:"REDIS_PORT" default:"6379"`
-	RedisPassword string `env:"REDIS_PASSWORD"`
+	RedisPassword string `env:"REDIS_PASSWORD" secret:"true"`
 	RedisDB       int    `env:"REDIS_DB" default:"0"`
 
+	// Restore target (empty host = restore into the Redis above)
+	RestoreRedisHost     string `env:"RESTORE_REDIS_HOST"`
+	RestoreRedisPort     string `env:"RESTORE_REDIS_PORT" default:"6379"`
+	RestoreRedisPassword string `env:"RESTORE_REDIS_PASSWORD" secret:"true"`
+	RestoreRedisDB       int    `env:"RESTORE_REDIS_DB" default:"-1"` // -1 = same database as in the backup
+
+	// Warm standby flushed and seeded with each new backup (empty host = disabled)
+	StandbyRedisHost     string `env:"STANDBY_REDIS_HOST"`
+	StandbyRedisPort     string `env:"STANDBY_REDIS_PORT" default:"6379"`
+	StandbyRedisPassword string `env:"STANDBY_REDIS_PASSWORD" secret:"true"`
+
+	// Number of connection attempts to Redis at startup
+	RedisConnectRetries int `env:"REDIS_CONNECT_RETRIES" default:"10"`
+
+	// Target discovery: empty for the single REDIS_HOST, or "kubernetes" to back up
+	// every service matching K8S_LABEL_SELECTOR
+	TargetDiscovery  string `env:"TARGET_DISCOVERY"`
+	K8sNamespace     string `env:"K8S_NAMESPACE"` // Empty = namespace of the pod
+	K8sLabelSelector string `env:"K8S_LABEL_SELECTOR"`
+	K8sPortName      string `env:"K8S_PORT_NAME" default:"redis"`
+
+	// Number of discovered targets backed up at the same time
+	MaxConcurrentBackups int `env:"MAX_CONCURRENT_BACKUPS" default:"1"`
+
+	// Directory holding the storage credentials of each discovered target in
+	// a sub-directory named after it (empty = shared credentials)
+	TargetCredentialsDir string `env:"TARGET_CREDENTIALS_DIR"`
+
+	// Server engine: auto, redis, valkey, keydb or dragonfly
+	Engine string `env:"ENGINE" default:"auto"`
+
 	// Backup configuration
 	BackupCron    string `env:"BACKUP_CRON" required:"true"`
 	BackupOnStart bool   `env:"BACKUP_ON_START" default:"false"`
 
+	// Retries of a run that failed with a transient error (Redis unavailable,
+	// storage network or server error), the delay doubles after each retry
+	BackupRetries    int `env:"BACKUP_RETRIES" default:"2"`
+	BackupRetryDelay int `env:"BACKUP_RETRY_DELAY" default:"30"` // Seconds
+
+	// Fraction of backups downloaded and verified after the run (0 = none,
+	// 1 = every backup); the first backup of each UTC day is always verified
+	VerifySampleRate float64 `env:"VERIFY_SAMPLE_RATE" default:"0"`
+
+	// Longest a backup run may take (seconds, 0 = no limit), and what happens
+	// to a backup still uploading when it is reached: abandon (cancel it and
+	// delete what was stored) or finish (complete it past the window)
+	MaxBackupDuration       int    `env:"MAX_BACKUP_DURATION" default:"1800"`
+	MaxBackupDurationAction string `env:"MAX_BACKUP_DURATION_ACTION" default:"abandon"`
+
+	// Go through each run without triggering BGSAVE, uploading or deleting anything
+	DryRun bool `env:"DRY_RUN" default:"false"`
+
+	// Extra backup when WRITE_TRIGGER_THRESHOLD writes accumulated since the last
+	// one (0 = disabled), counted from the dirty counter or keyspace notifications
+	WriteTriggerThreshold   int64  `env:"WRITE_TRIGGER_THRESHOLD" default:"0"`
+	WriteTriggerMinInterval int    `env:"WRITE_TRIGGER_MIN_INTERVAL" default:"900"` // Seconds
+	WriteTriggerSource      string `env:"WRITE_TRIGGER_SOURCE" default:"dirty"`
+
+	// Pub/sub channel on the target Redis accepting control commands (empty = disabled)
+	ControlChannel string `env:"CONTROL_CHANNEL"`
+	// Token prefixing every control command (empty = no token)
+	ControlToken string `env:"CONTROL_TOKEN" secret:"true"`
+
+	// URL prefixes allowed for the callbacks of "run" control commands
+	// (format: https://ci.example.com/hooks/,https://deploy.example.com/, empty = callbacks refused)
+	CallbackURLPrefixesRaw string `env:"CALLBACK_URL_PREFIXES"`
+	// Secret signing the callbacks with HMAC-SHA256 (empty = unsigned)
+	CallbackSecret string `env:"CALLBACK_SECRET" secret:"true"`
+
+	// Parsed callback URL prefixes (not from env, computed from CALLBACK_URL_PREFIXES)
+	CallbackURLPrefixes []string
+
+	// Distributed lock so only one of several replicas runs each backup
+	BackupLock    bool   `env:"BACKUP_LOCK" default:"false"`
+	BackupLockKey string `env:"BACKUP_LOCK_KEY" default:"redis-backup:lock"`
+	BackupLockTTL int    `env:"BACKUP_LOCK_TTL" default:"1800"` // Seconds
+
+	// Per-database split backups (one logical RDB file per DB index)
+	BackupSplitDatabases bool   `env:"BACKUP_SPLIT_DATABASES" default:"false"`
+	BackupDatabases      string `env:"BACKUP_DATABASES"` // Comma-separated DB indexes, empty = all non-empty DBs
+
+	// Parsed database list (not from env, computed from BACKUP_DATABASES)
+	BackupDatabaseList []int
+
+	// Back up Redis 7 functions (FUNCTION DUMP) alongside each backup
+	BackupFunctions bool `env:"BACKUP_FUNCTIONS" default:"false"`
+
+	// Capture sanitized CONFIG GET * and ACL LIST output alongside each backup
+	BackupServerConfig bool `env:"BACKUP_SERVER_CONFIG" default:"false"`
+
+	// Differential backups: a full backup every FULL_BACKUP_INTERVAL_DAYS days,
+	// and in between only the keys changed since that full backup
+	BackupDifferential     bool `env:"BACKUP_DIFFERENTIAL" default:"false"`
+	FullBackupIntervalDays int  `env:"FULL_BACKUP_INTERVAL_DAYS" default:"7"`
+
+	// Ship the data appended to the AOF (Redis 7 multi-part AOF in REDIS_DATA_PATH)
+	// every AOF_SHIP_INTERVAL seconds between snapshots
+	AOFShipping     bool `env:"AOF_SHIPPING" default:"false"`
+	AOFShipInterval int  `env:"AOF_SHIP_INTERVAL" default:"10"`
+
+	// Labels attached to every backup (format: env=prod,team=payments)
+	BackupLabelsRaw string `env:"BACKUP_LABELS"`
+	// Include the label values in backup file names
+	BackupLabelsInName bool `env:"BACKUP_LABELS_IN_NAME" default:"false"`
+
+	// Parsed labels (not from env, computed from BACKUP_LABELS)
+	BackupLabels map[string]string
+
+	// Interval between INFO polls while waiting for BGSAVE (milliseconds)
+	BGSAVEPollInterval int `env:"BGSAVE_POLL_INTERVAL_MS" default:"1000"`
+
+	// Give up waiting for BGSAVE after this long (seconds, 0 = no limit
+	// besides the backup timeout)
+	BGSAVETimeout int `env:"BGSAVE_TIMEOUT" default:"0"`
+
+	// Interval between BGSAVE progress log lines (seconds, 0 = disabled)
+	BGSAVEProgressInterval int `env:"BGSAVE_PROGRESS_INTERVAL" default:"30"`
+
+	// Server settings applied with CONFIG SET for the duration of BGSAVE
+	// (format: rdbcompression=no,rdb-key-save-delay=0), restored afterwards
+	BGSAVEConfigRaw string `env:"BGSAVE_CONFIG"`
+
+	// Parsed BGSAVE settings (not from env, computed from BGSAVE_CONFIG)
+	BGSAVEConfig map[string]string
+
+	// Memory available to Redis, the fork and its copy-on-write (format: 8GB,
+	// empty = total_system_memory from INFO), and the share of it the memory
+	// used during BGSAVE may reach before an alert (0 = disabled)
+	ForkMemoryLimitRaw     string  `env:"FORK_MEMORY_LIMIT"`
+	ForkMemoryAlertPercent float64 `env:"FORK_MEMORY_ALERT_PERCENT" default:"90"`
+
+	// Parsed fork memory limit in bytes (not from env, computed from FORK_MEMORY_LIMIT)
+	ForkMemoryLimit int64
+
+	// Synchronous SAVE fallback when BGSAVE is disabled or cannot fork
+	FallbackSave bool `env:"FALLBACK_SAVE" default:"false"`
+
+	// Never write to Redis: only read commands, BGSAVE and SAVE are sent, and
+	// restores and features storing keys are refused
+	ReadOnly bool `env:"READ_ONLY" default:"false"`
+
+	// Check of the ACL permissions of the Redis user at startup: fail, warn or off
+	ACLCheck string `env:"ACL_CHECK" default:"fail"`
+
+	// Renamed Redis commands (format: BGSAVE=MYBGSAVE,INFO=MYINFO), an empty
+	// name marks a disabled command (CONFIG=)
+	CommandAliasesRaw string `env:"COMMAND_ALIASES"`
+
+	// Parsed command aliases (not from env, computed from COMMAND_ALIASES)
+	CommandAliases map[string]string
+
 	// Storage configuration
 	StorageType string `env:"STORAGE_TYPE" default:"local"`
 
+	// Backup placement below the prefix: "flat" or "date" (YYYY/MM/DD/)
+	StorageLayout string `env:"STORAGE_LAYOUT" default:"flat"`
+
+	// Write/list/read/delete probe of the storage at startup: fail, warn or off
+	StorageProbe string `env:"STORAGE_PROBE" default:"warn"`
+
+	// Deduplicated chunk store: backups are split into content-defined chunks
+	// shared between backups (average chunk size in KB, power of two)
+	StorageDedup   bool `env:"STORAGE_DEDUP" default:"false"`
+	DedupChunkSize int  `env:"DEDUP_CHUNK_SIZE" default:"1024"`
+
+	// Scratch space of temporary files, with one subdirectory per backup run
+	// (empty = redis-backup in the system temporary directory)
+	WorkDir string `env:"WORK_DIR"`
+
+	// Upload tuning: per-part retries and resumable upload state (S3)
+	UploadPartRetries int    `env:"UPLOAD_PART_RETRIES" default:"3"`
+	UploadStateDir    string `env:"UPLOAD_STATE_DIR"` // Empty = resumable uploads disabled
+
+	// Failed uploads older than PARTIAL_UPLOAD_MAX_AGE hours (S3 multipart
+	// uploads, local .partial files) are removed every
+	// PARTIAL_UPLOAD_CLEANUP_INTERVAL hours (0 = disabled)
+	PartialUploadMaxAge          int `env:"PARTIAL_UPLOAD_MAX_AGE" default:"24"`
+	PartialUploadCleanupInterval int `env:"PARTIAL_UPLOAD_CLEANUP_INTERVAL" default:"6"`
+	// Delete the stale backups without a set manifest instead of only alerting
+	PartialSetDelete bool `env:"PARTIAL_SET_DELETE" default:"false"`
+
+	// Extra CA certificates (PEM bundle) trusted for storage HTTPS connections,
+	// e.g. for TLS-intercepting proxies
+	CACertFile string `env:"CA_CERT_FILE"`
+
+	// Client-side encryption (base64 AES-256 key) and the ID recorded with each backup
+	EncryptionKey   string `env:"ENCRYPTION_KEY" secret:"true"`
+	EncryptionKeyID string `env:"ENCRYPTION_KEY_ID" default:"default"`
+
+	// KMS key wrapping a per-backup data key (awskms://<key> or gcpkms://projects/.../cryptoKeys/<key>)
+	EncryptionKMSKey string `env:"ENCRYPTION_KMS_KEY"`
+
+	// Encrypt manifests and the other sidecars with the same key, keeping only
+	// the fields retention needs in plaintext
+	EncryptMetadata bool `env:"ENCRYPTION_METADATA" default:"false"`
+
+	// GPG recipient encryption: comma-separated public key files, and the private key used for restores
+	GPGRecipientKeys  string `env:"GPG_RECIPIENT_KEYS"`
+	GPGPrivateKeyFile string `env:"GPG_PRIVATE_KEY_FILE"`
+	GPGPassphrase     string `env:"GPG_PASSPHRASE" secret:"true"`
+
+	// Parsed recipient key files (not from env, computed from GPG_RECIPIENT_KEYS)
+	GPGRecipientKeyFiles []string
+
+	// Detached signatures of the backups: minisign or cosign private key (and its
+	// password) signing new backups, and public key checking them on restore and
+	// verify (empty = that of SIGNING_KEY_FILE)
+	SigningKeyFile       string `env:"SIGNING_KEY_FILE"`
+	SigningKeyPassword   string `env:"SIGNING_KEY_PASSWORD" secret:"true"`
+	SigningPublicKeyFile string `env:"SIGNING_PUBLIC_KEY_FILE"`
+
+	// Refuse to restore or verify backups without a signature
+	SignatureRequired bool `env:"SIGNATURE_REQUIRED" default:"false"`
+
+	// Older keys still accepted for decryption (format: id1=base64key,id2=base64key)
+	DecryptionKeysRaw string `env:"DECRYPTION_KEYS" secret:"true"`
+
+	// Parsed decryption keys (not from env, computed from DECRYPTION_KEYS)
+	DecryptionKeys map[string]string
+
+	// Directory holding the encryption keys of each discovered target in a
+	// sub-directory named after it (empty = shared keys)
+	TargetKeysDir string `env:"TARGET_KEYS_DIR"`
+
 	// Local storage configuration
 	LocalBackupPath string `env:"LOCAL_BACKUP_PATH" default:"/backups"`
 
+	// Flush local backups and their directory to disk before reporting success
+	LocalFsync bool `env:"LOCAL_FSYNC" default:"false"`
+
+	// Octal mode of local backup files (e.g. 0640, empty = 0666 minus the umask)
+	BackupFileModeRaw string `env:"BACKUP_FILE_MODE"`
+
+	// Parsed file mode (not from env, computed from BACKUP_FILE_MODE)
+	BackupFileMode os.FileMode
+
+	// Owner and group of local backup files (-1 = unchanged)
+	BackupUID int `env:"BACKUP_UID" default:"-1"`
+	BackupGID int `env:"BACKUP_GID" default:"-1"`
+
+	// Store a local backup identical to a previous one as a hard link to it
+	LocalHardLinks bool `env:"LOCAL_HARDLINK_DEDUP" default:"false"`
+
+	// LOCAL_BACKUP_PATH is an NFS or SMB mount: plain sequential writes,
+	// checked sizes and retries on stale file handles
+	LocalNetworkFS bool `env:"LOCAL_NETWORK_FS" default:"false"`
+
 	// S3 storage configuration (compatible with AWS S3, MinIO, etc.)
 	S3Endpoint     string `env:"S3_ENDPOINT"`
 	S3Region       string `env:"S3_REGION" default:"us-east-1"`
 	S3Bucket       string `env:"S3_BUCKET"`
 	S3AccessKey    string `env:"S3_ACCESS_KEY"`
-	S3SecretKey    string `env:"S3_SECRET_KEY"`
+	S3SecretKey    string `env:"S3_SECRET_KEY" secret:"true"`
 	S3PathStyle    bool   `env:"S3_PATH_STYLE" default:"false"`
 	S3BackupPrefix string `env:"S3_BACKUP_PREFIX"`
 
+	// Pay the requests to a requester-pays bucket (x-amz-request-payer)
+	S3RequesterPays bool `env:"S3_REQUESTER_PAYS" default:"false"`
+
+	// Endpoint used to list objects, for gateways serving listings apart
+	// from uploads and downloads (empty = S3_ENDPOINT)
+	S3ListEndpoint string `env:"S3_LIST_ENDPOINT"`
+
+	// Create the bucket when missing, with versioning or Object Lock
+	S3CreateBucket     bool `env:"S3_CREATE_BUCKET" default:"false"`
+	S3BucketVersioning bool `env:"S3_BUCKET_VERSIONING" default:"false"`
+	S3BucketObjectLock bool `env:"S3_BUCKET_OBJECT_LOCK" default:"false"`
+
+	// S3 TLS configuration for self-hosted endpoints with an internal CA
+	S3CACertFile         string `env:"S3_CA_CERT_FILE"`
+	S3InsecureSkipVerify bool   `env:"S3_INSECURE_SKIP_VERIFY" default:"false"`
+
+	// Store BACKUP_LABELS as S3 object tags (unsupported by some S3-compatible providers)
+	S3ObjectTagging bool `env:"S3_OBJECT_TAGGING" default:"true"`
+
+	// Integrity checksum sent with S3 uploads: sha256, md5 or none
+	// Empty: sha256 on AWS, none with S3_ENDPOINT (see S3Checksum)
+	S3UploadChecksum string `env:"S3_UPLOAD_CHECKSUM"`
+
+	// S3 multipart upload tuning (0 = SDK defaults: 5 MB parts, 5 parallel parts)
+	S3UploadPartSize    int `env:"S3_UPLOAD_PART_SIZE" default:"0"` // MB
+	S3UploadConcurrency int `env:"S3_UPLOAD_CONCURRENCY" default:"0"`
+
 	// GCP Cloud Storage configuration (native API with service account)
 	GCSBucket          string `env:"GCS_BUCKET"` // Format: gs://bucket-name/prefix
 	GCPCredentialsFile string `env:"GCP_CREDENTIALS_FILE"`
@@ -44,26 +330,351 @@ type Config struct {
 	// Backup retention
 	RetentionCount int `env:"RETENTION_COUNT" default:"0"`
 
+	// Free space kept on a local backup volume by deleting the oldest backups
+	// (format: 20GB, empty = disabled)
+	RetentionMinFreeRaw string `env:"RETENTION_MIN_FREE"`
+
+	// Parsed free space in bytes (not from env, computed from RETENTION_MIN_FREE)
+	RetentionMinFree int64
+
+	// Object tag (key or key=value) that pins a backup, S3 tags or GCS metadata (empty = disabled)
+	PinTag string `env:"PIN_TAG"`
+	// Days the backups of a snapshot stay pinned (0 = until unpinned)
+	SnapshotPinDays int `env:"SNAPSHOT_PIN_DAYS" default:"7"`
+
+	// Compliance mode: deleting backups needs the token whose SHA-256 is COMPLIANCE_UNLOCK_HASH
+	ComplianceMode        bool   `env:"COMPLIANCE_MODE" default:"false"`
+	ComplianceUnlockHash  string `env:"COMPLIANCE_UNLOCK_HASH" secret:"true"`
+	ComplianceUnlockToken string `env:"COMPLIANCE_UNLOCK_TOKEN" secret:"true"` // Lets the retention policy delete backups
+
+	// Audit log of backups, restores, deletions and administrative commands
+	AuditLogFile    string `env:"AUDIT_LOG_FILE"` // Append-only JSON lines file (empty = disabled)
+	AuditLogStorage bool   `env:"AUDIT_LOG_STORAGE" default:"false"`
+	// Size of AUDIT_LOG_FILE before it is rotated (format: 10MB, empty = never rotated)
+	AuditLogMaxSizeRaw string `env:"AUDIT_LOG_MAX_SIZE"`
+	AuditLogMaxFiles   int    `env:"AUDIT_LOG_MAX_FILES" default:"5"` // Rotated files kept
+
+	// Parsed size in bytes (not from env, computed from AUDIT_LOG_MAX_SIZE)
+	AuditLogMaxSize int64
+
+	// Retention of the run history and of the rotated audit log files
+	// (format: 90d for days, 5000 for runs, empty = kept forever)
+	HistoryRetentionRaw string `env:"HISTORY_RETENTION"`
+
+	// Parsed retention (not from env, computed from HISTORY_RETENTION)
+	HistoryRetentionDays    int
+	HistoryRetentionEntries int
+
+	// Asynchronous copy of each backup to a second storage (s3://, gs:// or a path, empty = disabled)
+	ReplicaStorage  string `env:"REPLICA_STORAGE"`
+	ReplicaS3Region string `env:"REPLICA_S3_REGION"`           // Empty = S3_REGION
+	ReplicaMaxLag   int    `env:"REPLICA_MAX_LAG" default:"2"` // Backups the replica may miss before alerting
+
+	// Digests recorded in the manifest (format: sha256,crc32c)
+	ChecksumAlgorithmsRaw string `env:"CHECKSUM_ALGORITHMS" default:"sha256"`
+
+	// Parsed checksum algorithms (not from env, computed from CHECKSUM_ALGORITHMS)
+	ChecksumAlgorithms []string
+
+	// Storage quota for usage alerting (format: 500GB, empty = no quota)
+	StorageQuotaRaw string `env:"STORAGE_QUOTA"`
+
+	// Parsed storage quota in bytes (not from env, computed from STORAGE_QUOTA)
+	StorageQuota int64
+
+	// Number of largest keys listed in the backup manifest (0 = disabled)
+	BigKeysTop int `env:"BIG_KEYS_TOP" default:"0"`
+
+	// Backup size anomaly detection (percent deviation from the recent average, 0 = disabled)
+	SizeAnomalyDropPercent   float64 `env:"SIZE_ANOMALY_DROP_PERCENT" default:"0"`
+	SizeAnomalyGrowthPercent float64 `env:"SIZE_ANOMALY_GROWTH_PERCENT" default:"0"`
+	SizeAnomalyWindow        int     `env:"SIZE_ANOMALY_WINDOW" default:"5"`
+
+	// Shell commands run at the phases of a backup run (empty = none)
+	HookPreBackup  string `env:"HOOK_PRE_BACKUP" secret:"true"`
+	HookPostBGSAVE string `env:"HOOK_POST_BGSAVE" secret:"true"`
+	HookPreUpload  string `env:"HOOK_PRE_UPLOAD" secret:"true"`
+	HookPostUpload string `env:"HOOK_POST_UPLOAD" secret:"true"`
+	HookPostBackup string `env:"HOOK_POST_BACKUP" secret:"true"`
+	HookTimeout    int    `env:"HOOK_TIMEOUT" default:"300"` // Seconds, 0 = no limit
+
+	// Maximum backup size (format: 10GB, empty = no limit) and what to do when exceeded
+	MaxBackupSizeRaw    string `env:"MAX_BACKUP_SIZE"`
+	MaxBackupSizeAction string `env:"MAX_BACKUP_SIZE_ACTION" default:"abort"`
+
+	// Parsed maximum backup size in bytes (not from env, computed from MAX_BACKUP_SIZE)
+	MaxBackupSize int64
+
+	// Notifications (JSON POST to a webhook)
+	NotifyWebhookURL string `env:"NOTIFY_WEBHOOK_URL" secret:"true"`
+
+	// Delivery of the notifications: retries after the first attempt, events
+	// queued per webhook, repeats of an event suppressed for a time and events
+	// sent per hour and webhook (0 = no limit)
+	NotifyRetries     int `env:"NOTIFY_RETRIES" default:"3"`
+	NotifyQueueSize   int `env:"NOTIFY_QUEUE_SIZE" default:"100"`
+	NotifyDedupWindow int `env:"NOTIFY_DEDUP_WINDOW" default:"3600"` // Seconds, 0 = disabled
+	NotifyRateLimit   int `env:"NOTIFY_RATE_LIMIT" default:"30"`
+
+	// Longest maintenance window muting the failure alerts of a target
+	MaintenanceMaxDuration int `env:"MAINTENANCE_MAX_DURATION" default:"86400"` // Seconds
+
+	// Per-target webhooks overriding NOTIFY_WEBHOOK_URL (format: svc1=URL,svc2=URL)
+	NotifyTargetWebhooksRaw string `env:"NOTIFY_TARGET_WEBHOOKS" secret:"true"`
+
+	// Parsed per-target webhooks (not from env, computed from NOTIFY_TARGET_WEBHOOKS)
+	NotifyTargetWebhooks map[string]string
+
+	// Webhooks by event type and optionally target, overriding the webhooks above
+	// (format: backup_failed=URL|URL,backup_succeeded=none,*@cache=URL)
+	NotifyRoutesRaw string `env:"NOTIFY_ROUTES" secret:"true"`
+
+	// Parsed routes (not from env, computed from NOTIFY_ROUTES), keyed by
+	// "event" or "event@target"; "none" routes to an empty list
+	NotifyRoutes map[string][]string
+
+	// Name of the discovered target (not from env, set by ForTarget)
+	TargetName string
+
+	// Directory of the credentials used by the storage of the target (not
+	// from env, set by UseTargetCredentials)
+	TargetCredentials string
+
+	// Directory of the encryption keys of the target (not from env, set by
+	// UseTargetKeys)
+	TargetKeys string
+
+	// Prometheus metrics endpoint address (e.g. :9090, empty = disabled)
+	MetricsAddr string `env:"METRICS_ADDR"`
+	// Serve the effective configuration, secrets redacted, on /config
+	ConfigEndpoint bool `env:"CONFIG_ENDPOINT" default:"false"`
+	// Fail on unknown variables looking like settings instead of warning
+	ConfigStrict bool `env:"CONFIG_STRICT" default:"false"`
+
+	// Opt-in check of the releases newer than the running version, every
+	// UPDATE_CHECK_INTERVAL hours, from a GitHub releases API URL
+	UpdateCheck         bool   `env:"UPDATE_CHECK" default:"false"`
+	UpdateCheckInterval int    `env:"UPDATE_CHECK_INTERVAL" default:"24"`
+	UpdateCheckURL      string `env:"UPDATE_CHECK_URL" default:"https://api.github.com/repos/ermos/docker-redis-backup/releases"`
+
+	// Parallel deletes for storages without a batch delete API (GCS)
+	DeleteConcurrency int `env:"DELETE_CONCURRENCY" default:"10"`
+
+	// Lifecycle rules of the bucket managed by the service (S3 and GCS)
+	LifecycleManage          bool   `env:"LIFECYCLE_MANAGE" default:"false"`
+	LifecycleTransitionDays  int    `env:"LIFECYCLE_TRANSITION_DAYS" default:"0"`
+	LifecycleTransitionClass string `env:"LIFECYCLE_TRANSITION_CLASS"`
+	LifecycleExpireDays      int    `env:"LIFECYCLE_EXPIRE_DAYS" default:"0"`
+
+	// Timeouts of a storage listing and of a delete request, so a hung cloud
+	// API fails the operation instead of blocking the scheduler (seconds, 0 = none)
+	ListTimeout   int `env:"LIST_TIMEOUT" default:"120"`
+	DeleteTimeout int `env:"DELETE_TIMEOUT" default:"60"`
+
 	// Redis data path (where dump.rdb is located)
 	RedisDataPath string `env:"REDIS_DATA_PATH" default:"/data"`
+
+	// RDB file name inside REDIS_DATA_PATH (empty = discovered from the server)
+	RedisRDBFileName string `env:"REDIS_RDB_FILENAME"`
+
+	// Upload the RDB file of the last save instead of triggering BGSAVE when it
+	// is at most this old (seconds, 0 = always trigger BGSAVE)
+	RDBReuseMaxAge int `env:"RDB_REUSE_MAX_AGE" default:"0"`
+
+	// Offset between the clocks of the container and of Redis above which a
+	// warning is logged (seconds, 0 = not checked)
+	ClockSkewThreshold int `env:"CLOCK_SKEW_THRESHOLD" default:"5"`
+
+	// Snapshot of the RDB file in WORK_DIR before it is read, so a BGSAVE
+	// finishing meanwhile cannot change it: auto (hard link, else copy), link,
+	// copy or off (read REDIS_DATA_PATH directly)
+	RDBSnapshot string `env:"RDB_SNAPSHOT" default:"auto"`
+
+	// RDB retrieval: "volume" reads REDIS_DATA_PATH directly, "docker" copies the
+	// file out of DOCKER_CONTAINER through the Docker API
+	RDBSource       string `env:"RDB_SOURCE" default:"volume"`
+	DockerHost      string `env:"DOCKER_HOST" default:"unix:///var/run/docker.sock"`
+	DockerContainer string `env:"DOCKER_CONTAINER"`
 }
 
 func Load() (*Config, error) {
-	// Try to load .env file (optional, won't fail if not found)
-	_ = dotenv.Parse(".env")
+	loadEnvFile()
 
 	var cfg Config
 	if err := dotenv.LoadStruct(&cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.applyProfile(); err != nil {
+		return nil, err
+	}
+
+	// Typos would otherwise silently fall back to the defaults
+	for _, unknown := range UnknownVariables() {
+		if cfg.ConfigStrict {
+			return nil, fmt.Errorf("unknown variable %s, rejected with CONFIG_STRICT", unknown)
+		}
+		log.Printf("Warning: unknown variable %s, ignored", unknown)
+	}
 
 	// Parse GCS_BUCKET URI (format: gs://bucket-name/optional/prefix)
 	if cfg.GCSBucket != "" {
 		cfg.GCPBucket, cfg.GCPBackupPrefix = parseGCSUri(cfg.GCSBucket)
 	}
 
+	// Parse BACKUP_DATABASES list (format: 0,2,5)
+	if cfg.BackupDatabases != "" {
+		dbs, err := parseDatabaseList(cfg.BackupDatabases)
+		if err != nil {
+			return nil, err
+		}
+		cfg.BackupDatabaseList = dbs
+	}
+
+	// Parse BACKUP_LABELS map (format: env=prod,team=payments)
+	if cfg.BackupLabelsRaw != "" {
+		labels, err := parseBackupLabels(cfg.BackupLabelsRaw)
+		if err != nil {
+			return nil, err
+		}
+		cfg.BackupLabels = labels
+	}
+
+	// Parse COMMAND_ALIASES map (format: BGSAVE=MYBGSAVE,INFO=MYINFO)
+	if cfg.CommandAliasesRaw != "" {
+		aliases, err := parseCommandAliases(cfg.CommandAliasesRaw)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CommandAliases = aliases
+	}
+
+	// Parse BGSAVE_CONFIG map (format: rdbcompression=no,rdb-key-save-delay=0)
+	if cfg.BGSAVEConfigRaw != "" {
+		settings, err := parseBGSAVEConfig(cfg.BGSAVEConfigRaw)
+		if err != nil {
+			return nil, err
+		}
+		cfg.BGSAVEConfig = settings
+	}
+
+	// Parse FORK_MEMORY_LIMIT (format: 8GB)
+	if cfg.ForkMemoryLimitRaw != "" {
+		limit, err := ParseSize(cfg.ForkMemoryLimitRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FORK_MEMORY_LIMIT: %w", err)
+		}
+		cfg.ForkMemoryLimit = limit
+	}
+
+	// Parse CHECKSUM_ALGORITHMS list (format: sha256,crc32c)
+	algorithms, err := parseChecksumAlgorithms(cfg.ChecksumAlgorithmsRaw)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ChecksumAlgorithms = algorithms
+
+	// Parse DECRYPTION_KEYS map (format: id1=base64key,id2=base64key)
+	if cfg.DecryptionKeysRaw != "" {
+		keys, err := parseDecryptionKeys(cfg.DecryptionKeysRaw)
+		if err != nil {
+			return nil, err
+		}
+		cfg.DecryptionKeys = keys
+	}
+
+	// Parse NOTIFY_TARGET_WEBHOOKS map (format: svc1=https://...,svc2=https://...)
+	if cfg.NotifyTargetWebhooksRaw != "" {
+		webhooks, err := parseTargetWebhooks(cfg.NotifyTargetWebhooksRaw)
+		if err != nil {
+			return nil, err
+		}
+		cfg.NotifyTargetWebhooks = webhooks
+	}
+
+	// Parse NOTIFY_ROUTES map (format: backup_failed=https://a|https://b,*@cache=https://c)
+	if cfg.NotifyRoutesRaw != "" {
+		routes, err := parseNotifyRoutes(cfg.NotifyRoutesRaw)
+		if err != nil {
+			return nil, err
+		}
+		cfg.NotifyRoutes = routes
+	}
+
+	// Parse CALLBACK_URL_PREFIXES list (format: https://ci.example.com/hooks/,...)
+	if cfg.CallbackURLPrefixesRaw != "" {
+		prefixes, err := parseCallbackURLPrefixes(cfg.CallbackURLPrefixesRaw)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CallbackURLPrefixes = prefixes
+	}
+
+	// Parse GPG_RECIPIENT_KEYS list (format: /keys/dr-team.asc,/keys/ops.asc)
+	for _, file := range strings.Split(cfg.GPGRecipientKeys, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			cfg.GPGRecipientKeyFiles = append(cfg.GPGRecipientKeyFiles, file)
+		}
+	}
+
+	// Parse STORAGE_QUOTA size (format: 500GB)
+	if cfg.StorageQuotaRaw != "" {
+		quota, err := ParseSize(cfg.StorageQuotaRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid STORAGE_QUOTA: %w", err)
+		}
+		cfg.StorageQuota = quota
+	}
+
+	// Parse RETENTION_MIN_FREE (format: 20GB)
+	if cfg.RetentionMinFreeRaw != "" {
+		minFree, err := ParseSize(cfg.RetentionMinFreeRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RETENTION_MIN_FREE: %w", err)
+		}
+		cfg.RetentionMinFree = minFree
+	}
+
+	// Parse AUDIT_LOG_MAX_SIZE (format: 10MB)
+	if cfg.AuditLogMaxSizeRaw != "" {
+		maxSize, err := ParseSize(cfg.AuditLogMaxSizeRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AUDIT_LOG_MAX_SIZE: %w", err)
+		}
+		cfg.AuditLogMaxSize = maxSize
+	}
+
+	// Parse HISTORY_RETENTION (format: 90d or 5000)
+	if cfg.HistoryRetentionRaw != "" {
+		days, entries, err := parseHistoryRetention(cfg.HistoryRetentionRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HISTORY_RETENTION: %w", err)
+		}
+		cfg.HistoryRetentionDays, cfg.HistoryRetentionEntries = days, entries
+	}
+
+	// Parse MAX_BACKUP_SIZE (format: 10GB)
+	if cfg.MaxBackupSizeRaw != "" {
+		maxSize, err := ParseSize(cfg.MaxBackupSizeRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAX_BACKUP_SIZE: %w", err)
+		}
+		cfg.MaxBackupSize = maxSize
+	}
+
+	// Parse BACKUP_FILE_MODE (format: 0640)
+	if cfg.BackupFileModeRaw != "" {
+		mode, err := strconv.ParseUint(cfg.BackupFileModeRaw, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid BACKUP_FILE_MODE %q: expected octal permissions like 0640", cfg.BackupFileModeRaw)
+		}
+		cfg.BackupFileMode = os.FileMode(mode)
+	}
+
 	// Validate storage-specific requirements
 	if err := cfg.validate(); err != nil {
+		if cfg.Profile != "" {
+			return nil, fmt.Errorf("%w (with the defaults of PROFILE %s)", err, cfg.Profile)
+		}
 		return nil, err
 	}
 
@@ -71,11 +682,354 @@ func Load() (*Config, error) {
 }
 
 func (c *Config) validate() error {
+	if _, err := CronParser.Parse(c.BackupCron); err != nil {
+		return fmt.Errorf("invalid BACKUP_CRON %q: %w", c.BackupCron, err)
+	}
+
+	switch c.Engine {
+	case "auto", "redis", "valkey", "keydb", "dragonfly":
+	default:
+		return errors.New("ENGINE must be 'auto', 'redis', 'valkey', 'keydb', or 'dragonfly'")
+	}
+
+	if c.BackupLock && c.BackupLockTTL <= 0 {
+		return errors.New("BACKUP_LOCK_TTL must be greater than 0")
+	}
+
+	if c.SizeAnomalyDropPercent < 0 || c.SizeAnomalyDropPercent > 100 {
+		return errors.New("SIZE_ANOMALY_DROP_PERCENT must be between 0 and 100")
+	}
+	if c.SizeAnomalyGrowthPercent < 0 {
+		return errors.New("SIZE_ANOMALY_GROWTH_PERCENT must not be negative")
+	}
+	if c.NotifyRetries < 0 || c.NotifyDedupWindow < 0 || c.NotifyRateLimit < 0 {
+		return errors.New("NOTIFY_RETRIES, NOTIFY_DEDUP_WINDOW and NOTIFY_RATE_LIMIT must not be negative")
+	}
+	if c.NotifyQueueSize < 1 {
+		return errors.New("NOTIFY_QUEUE_SIZE must be at least 1")
+	}
+	if c.HookTimeout < 0 {
+		return errors.New("HOOK_TIMEOUT must not be negative")
+	}
+	if c.UpdateCheck {
+		if c.UpdateCheckInterval < 1 {
+			return errors.New("UPDATE_CHECK_INTERVAL must be at least 1")
+		}
+		if c.UpdateCheckURL == "" {
+			return errors.New("UPDATE_CHECK_URL is required when UPDATE_CHECK is set")
+		}
+	}
+	if c.MaintenanceMaxDuration < 1 {
+		return errors.New("MAINTENANCE_MAX_DURATION must be at least 1")
+	}
+
+	if c.MaxBackupSizeAction != "abort" && c.MaxBackupSizeAction != "warn" {
+		return errors.New("MAX_BACKUP_SIZE_ACTION must be 'abort' or 'warn'")
+	}
+
+	if c.ComplianceMode {
+		if hash, err := hex.DecodeString(c.ComplianceUnlockHash); err != nil || len(hash) != sha256.Size {
+			return errors.New("COMPLIANCE_UNLOCK_HASH must be the hex SHA-256 of the unlock token when COMPLIANCE_MODE is enabled")
+		}
+	}
+
+	if c.ReplicaStorage != "" {
+		if !strings.HasPrefix(c.ReplicaStorage, "s3://") && !strings.HasPrefix(c.ReplicaStorage, "gs://") &&
+			!strings.HasPrefix(c.ReplicaStorage, "file://") && !strings.HasPrefix(c.ReplicaStorage, "/") {
+			return errors.New("REPLICA_STORAGE must start with 's3://', 'gs://', 'file://' or '/'")
+		}
+		if c.ReplicaMaxLag < 0 {
+			return errors.New("REPLICA_MAX_LAG must not be negative")
+		}
+	}
+
+	if c.StandbyRedisHost != "" {
+		if c.StandbyRedisHost == c.RedisHost && c.StandbyRedisPort == c.RedisPort {
+			return errors.New("STANDBY_REDIS_HOST must not be the backed up Redis, the standby is flushed before each seeding")
+		}
+		if c.TargetDiscovery != "" {
+			return errors.New("STANDBY_REDIS_HOST cannot be combined with TARGET_DISCOVERY")
+		}
+	}
+
+	if c.RestoreRedisDB < -1 {
+		return errors.New("RESTORE_REDIS_DB must be -1 (same database as in the backup) or a database index")
+	}
+
+	if c.EncryptionKey != "" && c.EncryptionKMSKey != "" {
+		return errors.New("ENCRYPTION_KEY and ENCRYPTION_KMS_KEY cannot be used together")
+	}
+	if c.EncryptionKMSKey != "" && !isKMSKeyURI(c.EncryptionKMSKey) {
+		return errors.New("ENCRYPTION_KMS_KEY must start with 'awskms://' or 'gcpkms://'")
+	}
+	if len(c.GPGRecipientKeyFiles) > 0 && (c.EncryptionKey != "" || c.EncryptionKMSKey != "") {
+		return errors.New("GPG_RECIPIENT_KEYS cannot be used together with ENCRYPTION_KEY or ENCRYPTION_KMS_KEY")
+	}
+	if c.EncryptionKey != "" && c.EncryptionKeyID == "" {
+		return errors.New("ENCRYPTION_KEY_ID must not be empty when ENCRYPTION_KEY is set")
+	}
+	if c.SignatureRequired && c.SigningKeyFile == "" && c.SigningPublicKeyFile == "" {
+		return errors.New("SIGNATURE_REQUIRED needs SIGNING_KEY_FILE or SIGNING_PUBLIC_KEY_FILE")
+	}
+	// With TARGET_KEYS_DIR, the keys of each target are checked when loaded
+	if c.EncryptMetadata && c.EncryptionKey == "" && c.EncryptionKMSKey == "" && c.TargetKeysDir == "" {
+		return errors.New("ENCRYPTION_METADATA requires ENCRYPTION_KEY or ENCRYPTION_KMS_KEY")
+	}
+	if c.TargetKeysDir != "" {
+		if c.TargetDiscovery == "" {
+			return errors.New("TARGET_KEYS_DIR requires TARGET_DISCOVERY")
+		}
+		if c.EncryptionKey != "" || c.EncryptionKMSKey != "" || len(c.GPGRecipientKeyFiles) > 0 || len(c.DecryptionKeys) > 0 {
+			return errors.New("TARGET_KEYS_DIR cannot be combined with ENCRYPTION_KEY, ENCRYPTION_KMS_KEY, GPG_RECIPIENT_KEYS or DECRYPTION_KEYS")
+		}
+	}
+
+	if c.AuditLogMaxSize > 0 && c.AuditLogFile == "" {
+		return errors.New("AUDIT_LOG_MAX_SIZE requires AUDIT_LOG_FILE")
+	}
+	if c.AuditLogMaxFiles < 1 {
+		return errors.New("AUDIT_LOG_MAX_FILES must be at least 1")
+	}
+
+	if len(c.BackupLabels) > maxBackupLabels {
+		return fmt.Errorf("BACKUP_LABELS supports at most %d labels (S3 object tag limit)", maxBackupLabels)
+	}
+	if c.BackupLabelsInName {
+		if len(c.BackupLabels) == 0 {
+			return errors.New("BACKUP_LABELS_IN_NAME requires BACKUP_LABELS")
+		}
+		for key, value := range c.BackupLabels {
+			if strings.Contains(value, "_") {
+				return fmt.Errorf("label %s=%s cannot be used in backup names: values must not contain '_'", key, value)
+			}
+		}
+	}
+
+	if c.MaxConcurrentBackups < 1 {
+		return errors.New("MAX_CONCURRENT_BACKUPS must be at least 1")
+	}
+
+	switch c.TargetDiscovery {
+	case "":
+	case "kubernetes":
+		if c.K8sLabelSelector == "" {
+			return errors.New("K8S_LABEL_SELECTOR is required when TARGET_DISCOVERY is 'kubernetes'")
+		}
+		if !c.BackupSplitDatabases {
+			return errors.New("BACKUP_SPLIT_DATABASES must be 'true' when TARGET_DISCOVERY is 'kubernetes' (RDB files of discovered pods are not reachable)")
+		}
+	default:
+		return errors.New("TARGET_DISCOVERY must be empty or 'kubernetes'")
+	}
+	if c.TargetCredentialsDir != "" {
+		if c.TargetDiscovery == "" {
+			return errors.New("TARGET_CREDENTIALS_DIR requires TARGET_DISCOVERY")
+		}
+		if c.StorageType != "s3" && c.StorageType != "gcp" {
+			return errors.New("TARGET_CREDENTIALS_DIR requires STORAGE_TYPE 's3' or 'gcp'")
+		}
+	}
+
+	switch c.RDBSource {
+	case "volume":
+	case "docker":
+		if c.DockerContainer == "" {
+			return errors.New("DOCKER_CONTAINER is required when RDB_SOURCE is 'docker'")
+		}
+	default:
+		return errors.New("RDB_SOURCE must be 'volume' or 'docker'")
+	}
+
+	if c.ReadOnly {
+		switch {
+		case c.BackupLock:
+			return errors.New("BACKUP_LOCK cannot be used with READ_ONLY (the lock is a Redis key)")
+		case c.AOFShipping:
+			return errors.New("AOF_SHIPPING cannot be used with READ_ONLY (the AOF marker is a Redis key)")
+		case c.ControlChannel != "":
+			return errors.New("CONTROL_CHANNEL cannot be used with READ_ONLY (replies are published to Redis)")
+		case len(c.BGSAVEConfig) > 0:
+			return errors.New("BGSAVE_CONFIG cannot be used with READ_ONLY (it changes the server configuration)")
+		}
+	}
+
+	if c.BGSAVEPollInterval < 10 {
+		return errors.New("BGSAVE_POLL_INTERVAL_MS must be at least 10 (milliseconds)")
+	}
+	if c.BGSAVETimeout < 0 {
+		return errors.New("BGSAVE_TIMEOUT must not be negative")
+	}
+	if c.BGSAVEProgressInterval < 0 {
+		return errors.New("BGSAVE_PROGRESS_INTERVAL must not be negative")
+	}
+	if c.ForkMemoryAlertPercent < 0 || c.ForkMemoryAlertPercent > 100 {
+		return errors.New("FORK_MEMORY_ALERT_PERCENT must be between 0 and 100")
+	}
+
+	if c.ClockSkewThreshold < 0 {
+		return errors.New("CLOCK_SKEW_THRESHOLD must not be negative")
+	}
+	if c.RDBReuseMaxAge < 0 {
+		return errors.New("RDB_REUSE_MAX_AGE must not be negative")
+	}
+
+	switch c.RDBSnapshot {
+	case "auto", "link", "copy", "off":
+	default:
+		return errors.New("RDB_SNAPSHOT must be 'auto', 'link', 'copy' or 'off'")
+	}
+
+	switch c.StorageLayout {
+	case "flat", "date":
+	default:
+		return errors.New("STORAGE_LAYOUT must be 'flat' or 'date'")
+	}
+
+	if c.BackupDifferential {
+		if c.BackupSplitDatabases {
+			return errors.New("BACKUP_DIFFERENTIAL cannot be combined with BACKUP_SPLIT_DATABASES")
+		}
+		if c.FullBackupIntervalDays < 1 {
+			return errors.New("FULL_BACKUP_INTERVAL_DAYS must be at least 1")
+		}
+	}
+
+	if c.WriteTriggerThreshold < 0 {
+		return errors.New("WRITE_TRIGGER_THRESHOLD must not be negative")
+	}
+	if c.WriteTriggerThreshold > 0 {
+		if c.TargetDiscovery != "" {
+			return errors.New("WRITE_TRIGGER_THRESHOLD cannot be combined with TARGET_DISCOVERY")
+		}
+		if c.WriteTriggerMinInterval < 0 {
+			return errors.New("WRITE_TRIGGER_MIN_INTERVAL must not be negative")
+		}
+		switch c.WriteTriggerSource {
+		case "dirty", "notifications":
+		default:
+			return errors.New("WRITE_TRIGGER_SOURCE must be 'dirty' or 'notifications'")
+		}
+	}
+
+	if c.ControlChannel != "" && c.TargetDiscovery != "" {
+		return errors.New("CONTROL_CHANNEL cannot be combined with TARGET_DISCOVERY")
+	}
+
+	if c.AOFShipping {
+		if c.RDBSource != "volume" {
+			return errors.New("AOF_SHIPPING requires RDB_SOURCE 'volume' (the AOF files are read from REDIS_DATA_PATH)")
+		}
+		if c.BackupSplitDatabases {
+			return errors.New("AOF_SHIPPING cannot be combined with BACKUP_SPLIT_DATABASES")
+		}
+		if c.AOFShipInterval < 1 {
+			return errors.New("AOF_SHIP_INTERVAL must be at least 1 (seconds)")
+		}
+	}
+
+	// A younger upload may still be running
+	if c.PartialUploadMaxAge < 1 {
+		return errors.New("PARTIAL_UPLOAD_MAX_AGE must be at least 1 (hours)")
+	}
+	if c.PartialUploadCleanupInterval < 0 {
+		return errors.New("PARTIAL_UPLOAD_CLEANUP_INTERVAL cannot be negative")
+	}
+	// Only a local volume reports its free space
+	if c.RetentionMinFree > 0 && c.StorageType != "local" {
+		return errors.New("RETENTION_MIN_FREE requires STORAGE_TYPE 'local'")
+	}
+	if c.BackupUID < -1 || c.BackupGID < -1 {
+		return errors.New("BACKUP_UID and BACKUP_GID must be a user or group ID, or -1 to keep the default")
+	}
+	if c.ListTimeout < 0 {
+		return errors.New("LIST_TIMEOUT cannot be negative")
+	}
+	if c.DeleteTimeout < 0 {
+		return errors.New("DELETE_TIMEOUT cannot be negative")
+	}
+	if c.SnapshotPinDays < 0 {
+		return errors.New("SNAPSHOT_PIN_DAYS cannot be negative")
+	}
+
+	if c.LifecycleManage {
+		if c.StorageType != "s3" && c.StorageType != "gcp" {
+			return errors.New("LIFECYCLE_MANAGE requires STORAGE_TYPE 's3' or 'gcp'")
+		}
+		if c.LifecycleTransitionDays < 0 || c.LifecycleExpireDays < 0 {
+			return errors.New("LIFECYCLE_TRANSITION_DAYS and LIFECYCLE_EXPIRE_DAYS cannot be negative")
+		}
+		if c.LifecycleTransitionDays > 0 && c.LifecycleTransitionClass == "" {
+			return errors.New("LIFECYCLE_TRANSITION_CLASS is required with LIFECYCLE_TRANSITION_DAYS")
+		}
+		if c.LifecycleExpireDays > 0 && c.LifecycleExpireDays <= c.LifecycleTransitionDays {
+			return errors.New("LIFECYCLE_EXPIRE_DAYS must be greater than LIFECYCLE_TRANSITION_DAYS")
+		}
+		// Chunks are shared with newer backups, expiring one breaks them
+		if c.StorageDedup {
+			return errors.New("LIFECYCLE_MANAGE cannot be combined with STORAGE_DEDUP")
+		}
+		// The bucket deletes expired backups without the unlock token nor an audit
+		if c.ComplianceMode && c.LifecycleExpireDays > 0 {
+			return errors.New("LIFECYCLE_EXPIRE_DAYS cannot be used in COMPLIANCE_MODE")
+		}
+	}
+
+	if c.StorageDedup {
+		if c.DedupChunkSize < 64 || c.DedupChunkSize > 16384 || c.DedupChunkSize&(c.DedupChunkSize-1) != 0 {
+			return errors.New("DEDUP_CHUNK_SIZE must be a power of two between 64 and 16384 (KB)")
+		}
+		if c.EncryptionKey != "" || c.EncryptionKMSKey != "" || len(c.GPGRecipientKeyFiles) > 0 || c.TargetKeysDir != "" {
+			return errors.New("STORAGE_DEDUP cannot be combined with encryption (encrypted backups share no chunks)")
+		}
+	}
+
+	if c.BackupRetries < 0 || c.BackupRetryDelay < 0 {
+		return errors.New("BACKUP_RETRIES and BACKUP_RETRY_DELAY must not be negative")
+	}
+
+	if c.MaxBackupDuration < 0 {
+		return errors.New("MAX_BACKUP_DURATION must not be negative")
+	}
+	if c.MaxBackupDurationAction != "abandon" && c.MaxBackupDurationAction != "finish" {
+		return errors.New("MAX_BACKUP_DURATION_ACTION must be 'abandon' or 'finish'")
+	}
+
+	if c.VerifySampleRate < 0 || c.VerifySampleRate > 1 {
+		return errors.New("VERIFY_SAMPLE_RATE must be between 0 and 1")
+	}
+
+	switch c.ACLCheck {
+	case "fail", "warn", "off":
+	default:
+		return errors.New("ACL_CHECK must be 'fail', 'warn' or 'off'")
+	}
+
+	switch c.StorageProbe {
+	case "fail", "warn", "off":
+	default:
+		return errors.New("STORAGE_PROBE must be 'fail', 'warn' or 'off'")
+	}
+
 	switch c.StorageType {
 	case "s3":
 		if c.S3Bucket == "" {
 			return errors.New("S3_BUCKET is required when STORAGE_TYPE is 's3'")
 		}
+		if c.S3UploadPartSize != 0 && c.S3UploadPartSize < 5 {
+			return errors.New("S3_UPLOAD_PART_SIZE must be at least 5 (MB)")
+		}
+		if c.S3UploadConcurrency < 0 {
+			return errors.New("S3_UPLOAD_CONCURRENCY must not be negative")
+		}
+		switch c.S3UploadChecksum {
+		case "", "sha256", "md5", "none":
+		default:
+			return errors.New("S3_UPLOAD_CHECKSUM must be 'sha256', 'md5' or 'none'")
+		}
+		// An existing bucket is never reconfigured
+		if (c.S3BucketVersioning || c.S3BucketObjectLock) && !c.S3CreateBucket {
+			return errors.New("S3_BUCKET_VERSIONING and S3_BUCKET_OBJECT_LOCK require S3_CREATE_BUCKET")
+		}
 	case "gcp":
 		if c.GCPBucket == "" {
 			return errors.New("GCS_BUCKET is required when STORAGE_TYPE is 'gcp' (format: gs://bucket-name/prefix)")
@@ -88,6 +1042,178 @@ func (c *Config) validate() error {
 	return nil
 }
 
+// ForTarget returns a copy of the configuration for another Redis target
+// The storage location is nested under the target name so each target is
+// listed and retained separately
+func (c *Config) ForTarget(name, host, port string) *Config {
+	target := *c
+	target.TargetName = name
+	target.RedisHost = host
+	target.RedisPort = port
+	target.LocalBackupPath = path.Join(c.LocalBackupPath, name)
+	target.S3BackupPrefix = path.Join(c.S3BackupPrefix, name)
+	target.GCPBackupPrefix = path.Join(c.GCPBackupPrefix, name)
+	if c.ReplicaStorage != "" {
+		location, query, found := strings.Cut(c.ReplicaStorage, "?")
+		target.ReplicaStorage = strings.TrimSuffix(location, "/") + "/" + name
+		if found {
+			target.ReplicaStorage += "?" + query
+		}
+	}
+	return &target
+}
+
+// Target returns the name identifying the backed up Redis in metrics and notifications
+// It is the discovered service name, or host:port for the single REDIS_HOST
+func (c *Config) Target() string {
+	if c.TargetName != "" {
+		return c.TargetName
+	}
+	return c.RedisHost + ":" + c.RedisPort
+}
+
+// CallbackAllowed reports whether a run callback may be sent to a URL
+func (c *Config) CallbackAllowed(callbackURL string) bool {
+	u, err := url.Parse(callbackURL)
+	if err != nil || u.User != nil {
+		return false
+	}
+	for _, prefix := range c.CallbackURLPrefixes {
+		if strings.HasPrefix(callbackURL, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForStorageURI returns a copy of the configuration using the storage at a
+// URI: s3://bucket/prefix, gs://bucket/prefix or a local path
+// (optionally file://); endpoints and credentials are shared with the configured storage
+func (c *Config) ForStorageURI(uri string) (*Config, error) {
+	target := *c
+	switch {
+	case strings.HasPrefix(uri, "s3://"):
+		target.StorageType = "s3"
+		location, query, _ := strings.Cut(strings.TrimPrefix(uri, "s3://"), "?")
+		target.S3Bucket, target.S3BackupPrefix, _ = strings.Cut(location, "/")
+		if err := target.setS3Options(query); err != nil {
+			return nil, err
+		}
+		// Resumable upload state belongs to the source storage
+		target.UploadStateDir = ""
+	case strings.HasPrefix(uri, "gs://"):
+		target.StorageType = "gcp"
+		target.GCPBucket, target.GCPBackupPrefix = parseGCSUri(uri)
+	case strings.HasPrefix(uri, "file://") || strings.HasPrefix(uri, "/"):
+		target.StorageType = "local"
+		target.LocalBackupPath = strings.TrimPrefix(uri, "file://")
+	default:
+		return nil, fmt.Errorf("unsupported storage URI %q (expected s3://, gs://, file:// or an absolute path)", uri)
+	}
+
+	if err := target.validate(); err != nil {
+		return nil, err
+	}
+	return &target, nil
+}
+
+// setS3Options applies the options of an s3:// URI query, e.g.
+// s3://bucket/prefix?region=eu-west-1&requester_pays=true
+func (c *Config) setS3Options(query string) error {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return fmt.Errorf("invalid storage URI options %q: %w", query, err)
+	}
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "region":
+			c.S3Region = value
+		case "endpoint":
+			c.S3Endpoint = value
+		case "list_endpoint":
+			c.S3ListEndpoint = value
+		case "requester_pays":
+			if c.S3RequesterPays, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid requester_pays %q in storage URI", value)
+			}
+		default:
+			return fmt.Errorf("unknown storage URI option %q (supported: region, endpoint, list_endpoint, requester_pays)", key)
+		}
+	}
+	return nil
+}
+
+// ForReplica returns a copy of the configuration using REPLICA_STORAGE
+// The options of the URI take precedence over REPLICA_S3_REGION
+func (c *Config) ForReplica() (*Config, error) {
+	base := *c
+	if c.ReplicaS3Region != "" {
+		base.S3Region = c.ReplicaS3Region
+	}
+	replica, err := base.ForStorageURI(c.ReplicaStorage)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REPLICA_STORAGE: %w", err)
+	}
+	replica.ReplicaStorage = ""
+	return replica, nil
+}
+
+// S3Checksum returns the checksum sent with S3 uploads
+// S3-compatible endpoints often reject x-amz-checksum-* headers, so only AWS
+// gets one unless S3_UPLOAD_CHECKSUM is set
+func (c *Config) S3Checksum() string {
+	switch {
+	case c.S3UploadChecksum != "":
+		return c.S3UploadChecksum
+	case c.S3Endpoint == "":
+		return "sha256"
+	default:
+		return "none"
+	}
+}
+
+// StorageURI returns the configured storage location in the form accepted by ForStorageURI
+func (c *Config) StorageURI() string {
+	switch c.StorageType {
+	case "s3":
+		return "s3://" + path.Join(c.S3Bucket, c.S3BackupPrefix)
+	case "gcp":
+		return "gs://" + path.Join(c.GCPBucket, c.GCPBackupPrefix)
+	default:
+		return c.LocalBackupPath
+	}
+}
+
+// ForRestore returns a copy of the configuration connecting to the restore target
+// Without RESTORE_REDIS_HOST, the backup source is also the restore target
+func (c *Config) ForRestore() *Config {
+	target := *c
+	if c.RestoreRedisHost != "" {
+		target.RedisHost = c.RestoreRedisHost
+		target.RedisPort = c.RestoreRedisPort
+		target.RedisPassword = c.RestoreRedisPassword
+	}
+	return &target
+}
+
+// ForStandby returns a copy of the configuration connecting to the warm standby
+// Features that only apply to the backed up Redis are disabled, and its
+// COMMAND_ALIASES are not applied to the standby
+func (c *Config) ForStandby() *Config {
+	target := *c
+	target.RedisHost = c.StandbyRedisHost
+	target.RedisPort = c.StandbyRedisPort
+	target.RedisPassword = c.StandbyRedisPassword
+	target.RedisConnectRetries = 1
+	target.ReadOnly = false
+	target.CommandAliases = nil
+	target.RDBReuseMaxAge = 0
+	target.ReplicaStorage = ""
+	target.StandbyRedisHost = ""
+	return &target
+}
+
 // parseGCSUri parses a GCS URI like "gs://bucket-name/path/to/prefix"
 // Returns the bucket name and the prefix (path within the bucket)
 func parseGCSUri(uri string) (bucket, prefix string) {
@@ -104,3 +1230,270 @@ func parseGCSUri(uri string) (bucket, prefix string) {
 
 	return bucket, prefix
 }
+
+// parseDatabaseList parses a comma-separated list of Redis DB indexes
+func parseDatabaseList(list string) ([]int, error) {
+	var dbs []int
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		db, err := strconv.Atoi(part)
+		if err != nil || db < 0 {
+			return nil, fmt.Errorf("invalid database index %q in BACKUP_DATABASES", part)
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, nil
+}
+
+// parseCommandAliases parses a comma-separated list of COMMAND=ALIAS pairs
+// An empty alias is kept, it marks the command as disabled
+func parseCommandAliases(list string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		command, alias, found := strings.Cut(part, "=")
+		command = strings.ToUpper(strings.TrimSpace(command))
+		alias = strings.TrimSpace(alias)
+		if !found || command == "" {
+			return nil, fmt.Errorf("invalid entry %q in COMMAND_ALIASES (format: COMMAND=ALIAS, or COMMAND= for a disabled command)", part)
+		}
+		aliases[command] = alias
+	}
+	return aliases, nil
+}
+
+// parseBGSAVEConfig parses a comma-separated list of name=value server settings
+func parseBGSAVEConfig(list string) (map[string]string, error) {
+	settings := make(map[string]string)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid entry %q in BGSAVE_CONFIG (format: name=value)", part)
+		}
+		settings[name] = strings.TrimSpace(value)
+	}
+	return settings, nil
+}
+
+// parseChecksumAlgorithms parses a comma-separated list of checksum algorithms
+func parseChecksumAlgorithms(list string) ([]string, error) {
+	var algorithms []string
+	for _, part := range strings.Split(list, ",") {
+		name := strings.ToLower(strings.TrimSpace(part))
+		if name == "" || slices.Contains(algorithms, name) {
+			continue
+		}
+		if !checksum.Supported(name) {
+			return nil, fmt.Errorf("unsupported algorithm %q in CHECKSUM_ALGORITHMS (supported: sha256, sha512, xxhash64, crc32c, md5)", name)
+		}
+		algorithms = append(algorithms, name)
+	}
+	if len(algorithms) == 0 {
+		return nil, errors.New("CHECKSUM_ALGORITHMS must list at least one algorithm")
+	}
+	return algorithms, nil
+}
+
+// parseTargetWebhooks parses a list like "cache=https://hooks/a,sessions=https://hooks/b"
+func parseTargetWebhooks(list string) (map[string]string, error) {
+	webhooks := make(map[string]string)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		target, url, found := strings.Cut(part, "=")
+		target = strings.TrimSpace(target)
+		url = strings.TrimSpace(url)
+		if !found || target == "" || url == "" {
+			return nil, fmt.Errorf("invalid entry %q in NOTIFY_TARGET_WEBHOOKS (format: TARGET=URL)", part)
+		}
+		webhooks[target] = url
+	}
+	return webhooks, nil
+}
+
+// notifyRoutePattern matches the key of a route: an event type or "*",
+// optionally followed by "@target"
+var notifyRoutePattern = regexp.MustCompile(`^(\*|[a-z_]+)(@.+)?$`)
+
+// parseNotifyRoutes parses a list like "backup_failed=https://a|https://b,backup_succeeded=none"
+func parseNotifyRoutes(list string) (map[string][]string, error) {
+	routes := make(map[string][]string)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(part, "=")
+		key = strings.TrimSpace(key)
+		if !found || !notifyRoutePattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid entry %q in NOTIFY_ROUTES (format: EVENT[@TARGET]=URL|URL or none)", part)
+		}
+		urls := []string{}
+		if value = strings.TrimSpace(value); value != "none" {
+			for _, u := range strings.Split(value, "|") {
+				u = strings.TrimSpace(u)
+				if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+					return nil, fmt.Errorf("invalid URL %q for %s in NOTIFY_ROUTES (expected http(s)://... or none)", u, key)
+				}
+				urls = append(urls, u)
+			}
+		}
+		routes[key] = urls
+	}
+	return routes, nil
+}
+
+// parseCallbackURLPrefixes parses a list like "https://ci/hooks/,https://deploy/"
+// Each prefix must be an http(s) URL with a host, ending the host with a path,
+// so "https://ci.example.com" cannot be extended to "https://ci.example.com.evil"
+func parseCallbackURLPrefixes(list string) ([]string, error) {
+	var prefixes []string
+	for _, part := range strings.Split(list, ",") {
+		prefix := strings.TrimSpace(part)
+		if prefix == "" {
+			continue
+		}
+		u, err := url.Parse(prefix)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || !strings.HasPrefix(u.Path, "/") {
+			return nil, fmt.Errorf("invalid entry %q in CALLBACK_URL_PREFIXES (format: https://host/path/)", prefix)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// maxBackupLabels is the number of tags S3 accepts on an object
+const maxBackupLabels = 10
+
+// backupLabelPattern restricts labels to characters valid in object tags, metadata and names
+var backupLabelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// parseBackupLabels parses a list like "env=prod,team=payments"
+func parseBackupLabels(list string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(part, "=")
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if !found || !backupLabelPattern.MatchString(key) || !backupLabelPattern.MatchString(value) {
+			return nil, fmt.Errorf("invalid entry %q in BACKUP_LABELS (format: KEY=VALUE, letters, digits, '.', '_' and '-')", part)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// parseDecryptionKeys parses a list like "2023=base64key,2024=base64key"
+// Base64 padding is kept since only the first "=" separates the ID
+func parseDecryptionKeys(list string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		id, key, found := strings.Cut(part, "=")
+		id = strings.TrimSpace(id)
+		key = strings.TrimSpace(key)
+		if !found || id == "" || key == "" {
+			return nil, fmt.Errorf("invalid entry in DECRYPTION_KEYS (format: ID=BASE64KEY)")
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// parseHistoryRetention parses a retention like "90d" (days) or "5000" (runs)
+func parseHistoryRetention(value string) (days, entries int, err error) {
+	value = strings.TrimSpace(value)
+	number, inDays := strings.CutSuffix(value, "d")
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 {
+		return 0, 0, fmt.Errorf("%q is not a number of days like 90d or of runs like 5000", value)
+	}
+	if inDays {
+		return n, 0, nil
+	}
+	return 0, n, nil
+}
+
+// sizeUnits maps size suffixes to their multiplier (binary units)
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1 << 10,
+	"KIB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1 << 20,
+	"MIB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1 << 30,
+	"GIB": 1 << 30,
+	"T":   1 << 40,
+	"TB":  1 << 40,
+	"TIB": 1 << 40,
+}
+
+// ParseSize parses a human-readable size like "500MB" or "1.5GB" into bytes
+// Units are binary (1KB = 1024 bytes)
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	i := strings.IndexFunc(size, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	number, unit := size, ""
+	if i >= 0 {
+		number, unit = size[:i], strings.TrimSpace(size[i:])
+	}
+
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q (supported: B, KB, MB, GB, TB)", unit)
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// FormatSize renders a byte count with a binary unit (e.g. "1.5 GB")
+func FormatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
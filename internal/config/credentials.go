@@ -0,0 +1,95 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files of the credentials directory of a target
+const (
+	targetAccessKeyFile      = "s3-access-key"
+	targetSecretKeyFile      = "s3-secret-key"
+	targetGCPCredentialsFile = "gcp-credentials.json"
+	targetBucketFile         = "bucket"
+	targetPrefixFile         = "prefix"
+)
+
+// UseTargetCredentials replaces the storage credentials with those of the
+// sub-directory of TARGET_CREDENTIALS_DIR named after the target, whose bucket
+// and prefix files, when present, also replace its storage location
+// A target without credentials is an error: it never falls back to the shared
+// credentials
+func (c *Config) UseTargetCredentials() error {
+	name := c.TargetName
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid target name %q", name)
+	}
+	dir := filepath.Join(c.TargetCredentialsDir, name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("no credentials for target %s in TARGET_CREDENTIALS_DIR (%s)", name, dir)
+	}
+
+	bucket, hasBucket, err := readTargetFile(dir, targetBucketFile)
+	if err != nil {
+		return err
+	}
+	prefix, hasPrefix, err := readTargetFile(dir, targetPrefixFile)
+	if err != nil {
+		return err
+	}
+	prefix = strings.Trim(prefix, "/")
+
+	switch c.StorageType {
+	case "s3":
+		accessKey, _, err := readTargetFile(dir, targetAccessKeyFile)
+		if err != nil {
+			return err
+		}
+		secretKey, _, err := readTargetFile(dir, targetSecretKeyFile)
+		if err != nil {
+			return err
+		}
+		if accessKey == "" || secretKey == "" {
+			return fmt.Errorf("%s and %s are required in %s", targetAccessKeyFile, targetSecretKeyFile, dir)
+		}
+		c.S3AccessKey, c.S3SecretKey = accessKey, secretKey
+		if hasBucket {
+			c.S3Bucket = bucket
+		}
+		if hasPrefix {
+			c.S3BackupPrefix = prefix
+		}
+	case "gcp":
+		file := filepath.Join(dir, targetGCPCredentialsFile)
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("%s is required in %s", targetGCPCredentialsFile, dir)
+		}
+		c.GCPCredentialsFile = file
+		if hasBucket {
+			c.GCPBucket = bucket
+		}
+		if hasPrefix {
+			c.GCPBackupPrefix = prefix
+		}
+	default:
+		return errors.New("TARGET_CREDENTIALS_DIR requires STORAGE_TYPE 's3' or 'gcp'")
+	}
+	c.TargetCredentials = dir
+	return nil
+}
+
+// readTargetFile reads a file of a credentials directory, reporting whether
+// it exists
+func readTargetFile(dir, name string) (string, bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
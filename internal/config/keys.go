@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files of the keys directory of a target
+const (
+	targetEncryptionKeyFile   = "encryption-key"
+	targetEncryptionKeyIDFile = "encryption-key-id"
+	targetKMSKeyFile          = "encryption-kms-key"
+	targetDecryptionKeysFile  = "decryption-keys"
+	targetGPGRecipientsDir    = "gpg-recipients"
+	targetGPGPrivateKeyFile   = "gpg-private-key"
+	targetGPGPassphraseFile   = "gpg-passphrase"
+)
+
+// UseTargetKeys replaces the encryption keys with those of the sub-directory of
+// TARGET_KEYS_DIR named after the target, so a leaked key only exposes the
+// backups of one target
+// The sub-directory must hold one key: a target is never stored unencrypted
+// nor with the key of another one
+func (c *Config) UseTargetKeys() error {
+	name := c.TargetName
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid target name %q", name)
+	}
+	dir := filepath.Join(c.TargetKeysDir, name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("no encryption keys for target %s in TARGET_KEYS_DIR (%s)", name, dir)
+	}
+
+	c.EncryptionKeyID = name
+	c.GPGRecipientKeyFiles, c.GPGPrivateKeyFile = nil, ""
+	c.DecryptionKeys = nil
+	for file, value := range map[string]*string{
+		targetEncryptionKeyFile: &c.EncryptionKey,
+		targetKMSKeyFile:        &c.EncryptionKMSKey,
+		targetGPGPassphraseFile: &c.GPGPassphrase,
+	} {
+		var err error
+		if *value, _, err = readTargetFile(dir, file); err != nil {
+			return err
+		}
+	}
+	id, _, err := readTargetFile(dir, targetEncryptionKeyIDFile)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		c.EncryptionKeyID = id
+	}
+	keys, _, err := readTargetFile(dir, targetDecryptionKeysFile)
+	if err != nil {
+		return err
+	}
+	if keys != "" {
+		// One ID=BASE64KEY per line, or comma-separated as in DECRYPTION_KEYS
+		if c.DecryptionKeys, err = parseDecryptionKeys(strings.ReplaceAll(keys, "\n", ",")); err != nil {
+			return fmt.Errorf("invalid %s of target %s: %w", targetDecryptionKeysFile, name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, targetGPGPrivateKeyFile)); err == nil {
+		c.GPGPrivateKeyFile = filepath.Join(dir, targetGPGPrivateKeyFile)
+	}
+	recipients, err := os.ReadDir(filepath.Join(dir, targetGPGRecipientsDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", targetGPGRecipientsDir, err)
+	}
+	for _, entry := range recipients {
+		// Kubernetes mounts the files of a Secret through hidden entries
+		if !strings.HasPrefix(entry.Name(), ".") {
+			c.GPGRecipientKeyFiles = append(c.GPGRecipientKeyFiles, filepath.Join(dir, targetGPGRecipientsDir, entry.Name()))
+		}
+	}
+
+	configured := 0
+	for _, set := range []bool{c.EncryptionKey != "", c.EncryptionKMSKey != "", len(c.GPGRecipientKeyFiles) > 0} {
+		if set {
+			configured++
+		}
+	}
+	switch {
+	case configured == 0:
+		return fmt.Errorf("one of %s, %s or %s is required in %s", targetEncryptionKeyFile, targetKMSKeyFile, targetGPGRecipientsDir, dir)
+	case configured > 1:
+		return fmt.Errorf("only one of %s, %s and %s may be set in %s", targetEncryptionKeyFile, targetKMSKeyFile, targetGPGRecipientsDir, dir)
+	case c.EncryptionKMSKey != "" && !isKMSKeyURI(c.EncryptionKMSKey):
+		return fmt.Errorf("%s of target %s must start with 'awskms://' or 'gcpkms://'", targetKMSKeyFile, name)
+	case c.EncryptMetadata && len(c.GPGRecipientKeyFiles) > 0:
+		return fmt.Errorf("ENCRYPTION_METADATA requires %s or %s for target %s", targetEncryptionKeyFile, targetKMSKeyFile, name)
+	}
+	c.TargetKeys = dir
+	return nil
+}
+
+// isKMSKeyURI reports whether a key is an awskms:// or gcpkms:// URI
+func isKMSKeyURI(key string) bool {
+	return strings.HasPrefix(key, "awskms://") || strings.HasPrefix(key, "gcpkms://")
+}
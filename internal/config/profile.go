@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// preset is a setting of a profile
+type preset struct {
+	name, value string
+}
+
+// profiles are the bundles of defaults selected with PROFILE; a setting of the
+// environment or the .env file always takes precedence
+var profiles = map[string][]preset{
+	// Backups only, at the lowest cost in transfers and alerts
+	"minimal": {
+		{"RETENTION_COUNT", "7"},
+		{"VERIFY_SAMPLE_RATE", "0"},
+		{"BACKUP_RETRIES", "1"},
+		{"NOTIFY_DEDUP_WINDOW", "86400"},
+	},
+	// Every backup verified and everything needed to rebuild the server kept
+	"paranoid": {
+		{"RETENTION_COUNT", "30"},
+		{"VERIFY_SAMPLE_RATE", "1"},
+		{"BACKUP_RETRIES", "3"},
+		{"CHECKSUM_ALGORITHMS", "sha256,sha512"},
+		{"LOCAL_FSYNC", "true"},
+		{"BACKUP_FUNCTIONS", "true"},
+		{"BACKUP_SERVER_CONFIG", "true"},
+		{"SIZE_ANOMALY_DROP_PERCENT", "50"},
+		{"SIZE_ANOMALY_GROWTH_PERCENT", "200"},
+		{"NOTIFY_RETRIES", "5"},
+		{"NOTIFY_DEDUP_WINDOW", "0"},
+	},
+	// Less storage and transfer: differential backups, a daily verification
+	"cost-optimized": {
+		{"RETENTION_COUNT", "14"},
+		{"VERIFY_SAMPLE_RATE", "0.01"},
+		{"BACKUP_DIFFERENTIAL", "true"},
+		{"FULL_BACKUP_INTERVAL_DAYS", "7"},
+		{"CHECKSUM_ALGORITHMS", "sha256"},
+		{"SIZE_ANOMALY_DROP_PERCENT", "50"},
+	},
+}
+
+// profileNames returns the names of the profiles, sorted
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// profileValue returns the value a profile gives to a variable
+func profileValue(profile, name string) (string, bool) {
+	for _, p := range profiles[profile] {
+		if p.name == name {
+			return p.value, true
+		}
+	}
+	return "", false
+}
+
+// applyProfile sets the presets of PROFILE that the environment and the .env
+// file don't set
+func (c *Config) applyProfile() error {
+	if c.Profile == "" {
+		return nil
+	}
+	presets, ok := profiles[c.Profile]
+	if !ok {
+		return fmt.Errorf("PROFILE must be one of %s", strings.Join(profileNames(), ", "))
+	}
+	for _, p := range presets {
+		if _, set := os.LookupEnv(p.name); set {
+			continue
+		}
+		if err := c.set(p.name, p.value); err != nil {
+			return fmt.Errorf("invalid %s of PROFILE %s: %w", p.name, c.Profile, err)
+		}
+	}
+	return nil
+}
+
+// set sets the field of a variable from its text value, as Load reads it
+func (c *Config) set(name, value string) error {
+	config := reflect.ValueOf(c).Elem()
+	for i := 0; i < config.NumField(); i++ {
+		if config.Type().Field(i).Tag.Get("env") != name {
+			continue
+		}
+		field := config.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(n))
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			field.SetFloat(f)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			field.SetBool(b)
+		default:
+			return fmt.Errorf("unsupported type %s", field.Kind())
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown variable %s", name)
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ermos/dotenv"
+)
+
+// envFile is the optional file loaded into the environment, overriding it
+const envFile = ".env"
+
+// Sources of a setting
+const (
+	SourceEnv     = "env"
+	SourceEnvFile = envFile
+	SourceProfile = "profile"
+	SourceDefault = "default"
+	SourceUnset   = "unset"
+)
+
+// k8sServiceVariable matches the variables Kubernetes sets for each service of
+// the namespace, e.g. REDIS_SERVICE_HOST or REDIS_PORT_6379_TCP_ADDR
+var k8sServiceVariable = regexp.MustCompile(`_(SERVICE_HOST|SERVICE_PORT(_\w+)?|PORT_\d+_(TCP|UDP|SCTP)(_\w+)?)$`)
+
+// redacted replaces the value of secrets
+const redacted = "<redacted>"
+
+// urlPassword matches the password of credentials embedded in URLs
+var urlPassword = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^:/@\s]*:)[^@/\s]+@`)
+
+// fileKeys are the variables set by envFile, loaded once
+var (
+	envFileOnce sync.Once
+	fileKeys    = make(map[string]bool)
+)
+
+// Setting is a configuration variable with its effective value
+type Setting struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Source   string `json:"source"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// loadEnvFile loads envFile into the environment, when it exists, and records
+// the variables it sets
+func loadEnvFile() {
+	envFileOnce.Do(func() {
+		_ = dotenv.Parse(envFile)
+		file, err := os.Open(envFile)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		readFileKeys(file)
+	})
+}
+
+// readFileKeys records the variables set by envFile
+func readFileKeys(file *os.File) {
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, _, ok := strings.Cut(line, "="); ok {
+			fileKeys[strings.TrimSpace(key)] = true
+		}
+	}
+}
+
+// Settings returns every variable of the configuration with the value Load
+// reads and its source
+// Values are read as set, so that an invalid configuration can still be
+// shown; secrets (fields tagged secret:"true") and passwords embedded in URLs
+// are redacted
+func Settings() []Setting {
+	loadEnvFile()
+
+	profile := os.Getenv("PROFILE")
+	configType := reflect.TypeOf(Config{})
+	var settings []Setting
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		setting := Setting{Name: name}
+		defaultValue, hasDefault := field.Tag.Lookup("default")
+		envValue, inEnv := os.LookupEnv(name)
+		presetValue, inProfile := profileValue(profile, name)
+		switch {
+		case fileKeys[name]:
+			setting.Source, setting.Value = SourceEnvFile, envValue
+		case inEnv:
+			setting.Source, setting.Value = SourceEnv, envValue
+		case inProfile:
+			setting.Source, setting.Value = SourceProfile, presetValue
+		case hasDefault:
+			setting.Source, setting.Value = SourceDefault, defaultValue
+		default:
+			setting.Source = SourceUnset
+		}
+
+		switch {
+		case field.Tag.Get("secret") == "true" && setting.Value != "":
+			setting.Value = redacted
+			setting.Redacted = true
+		case urlPassword.MatchString(setting.Value):
+			setting.Value = urlPassword.ReplaceAllString(setting.Value, "${1}"+redacted+"@")
+			setting.Redacted = true
+		}
+		settings = append(settings, setting)
+	}
+	return settings
+}
+
+// UnknownVariable is a variable of the environment that looks like a setting
+// but is none, e.g. a typo
+type UnknownVariable struct {
+	Name string
+	// Closest is the setting with the nearest name, empty when none is close
+	Closest string
+}
+
+// String describes the variable with its closest setting
+func (v UnknownVariable) String() string {
+	if v.Closest == "" {
+		return v.Name
+	}
+	return fmt.Sprintf("%s (did you mean %s?)", v.Name, v.Closest)
+}
+
+// UnknownVariables returns the variables of the environment and the .env file
+// starting with the first word of a setting (S3_, REDIS_, NOTIFY_, ...) that
+// are not settings, sorted by name
+func UnknownVariables() []UnknownVariable {
+	loadEnvFile()
+
+	known := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		if name := configType.Field(i).Tag.Get("env"); name != "" {
+			known[name] = true
+			prefix, _, _ := strings.Cut(name, "_")
+			prefixes[prefix] = true
+		}
+	}
+
+	var unknown []UnknownVariable
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		prefix, _, _ := strings.Cut(name, "_")
+		if known[name] || !prefixes[prefix] || k8sServiceVariable.MatchString(name) {
+			continue
+		}
+		variable := UnknownVariable{Name: name}
+		best := len(name)/3 + 1
+		for candidate := range known {
+			if d := editDistance(name, candidate); d < best || (d == best && candidate < variable.Closest) {
+				best, variable.Closest = d, candidate
+			}
+		}
+		unknown = append(unknown, variable)
+	}
+	slices.SortFunc(unknown, func(a, b UnknownVariable) int { return strings.Compare(a.Name, b.Name) })
+	return unknown
+}
+
+// editDistance returns the Levenshtein distance between two names
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
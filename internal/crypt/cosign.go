@@ -0,0 +1,185 @@
+package crypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// cosignKeyTypes are the PEM types of the private keys cosign generates,
+// encrypted with the password
+var cosignKeyTypes = map[string]bool{
+	"ENCRYPTED SIGSTORE PRIVATE KEY": true,
+	"ENCRYPTED COSIGN PRIVATE KEY":   true,
+}
+
+// cosignEncryptedKey is the content of an encrypted cosign private key
+type cosignEncryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// cosignPrivateKey is an ECDSA key signing like cosign sign-blob
+type cosignPrivateKey struct {
+	key *ecdsa.PrivateKey
+}
+
+// cosignPublicKey is an ECDSA key checking like cosign verify-blob
+type cosignPublicKey struct {
+	key *ecdsa.PublicKey
+}
+
+// parseCosignPrivateKey decodes a private key generated by cosign
+// generate-key-pair, or an unencrypted PEM ECDSA key
+func parseCosignPrivateKey(data, password []byte) (*cosignPrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("neither a minisign nor a PEM private key")
+	}
+
+	var key any
+	var err error
+	switch {
+	case cosignKeyTypes[block.Type]:
+		var der []byte
+		if der, err = decryptCosignKey(block.Bytes, password); err != nil {
+			return nil, err
+		}
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case block.Type == "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case block.Type == "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("only ECDSA cosign keys are supported")
+	}
+	return &cosignPrivateKey{key: ecKey}, nil
+}
+
+// decryptCosignKey decrypts the content of an encrypted cosign private key
+// (scrypt and NaCl secretbox)
+func decryptCosignKey(data, password []byte) ([]byte, error) {
+	var encrypted cosignEncryptedKey
+	if err := json.Unmarshal(data, &encrypted); err != nil {
+		return nil, fmt.Errorf("failed to decode encrypted key: %w", err)
+	}
+	if encrypted.KDF.Name != "scrypt" || encrypted.Cipher.Name != "nacl/secretbox" || len(encrypted.Cipher.Nonce) != 24 {
+		return nil, errors.New("unsupported key encryption")
+	}
+	derived, err := scrypt.Key(password, encrypted.KDF.Salt, encrypted.KDF.Params.N, encrypted.KDF.Params.R, encrypted.KDF.Params.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive the key encryption key: %w", err)
+	}
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], derived)
+	copy(nonce[:], encrypted.Cipher.Nonce)
+	der, ok := secretbox.Open(nil, encrypted.Ciphertext, &nonce, &key)
+	if !ok {
+		return nil, errors.New("wrong SIGNING_KEY_PASSWORD")
+	}
+	return der, nil
+}
+
+func (k *cosignPrivateKey) public() publicKey {
+	return &cosignPublicKey{key: &k.key.PublicKey}
+}
+
+// sign returns the base64 ASN.1 ECDSA signature of the SHA-256 of the content
+func (k *cosignPrivateKey) sign(r io.Reader, _ string) ([]byte, error) {
+	digest, err := sha256Digest(r)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := ecdsa.SignASN1(rand.Reader, k.key, digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// parseCosignPublicKey decodes a PEM public key, as written to cosign.pub
+func parseCosignPublicKey(data []byte) (*cosignPublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("not a PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("only ECDSA cosign keys are supported")
+	}
+	return &cosignPublicKey{key: ecKey}, nil
+}
+
+func (k *cosignPublicKey) suffix() string {
+	return CosignSuffix
+}
+
+// String identifies the key by the start of the SHA-256 of its DER encoding
+func (k *cosignPublicKey) String() string {
+	der, err := x509.MarshalPKIXPublicKey(k.key)
+	if err != nil {
+		return "cosign key"
+	}
+	sum := sha256.Sum256(der)
+	return fmt.Sprintf("cosign key sha256:%x", sum[:8])
+}
+
+// verify checks a base64 or raw ASN.1 ECDSA signature of the SHA-256 of the content
+func (k *cosignPublicKey) verify(r io.Reader, signature []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		raw = signature
+	}
+	digest, err := sha256Digest(r)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.VerifyASN1(k.key, digest, raw) {
+		return fmt.Errorf("%w: the backup does not match its signature or was signed with another key than %s", ErrBadSignature, k)
+	}
+	return nil
+}
+
+// sha256Digest returns the SHA-256 of the content of r
+func sha256Digest(r io.Reader) ([]byte, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,440 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+)
+
+// magic identifies encrypted backups, followed by a format version byte
+const magic = "RDBKCRYP"
+
+// FormatVersion is the version of the encrypted file format, the only one
+// this build decrypts
+const FormatVersion = 1
+
+// chunkSize is the plaintext size of each encrypted chunk
+const chunkSize = 64 * 1024
+
+// Chunk flags (also authenticated as additional data)
+const (
+	flagMore  = 0
+	flagFinal = 1
+)
+
+// dataKeySize is the size of the per-backup AES-256 data key
+const dataKeySize = 32
+
+// ErrUnknownKey is returned when a backup was encrypted with a key that is not configured
+var ErrUnknownKey = errors.New("encryption key not configured")
+
+// KeyWrapper encrypts (wraps) and decrypts (unwraps) per-backup data keys
+type KeyWrapper interface {
+	Wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// Keyring holds the key used to encrypt new backups and every key that can
+// decrypt existing ones, indexed by key ID
+// KMS keys are identified by their URI, so backups wrapped with KMS can be
+// decrypted without any configured key
+type Keyring struct {
+	currentID          string
+	mu                 sync.RWMutex
+	keys               map[string]KeyWrapper
+	gcpCredentialsFile string
+}
+
+// NewKeyring creates a keyring from ENCRYPTION_KEY, ENCRYPTION_KMS_KEY and DECRYPTION_KEYS
+// Without ENCRYPTION_KEY or ENCRYPTION_KMS_KEY, backups are not encrypted
+func NewKeyring(cfg *config.Config) (*Keyring, error) {
+	k := &Keyring{
+		keys:               make(map[string]KeyWrapper),
+		gcpCredentialsFile: cfg.GCPCredentialsFile,
+	}
+	for id, encoded := range cfg.DecryptionKeys {
+		wrapper, err := newAESWrapper(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in DECRYPTION_KEYS: %w", id, err)
+		}
+		k.keys[id] = wrapper
+	}
+
+	switch {
+	case cfg.EncryptionKMSKey != "":
+		wrapper, err := newKMSWrapper(context.Background(), cfg.EncryptionKMSKey, cfg.GCPCredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENCRYPTION_KMS_KEY: %w", err)
+		}
+		k.currentID = cfg.EncryptionKMSKey
+		k.keys[k.currentID] = wrapper
+	case cfg.EncryptionKey != "":
+		wrapper, err := newAESWrapper(cfg.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENCRYPTION_KEY: %w", err)
+		}
+		k.currentID = cfg.EncryptionKeyID
+		k.keys[k.currentID] = wrapper
+	}
+
+	return k, nil
+}
+
+// wrapper returns the wrapper of a key ID, creating KMS wrappers on demand
+func (k *Keyring) wrapper(ctx context.Context, id string) (KeyWrapper, error) {
+	if k == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	k.mu.RLock()
+	wrapper, ok := k.keys[id]
+	k.mu.RUnlock()
+	if ok {
+		return wrapper, nil
+	}
+	if !isKMSKey(id) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+
+	wrapper, err := newKMSWrapper(ctx, id, k.gcpCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Another goroutine may have created the same wrapper meanwhile, keep the first
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if existing, ok := k.keys[id]; ok {
+		return existing, nil
+	}
+	k.keys[id] = wrapper
+	return wrapper, nil
+}
+
+// CurrentKeyID returns the ID of the key used for new backups, or an empty
+// string when the keyring can only decrypt
+func (k *Keyring) CurrentKeyID() string {
+	if k == nil {
+		return ""
+	}
+	return k.currentID
+}
+
+// KeyIDs returns the IDs of every configured key
+func (k *Keyring) KeyIDs() []string {
+	if k == nil {
+		return nil
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Params describes how new backups are encrypted, recorded in manifests
+func (k *Keyring) Params() map[string]string {
+	keyWrap := "aes-256-gcm"
+	switch {
+	case strings.HasPrefix(k.CurrentKeyID(), awsKMSScheme):
+		keyWrap = "aws-kms"
+	case strings.HasPrefix(k.CurrentKeyID(), gcpKMSScheme):
+		keyWrap = "gcp-kms"
+	}
+	return map[string]string{
+		"cipher":     "aes-256-gcm",
+		"chunk_size": strconv.Itoa(chunkSize),
+		"key_wrap":   keyWrap,
+	}
+}
+
+// IsEncrypted reports whether data starts with the encrypted backup header
+func IsEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(magic))
+}
+
+// HeaderKeyID returns the key ID recorded in the header of an encrypted stream
+func HeaderKeyID(r io.Reader) (string, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return "", err
+	}
+	return h.keyID, nil
+}
+
+// Encrypt copies src to dst encrypted with the current key
+func (k *Keyring) Encrypt(ctx context.Context, dst io.Writer, src io.Reader) error {
+	if k.CurrentKeyID() == "" {
+		return errors.New("no encryption key configured")
+	}
+
+	dataKey, wrapped, err := k.newDataKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	h := header{keyID: k.currentID, wrappedKey: wrapped}
+	if err := h.write(dst); err != nil {
+		return err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	return sealChunks(aead, dst, src)
+}
+
+// Decrypt copies the encrypted src to dst, using the key recorded in its header
+// It returns the ID of the key that was used
+func (k *Keyring) Decrypt(ctx context.Context, dst io.Writer, src io.Reader) (string, error) {
+	br := bufio.NewReader(src)
+	h, err := readHeader(br)
+	if err != nil {
+		return "", err
+	}
+
+	wrapper, err := k.wrapper(ctx, h.keyID)
+	if err != nil {
+		return h.keyID, err
+	}
+
+	dataKey, err := wrapper.Unwrap(ctx, h.wrappedKey)
+	if err != nil {
+		return h.keyID, fmt.Errorf("failed to unwrap data key with key %s: %w", h.keyID, err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return h.keyID, err
+	}
+	return h.keyID, openChunks(aead, dst, br)
+}
+
+// newDataKey returns a new data key and its wrapped form for the current key
+func (k *Keyring) newDataKey(ctx context.Context) ([]byte, []byte, error) {
+	k.mu.RLock()
+	wrapper := k.keys[k.currentID]
+	k.mu.RUnlock()
+	if generator, ok := wrapper.(DataKeyGenerator); ok {
+		return generator.GenerateDataKey(ctx)
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err := wrapper.Wrap(ctx, dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return dataKey, wrapped, nil
+}
+
+// header is the clear-text header of an encrypted backup
+type header struct {
+	keyID      string
+	wrappedKey []byte
+}
+
+func (h header) write(w io.Writer) error {
+	if len(h.keyID) > 255 {
+		return errors.New("key ID too long")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.WriteByte(FormatVersion)
+	buf.WriteByte(byte(len(h.keyID)))
+	buf.WriteString(h.keyID)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(h.wrappedKey)))
+	buf.Write(h.wrappedKey)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readHeader(r io.Reader) (header, error) {
+	prefix := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return header{}, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	if !IsEncrypted(prefix) {
+		return header{}, errors.New("not an encrypted backup")
+	}
+	if prefix[len(magic)] != FormatVersion {
+		return header{}, fmt.Errorf("unsupported encryption format version %d", prefix[len(magic)])
+	}
+
+	keyID := make([]byte, prefix[len(magic)+1])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return header{}, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+
+	var wrappedLen uint16
+	if err := binary.Read(r, binary.BigEndian, &wrappedLen); err != nil {
+		return header{}, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	wrapped := make([]byte, wrappedLen)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return header{}, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+
+	return header{keyID: string(keyID), wrappedKey: wrapped}, nil
+}
+
+// sealChunks encrypts src in chunks of chunkSize
+// Each chunk is written as <flag:1><length:4><ciphertext>; the last one is
+// flagged so a truncated file is detected
+func sealChunks(aead cipher.AEAD, dst io.Writer, src io.Reader) error {
+	plain := make([]byte, chunkSize)
+	next := make([]byte, chunkSize)
+	n, err := io.ReadFull(src, plain)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	var counter uint64
+	for {
+		// Read ahead to know whether the current chunk is the last one
+		m, err := io.ReadFull(src, next)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+
+		flag := byte(flagMore)
+		if m == 0 {
+			flag = flagFinal
+		}
+
+		sealed := aead.Seal(nil, nonce(counter), plain[:n], []byte{flag})
+		var prefix [5]byte
+		prefix[0] = flag
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(sealed)))
+		if _, err := dst.Write(prefix[:]); err != nil {
+			return err
+		}
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+
+		if flag == flagFinal {
+			return nil
+		}
+		plain, next = next, plain
+		n = m
+		counter++
+	}
+}
+
+// openChunks decrypts the chunks written by sealChunks
+func openChunks(aead cipher.AEAD, dst io.Writer, src io.Reader) error {
+	var counter uint64
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(src, prefix[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("encrypted backup is truncated")
+			}
+			return err
+		}
+
+		length := binary.BigEndian.Uint32(prefix[1:])
+		if length > chunkSize+uint32(aead.Overhead()) {
+			return errors.New("encrypted backup is corrupted (invalid chunk length)")
+		}
+		sealed := make([]byte, length)
+		if _, err := io.ReadFull(src, sealed); err != nil {
+			return fmt.Errorf("encrypted backup is truncated: %w", err)
+		}
+
+		plain, err := aead.Open(nil, nonce(counter), sealed, prefix[:1])
+		if err != nil {
+			return errors.New("encrypted backup is corrupted or was modified")
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+
+		if prefix[0] == flagFinal {
+			return nil
+		}
+		counter++
+	}
+}
+
+// nonce builds the GCM nonce of a chunk
+// Data keys are never reused, so a counter is enough
+func nonce(counter uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aesWrapper wraps data keys with a static AES-256 key
+type aesWrapper struct {
+	aead cipher.AEAD
+}
+
+// newAESWrapper creates a wrapper from a base64-encoded 32-byte key
+func newAESWrapper(encoded string) (*aesWrapper, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("key must be base64 encoded: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesWrapper{aead: aead}, nil
+}
+
+// Wrap encrypts a data key, prefixing the result with its random nonce
+func (w *aesWrapper) Wrap(_ context.Context, dataKey []byte) ([]byte, error) {
+	n := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(n); err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(n, n, dataKey, nil), nil
+}
+
+// Unwrap decrypts a data key wrapped by Wrap
+func (w *aesWrapper) Unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	size := w.aead.NonceSize()
+	if len(wrapped) < size {
+		return nil, errors.New("wrapped key too short")
+	}
+	dataKey, err := w.aead.Open(nil, wrapped[:size], wrapped[size:], nil)
+	if err != nil {
+		return nil, errors.New("wrong key")
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,137 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	_ "crypto/sha256" // Hash functions negotiated with recipients
+	_ "crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/ermos/docker-redis-backup/internal/config"
+	_ "golang.org/x/crypto/ripemd160" // Assumed by OpenPGP for keys without hash preferences
+)
+
+// GPGSuffix is appended to the name of backups encrypted for GPG recipients
+const GPGSuffix = ".gpg"
+
+// GPG encrypts backups as standard OpenPGP messages that `gpg --decrypt` can read
+type GPG struct {
+	recipients openpgp.EntityList
+	private    openpgp.EntityList
+	passphrase []byte
+}
+
+// NewGPG loads the recipient public keys (GPG_RECIPIENT_KEYS) and the optional
+// private key used for restores (GPG_PRIVATE_KEY_FILE)
+// It returns nil when neither is configured
+func NewGPG(cfg *config.Config) (*GPG, error) {
+	if len(cfg.GPGRecipientKeyFiles) == 0 && cfg.GPGPrivateKeyFile == "" {
+		return nil, nil
+	}
+
+	g := &GPG{passphrase: []byte(cfg.GPGPassphrase)}
+	for _, file := range cfg.GPGRecipientKeyFiles {
+		keys, err := readKeyFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GPG recipient key %s: %w", file, err)
+		}
+		g.recipients = append(g.recipients, keys...)
+	}
+
+	if cfg.GPGPrivateKeyFile != "" {
+		keys, err := readKeyFile(cfg.GPGPrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GPG private key %s: %w", cfg.GPGPrivateKeyFile, err)
+		}
+		g.private = keys
+	}
+
+	return g, nil
+}
+
+// Enabled reports whether new backups are encrypted for recipients
+func (g *GPG) Enabled() bool {
+	return g != nil && len(g.recipients) > 0
+}
+
+// Params describes how new backups are encrypted, recorded in manifests
+func (g *GPG) Params() map[string]string {
+	ids := make([]string, 0, len(g.recipients))
+	for _, entity := range g.recipients {
+		ids = append(ids, entity.PrimaryKey.KeyIdString())
+	}
+	return map[string]string{
+		"cipher":      "aes-256",
+		"compression": "none",
+		"recipients":  strings.Join(ids, ","),
+	}
+}
+
+// Encrypt copies src to dst as a binary OpenPGP message for every recipient
+func (g *GPG) Encrypt(dst io.Writer, src io.Reader, fileName string) error {
+	plaintext, err := openpgp.Encrypt(dst, g.recipients, nil, &openpgp.FileHints{IsBinary: true, FileName: fileName}, &packet.Config{
+		DefaultCipher:          packet.CipherAES256,
+		DefaultCompressionAlgo: packet.CompressionNone,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start GPG encryption: %w", err)
+	}
+
+	if _, err := io.Copy(plaintext, src); err != nil {
+		plaintext.Close()
+		return err
+	}
+	return plaintext.Close()
+}
+
+// Decrypt copies a GPG-encrypted src to dst with the configured private key
+func (g *GPG) Decrypt(dst io.Writer, src io.Reader) error {
+	if g == nil || len(g.private) == 0 {
+		return errors.New("backup is GPG-encrypted: set GPG_PRIVATE_KEY_FILE to restore it, or decrypt it with gpg")
+	}
+
+	tried := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if symmetric || tried {
+			return nil, errors.New("wrong GPG_PASSPHRASE")
+		}
+		tried = true
+		for _, key := range keys {
+			if key.PrivateKey != nil && key.PrivateKey.Encrypted {
+				if err := key.PrivateKey.Decrypt(g.passphrase); err != nil {
+					return nil, errors.New("wrong GPG_PASSPHRASE")
+				}
+			}
+		}
+		return nil, nil
+	}
+
+	md, err := openpgp.ReadMessage(src, g.private, prompt, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt GPG message: %w", err)
+	}
+	if _, err := io.Copy(dst, md.UnverifiedBody); err != nil {
+		return fmt.Errorf("failed to decrypt GPG message: %w", err)
+	}
+	return nil
+}
+
+// readKeyFile reads an armored or binary OpenPGP key file
+func readKeyFile(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, err := armor.Decode(bytes.NewReader(data)); err == nil {
+		return openpgp.ReadKeyRing(bufio.NewReader(block.Body))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
@@ -0,0 +1,150 @@
+package crypt
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	cloudkms "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// KMS key URI schemes
+const (
+	awsKMSScheme = "awskms://"
+	gcpKMSScheme = "gcpkms://"
+)
+
+// DataKeyGenerator is implemented by wrappers that generate data keys themselves (AWS KMS)
+type DataKeyGenerator interface {
+	GenerateDataKey(ctx context.Context) (plain, wrapped []byte, err error)
+}
+
+// isKMSKey reports whether a key ID is a KMS key URI
+func isKMSKey(id string) bool {
+	return strings.HasPrefix(id, awsKMSScheme) || strings.HasPrefix(id, gcpKMSScheme)
+}
+
+// newKMSWrapper creates a wrapper for a KMS key URI
+// awskms://<key ARN, ID or alias> or gcpkms://projects/.../cryptoKeys/<key>
+func newKMSWrapper(ctx context.Context, uri, gcpCredentialsFile string) (KeyWrapper, error) {
+	switch {
+	case strings.HasPrefix(uri, awsKMSScheme):
+		return newAWSKMSWrapper(strings.TrimPrefix(uri, awsKMSScheme))
+	case strings.HasPrefix(uri, gcpKMSScheme):
+		return newGCPKMSWrapper(ctx, strings.TrimPrefix(uri, gcpKMSScheme), gcpCredentialsFile)
+	default:
+		return nil, fmt.Errorf("unsupported KMS key %q (expected awskms:// or gcpkms://)", uri)
+	}
+}
+
+// awsKMSWrapper wraps data keys with AWS KMS
+type awsKMSWrapper struct {
+	client *kms.KMS
+	keyID  string
+}
+
+// newAWSKMSWrapper creates an AWS KMS wrapper using the default credential chain
+// The region is taken from the key ARN, or from the AWS environment
+func newAWSKMSWrapper(keyID string) (*awsKMSWrapper, error) {
+	awsCfg := aws.Config{}
+	if parts := strings.Split(keyID, ":"); len(parts) > 3 && parts[0] == "arn" {
+		awsCfg.Region = aws.String(parts[3])
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsCfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+	return &awsKMSWrapper{client: kms.New(sess), keyID: keyID}, nil
+}
+
+// GenerateDataKey asks KMS for a new AES-256 data key
+func (w *awsKMSWrapper) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	out, err := w.client.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(w.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("KMS GenerateDataKey failed: %w", err)
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+// Wrap encrypts a data key with KMS
+func (w *awsKMSWrapper) Wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	out, err := w.client.EncryptWithContext(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(w.keyID),
+		Plaintext: dataKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("KMS Encrypt failed: %w", err)
+	}
+	return out.CiphertextBlob, nil
+}
+
+// Unwrap decrypts a data key with KMS
+func (w *awsKMSWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := w.client.DecryptWithContext(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(w.keyID),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("KMS Decrypt failed: %w", err)
+	}
+	return out.Plaintext, nil
+}
+
+// gcpKMSWrapper wraps data keys with Google Cloud KMS
+type gcpKMSWrapper struct {
+	keys *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
+	name string
+}
+
+// newGCPKMSWrapper creates a Cloud KMS wrapper using the service account file
+// or the application default credentials
+func newGCPKMSWrapper(ctx context.Context, name, credentialsFile string) (*gcpKMSWrapper, error) {
+	var opts []option.ClientOption
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+
+	service, err := cloudkms.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud KMS client: %w", err)
+	}
+	return &gcpKMSWrapper{keys: service.Projects.Locations.KeyRings.CryptoKeys, name: name}, nil
+}
+
+// Wrap encrypts a data key with Cloud KMS
+func (w *gcpKMSWrapper) Wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	out, err := w.keys.Encrypt(w.name, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(dataKey),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with Cloud KMS: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(out.Ciphertext)
+}
+
+// Unwrap decrypts a data key with Cloud KMS
+func (w *gcpKMSWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := w.keys.Decrypt(w.name, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with Cloud KMS: %w", err)
+	}
+	if out.Plaintext == "" {
+		return nil, errors.New("empty key returned by Cloud KMS")
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
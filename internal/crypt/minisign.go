@@ -0,0 +1,221 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Minisign algorithms: Ed25519 over the content, or over its BLAKE2b-512 hash
+// (prehashed, the only one minisign creates for large files)
+const (
+	minisignAlgorithm         = "Ed"
+	minisignPrehashed         = "ED"
+	minisignKDFScrypt         = "Sc"
+	minisignChecksumAlgorithm = "B2"
+)
+
+// minisignSecretKeySize is the size of a decoded minisign secret key
+const minisignSecretKeySize = 2 + 2 + 2 + 32 + 8 + 8 + 104
+
+// minisignPrivateKey is a minisign secret key
+type minisignPrivateKey struct {
+	id  [8]byte
+	key ed25519.PrivateKey
+}
+
+// minisignPublicKey is a minisign public key
+type minisignPublicKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// isMinisignKey reports whether a key file has the minisign layout
+func isMinisignKey(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("untrusted comment:"))
+}
+
+// minisignBase64 returns the decoded base64 line of a minisign file
+func minisignBase64(data []byte) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		return base64.StdEncoding.DecodeString(line)
+	}
+	return nil, errors.New("no key found")
+}
+
+// parseMinisignPrivateKey decodes a minisign secret key, decrypting it with
+// the password unless it was created without one (minisign -G -W)
+func parseMinisignPrivateKey(data, password []byte) (*minisignPrivateKey, error) {
+	decoded, err := minisignBase64(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid minisign secret key: %w", err)
+	}
+	if len(decoded) != minisignSecretKeySize || string(decoded[:2]) != minisignAlgorithm ||
+		string(decoded[4:6]) != minisignChecksumAlgorithm {
+		return nil, errors.New("invalid minisign secret key")
+	}
+	salt := decoded[6:38]
+	opsLimit := binary.LittleEndian.Uint64(decoded[38:46])
+	memLimit := binary.LittleEndian.Uint64(decoded[46:54])
+	secret := bytes.Clone(decoded[54:])
+
+	switch string(decoded[2:4]) {
+	case minisignKDFScrypt:
+		n, r, p := scryptParams(opsLimit, memLimit)
+		stream, err := scrypt.Key(password, salt, n, r, p, len(secret))
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive the key encryption key: %w", err)
+		}
+		subtle.XORBytes(secret, secret, stream)
+	case "\x00\x00":
+	default:
+		return nil, errors.New("unsupported minisign key derivation")
+	}
+
+	key := &minisignPrivateKey{key: ed25519.PrivateKey(secret[8:72])}
+	copy(key.id[:], secret[:8])
+	hash, _ := blake2b.New256(nil)
+	hash.Write(decoded[:2])
+	hash.Write(secret[:72])
+	if subtle.ConstantTimeCompare(hash.Sum(nil), secret[72:]) != 1 {
+		return nil, errors.New("wrong SIGNING_KEY_PASSWORD or corrupted minisign secret key")
+	}
+	return key, nil
+}
+
+// scryptParams converts the limits of a minisign secret key to the scrypt
+// parameters, as libsodium does
+func scryptParams(opsLimit, memLimit uint64) (n, r, p int) {
+	opsLimit = max(opsLimit, 32768)
+	r = 8
+	var maxN uint64
+	if opsLimit < memLimit/32 {
+		p = 1
+		maxN = opsLimit / uint64(r*4)
+	} else {
+		maxN = memLimit / uint64(r*128)
+	}
+	logN := 1
+	for ; logN < 63; logN++ {
+		if uint64(1)<<logN > maxN/2 {
+			break
+		}
+	}
+	if p == 0 {
+		maxRP := min((opsLimit/4)/(uint64(1)<<logN), 0x3fffffff)
+		p = int(maxRP) / r
+	}
+	return 1 << logN, r, p
+}
+
+func (k *minisignPrivateKey) public() publicKey {
+	return &minisignPublicKey{id: k.id, key: k.key.Public().(ed25519.PublicKey)}
+}
+
+// sign creates a prehashed minisign signature, whose trusted comment records
+// the time and the file name
+func (k *minisignPrivateKey) sign(r io.Reader, name string) ([]byte, error) {
+	hash, _ := blake2b.New512(nil)
+	if _, err := io.Copy(hash, r); err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	signature := ed25519.Sign(k.key, hash.Sum(nil))
+	trusted := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", time.Now().Unix(), path.Base(name))
+	global := ed25519.Sign(k.key, append(bytes.Clone(signature), trusted...))
+
+	encoded := append([]byte(minisignPrehashed), k.id[:]...)
+	encoded = append(encoded, signature...)
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "untrusted comment: signature from redis-backup with %s\n", k.public())
+	fmt.Fprintf(&out, "%s\n", base64.StdEncoding.EncodeToString(encoded))
+	fmt.Fprintf(&out, "trusted comment: %s\n", trusted)
+	fmt.Fprintf(&out, "%s\n", base64.StdEncoding.EncodeToString(global))
+	return out.Bytes(), nil
+}
+
+// parseMinisignPublicKey decodes a minisign public key file, or the key alone
+func parseMinisignPublicKey(data []byte) (*minisignPublicKey, error) {
+	decoded, err := minisignBase64(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid minisign public key: %w", err)
+	}
+	if len(decoded) != 2+8+ed25519.PublicKeySize || string(decoded[:2]) != minisignAlgorithm {
+		return nil, errors.New("invalid minisign public key")
+	}
+	key := &minisignPublicKey{key: ed25519.PublicKey(decoded[10:])}
+	copy(key.id[:], decoded[2:10])
+	return key, nil
+}
+
+func (k *minisignPublicKey) suffix() string {
+	return MinisignSuffix
+}
+
+// String returns the key ID as minisign prints it
+func (k *minisignPublicKey) String() string {
+	return fmt.Sprintf("minisign key %016X", binary.LittleEndian.Uint64(k.id[:]))
+}
+
+// verify checks a minisign signature and its trusted comment
+func (k *minisignPublicKey) verify(r io.Reader, signature []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) < 4 {
+		return fmt.Errorf("%w: not a minisign signature", ErrBadSignature)
+	}
+	encoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(encoded) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("%w: not a minisign signature", ErrBadSignature)
+	}
+	trusted, ok := strings.CutPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !ok {
+		return fmt.Errorf("%w: no trusted comment", ErrBadSignature)
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return fmt.Errorf("%w: invalid global signature", ErrBadSignature)
+	}
+	if !bytes.Equal(encoded[2:10], k.id[:]) {
+		return fmt.Errorf("%w: signed with key %016X, not %s", ErrBadSignature, binary.LittleEndian.Uint64(encoded[2:10]), k)
+	}
+
+	var message []byte
+	switch string(encoded[:2]) {
+	case minisignPrehashed:
+		hash, _ := blake2b.New512(nil)
+		if _, err := io.Copy(hash, r); err != nil {
+			return fmt.Errorf("failed to read backup: %w", err)
+		}
+		message = hash.Sum(nil)
+	case minisignAlgorithm:
+		if message, err = io.ReadAll(r); err != nil {
+			return fmt.Errorf("failed to read backup: %w", err)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported minisign algorithm", ErrBadSignature)
+	}
+	sig := encoded[10:]
+	if !ed25519.Verify(k.key, message, sig) {
+		return fmt.Errorf("%w: the backup does not match its signature", ErrBadSignature)
+	}
+	if !ed25519.Verify(k.key, append(bytes.Clone(sig), trusted...), global) {
+		return fmt.Errorf("%w: the trusted comment does not match its signature", ErrBadSignature)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+)
+
+// Suffixes appended to the name of a backup for its detached signature
+const (
+	MinisignSuffix = ".minisig"
+	CosignSuffix   = ".sig"
+)
+
+// ErrBadSignature is returned when a signature does not match the backup or
+// was not made with the configured key
+var ErrBadSignature = errors.New("invalid signature")
+
+// privateKey signs backups in the format of its tool
+type privateKey interface {
+	sign(r io.Reader, name string) ([]byte, error)
+	public() publicKey
+}
+
+// publicKey checks the signatures of its tool
+type publicKey interface {
+	verify(r io.Reader, signature []byte) error
+	suffix() string
+	String() string
+}
+
+// Signer creates detached signatures of backups that minisign or cosign can
+// check, and checks them on restore
+type Signer struct {
+	private privateKey
+	public  publicKey
+}
+
+// signerFiles identifies the keys of a signer
+type signerFiles struct {
+	key, password, public string
+}
+
+// signers caches the loaded signers: decrypting a minisign key takes a second
+// and a gigabyte of memory, and every target and replica has a manager
+var (
+	signersMu sync.Mutex
+	signers   = make(map[signerFiles]*Signer)
+)
+
+// NewSigner loads the signing key (SIGNING_KEY_FILE) and the public key
+// checking signatures (SIGNING_PUBLIC_KEY_FILE, by default that of the
+// signing key)
+// The format is detected from the key files; it returns nil when neither is
+// configured
+func NewSigner(cfg *config.Config) (*Signer, error) {
+	if cfg.SigningKeyFile == "" && cfg.SigningPublicKeyFile == "" {
+		return nil, nil
+	}
+	files := signerFiles{cfg.SigningKeyFile, cfg.SigningKeyPassword, cfg.SigningPublicKeyFile}
+	signersMu.Lock()
+	defer signersMu.Unlock()
+	if s, ok := signers[files]; ok {
+		return s, nil
+	}
+
+	s := &Signer{}
+	if cfg.SigningKeyFile != "" {
+		data, err := os.ReadFile(cfg.SigningKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SIGNING_KEY_FILE: %w", err)
+		}
+		if isMinisignKey(data) {
+			s.private, err = parseMinisignPrivateKey(data, []byte(cfg.SigningKeyPassword))
+		} else {
+			s.private, err = parseCosignPrivateKey(data, []byte(cfg.SigningKeyPassword))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid SIGNING_KEY_FILE: %w", err)
+		}
+		s.public = s.private.public()
+	}
+
+	if cfg.SigningPublicKeyFile != "" {
+		data, err := os.ReadFile(cfg.SigningPublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SIGNING_PUBLIC_KEY_FILE: %w", err)
+		}
+		var public publicKey
+		if isMinisignKey(data) || !bytes.Contains(data, []byte("-----BEGIN")) {
+			public, err = parseMinisignPublicKey(data)
+		} else {
+			public, err = parseCosignPublicKey(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid SIGNING_PUBLIC_KEY_FILE: %w", err)
+		}
+		if s.private != nil && public.suffix() != s.private.public().suffix() {
+			return nil, errors.New("SIGNING_KEY_FILE and SIGNING_PUBLIC_KEY_FILE are not keys of the same tool")
+		}
+		s.public = public
+	}
+	signers[files] = s
+	return s, nil
+}
+
+// CanSign reports whether new backups are signed
+func (s *Signer) CanSign() bool {
+	return s != nil && s.private != nil
+}
+
+// Suffix returns the suffix of the signatures of the configured tool
+func (s *Signer) Suffix() string {
+	return s.public.suffix()
+}
+
+// String describes the key checking the signatures
+func (s *Signer) String() string {
+	return s.public.String()
+}
+
+// Sign returns the detached signature of the content of r, stored as name
+func (s *Signer) Sign(r io.Reader, name string) ([]byte, error) {
+	return s.private.sign(r, name)
+}
+
+// Verify checks a detached signature of the content of r, and returns
+// ErrBadSignature when it does not match
+func (s *Signer) Verify(r io.Reader, signature []byte) error {
+	return s.public.verify(r, signature)
+}
@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Client is a minimal Docker Engine API client
+type Client struct {
+	http    *http.Client
+	baseURL string
+}
+
+// NewClient creates a client for a DOCKER_HOST style address
+// Supported formats: unix:///var/run/docker.sock and tcp://host:port
+func NewClient(host string) (*Client, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &Client{
+			http:    &http.Client{Transport: transport},
+			baseURL: "http://docker",
+		}, nil
+	case "tcp", "http":
+		return &Client{
+			http:    &http.Client{},
+			baseURL: "http://" + u.Host,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host scheme %q (supported: unix, tcp)", u.Scheme)
+	}
+}
+
+// CopyFile copies a single file out of a container into w
+// It uses the container archive endpoint, which returns the file as a tar stream
+func (c *Client) CopyFile(ctx context.Context, container, filePath string, w io.Writer) (int64, error) {
+	endpoint := fmt.Sprintf("%s/containers/%s/archive?path=%s", c.baseURL, url.PathEscape(container), url.QueryEscape(filePath))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("docker API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("docker API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	name := path.Base(filePath)
+	archive := tar.NewReader(resp.Body)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("file %s not found in container archive", filePath)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read container archive: %w", err)
+		}
+
+		if header.Typeflag == tar.TypeReg && path.Base(header.Name) == name {
+			n, err := io.Copy(w, archive)
+			if err != nil {
+				return n, fmt.Errorf("failed to copy %s from container: %w", filePath, err)
+			}
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// NewTransport creates an HTTP transport based on http.DefaultTransport
+// Proxies are taken from HTTP_PROXY/HTTPS_PROXY/NO_PROXY. The certificates in
+// caCertFiles (PEM bundles, empty entries are ignored) are trusted in addition
+// to the system roots
+func NewTransport(insecureSkipVerify bool, caCertFiles ...string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	for _, caCertFile := range caCertFiles {
+		if caCertFile == "" {
+			continue
+		}
+
+		if tlsConfig.RootCAs == nil {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		pem, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate file: %w", err)
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid PEM certificate found in " + caCertFile)
+		}
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
@@ -0,0 +1,198 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir is where Kubernetes mounts the pod's ServiceAccount credentials
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client is a minimal in-cluster Kubernetes API client
+type Client struct {
+	http      *http.Client
+	baseURL   string
+	token     string
+	namespace string
+}
+
+// Service is a discovered Redis service
+type Service struct {
+	Name      string
+	Namespace string
+	UID       string
+	Host      string
+	Port      int
+}
+
+// NewInClusterClient creates a client authenticated with the pod's ServiceAccount
+func NewInClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running inside Kubernetes (KUBERNETES_SERVICE_HOST is not set)")
+	}
+
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ServiceAccount token: %w", err)
+	}
+
+	caCert, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ServiceAccount CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("invalid ServiceAccount CA certificate")
+	}
+
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ServiceAccount namespace: %w", err)
+	}
+
+	return &Client{
+		http: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: strings.TrimSpace(string(namespace)),
+	}, nil
+}
+
+// Namespace returns the namespace the pod is running in
+func (c *Client) Namespace() string {
+	return c.namespace
+}
+
+// ListServices returns the services matching a label selector
+// The port named portName is used, or the first port when there is no such port
+func (c *Client) ListServices(ctx context.Context, namespace, selector, portName string) ([]Service, error) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/services?labelSelector=%s", url.PathEscape(namespace), url.QueryEscape(selector))
+
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+				UID       string `json:"uid"`
+			} `json:"metadata"`
+			Spec struct {
+				Ports []struct {
+					Name string `json:"name"`
+					Port int    `json:"port"`
+				} `json:"ports"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &list); err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+
+	var services []Service
+	for _, item := range list.Items {
+		if len(item.Spec.Ports) == 0 {
+			continue
+		}
+		port := item.Spec.Ports[0].Port
+		for _, p := range item.Spec.Ports {
+			if p.Name == portName {
+				port = p.Port
+				break
+			}
+		}
+
+		services = append(services, Service{
+			Name:      item.Metadata.Name,
+			Namespace: item.Metadata.Namespace,
+			UID:       item.Metadata.UID,
+			Host:      fmt.Sprintf("%s.%s.svc", item.Metadata.Name, item.Metadata.Namespace),
+			Port:      port,
+		})
+	}
+	return services, nil
+}
+
+// RecordEvent creates an Event attached to a service
+// eventType is "Normal" or "Warning"
+func (c *Client) RecordEvent(ctx context.Context, svc Service, eventType, reason, message string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	event := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"generateName": svc.Name + "-backup-",
+			"namespace":    svc.Namespace,
+		},
+		"involvedObject": map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"name":       svc.Name,
+			"namespace":  svc.Namespace,
+			"uid":        svc.UID,
+		},
+		"type":           eventType,
+		"reason":         reason,
+		"message":        message,
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+		"count":          1,
+		"source":         map[string]interface{}{"component": "redis-backup"},
+	}
+
+	path := fmt.Sprintf("/api/v1/namespaces/%s/events", url.PathEscape(svc.Namespace))
+	if err := c.do(ctx, http.MethodPost, path, event, nil); err != nil {
+		return fmt.Errorf("failed to record event: %w", err)
+	}
+	return nil
+}
+
+// do sends an authenticated API request and decodes the JSON response into out
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("kubernetes API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
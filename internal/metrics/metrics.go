@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry holds gauges exposed in the Prometheus text format
+type Registry struct {
+	mu     sync.Mutex
+	help   map[string]string
+	values map[string]map[string]float64 // metric name -> label set -> value
+}
+
+// Default is the registry used by the package-level functions
+var Default = NewRegistry()
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		help:   make(map[string]string),
+		values: make(map[string]map[string]float64),
+	}
+}
+
+// SetGauge sets the value of a gauge for a set of labels
+func (r *Registry) SetGauge(name, help string, labels map[string]string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.help[name] = help
+	if r.values[name] == nil {
+		r.values[name] = make(map[string]float64)
+	}
+	r.values[name][formatLabels(labels)] = value
+}
+
+// ServeHTTP writes every gauge in the Prometheus text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.values))
+	for name := range r.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, r.help[name], name)
+
+		series := make([]string, 0, len(r.values[name]))
+		for labels := range r.values[name] {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+
+		for _, labels := range series {
+			fmt.Fprintf(w, "%s%s %v\n", name, labels, r.values[name][labels])
+		}
+	}
+}
+
+// SetGauge sets a gauge in the default registry
+func SetGauge(name, help string, labels map[string]string, value float64) {
+	Default.SetGauge(name, help, labels, value)
+}
+
+// mux serves the metrics endpoint and the handlers registered with Handle
+var mux = http.NewServeMux()
+
+// Handle registers an additional endpoint served next to /metrics
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// Serve exposes the default registry on addr at /metrics in the background
+func Serve(addr string) {
+	mux.Handle("/metrics", Default)
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
+
+// formatLabels renders a label set as {a="1",b="2"} with sorted keys
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[key])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, key, value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
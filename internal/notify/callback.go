@@ -0,0 +1,98 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/httpclient"
+)
+
+// Run statuses reported to callbacks
+const (
+	RunSuccess = "success"
+	RunFailure = "failure"
+	RunSkipped = "skipped"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of a callback body, keyed with
+// CALLBACK_SECRET, as "sha256=<hex>"
+const SignatureHeader = "X-Redis-Backup-Signature"
+
+// callbackAttempts is the number of times a callback is sent before giving up
+const callbackAttempts = 3
+
+// RunResult is posted to the callback URL of a run once it ends
+type RunResult struct {
+	RunID      string    `json:"run_id"`
+	Target     string    `json:"target"`
+	Status     string    `json:"status"`
+	Backups    []string  `json:"backups,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// SendCallback posts the result of a run as JSON to a callback URL, retrying
+// with a backoff when it fails or does not answer with a 2xx status
+func SendCallback(ctx context.Context, cfg *config.Config, url string, result RunResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to encode callback: %w", err)
+	}
+	transport, err := httpclient.NewTransport(false, cfg.CACertFile)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	delay := 2 * time.Second
+	for attempt := 1; ; attempt++ {
+		err = postCallback(ctx, client, url, body, cfg.CallbackSecret)
+		if err == nil || attempt == callbackAttempts {
+			return err
+		}
+		log.Printf("Warning: callback of run %s failed, retrying in %s: %v", result.RunID, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// postCallback sends a callback body once
+func postCallback(ctx context.Context, client *http.Client, url string, body []byte, secret string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create callback request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send callback: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
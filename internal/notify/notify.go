@@ -0,0 +1,188 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/httpclient"
+)
+
+// Event types
+const (
+	EventQuotaExceeded     = "storage_quota_exceeded"
+	EventSizeAnomaly       = "backup_size_anomaly"
+	EventBackupTooBig      = "backup_too_large"
+	EventBackupFailed      = "backup_failed"
+	EventRecovered         = "backup_recovered"
+	EventReplicaLagging    = "replication_lagging"
+	EventReplicaRecovered  = "replication_recovered"
+	EventStandbySeedFailed = "standby_seed_failed"
+	EventForkMemoryHigh    = "fork_memory_high"
+	EventWindowExceeded    = "backup_window_exceeded"
+	EventBackupSucceeded   = "backup_succeeded"
+	EventBackupsDeleted    = "backups_deleted"
+	EventUpdateAvailable   = "update_available"
+	EventIncompleteSets    = "incomplete_backup_sets"
+)
+
+// optIn lists the events only sent to the NOTIFY_ROUTES naming them, as they
+// would be noise on the default webhook
+var optIn = map[string]bool{
+	EventBackupSucceeded: true,
+	EventBackupsDeleted:  true,
+}
+
+// Event is a notification sent to the configured webhook
+type Event struct {
+	Type    string                 `json:"event"`
+	Target  string                 `json:"target,omitempty"`
+	Message string                 `json:"message"`
+	Time    time.Time              `json:"time"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Notifier delivers events
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// New creates a notifier based on configuration
+// Events are sent to the webhooks of their route in NOTIFY_ROUTES, to the
+// webhook of the target in NOTIFY_TARGET_WEBHOOKS, or to NOTIFY_WEBHOOK_URL;
+// without any, events are only logged
+func New(cfg *config.Config) (Notifier, error) {
+	target := cfg.Target()
+	if cfg.NotifyWebhookURL == "" && len(cfg.NotifyTargetWebhooks) == 0 && len(cfg.NotifyRoutes) == 0 {
+		return logNotifier{target: target}, nil
+	}
+
+	transport, err := httpclient.NewTransport(false, cfg.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookNotifier{
+		cfg:    cfg,
+		target: target,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+		},
+	}, nil
+}
+
+// WebhookNotifier posts events as JSON to the webhooks they are routed to
+// Events are queued and delivered in the background, so a slow or dead
+// webhook does not hold up backups, see queue
+type WebhookNotifier struct {
+	cfg    *config.Config
+	target string
+	client *http.Client
+}
+
+// Notify queues an event for its webhooks
+// It only fails when the event is dropped by the rate limit or a full queue
+func (n *WebhookNotifier) Notify(_ context.Context, event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Target == "" {
+		event.Target = n.target
+	}
+	urls := n.route(event.Type, event.Target)
+	if len(urls) == 0 && optIn[event.Type] {
+		return nil
+	}
+	log.Printf("Notification [%s] %s: %s", event.Type, event.Target, event.Message)
+
+	var errs []error
+	for _, url := range urls {
+		q := queueFor(n.cfg, url, func(ctx context.Context, event Event) error {
+			return post(ctx, n.client, url, event)
+		})
+		if err := q.push(event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// route returns the webhooks of an event, from the most specific setting:
+// "event@target" and "*@target" routes, NOTIFY_TARGET_WEBHOOKS, "event" and
+// "*" routes, then NOTIFY_WEBHOOK_URL
+// Opt-in events only go to the routes naming them
+func (n *WebhookNotifier) route(eventType, target string) []string {
+	routes := n.cfg.NotifyRoutes
+	if optIn[eventType] {
+		if urls, ok := routes[eventType+"@"+target]; ok {
+			return urls
+		}
+		return routes[eventType]
+	}
+
+	for _, key := range []string{eventType + "@" + target, "*@" + target} {
+		if urls, ok := routes[key]; ok {
+			return urls
+		}
+	}
+	if url, ok := n.cfg.NotifyTargetWebhooks[n.cfg.TargetName]; ok {
+		return []string{url}
+	}
+	for _, key := range []string{eventType, "*"} {
+		if urls, ok := routes[key]; ok {
+			return urls
+		}
+	}
+	if n.cfg.NotifyWebhookURL == "" {
+		return nil
+	}
+	return []string{n.cfg.NotifyWebhookURL}
+}
+
+// post sends an event to a webhook once
+func post(ctx context.Context, client *http.Client, url string, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create notification request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// logNotifier only logs events
+type logNotifier struct {
+	target string
+}
+
+// Notify logs an event
+func (n logNotifier) Notify(_ context.Context, event Event) error {
+	if event.Target == "" {
+		event.Target = n.target
+	}
+	log.Printf("Notification [%s] %s: %s", event.Type, event.Target, event.Message)
+	return nil
+}
@@ -0,0 +1,210 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/metrics"
+)
+
+// ErrQueueFull is returned when an event is dropped because the webhook is
+// too far behind
+var ErrQueueFull = errors.New("notification queue full")
+
+// ErrRateLimited is returned when an event is dropped by NOTIFY_RATE_LIMIT
+var ErrRateLimited = errors.New("notification rate limit reached")
+
+// maxRetryDelay caps the delay between two attempts to deliver an event
+const maxRetryDelay = time.Minute
+
+// resolves maps the events closing an incident to the event opening it, so
+// a new incident right after the previous one is resolved is not suppressed
+var resolves = map[string]string{
+	EventRecovered:        EventBackupFailed,
+	EventReplicaRecovered: EventReplicaLagging,
+}
+
+var (
+	queuesMu sync.Mutex
+	queues   = make(map[string]*queue)
+
+	// pending counts the queued events not delivered or given up on yet
+	pendingMu sync.Mutex
+	pending   int
+
+	droppedMu sync.Mutex
+	dropped   = make(map[string]int)
+)
+
+// queued is an event waiting for delivery, with the time it was queued
+type queued struct {
+	event Event
+	at    time.Time
+}
+
+// queue delivers the events of a webhook in the background, one at a time
+type queue struct {
+	events  chan queued
+	send    func(ctx context.Context, event Event) error
+	retries int
+	window  time.Duration
+	limit   int
+
+	mu         sync.Mutex
+	lastSent   map[string]time.Time // by event type and target
+	suppressed map[string]int
+	sent       []time.Time // in the last hour, for the rate limit
+}
+
+// queueFor returns the queue of a webhook, started on first use
+// Every notifier of a URL shares it, so the limits hold across targets
+func queueFor(cfg *config.Config, url string, send func(ctx context.Context, event Event) error) *queue {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	if q, ok := queues[url]; ok {
+		return q
+	}
+	q := &queue{
+		events:     make(chan queued, cfg.NotifyQueueSize),
+		send:       send,
+		retries:    cfg.NotifyRetries,
+		window:     time.Duration(cfg.NotifyDedupWindow) * time.Second,
+		limit:      cfg.NotifyRateLimit,
+		lastSent:   make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+	queues[url] = q
+	go q.deliver()
+	return q
+}
+
+// push queues an event without blocking
+// Repeats of an event of the same type and target within NOTIFY_DEDUP_WINDOW
+// are suppressed, and counted in the "suppressed" detail of the next one sent;
+// opt-in events report each run and are never suppressed
+func (q *queue) push(event Event) error {
+	key := event.Type + "\x00" + event.Target
+	now := time.Now()
+
+	q.mu.Lock()
+	if last, ok := q.lastSent[key]; ok && q.window > 0 && !optIn[event.Type] && now.Sub(last) < q.window {
+		q.suppressed[key]++
+		q.mu.Unlock()
+		log.Printf("Notification [%s] %s suppressed, already sent %s ago", event.Type, event.Target, now.Sub(last).Round(time.Second))
+		return nil
+	}
+
+	cutoff := now.Add(-time.Hour)
+	for len(q.sent) > 0 && q.sent[0].Before(cutoff) {
+		q.sent = q.sent[1:]
+	}
+	if q.limit > 0 && len(q.sent) >= q.limit {
+		q.mu.Unlock()
+		drop("rate_limited")
+		return fmt.Errorf("%w (%d per hour)", ErrRateLimited, q.limit)
+	}
+
+	if n := q.suppressed[key]; n > 0 {
+		event.Details = maps.Clone(event.Details)
+		if event.Details == nil {
+			event.Details = make(map[string]interface{})
+		}
+		event.Details["suppressed"] = n
+	}
+
+	addPending(1)
+	select {
+	case q.events <- queued{event: event, at: now}:
+	default:
+		addPending(-1)
+		q.mu.Unlock()
+		drop("queue_full")
+		return ErrQueueFull
+	}
+	q.lastSent[key] = now
+	delete(q.suppressed, key)
+	if opened, ok := resolves[event.Type]; ok {
+		delete(q.lastSent, opened+"\x00"+event.Target)
+		delete(q.suppressed, opened+"\x00"+event.Target)
+	}
+	q.sent = append(q.sent, now)
+	q.mu.Unlock()
+	return nil
+}
+
+// deliver sends the queued events, retrying each NOTIFY_RETRIES times with a
+// backoff before giving up on it
+func (q *queue) deliver() {
+	for item := range q.events {
+		event := item.event
+		delay := 2 * time.Second
+		for attempt := 0; ; attempt++ {
+			err := q.send(context.Background(), event)
+			if err == nil {
+				break
+			}
+			if attempt == q.retries {
+				log.Printf("Warning: gave up on the %s notification after %d attempt(s): %v", event.Type, attempt+1, err)
+				drop("failed")
+				q.forget(item)
+				break
+			}
+			log.Printf("Warning: failed to send the %s notification, retrying in %s: %v", event.Type, delay, err)
+			time.Sleep(delay)
+			delay = min(delay*2, maxRetryDelay)
+		}
+		addPending(-1)
+	}
+}
+
+// forget clears the deduplication of an event given up on, so its next repeat
+// is sent instead of being suppressed by an event that was never delivered
+func (q *queue) forget(item queued) {
+	key := item.event.Type + "\x00" + item.event.Target
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if last, ok := q.lastSent[key]; ok && last.Equal(item.at) {
+		delete(q.lastSent, key)
+	}
+}
+
+// addPending updates the number of events queued
+func addPending(delta int) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	pending += delta
+}
+
+// drop counts an event dropped for a reason
+func drop(reason string) {
+	droppedMu.Lock()
+	defer droppedMu.Unlock()
+	dropped[reason]++
+	metrics.SetGauge("redis_backup_notifications_dropped", "Notifications dropped since the start, by reason",
+		map[string]string{"reason": reason}, float64(dropped[reason]))
+}
+
+// Flush waits until the queued events are delivered or given up on, at most
+// for timeout, so a command does not exit before its notifications are sent
+func Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pendingMu.Lock()
+		n := pending
+		pendingMu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Warning: %d notification(s) still queued after %s, giving up on them", n, timeout)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
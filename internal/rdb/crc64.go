@@ -0,0 +1,16 @@
+package rdb
+
+import "hash/crc64"
+
+// jonesTable is the lookup table for the CRC-64/Jones variant used by Redis
+// for RDB files and DUMP payloads (reflected polynomial 0xad93d23594c935a9)
+var jonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// CRC64 updates a Redis-compatible CRC-64 checksum with p
+// Unlike hash/crc64, Redis does not invert the checksum before or after
+func CRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = jonesTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
@@ -0,0 +1,613 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ErrUnsupportedValue is returned when decoding a value of a type that has no
+// plain representation (streams, module values)
+var ErrUnsupportedValue = errors.New("rdb: value type cannot be decoded")
+
+// HashField is a field of a hash
+type HashField struct {
+	Field string
+	Value string
+}
+
+// ZSetMember is a member of a sorted set
+type ZSetMember struct {
+	Member string
+	Score  float64
+}
+
+// Decode decodes the value of an entry
+// Strings are returned as a string, lists and sets as a []string, hashes as
+// a []HashField and sorted sets as a []ZSetMember, in the order of the file
+func (e *Entry) Decode() (any, error) {
+	r := &Reader{r: bufio.NewReader(bytes.NewReader(e.Value))}
+	value, err := r.decodeValue(e.Type)
+	if err != nil {
+		return nil, fmt.Errorf("rdb: failed to decode %s value of key %q: %w", TypeName(e.Type), e.Key, err)
+	}
+	return value, nil
+}
+
+// decodeValue reads and decodes a value of the given type
+func (r *Reader) decodeValue(valueType byte) (any, error) {
+	switch valueType {
+	case TypeString:
+		s, err := r.readString()
+		return string(s), err
+	case TypeList, TypeSet:
+		return r.decodeStrings()
+	case TypeListZiplist:
+		return r.decodeEncoded(decodeZiplist)
+	case TypeListQuicklist:
+		n, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		var list []string
+		for i := uint64(0); i < n; i++ {
+			node, err := r.decodeEncoded(decodeZiplist)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, node...)
+		}
+		return list, nil
+	case TypeListQuicklist2:
+		n, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		var list []string
+		for i := uint64(0); i < n; i++ {
+			container, err := r.readLength()
+			if err != nil {
+				return nil, err
+			}
+			node, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			// Plain nodes hold a single large element, packed nodes a listpack
+			if container == 1 {
+				list = append(list, string(node))
+				continue
+			}
+			elements, err := decodeListpack(node)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elements...)
+		}
+		return list, nil
+	case TypeSetIntset:
+		return r.decodeEncoded(decodeIntset)
+	case TypeSetListpack:
+		return r.decodeEncoded(decodeListpack)
+	case TypeHash:
+		elements, err := r.decodeStrings2()
+		if err != nil {
+			return nil, err
+		}
+		return hashFields(elements, 2)
+	case TypeHashZipmap:
+		elements, err := r.decodeEncoded(decodeZipmap)
+		if err != nil {
+			return nil, err
+		}
+		return hashFields(elements, 2)
+	case TypeHashZiplist:
+		elements, err := r.decodeEncoded(decodeZiplist)
+		if err != nil {
+			return nil, err
+		}
+		return hashFields(elements, 2)
+	case TypeHashListpack:
+		elements, err := r.decodeEncoded(decodeListpack)
+		if err != nil {
+			return nil, err
+		}
+		return hashFields(elements, 2)
+	case TypeHashMetadata:
+		// Minimum expiry of the fields, then the TTL of each field before it
+		if _, err := r.readFull(8); err != nil {
+			return nil, err
+		}
+		n, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]HashField, 0, min(n, preallocElements))
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+			field, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, HashField{Field: string(field), Value: string(value)})
+		}
+		return fields, nil
+	case TypeHashListpackEx:
+		// Minimum expiry of the fields, then field, value and TTL triplets
+		if _, err := r.readFull(8); err != nil {
+			return nil, err
+		}
+		elements, err := r.decodeEncoded(decodeListpack)
+		if err != nil {
+			return nil, err
+		}
+		return hashFields(elements, 3)
+	case TypeZSet, TypeZSet2:
+		n, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		members := make([]ZSetMember, 0, min(n, preallocElements))
+		for i := uint64(0); i < n; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if valueType == TypeZSet2 {
+				buf, err := r.readFull(8)
+				if err != nil {
+					return nil, err
+				}
+				score = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+			} else if score, err = r.readDouble(); err != nil {
+				return nil, err
+			}
+			members = append(members, ZSetMember{Member: string(member), Score: score})
+		}
+		return members, nil
+	case TypeZSetZiplist:
+		elements, err := r.decodeEncoded(decodeZiplist)
+		if err != nil {
+			return nil, err
+		}
+		return zsetMembers(elements)
+	case TypeZSetListpack:
+		elements, err := r.decodeEncoded(decodeListpack)
+		if err != nil {
+			return nil, err
+		}
+		return zsetMembers(elements)
+	default:
+		return nil, ErrUnsupportedValue
+	}
+}
+
+// decodeStrings reads a length followed by that many strings
+func (r *Reader) decodeStrings() ([]string, error) {
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	return r.readStrings(n)
+}
+
+// decodeStrings2 reads a length followed by that many pairs of strings
+func (r *Reader) decodeStrings2() ([]string, error) {
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	return r.readStrings(n * 2)
+}
+
+func (r *Reader) readStrings(n uint64) ([]string, error) {
+	strs := make([]string, 0, min(n, preallocElements))
+	for i := uint64(0); i < n; i++ {
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, string(s))
+	}
+	return strs, nil
+}
+
+// decodeEncoded reads a string holding an encoded structure and decodes it
+func (r *Reader) decodeEncoded(decode func([]byte) ([]string, error)) ([]string, error) {
+	s, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	return decode(s)
+}
+
+// readDouble reads a double in the legacy string format
+func (r *Reader) readDouble() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := r.readFull(int(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// hashFields groups flat elements into fields, each made of stride elements
+// starting with the field and its value
+func hashFields(elements []string, stride int) ([]HashField, error) {
+	if len(elements)%stride != 0 {
+		return nil, errors.New("odd number of hash elements")
+	}
+	fields := make([]HashField, 0, len(elements)/stride)
+	for i := 0; i < len(elements); i += stride {
+		fields = append(fields, HashField{Field: elements[i], Value: elements[i+1]})
+	}
+	return fields, nil
+}
+
+// zsetMembers groups flat member and score elements into sorted set members
+func zsetMembers(elements []string) ([]ZSetMember, error) {
+	if len(elements)%2 != 0 {
+		return nil, errors.New("odd number of sorted set elements")
+	}
+	members := make([]ZSetMember, 0, len(elements)/2)
+	for i := 0; i < len(elements); i += 2 {
+		score, err := strconv.ParseFloat(elements[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid score %q", elements[i+1])
+		}
+		members = append(members, ZSetMember{Member: elements[i], Score: score})
+	}
+	return members, nil
+}
+
+// cursor reads an encoded structure with bounds checks
+type cursor struct {
+	b []byte
+	i int
+}
+
+func (c *cursor) take(n int) ([]byte, error) {
+	if n < 0 || c.i+n > len(c.b) {
+		return nil, errors.New("truncated encoding")
+	}
+	buf := c.b[c.i : c.i+n]
+	c.i += n
+	return buf, nil
+}
+
+func (c *cursor) peek() (byte, error) {
+	if c.i >= len(c.b) {
+		return 0, errors.New("truncated encoding")
+	}
+	return c.b[c.i], nil
+}
+
+// int24 decodes a little-endian signed 24-bit integer
+func int24(b []byte) int64 {
+	return int64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8)
+}
+
+// decodeZiplist decodes the elements of a ziplist
+func decodeZiplist(b []byte) ([]string, error) {
+	// Total bytes, offset of the last entry and number of entries
+	c := &cursor{b: b, i: 10}
+	var elements []string
+	for {
+		flag, err := c.peek()
+		if err != nil {
+			return nil, err
+		}
+		if flag == 0xFF {
+			return elements, nil
+		}
+		// Length of the previous entry
+		prevLen := 1
+		if flag == 0xFE {
+			prevLen = 5
+		}
+		if _, err := c.take(prevLen); err != nil {
+			return nil, err
+		}
+
+		header, err := c.take(1)
+		if err != nil {
+			return nil, err
+		}
+		enc := header[0]
+		var (
+			n     int
+			value int64
+			isInt = true
+		)
+		switch {
+		case enc>>6 == 0:
+			n, isInt = int(enc&0x3F), false
+		case enc>>6 == 1:
+			next, err := c.take(1)
+			if err != nil {
+				return nil, err
+			}
+			n, isInt = int(enc&0x3F)<<8|int(next[0]), false
+		case enc>>6 == 2:
+			buf, err := c.take(4)
+			if err != nil {
+				return nil, err
+			}
+			n, isInt = int(binary.BigEndian.Uint32(buf)), false
+		case enc == 0xC0:
+			buf, err := c.take(2)
+			if err != nil {
+				return nil, err
+			}
+			value = int64(int16(binary.LittleEndian.Uint16(buf)))
+		case enc == 0xD0:
+			buf, err := c.take(4)
+			if err != nil {
+				return nil, err
+			}
+			value = int64(int32(binary.LittleEndian.Uint32(buf)))
+		case enc == 0xE0:
+			buf, err := c.take(8)
+			if err != nil {
+				return nil, err
+			}
+			value = int64(binary.LittleEndian.Uint64(buf))
+		case enc == 0xF0:
+			buf, err := c.take(3)
+			if err != nil {
+				return nil, err
+			}
+			value = int24(buf)
+		case enc == 0xFE:
+			buf, err := c.take(1)
+			if err != nil {
+				return nil, err
+			}
+			value = int64(int8(buf[0]))
+		case enc >= 0xF1 && enc <= 0xFD:
+			// Immediate 4-bit integer from 0 to 12
+			value = int64(enc&0x0F) - 1
+		default:
+			return nil, fmt.Errorf("invalid ziplist encoding 0x%02x", enc)
+		}
+
+		if isInt {
+			elements = append(elements, strconv.FormatInt(value, 10))
+			continue
+		}
+		s, err := c.take(n)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, string(s))
+	}
+}
+
+// decodeListpack decodes the elements of a listpack
+func decodeListpack(b []byte) ([]string, error) {
+	// Total bytes and number of elements
+	c := &cursor{b: b, i: 6}
+	var elements []string
+	for {
+		enc, err := c.peek()
+		if err != nil {
+			return nil, err
+		}
+		if enc == 0xFF {
+			return elements, nil
+		}
+
+		start := c.i
+		var (
+			s     []byte
+			value int64
+			isInt = true
+		)
+		switch {
+		case enc&0x80 == 0:
+			// 7-bit unsigned integer
+			c.i++
+			value = int64(enc & 0x7F)
+		case enc&0xC0 == 0x80:
+			c.i++
+			if s, err = c.take(int(enc & 0x3F)); err != nil {
+				return nil, err
+			}
+			isInt = false
+		case enc&0xE0 == 0xC0:
+			// 13-bit signed integer
+			buf, err := c.take(2)
+			if err != nil {
+				return nil, err
+			}
+			value = int64(buf[0]&0x1F)<<8 | int64(buf[1])
+			if value >= 1<<12 {
+				value -= 1 << 13
+			}
+		case enc&0xF0 == 0xE0:
+			buf, err := c.take(2)
+			if err != nil {
+				return nil, err
+			}
+			if s, err = c.take(int(buf[0]&0x0F)<<8 | int(buf[1])); err != nil {
+				return nil, err
+			}
+			isInt = false
+		case enc == 0xF0:
+			buf, err := c.take(5)
+			if err != nil {
+				return nil, err
+			}
+			if s, err = c.take(int(binary.LittleEndian.Uint32(buf[1:]))); err != nil {
+				return nil, err
+			}
+			isInt = false
+		case enc == 0xF1:
+			buf, err := c.take(3)
+			if err != nil {
+				return nil, err
+			}
+			value = int64(int16(binary.LittleEndian.Uint16(buf[1:])))
+		case enc == 0xF2:
+			buf, err := c.take(4)
+			if err != nil {
+				return nil, err
+			}
+			value = int24(buf[1:])
+		case enc == 0xF3:
+			buf, err := c.take(5)
+			if err != nil {
+				return nil, err
+			}
+			value = int64(int32(binary.LittleEndian.Uint32(buf[1:])))
+		case enc == 0xF4:
+			buf, err := c.take(9)
+			if err != nil {
+				return nil, err
+			}
+			value = int64(binary.LittleEndian.Uint64(buf[1:]))
+		default:
+			return nil, fmt.Errorf("invalid listpack encoding 0x%02x", enc)
+		}
+
+		if isInt {
+			elements = append(elements, strconv.FormatInt(value, 10))
+		} else {
+			elements = append(elements, string(s))
+		}
+		// Length of the entry, used to iterate backwards
+		if _, err := c.take(backlenSize(c.i - start)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// backlenSize returns the size of the backward length of a listpack entry
+func backlenSize(entryLen int) int {
+	switch {
+	case entryLen <= 127:
+		return 1
+	case entryLen < 16383:
+		return 2
+	case entryLen < 2097151:
+		return 3
+	case entryLen < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// decodeIntset decodes the members of an intset
+func decodeIntset(b []byte) ([]string, error) {
+	c := &cursor{b: b}
+	header, err := c.take(8)
+	if err != nil {
+		return nil, err
+	}
+	width := int(binary.LittleEndian.Uint32(header))
+	n := int(binary.LittleEndian.Uint32(header[4:]))
+	if width != 2 && width != 4 && width != 8 {
+		return nil, fmt.Errorf("invalid intset encoding %d", width)
+	}
+	if n > (len(b)-8)/width {
+		return nil, fmt.Errorf("intset of %d members exceeds its %d bytes", n, len(b))
+	}
+
+	members := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		buf, err := c.take(width)
+		if err != nil {
+			return nil, err
+		}
+		var value int64
+		switch width {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(buf)))
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(buf)))
+		default:
+			value = int64(binary.LittleEndian.Uint64(buf))
+		}
+		members = append(members, strconv.FormatInt(value, 10))
+	}
+	return members, nil
+}
+
+// decodeZipmap decodes the fields and values of a zipmap
+func decodeZipmap(b []byte) ([]string, error) {
+	// Number of entries when below 254
+	c := &cursor{b: b, i: 1}
+	readLen := func() (int, error) {
+		buf, err := c.take(1)
+		if err != nil {
+			return 0, err
+		}
+		if buf[0] < 254 {
+			return int(buf[0]), nil
+		}
+		buf, err = c.take(4)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.LittleEndian.Uint32(buf)), nil
+	}
+
+	var elements []string
+	for {
+		flag, err := c.peek()
+		if err != nil {
+			return nil, err
+		}
+		if flag == 0xFF {
+			return elements, nil
+		}
+
+		n, err := readLen()
+		if err != nil {
+			return nil, err
+		}
+		field, err := c.take(n)
+		if err != nil {
+			return nil, err
+		}
+		if n, err = readLen(); err != nil {
+			return nil, err
+		}
+		// Unused bytes after the value
+		free, err := c.take(1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := c.take(n)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.take(int(free[0])); err != nil {
+			return nil, err
+		}
+		elements = append(elements, string(field), string(value))
+	}
+}
@@ -0,0 +1,744 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// RDB opcodes only handled by the reader
+const (
+	opSlotInfo      = 0xF4
+	opFunction      = 0xF5
+	opFunction2     = 0xF6
+	opModuleAux     = 0xF7
+	opIdle          = 0xF8
+	opFreq          = 0xF9
+	opAux           = 0xFA
+	opResizeDB      = 0xFB
+	opExpireTimeSec = 0xFD
+)
+
+// RDB value types
+const (
+	TypeString           = 0
+	TypeList             = 1
+	TypeSet              = 2
+	TypeZSet             = 3
+	TypeHash             = 4
+	TypeZSet2            = 5
+	TypeModule           = 6
+	TypeModule2          = 7
+	TypeHashZipmap       = 9
+	TypeListZiplist      = 10
+	TypeSetIntset        = 11
+	TypeZSetZiplist      = 12
+	TypeHashZiplist      = 13
+	TypeListQuicklist    = 14
+	TypeStreamListpacks  = 15
+	TypeHashListpack     = 16
+	TypeZSetListpack     = 17
+	TypeListQuicklist2   = 18
+	TypeStreamListpacks2 = 19
+	TypeSetListpack      = 20
+	TypeStreamListpacks3 = 21
+	TypeHashMetadata     = 24
+	TypeHashListpackEx   = 25
+)
+
+// Module2 value opcodes
+const (
+	moduleOpEOF    = 0
+	moduleOpSInt   = 1
+	moduleOpUInt   = 2
+	moduleOpFloat  = 3
+	moduleOpDouble = 4
+	moduleOpString = 5
+)
+
+// maxStringLength bounds the length of a string read from a file, so a corrupt
+// length fails instead of exhausting memory (Redis strings are limited by
+// proto-max-bulk-len, 512 MB by default)
+const maxStringLength = 1 << 32
+
+// readChunkSize is the size up to which a string is allocated at once; longer
+// ones grow with the data actually read
+const readChunkSize = 1 << 20
+
+// preallocElements is the number of elements of a collection allocated at
+// once; larger collections grow with the elements actually read
+const preallocElements = 1024
+
+// ErrChecksum is returned when the RDB checksum does not match its content
+var ErrChecksum = errors.New("rdb checksum mismatch")
+
+// Entry is a key read from an RDB file
+// Value holds the encoded value exactly as stored in the file, so it can be
+// turned back into a DUMP payload without decoding it
+type Entry struct {
+	DB       int
+	Key      string
+	Type     byte
+	ExpireAt int64 // unix milliseconds, 0 means no expiry
+	Value    []byte
+}
+
+// TypeName returns the Redis data type (as reported by TYPE) of an RDB value type
+func TypeName(t byte) string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList, TypeListZiplist, TypeListQuicklist, TypeListQuicklist2:
+		return "list"
+	case TypeSet, TypeSetIntset, TypeSetListpack:
+		return "set"
+	case TypeZSet, TypeZSet2, TypeZSetZiplist, TypeZSetListpack:
+		return "zset"
+	case TypeHash, TypeHashZipmap, TypeHashZiplist, TypeHashListpack, TypeHashMetadata, TypeHashListpackEx:
+		return "hash"
+	case TypeStreamListpacks, TypeStreamListpacks2, TypeStreamListpacks3:
+		return "stream"
+	case TypeModule, TypeModule2:
+		return "module"
+	default:
+		return "unknown"
+	}
+}
+
+// Reader iterates over the keys of an RDB file
+type Reader struct {
+	r       *bufio.Reader
+	version int
+	db      int
+	crc     uint64
+	record  *bytes.Buffer
+	started bool
+	done    bool
+}
+
+// NewReader creates a reader for an RDB file
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Version returns the RDB version of the file (available after the first Next call)
+func (r *Reader) Version() int {
+	return r.version
+}
+
+// Next returns the next key of the file, or io.EOF once the end of the file
+// was reached and its checksum verified
+func (r *Reader) Next() (*Entry, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	if !r.started {
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	var expireAt int64
+	for {
+		opcode, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opEOF:
+			r.done = true
+			return nil, r.verifyChecksum()
+		case opSelectDB:
+			db, err := r.readLength()
+			if err != nil {
+				return nil, err
+			}
+			r.db = int(db)
+		case opResizeDB:
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+		case opAux:
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+		case opExpireTimeMs:
+			buf, err := r.readFull(8)
+			if err != nil {
+				return nil, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(buf))
+		case opExpireTimeSec:
+			buf, err := r.readFull(4)
+			if err != nil {
+				return nil, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(buf)) * 1000
+		case opFreq:
+			if _, err := r.readByte(); err != nil {
+				return nil, err
+			}
+		case opIdle:
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+		case opFunction2:
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+		case opModuleAux:
+			if err := r.skipModuleAux(); err != nil {
+				return nil, err
+			}
+		case opSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := r.readLength(); err != nil {
+					return nil, err
+				}
+			}
+		case opFunction:
+			return nil, errors.New("rdb: pre-release function format is not supported")
+		default:
+			return r.readEntry(opcode, expireAt)
+		}
+	}
+}
+
+// Payload returns the entry as a DUMP payload that can be passed to RESTORE
+func (e *Entry) Payload(version int) []byte {
+	payload := make([]byte, 0, len(e.Value)+11)
+	payload = append(payload, e.Type)
+	payload = append(payload, e.Value...)
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(version))
+	return binary.LittleEndian.AppendUint64(payload, CRC64(0, payload))
+}
+
+// ReadVersion reads the header of an RDB file and returns its version
+func ReadVersion(r io.Reader) (int, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, fmt.Errorf("rdb: failed to read header: %w", err)
+	}
+	return parseHeader(header)
+}
+
+func (r *Reader) readHeader() error {
+	r.started = true
+	header, err := r.readFull(9)
+	if err != nil {
+		return fmt.Errorf("rdb: failed to read header: %w", err)
+	}
+	r.version, err = parseHeader(header)
+	return err
+}
+
+// parseHeader validates the REDIS magic and parses the 4-digit version
+func parseHeader(header []byte) (int, error) {
+	if string(header[:5]) != "REDIS" {
+		return 0, errors.New("rdb: not an RDB file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil {
+		return 0, fmt.Errorf("rdb: invalid version %q", header[5:])
+	}
+	return version, nil
+}
+
+// readEntry reads the key and the raw value of a key of the given type
+func (r *Reader) readEntry(valueType byte, expireAt int64) (*Entry, error) {
+	key, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	r.record = &bytes.Buffer{}
+	err = r.skipValue(valueType)
+	value := r.record.Bytes()
+	r.record = nil
+	if err != nil {
+		return nil, fmt.Errorf("rdb: failed to read key %q: %w", key, err)
+	}
+
+	return &Entry{
+		DB:       r.db,
+		Key:      string(key),
+		Type:     valueType,
+		ExpireAt: expireAt,
+		Value:    value,
+	}, nil
+}
+
+// skipValue reads a value of the given type without decoding it
+func (r *Reader) skipValue(valueType byte) error {
+	switch valueType {
+	case TypeString, TypeHashZipmap, TypeListZiplist, TypeSetIntset, TypeZSetZiplist,
+		TypeHashZiplist, TypeHashListpack, TypeZSetListpack, TypeSetListpack:
+		_, err := r.readString()
+		return err
+	case TypeList, TypeSet, TypeListQuicklist:
+		return r.skipStrings(1)
+	case TypeHash:
+		return r.skipStrings(2)
+	case TypeZSet:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			if err := r.skipDouble(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case TypeZSet2:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			if _, err := r.readFull(8); err != nil {
+				return err
+			}
+		}
+		return nil
+	case TypeListQuicklist2:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.readLength(); err != nil {
+				return err
+			}
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case TypeHashMetadata:
+		if _, err := r.readFull(8); err != nil {
+			return err
+		}
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.readLength(); err != nil {
+				return err
+			}
+			if err := r.skipStrings2(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case TypeHashListpackEx:
+		if _, err := r.readFull(8); err != nil {
+			return err
+		}
+		_, err := r.readString()
+		return err
+	case TypeStreamListpacks, TypeStreamListpacks2, TypeStreamListpacks3:
+		return r.skipStream(valueType)
+	case TypeModule2:
+		if _, err := r.readLength(); err != nil {
+			return err
+		}
+		return r.skipModuleValue()
+	default:
+		return fmt.Errorf("unsupported value type %d", valueType)
+	}
+}
+
+// skipStrings reads a length followed by length*perItem strings
+func (r *Reader) skipStrings(perItem int) error {
+	n, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n*uint64(perItem); i++ {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipStrings2 reads two strings (field and value)
+func (r *Reader) skipStrings2() error {
+	if _, err := r.readString(); err != nil {
+		return err
+	}
+	_, err := r.readString()
+	return err
+}
+
+// skipStream reads a stream value (listpacks, metadata, consumer groups)
+func (r *Reader) skipStream(valueType byte) error {
+	// Listpacks indexed by their master ID
+	if err := r.skipStrings(2); err != nil {
+		return err
+	}
+
+	// Length and last ID, then first ID, max deleted ID and entries added (v2+)
+	lengths := 3
+	if valueType >= TypeStreamListpacks2 {
+		lengths += 5
+	}
+	if err := r.skipLengths(lengths); err != nil {
+		return err
+	}
+
+	groups, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < groups; i++ {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+		// Last delivered ID, then entries read (v2+)
+		lengths := 2
+		if valueType >= TypeStreamListpacks2 {
+			lengths++
+		}
+		if err := r.skipLengths(lengths); err != nil {
+			return err
+		}
+
+		// Group PEL: raw ID, delivery time and delivery count
+		pel, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < pel; j++ {
+			if _, err := r.readFull(16 + 8); err != nil {
+				return err
+			}
+			if _, err := r.readLength(); err != nil {
+				return err
+			}
+		}
+
+		consumers, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < consumers; j++ {
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			// Seen time, then active time (v3)
+			times := 8
+			if valueType >= TypeStreamListpacks3 {
+				times += 8
+			}
+			if _, err := r.readFull(times); err != nil {
+				return err
+			}
+
+			// Consumer PEL: raw IDs only
+			pel, err := r.readLength()
+			if err != nil {
+				return err
+			}
+			if _, err := r.readFull(int(pel) * 16); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// skipModuleAux reads a module auxiliary field
+func (r *Reader) skipModuleAux() error {
+	// Module ID and "when" opcode followed by its value
+	if err := r.skipLengths(3); err != nil {
+		return err
+	}
+	return r.skipModuleValue()
+}
+
+// skipModuleValue reads a self-describing module value up to its EOF opcode
+func (r *Reader) skipModuleValue() error {
+	for {
+		opcode, err := r.readLength()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case moduleOpEOF:
+			return nil
+		case moduleOpSInt, moduleOpUInt:
+			_, err = r.readLength()
+		case moduleOpFloat:
+			_, err = r.readFull(4)
+		case moduleOpDouble:
+			_, err = r.readFull(8)
+		case moduleOpString:
+			_, err = r.readString()
+		default:
+			return fmt.Errorf("unknown module opcode %d", opcode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Reader) skipLengths(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := r.readLength(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipDouble reads a double in the legacy string format
+func (r *Reader) skipDouble() error {
+	n, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	// 253, 254 and 255 encode NaN, +inf and -inf without payload
+	if n >= 253 {
+		return nil
+	}
+	_, err = r.readFull(int(n))
+	return err
+}
+
+// readLength reads a length using the RDB length encoding
+func (r *Reader) readLength() (uint64, error) {
+	n, encoded, err := r.readLengthOrEncoding()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, errors.New("unexpected encoded length")
+	}
+	return n, nil
+}
+
+// readLengthOrEncoding reads a length, or a special string encoding when encoded is true
+func (r *Reader) readLengthOrEncoding() (uint64, bool, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(next), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			buf, err := r.readFull(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := r.readFull(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		default:
+			return 0, false, fmt.Errorf("invalid length encoding 0x%02x", b)
+		}
+	default:
+		return uint64(b & 0x3F), true, nil
+	}
+}
+
+// readString reads a string, decoding integer and LZF encodings
+func (r *Reader) readString() ([]byte, error) {
+	n, encoded, err := r.readLengthOrEncoding()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return r.readFull(int(n))
+	}
+
+	switch n {
+	case 0:
+		buf, err := r.readFull(1)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(buf[0])), 10), nil
+	case 1:
+		buf, err := r.readFull(2)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(buf))), 10), nil
+	case 2:
+		buf, err := r.readFull(4)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(buf))), 10), nil
+	case 3:
+		compressedLen, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := r.readFull(int(compressedLen))
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, int(length))
+	default:
+		return nil, fmt.Errorf("unknown string encoding %d", n)
+	}
+}
+
+func (r *Reader) readByte() (byte, error) {
+	buf, err := r.readFull(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// readFull reads n bytes, updating the checksum and the value recording
+// A length above maxStringLength is rejected, and long strings are read in
+// chunks so a truncated file cannot make it allocate more than it holds
+func (r *Reader) readFull(n int) ([]byte, error) {
+	if n < 0 || n > maxStringLength {
+		return nil, fmt.Errorf("rdb: invalid length %d", n)
+	}
+	var buf []byte
+	if n <= readChunkSize {
+		buf = make([]byte, n)
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	} else {
+		var data bytes.Buffer
+		if copied, err := io.CopyN(&data, r.r, int64(n)); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("%w after %d of %d bytes", io.ErrUnexpectedEOF, copied, n)
+			}
+			return nil, err
+		}
+		buf = data.Bytes()
+	}
+	r.crc = CRC64(r.crc, buf)
+	if r.record != nil {
+		r.record.Write(buf)
+	}
+	return buf, nil
+}
+
+// verifyChecksum checks the trailing CRC-64 (RDB version 5 and later)
+func (r *Reader) verifyChecksum() error {
+	if r.version < 5 {
+		return io.EOF
+	}
+
+	expected := r.crc
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return fmt.Errorf("rdb: failed to read checksum: %w", err)
+	}
+
+	// A zero checksum means checksums were disabled (rdbchecksum no)
+	stored := binary.LittleEndian.Uint64(buf)
+	if stored != 0 && stored != expected {
+		return ErrChecksum
+	}
+	return io.EOF
+}
+
+// lzfDecompress decompresses an LZF-compressed string
+// The output is not allowed to grow past length, so a corrupt length or
+// stream cannot exhaust memory
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	if length < 0 || length > maxStringLength {
+		return nil, fmt.Errorf("lzf: invalid length %d", length)
+	}
+	out := make([]byte, 0, min(length, readChunkSize))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 {
+			// Literal run of ctrl+1 bytes
+			end := i + ctrl + 1
+			if end > len(in) {
+				return nil, errors.New("lzf: literal run out of range")
+			}
+			if len(out)+end-i > length {
+				return nil, errors.New("lzf: output longer than expected")
+			}
+			out = append(out, in[i:end]...)
+			i = end
+			continue
+		}
+
+		// Back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errors.New("lzf: truncated back reference")
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("lzf: truncated back reference")
+		}
+		ref := len(out) - ((ctrl&0x1F)<<8 | int(in[i])) - 1
+		i++
+		if ref < 0 {
+			return nil, errors.New("lzf: back reference out of range")
+		}
+		if len(out)+n+2 > length {
+			return nil, errors.New("lzf: output longer than expected")
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != length {
+		return nil, fmt.Errorf("lzf: decompressed %d bytes, expected %d", len(out), length)
+	}
+	return out, nil
+}
@@ -0,0 +1,163 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// RDB opcodes used by the writer
+const (
+	opExpireTimeMs = 0xFC
+	opSelectDB     = 0xFE
+	opEOF          = 0xFF
+)
+
+// defaultVersion is the RDB version written when no DUMP payload was seen
+const defaultVersion = 9
+
+// Writer builds a loadable RDB file from DUMP payloads
+// Keys are written to the database given to NewWriter until SelectDB is called
+type Writer struct {
+	w       io.Writer
+	db      int
+	crc     uint64
+	started bool
+	closed  bool
+}
+
+// NewWriter creates a new RDB writer for the given database index
+// The header is written lazily so it can carry the RDB version of the payloads
+func NewWriter(w io.Writer, db int) *Writer {
+	return &Writer{w: w, db: db}
+}
+
+// WriteDump appends a key using its DUMP payload
+// expireAt is the absolute expiry as unix milliseconds (0 means no expiry)
+func (w *Writer) WriteDump(key string, expireAt int64, payload []byte) error {
+	if w.closed {
+		return errors.New("rdb writer is closed")
+	}
+
+	version, err := PayloadVersion(payload)
+	if err != nil {
+		return fmt.Errorf("invalid DUMP payload for key %q: %w", key, err)
+	}
+
+	if !w.started {
+		if err := w.writeHeader(version); err != nil {
+			return err
+		}
+	}
+
+	if expireAt > 0 {
+		var buf [9]byte
+		buf[0] = opExpireTimeMs
+		binary.LittleEndian.PutUint64(buf[1:], uint64(expireAt))
+		if err := w.write(buf[:]); err != nil {
+			return err
+		}
+	}
+
+	// The payload is <type><value><version:2><crc:8>, while the file
+	// expects <type><key><value>
+	if err := w.write(payload[:1]); err != nil {
+		return err
+	}
+	if err := w.write(encodeString(key)); err != nil {
+		return err
+	}
+	return w.write(payload[1 : len(payload)-10])
+}
+
+// SelectDB switches the database the following keys are written to
+func (w *Writer) SelectDB(db int) error {
+	if w.closed {
+		return errors.New("rdb writer is closed")
+	}
+	if db == w.db {
+		return nil
+	}
+	w.db = db
+	if !w.started {
+		// The header selects the database
+		return nil
+	}
+	return w.write(append([]byte{opSelectDB}, encodeLength(uint64(db))...))
+}
+
+// Close writes the EOF marker and the file checksum
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	if !w.started {
+		if err := w.writeHeader(defaultVersion); err != nil {
+			return err
+		}
+	}
+	if err := w.write([]byte{opEOF}); err != nil {
+		return err
+	}
+	w.closed = true
+
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], w.crc)
+	_, err := w.w.Write(sum[:])
+	return err
+}
+
+// PayloadVersion validates a DUMP payload and returns its RDB version
+func PayloadVersion(payload []byte) (int, error) {
+	if len(payload) < 11 {
+		return 0, errors.New("payload too short")
+	}
+
+	footer := payload[len(payload)-10:]
+	expected := binary.LittleEndian.Uint64(footer[2:])
+	if expected != 0 && CRC64(0, payload[:len(payload)-8]) != expected {
+		return 0, errors.New("payload checksum mismatch")
+	}
+
+	return int(binary.LittleEndian.Uint16(footer[:2])), nil
+}
+
+func (w *Writer) writeHeader(version int) error {
+	w.started = true
+	if err := w.write([]byte(fmt.Sprintf("REDIS%04d", version))); err != nil {
+		return err
+	}
+	return w.write(append([]byte{opSelectDB}, encodeLength(uint64(w.db))...))
+}
+
+func (w *Writer) write(p []byte) error {
+	w.crc = CRC64(w.crc, p)
+	_, err := w.w.Write(p)
+	return err
+}
+
+// encodeLength encodes a length using the RDB length encoding
+func encodeLength(n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return []byte{byte(n)}
+	case n < 1<<14:
+		return []byte{byte(n>>8) | 0x40, byte(n)}
+	case n <= 0xFFFFFFFF:
+		buf := make([]byte, 5)
+		buf[0] = 0x80
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		return buf
+	default:
+		buf := make([]byte, 9)
+		buf[0] = 0x81
+		binary.BigEndian.PutUint64(buf[1:], n)
+		return buf
+	}
+}
+
+// encodeString encodes a raw string with its length prefix
+func encodeString(s string) []byte {
+	return append(encodeLength(uint64(len(s))), s...)
+}
@@ -0,0 +1,167 @@
+package redisinfo
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Info is a parsed INFO reply: the fields of each section, by lowercase
+// section name
+type Info struct {
+	sections map[string]map[string]string
+	order    []string
+}
+
+// Keyspace holds the counts of a database reported in INFO keyspace
+type Keyspace struct {
+	Keys    int64
+	Expires int64
+	AvgTTL  int64
+}
+
+// Parse parses the text of an INFO reply
+// Fields before the first section header go to a section named ""
+func Parse(text string) *Info {
+	info := &Info{sections: make(map[string]map[string]string)}
+	section := ""
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			section = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		fields, ok := info.sections[section]
+		if !ok {
+			fields = make(map[string]string)
+			info.sections[section] = fields
+			info.order = append(info.order, section)
+		}
+		fields[key] = value
+	}
+	return info
+}
+
+// Sections returns the names of the sections in reply order
+func (i *Info) Sections() []string {
+	return i.order
+}
+
+// Section returns the fields of a section, or nil when it is not in the reply
+func (i *Info) Section(name string) map[string]string {
+	return i.sections[strings.ToLower(name)]
+}
+
+// Lookup returns the value of a field from any section
+func (i *Info) Lookup(field string) (string, bool) {
+	for _, section := range i.order {
+		if value, ok := i.sections[section][field]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Get returns the value of a field from any section, or an empty string
+func (i *Info) Get(field string) string {
+	value, _ := i.Lookup(field)
+	return value
+}
+
+// Int returns the integer value of a field, and false when it is missing or
+// not an integer
+func (i *Info) Int(field string) (int64, bool) {
+	n, err := strconv.ParseInt(i.Get(field), 10, 64)
+	return n, err == nil
+}
+
+// Flag reports whether a 0/1 field is set
+func (i *Info) Flag(field string) bool {
+	return i.Get(field) == "1"
+}
+
+// BGSAVEInProgress reports whether a background save is running
+// (rdb_bgsave_in_progress)
+func (i *Info) BGSAVEInProgress() bool {
+	return i.Flag("rdb_bgsave_in_progress")
+}
+
+// LastBGSAVEStatus returns the result of the last background save ("ok" or
+// "err"), or an empty string when unknown
+func (i *Info) LastBGSAVEStatus() string {
+	return i.Get("rdb_last_bgsave_status")
+}
+
+// LastSaveTime returns the time of the last successful save, or the zero time
+// when unknown
+func (i *Info) LastSaveTime() time.Time {
+	seconds, ok := i.Int("rdb_last_save_time")
+	if !ok || seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// ChangesSinceLastSave returns the number of writes since the last save, and
+// false when the server does not report it
+func (i *Info) ChangesSinceLastSave() (int64, bool) {
+	return i.Int("rdb_changes_since_last_save")
+}
+
+// Loading reports whether the server is still loading its dataset
+func (i *Info) Loading() bool {
+	return i.Flag("loading")
+}
+
+// Role returns the replication role ("master" or "slave")
+func (i *Info) Role() string {
+	return i.Get("role")
+}
+
+// UsedMemory returns used_memory in bytes, or 0 when unknown
+func (i *Info) UsedMemory() int64 {
+	n, _ := i.Int("used_memory")
+	return n
+}
+
+// MaxMemory returns maxmemory in bytes, or 0 when unknown or unlimited
+func (i *Info) MaxMemory() int64 {
+	n, _ := i.Int("maxmemory")
+	return n
+}
+
+// Keyspace returns the databases listed in INFO keyspace, by index, from
+// lines like db0:keys=1,expires=0,avg_ttl=0
+func (i *Info) Keyspace() map[int]Keyspace {
+	databases := make(map[int]Keyspace)
+	for name, fields := range i.Section("keyspace") {
+		db, err := strconv.Atoi(strings.TrimPrefix(name, "db"))
+		if !strings.HasPrefix(name, "db") || err != nil {
+			continue
+		}
+
+		var keyspace Keyspace
+		for _, field := range strings.Split(fields, ",") {
+			key, value, _ := strings.Cut(field, "=")
+			n, _ := strconv.ParseInt(value, 10, 64)
+			switch key {
+			case "keys":
+				keyspace.Keys = n
+			case "expires":
+				keyspace.Expires = n
+			case "avg_ttl":
+				keyspace.AvgTTL = n
+			}
+		}
+		databases[db] = keyspace
+	}
+	return databases
+}
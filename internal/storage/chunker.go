@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+)
+
+// gearTable maps each byte to a pseudo-random value for the rolling hash
+// It is generated from a fixed seed: changing it would change every chunk boundary
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6a09e667f3bcc908)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks with a gear rolling hash
+// Boundaries depend only on the surrounding bytes, so data inserted or removed
+// in one place of a file only changes the chunks around it
+type chunker struct {
+	r       *bufio.Reader
+	mask    uint64
+	minSize int
+	maxSize int
+}
+
+// newChunker creates a chunker producing chunks of avgSize bytes on average
+// avgSize must be a power of two
+func newChunker(r io.Reader, avgSize int) *chunker {
+	maskBits := bits.TrailingZeros(uint(avgSize))
+	return &chunker{
+		r:       bufio.NewReaderSize(r, 1<<20),
+		mask:    ((1 << maskBits) - 1) << (64 - maskBits),
+		minSize: avgSize / 4,
+		maxSize: avgSize * 8,
+	}
+}
+
+// Next returns the next chunk, or io.EOF after the last one
+func (c *chunker) Next() ([]byte, error) {
+	chunk := make([]byte, 0, c.minSize)
+	var hash uint64
+	for len(chunk) < c.maxSize {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(chunk) == 0 {
+				return nil, io.EOF
+			}
+			return chunk, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chunk = append(chunk, b)
+		hash = (hash << 1) + gearTable[b]
+		if len(chunk) >= c.minSize && hash&c.mask == 0 {
+			break
+		}
+	}
+	return chunk, nil
+}
@@ -0,0 +1,458 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// dedupIndexHeader starts every backup index stored by DedupStorage
+const dedupIndexHeader = "redis-backup-dedup/1\n"
+
+// chunkSuffix is appended to the SHA-256 of a chunk to form its object name
+const chunkSuffix = ".chunk"
+
+// IsChunkName reports whether an object is a chunk stored by DedupStorage
+func IsChunkName(name string) bool {
+	return strings.HasSuffix(name, chunkSuffix)
+}
+
+// dedupIndex lists the chunks of a backup in order
+type dedupIndex struct {
+	Size   int64        `json:"size"`
+	SHA256 string       `json:"sha256"`
+	Chunks []dedupChunk `json:"chunks"`
+}
+
+// dedupChunk is one chunk of a backup
+type dedupChunk struct {
+	Hash string `json:"sha256"`
+	Size int    `json:"size"`
+}
+
+// DedupStorage stores backups as content-defined chunks shared between backups
+// Each backup object only holds an index of its chunks; unchanged parts of
+// successive snapshots are stored once. Sidecars are stored as-is
+type DedupStorage struct {
+	inner     Storage
+	chunkSize int
+	// gcGrace protects the chunks of uploads whose index is not stored yet
+	// from the cleanup of another process
+	gcGrace time.Duration
+}
+
+// NewDedupStorage wraps a storage with chunk deduplication
+// chunkSize is the average chunk size in bytes (a power of two); unreferenced
+// chunks younger than gcGrace are kept
+func NewDedupStorage(inner Storage, chunkSize int, gcGrace time.Duration) *DedupStorage {
+	return &DedupStorage{inner: inner, chunkSize: chunkSize, gcGrace: gcGrace}
+}
+
+// Upload stores a backup file as chunks
+func (s *DedupStorage) Upload(ctx context.Context, sourcePath string, backupName string) error {
+	if !IsBackupName(backupName) {
+		return s.inner.Upload(ctx, sourcePath, backupName)
+	}
+
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer file.Close()
+
+	return s.UploadStream(ctx, file, backupName)
+}
+
+// UploadStream stores the content of r as chunks, uploading only the chunks not
+// already present, then stores the index under the backup name
+func (s *DedupStorage) UploadStream(ctx context.Context, r io.Reader, backupName string) error {
+	if !IsBackupName(backupName) {
+		return s.putObject(ctx, r, backupName)
+	}
+
+	objects, err := s.inner.ListObjects(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list chunks: %w", err)
+	}
+	existing := make(map[string]bool)
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Name, chunkSuffix) {
+			existing[obj.Name] = true
+		}
+	}
+
+	var index dedupIndex
+	reused := make(map[string]bool)
+	total := sha256.New()
+	uploaded, uploadedBytes := 0, int64(0)
+	chunks := newChunker(r, s.chunkSize)
+	for {
+		chunk, err := chunks.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read backup: %w", err)
+		}
+
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		total.Write(chunk)
+		index.Size += int64(len(chunk))
+		index.Chunks = append(index.Chunks, dedupChunk{Hash: hash, Size: len(chunk)})
+
+		name := hash + chunkSuffix
+		if existing[name] {
+			reused[name] = true
+			continue
+		}
+		if err := s.putObject(ctx, bytes.NewReader(chunk), name); err != nil {
+			return fmt.Errorf("failed to store chunk: %w", err)
+		}
+		existing[name] = true
+		uploaded++
+		uploadedBytes += int64(len(chunk))
+	}
+	index.SHA256 = hex.EncodeToString(total.Sum(nil))
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to encode chunk index: %w", err)
+	}
+	if err := s.putObject(ctx, io.MultiReader(strings.NewReader(dedupIndexHeader), bytes.NewReader(data)), backupName); err != nil {
+		return fmt.Errorf("failed to store chunk index: %w", err)
+	}
+	if err := s.checkReused(ctx, reused, backupName); err != nil {
+		return err
+	}
+
+	log.Printf("Deduplication: %d of %d chunk(s) new, %d of %d bytes uploaded", uploaded, len(index.Chunks), uploadedBytes, index.Size)
+	return nil
+}
+
+// checkReused checks that the existing chunks a backup reuses were not removed
+// by the cleanup of another process before its index was stored, and deletes
+// the index when some were
+// Unlike the new chunks, these can be older than the grace period
+func (s *DedupStorage) checkReused(ctx context.Context, reused map[string]bool, backupName string) error {
+	if len(reused) == 0 {
+		return nil
+	}
+	objects, err := s.inner.ListObjects(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list chunks: %w", err)
+	}
+	for _, obj := range objects {
+		delete(reused, obj.Name)
+	}
+	if len(reused) == 0 {
+		return nil
+	}
+
+	if err := s.inner.Delete(ctx, backupName); err != nil {
+		log.Printf("Warning: failed to delete chunk index of %s: %v", backupName, err)
+	}
+	return fmt.Errorf("%d reused chunk(s) removed by a concurrent cleanup", len(reused))
+}
+
+// putObject uploads an object to the inner storage, through a temporary file
+// when the inner storage cannot upload streams
+func (s *DedupStorage) putObject(ctx context.Context, r io.Reader, name string) error {
+	if uploader, ok := s.inner.(StreamUploader); ok {
+		return uploader.UploadStream(ctx, r, name)
+	}
+
+	tmp, err := os.CreateTemp("", "redis-backup-chunk-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	return s.inner.Upload(ctx, tmp.Name(), name)
+}
+
+// Download reassembles a backup from its chunks and writes it to w
+// Backups stored before deduplication was enabled are downloaded as-is
+func (s *DedupStorage) Download(ctx context.Context, backupName string, w io.Writer) error {
+	if !IsBackupName(backupName) {
+		return s.inner.Download(ctx, backupName, w)
+	}
+
+	sniffer := &indexSniffer{w: w}
+	if err := s.inner.Download(ctx, backupName, sniffer); err != nil {
+		return err
+	}
+	if err := sniffer.flush(); err != nil {
+		return err
+	}
+	if !sniffer.isIndex {
+		return nil
+	}
+
+	var index dedupIndex
+	if err := json.Unmarshal(sniffer.index.Bytes(), &index); err != nil {
+		return fmt.Errorf("failed to decode chunk index of %s: %w", backupName, err)
+	}
+
+	out := bufio.NewWriterSize(w, 1<<20)
+	total := sha256.New()
+	var chunk bytes.Buffer
+	for _, c := range index.Chunks {
+		chunk.Reset()
+		if err := s.inner.Download(ctx, c.Hash+chunkSuffix, &chunk); err != nil {
+			return fmt.Errorf("failed to download chunk %s: %w", c.Hash, err)
+		}
+		sum := sha256.Sum256(chunk.Bytes())
+		if hex.EncodeToString(sum[:]) != c.Hash {
+			return fmt.Errorf("chunk %s of %s is corrupted", c.Hash, backupName)
+		}
+		total.Write(chunk.Bytes())
+		if _, err := out.Write(chunk.Bytes()); err != nil {
+			return err
+		}
+	}
+	if hex.EncodeToString(total.Sum(nil)) != index.SHA256 {
+		return fmt.Errorf("reassembled %s does not match its checksum", backupName)
+	}
+	return out.Flush()
+}
+
+// errNotIndex stops the download of a plain backup when only its index was wanted
+var errNotIndex = errors.New("not a chunk index")
+
+// indexSniffer passes a download through to w unless it starts with the
+// chunk index header, in which case the index is kept in memory
+// Without w, the download of a plain backup is stopped with errNotIndex
+type indexSniffer struct {
+	w       io.Writer
+	head    []byte
+	decided bool
+	isIndex bool
+	index   bytes.Buffer
+}
+
+func (s *indexSniffer) Write(p []byte) (int, error) {
+	if !s.decided {
+		need := len(dedupIndexHeader) - len(s.head)
+		if len(p) < need {
+			s.head = append(s.head, p...)
+			return len(p), nil
+		}
+		s.head = append(s.head, p[:need]...)
+		if err := s.decide(); err != nil {
+			return 0, err
+		}
+		n, err := s.Write(p[need:])
+		return n + need, err
+	}
+
+	if s.isIndex {
+		return s.index.Write(p)
+	}
+	return s.w.Write(p)
+}
+
+// decide checks the header once enough bytes were received
+func (s *indexSniffer) decide() error {
+	s.decided = true
+	s.isIndex = string(s.head) == dedupIndexHeader
+	if s.isIndex {
+		return nil
+	}
+	if s.w == nil {
+		return errNotIndex
+	}
+	_, err := s.w.Write(s.head)
+	return err
+}
+
+// flush writes the bytes of a download shorter than the header
+func (s *indexSniffer) flush() error {
+	if s.decided {
+		return nil
+	}
+	return s.decide()
+}
+
+// Tags returns the tags of an object of the inner storage
+func (s *DedupStorage) Tags(ctx context.Context, backupName string) (map[string]string, error) {
+	tagger, ok := s.inner.(Tagger)
+	if !ok {
+		return nil, nil
+	}
+	return tagger.Tags(ctx, backupName)
+}
+
+// Stat returns the attributes of an object of the inner storage; the size
+// of a deduplicated backup is the size of its chunk index
+func (s *DedupStorage) Stat(ctx context.Context, backupName string) (ObjectInfo, error) {
+	return s.inner.Stat(ctx, backupName)
+}
+
+// CleanupPartial removes the partial uploads of the inner storage
+func (s *DedupStorage) CleanupPartial(ctx context.Context, cutoff time.Time) ([]string, error) {
+	cleaner, ok := s.inner.(PartialCleaner)
+	if !ok {
+		return nil, nil
+	}
+	return cleaner.CleanupPartial(ctx, cutoff)
+}
+
+// FreeSpace returns the free space of the volume of the inner storage
+func (s *DedupStorage) FreeSpace(ctx context.Context) (int64, error) {
+	reporter, ok := s.inner.(SpaceReporter)
+	if !ok {
+		return 0, fmt.Errorf("%s storage does not report its free space", s.inner.Type())
+	}
+	return reporter.FreeSpace(ctx)
+}
+
+// List returns the backup names of the inner storage
+func (s *DedupStorage) List(ctx context.Context) ([]string, error) {
+	return s.inner.List(ctx)
+}
+
+// ListObjects returns every object of the inner storage, chunks included
+func (s *DedupStorage) ListObjects(ctx context.Context) ([]ObjectInfo, error) {
+	return s.inner.ListObjects(ctx)
+}
+
+// Delete removes an object; deleting a backup also removes the chunks no
+// other backup references
+func (s *DedupStorage) Delete(ctx context.Context, backupName string) error {
+	if err := s.inner.Delete(ctx, backupName); err != nil {
+		return err
+	}
+	if IsBackupName(backupName) {
+		s.collectGarbage(ctx)
+	}
+	return nil
+}
+
+// DeleteBatch removes several objects, then the chunks no remaining backup references
+func (s *DedupStorage) DeleteBatch(ctx context.Context, backupNames []string) map[string]error {
+	var failed map[string]error
+	if batch, ok := s.inner.(BatchDeleter); ok {
+		failed = batch.DeleteBatch(ctx, backupNames)
+	} else {
+		failed = make(map[string]error)
+		for _, name := range backupNames {
+			if err := s.inner.Delete(ctx, name); err != nil {
+				failed[name] = err
+			}
+		}
+	}
+
+	for _, name := range backupNames {
+		if _, ok := failed[name]; !ok && IsBackupName(name) {
+			s.collectGarbage(ctx)
+			break
+		}
+	}
+	return failed
+}
+
+// collectGarbage deletes chunks referenced by no backup index and older than
+// the grace period
+// Nothing is deleted when an index cannot be read
+func (s *DedupStorage) collectGarbage(ctx context.Context) {
+	objects, err := s.inner.ListObjects(ctx)
+	if err != nil {
+		log.Printf("Warning: chunk cleanup skipped, failed to list objects: %v", err)
+		return
+	}
+
+	referenced := make(map[string]bool)
+	var chunks []string
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Name, chunkSuffix) {
+			// A young chunk may belong to an upload whose index is not stored yet
+			if time.Since(obj.ModTime) >= s.gcGrace {
+				chunks = append(chunks, obj.Name)
+			}
+			continue
+		}
+		if !IsBackupName(obj.Name) {
+			continue
+		}
+
+		sniffer := &indexSniffer{}
+		err := s.inner.Download(ctx, obj.Name, sniffer)
+		if err == nil {
+			err = sniffer.flush()
+		}
+		if errors.Is(err, errNotIndex) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: chunk cleanup skipped, failed to read %s: %v", obj.Name, err)
+			return
+		}
+
+		var index dedupIndex
+		if err := json.Unmarshal(sniffer.index.Bytes(), &index); err != nil {
+			log.Printf("Warning: chunk cleanup skipped, failed to decode index of %s: %v", obj.Name, err)
+			return
+		}
+		for _, c := range index.Chunks {
+			referenced[c.Hash+chunkSuffix] = true
+		}
+	}
+
+	var unused []string
+	for _, name := range chunks {
+		if !referenced[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) == 0 {
+		return
+	}
+
+	removed := len(unused)
+	if batch, ok := s.inner.(BatchDeleter); ok {
+		failed := batch.DeleteBatch(ctx, unused)
+		removed -= len(failed)
+		for name, err := range failed {
+			log.Printf("Warning: failed to delete chunk %s: %v", name, err)
+		}
+	} else {
+		for _, name := range unused {
+			if err := s.inner.Delete(ctx, name); err != nil {
+				log.Printf("Warning: failed to delete chunk %s: %v", name, err)
+				removed--
+			}
+		}
+	}
+	log.Printf("Deduplication: removed %d unused chunk(s)", removed)
+}
+
+// Type returns the inner storage type
+func (s *DedupStorage) Type() string {
+	return s.inner.Type() + "+dedup"
+}
+
+// Close closes the inner storage when it holds resources
+func (s *DedupStorage) Close() error {
+	if closer, ok := s.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrStorageAuth is returned when the storage rejects the credentials or
+// denies an operation; retrying does not help
+var ErrStorageAuth = errors.New("storage access denied")
+
+// ErrStorageTransient is returned for failures that may go away on retry
+// (network errors, throttling, server errors)
+var ErrStorageTransient = errors.New("transient storage error")
+
+// s3AuthCodes are the S3 error codes caused by credentials or permissions
+var s3AuthCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AllAccessDisabled":           true,
+	"ExpiredToken":                true,
+	"InvalidAccessKeyId":          true,
+	"InvalidToken":                true,
+	"NoCredentialProviders":       true,
+	"SignatureDoesNotMatch":       true,
+	"AccountProblem":              true,
+	"InvalidClientTokenId":        true,
+	"UnrecognizedClientException": true,
+}
+
+// s3TransientCodes are the S3 error codes of failures worth retrying
+var s3TransientCodes = map[string]bool{
+	request.ErrCodeRequestError:    true,
+	request.ErrCodeResponseTimeout: true,
+	"RequestTimeout":               true,
+	"SlowDown":                     true,
+	"Throttling":                   true,
+	"ThrottlingException":          true,
+	"InternalError":                true,
+	"ServiceUnavailable":           true,
+}
+
+// classifiedError tags an error with its category while keeping its message
+type classifiedError struct {
+	category error
+	err      error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() []error {
+	return []error{e.err, e.category}
+}
+
+// classify tags a backend error with ErrStorageAuth or ErrStorageTransient
+// when its cause is recognized, and returns it unchanged otherwise
+func classify(err error) error {
+	if err == nil || errors.Is(err, ErrStorageAuth) || errors.Is(err, ErrStorageTransient) {
+		return err
+	}
+	if category := errorCategory(err); category != nil {
+		return &classifiedError{category: category, err: err}
+	}
+	return err
+}
+
+// errorCategory returns the category of a backend error, or nil
+func errorCategory(err error) error {
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) {
+		if category := statusCategory(failure.StatusCode()); category != nil {
+			return category
+		}
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch {
+		case s3AuthCodes[awsErr.Code()]:
+			return ErrStorageAuth
+		case s3TransientCodes[awsErr.Code()]:
+			return ErrStorageTransient
+		}
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return statusCategory(apiErr.Code)
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return ErrStorageAuth
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EPIPE):
+		return ErrStorageTransient
+	}
+	return nil
+}
+
+// statusCategory returns the category of an HTTP status code, or nil
+func statusCategory(code int) error {
+	switch {
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return ErrStorageAuth
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+		return ErrStorageTransient
+	}
+	return nil
+}
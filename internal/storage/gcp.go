@@ -2,120 +2,402 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/ermos/docker-redis-backup/internal/httpclient"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 // GCPStorage implements Storage interface for Google Cloud Storage
 type GCPStorage struct {
-	client       *storage.Client
-	bucket       string
-	backupPrefix string
+	client        *storage.Client
+	bucket        string
+	backupPrefix  string
+	layout        Layout
+	partRetries   int
+	deleteConc    int
+	metadata      map[string]string
+	listTimeout   time.Duration
+	deleteTimeout time.Duration
+	// stateDir persists the sessions of resumable uploads, sent with
+	// httpClient through the JSON API (empty = uploads are not resumed)
+	stateDir   string
+	httpClient *http.Client
 }
 
 // NewGCPStorage creates a new GCP Cloud Storage instance
 // Uses service account JSON file for authentication
-func NewGCPStorage(credentialsFile, bucket, backupPrefix string) (*GCPStorage, error) {
+func NewGCPStorage(credentialsFile, bucket, backupPrefix string, layout Layout, opts UploadOptions, tlsOpts TLSOptions) (*GCPStorage, error) {
 	if bucket == "" {
 		return nil, fmt.Errorf("GCP bucket name is required")
 	}
 
+	// The client outlives this call and refreshes its credentials with ctx,
+	// every operation is bound to the context of its caller
 	ctx := context.Background()
-	var client *storage.Client
-	var err error
+	var clientOpts []option.ClientOption
 
 	if credentialsFile != "" {
 		// Use service account JSON file
-		client, err = storage.NewClient(ctx, option.WithCredentialsFile(credentialsFile))
-	} else {
-		// Use default credentials (GOOGLE_APPLICATION_CREDENTIALS env var or metadata server)
-		client, err = storage.NewClient(ctx)
+		clientOpts = append(clientOpts, option.WithCredentialsFile(credentialsFile))
 	}
+	// Otherwise use default credentials (GOOGLE_APPLICATION_CREDENTIALS env var or metadata server)
+
+	// Use a custom authenticated HTTP client when extra CA certificates are configured
+	var httpClient *http.Client
+	if tlsOpts.custom() {
+		base, err := httpclient.NewTransport(tlsOpts.InsecureSkipVerify, tlsOpts.CACertFiles...)
+		if err != nil {
+			return nil, err
+		}
+		transport, err := htransport.NewTransport(ctx, base, append(clientOpts, option.WithScopes(storage.ScopeFullControl))...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCP HTTP transport: %w", err)
+		}
+		httpClient = &http.Client{Transport: transport}
+		clientOpts = []option.ClientOption{option.WithHTTPClient(httpClient)}
+	}
+
+	// Resumable sessions are sent through the same authenticated client
+	if opts.StateDir != "" {
+		if err := os.MkdirAll(opts.StateDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create upload state directory: %w", err)
+		}
+		if httpClient == nil {
+			var err error
+			httpClient, _, err = htransport.NewClient(ctx, append(clientOpts, option.WithScopes(storage.ScopeFullControl))...)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create GCP HTTP client: %w", err)
+			}
+			clientOpts = []option.ClientOption{option.WithHTTPClient(httpClient)}
+		}
+	}
+
+	client, err := storage.NewClient(ctx, clientOpts...)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GCP storage client: %w", err)
 	}
 
 	return &GCPStorage{
-		client:       client,
-		bucket:       bucket,
-		backupPrefix: backupPrefix,
+		client:        client,
+		bucket:        bucket,
+		backupPrefix:  backupPrefix,
+		layout:        layout,
+		partRetries:   opts.PartRetries,
+		deleteConc:    opts.DeleteConcurrency,
+		metadata:      opts.Labels,
+		listTimeout:   opts.ListTimeout,
+		deleteTimeout: opts.DeleteTimeout,
+		stateDir:      opts.StateDir,
+		httpClient:    httpClient,
 	}, nil
 }
 
 // Upload uploads a file to GCP Cloud Storage
+// With an upload state directory, the session is persisted so the upload can
+// be resumed after a restart
 func (s *GCPStorage) Upload(ctx context.Context, sourcePath string, backupName string) error {
+	if s.stateDir != "" {
+		return s.uploadResumable(ctx, sourcePath, backupName)
+	}
+
 	file, err := os.Open(sourcePath)
 	if err != nil {
 		return fmt.Errorf("failed to open source file: %w", err)
 	}
 	defer file.Close()
 
+	return s.UploadStream(ctx, file, backupName)
+}
+
+// UploadStream uploads the content of r to GCP Cloud Storage
+// The object is only created when the whole stream was read successfully
+func (s *GCPStorage) UploadStream(ctx context.Context, r io.Reader, backupName string) error {
 	objectName := s.getObjectName(backupName)
-	obj := s.client.Bucket(s.bucket).Object(objectName)
+	// Backup names are unique, so retrying every chunk of the resumable upload is safe
+	obj := s.client.Bucket(s.bucket).Object(objectName).Retryer(
+		storage.WithPolicy(storage.RetryAlways),
+		storage.WithMaxAttempts(s.partRetries+1),
+	)
+
+	// Cancelling the writer's context aborts the upload instead of committing a partial object
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	writer := obj.NewWriter(ctx)
-	defer writer.Close()
+	writer.ChunkRetryDeadline = 2 * time.Minute
+	writer.Metadata = s.metadata
 
-	if _, err := io.Copy(writer, file); err != nil {
-		return fmt.Errorf("failed to upload to GCS: %w", err)
+	if _, err := io.Copy(writer, r); err != nil {
+		cancel()
+		_ = writer.Close()
+		return fmt.Errorf("failed to upload to GCS: %w", classify(err))
 	}
 
-	return writer.Close()
+	// Most upload failures (auth, server errors, preconditions) are only reported on Close
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload to GCS: %w", classify(err))
+	}
+	return nil
+}
+
+// Download streams a backup from GCS to w
+func (s *GCPStorage) Download(ctx context.Context, backupName string, w io.Writer) error {
+	objectName := s.getObjectName(backupName)
+	reader, err := s.client.Bucket(s.bucket).Object(objectName).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) && s.layout.nested(backupName) {
+		// Backup stored before the date layout was enabled
+		reader, err = s.client.Bucket(s.bucket).Object(s.prefixed(backupName)).NewReader(ctx)
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%w: %s", ErrNotFound, backupName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open GCS object: %w", classify(err))
+	}
+	defer reader.Close()
+
+	if _, err := io.Copy(w, reader); err != nil {
+		return fmt.Errorf("failed to download from GCS: %w", classify(err))
+	}
+	return nil
+}
+
+// Tags returns the custom metadata of a backup object
+func (s *GCPStorage) Tags(ctx context.Context, backupName string) (map[string]string, error) {
+	attrs, err := s.client.Bucket(s.bucket).Object(s.getObjectName(backupName)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) && s.layout.nested(backupName) {
+		// Backup stored before the date layout was enabled
+		attrs, err = s.client.Bucket(s.bucket).Object(s.prefixed(backupName)).Attrs(ctx)
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, backupName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GCS object attributes: %w", classify(err))
+	}
+	return attrs.Metadata, nil
+}
+
+// Stat returns the attributes of a GCS object
+func (s *GCPStorage) Stat(ctx context.Context, backupName string) (ObjectInfo, error) {
+	attrs, err := s.client.Bucket(s.bucket).Object(s.getObjectName(backupName)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) && s.layout.nested(backupName) {
+		// Backup stored before the date layout was enabled
+		attrs, err = s.client.Bucket(s.bucket).Object(s.prefixed(backupName)).Attrs(ctx)
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, backupName)
+	}
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to get GCS object attributes: %w", classify(err))
+	}
+	return ObjectInfo{Name: backupName, Size: attrs.Size, ModTime: attrs.Updated, Metadata: attrs.Metadata}, nil
 }
 
 // List returns all backup files in the GCS bucket with the configured prefix
 func (s *GCPStorage) List(ctx context.Context) ([]string, error) {
+	objects, err := s.ListObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return backupNames(objects), nil
+}
+
+// ListObjects returns every object below the configured prefix
+func (s *GCPStorage) ListObjects(ctx context.Context) ([]ObjectInfo, error) {
 	prefix := s.backupPrefix
 	if prefix != "" && !strings.HasSuffix(prefix, "/") {
 		prefix += "/"
 	}
 
+	ctx, cancel := withTimeout(ctx, s.listTimeout)
+	defer cancel()
+
 	query := &storage.Query{Prefix: prefix}
 	it := s.client.Bucket(s.bucket).Objects(ctx, query)
 
-	var backups []string
+	var objects []ObjectInfo
 	for {
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to list GCS objects: %w", err)
+			return nil, fmt.Errorf("failed to list GCS objects: %w", classify(err))
 		}
 
-		name := filepath.Base(attrs.Name)
-		if strings.HasSuffix(name, ".rdb") {
-			backups = append(backups, name)
-		}
+		objects = append(objects, ObjectInfo{
+			Name:    filepath.Base(attrs.Name),
+			Size:    attrs.Size,
+			ModTime: attrs.Updated,
+		})
 	}
 
-	// Sort by name (oldest first)
-	sort.Strings(backups)
+	return objects, nil
+}
+
+// CheckIsolation lists the parent of the backup prefix and deletes a missing
+// object beside it, which the credentials of a target must both be denied
+// Listing only the backup prefix is not reported
+func (s *GCPStorage) CheckIsolation(ctx context.Context) error {
+	own, parent, probe, ok := isolationScope(s.backupPrefix)
+	if !ok {
+		return nil
+	}
 
-	return backups, nil
+	listCtx, cancel := withTimeout(ctx, s.listTimeout)
+	defer cancel()
+	it := s.client.Bucket(s.bucket).Objects(listCtx, &storage.Query{Prefix: parent, Delimiter: "/"})
+	attrs, err := it.Next()
+	for ; err == nil; attrs, err = it.Next() {
+		if name := attrs.Prefix + attrs.Name; name != own {
+			return fmt.Errorf("%w: %s can be listed", ErrNotIsolated, name)
+		}
+	}
+	if err = classify(err); err != iterator.Done && !errors.Is(err, ErrStorageAuth) {
+		return fmt.Errorf("failed to list GCS objects: %w", err)
+	}
+
+	deleteCtx, cancel := withTimeout(ctx, s.deleteTimeout)
+	defer cancel()
+	err = s.client.Bucket(s.bucket).Object(probe).Delete(deleteCtx)
+	switch {
+	case err == nil, errors.Is(err, storage.ErrObjectNotExist):
+		return fmt.Errorf("%w: %s can be deleted", ErrNotIsolated, probe)
+	case !errors.Is(classify(err), ErrStorageAuth):
+		return fmt.Errorf("failed to delete GCS object %s: %w", probe, classify(err))
+	}
+	return nil
 }
 
 // Delete removes a backup from GCS
 func (s *GCPStorage) Delete(ctx context.Context, backupName string) error {
+	ctx, cancel := withTimeout(ctx, s.deleteTimeout)
+	defer cancel()
+
 	objectName := s.getObjectName(backupName)
-	obj := s.client.Bucket(s.bucket).Object(objectName)
+	err := s.client.Bucket(s.bucket).Object(objectName).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) && s.layout.nested(backupName) {
+		// Backup stored before the date layout was enabled
+		err = s.client.Bucket(s.bucket).Object(s.prefixed(backupName)).Delete(ctx)
+	}
 
-	if err := obj.Delete(ctx); err != nil {
-		return fmt.Errorf("failed to delete GCS object: %w", err)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("%w: %s", ErrNotFound, backupName)
+		}
+		return fmt.Errorf("failed to delete GCS object: %w", classify(err))
 	}
 
 	return nil
 }
 
+// DeleteBatch removes backups with parallel delete requests
+// GCS has no batch delete in the client library, so concurrency is bounded by DELETE_CONCURRENCY
+func (s *GCPStorage) DeleteBatch(ctx context.Context, backupNames []string) map[string]error {
+	concurrency := s.deleteConc
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := make(map[string]error)
+	sem := make(chan struct{}, concurrency)
+
+	for _, name := range backupNames {
+		if err := ctx.Err(); err != nil {
+			// Cancelled: the remaining deletes are not sent
+			mu.Lock()
+			failed[name] = err
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := s.Delete(ctx, name); err != nil {
+				mu.Lock()
+				failed[name] = err
+				mu.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	return failed
+}
+
+// ApplyLifecycle replaces the lifecycle rules of the backup prefix: the
+// Delete and SetStorageClass rules on the age of objects matching exactly
+// this prefix; other rules of the bucket are kept as they are
+func (s *GCPStorage) ApplyLifecycle(ctx context.Context, policy LifecyclePolicy) (bool, error) {
+	var prefixes []string
+	if s.backupPrefix != "" {
+		prefixes = []string{strings.TrimSuffix(s.backupPrefix, "/") + "/"}
+	}
+
+	bucket := s.client.Bucket(s.bucket)
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get GCS bucket attributes: %w", classify(err))
+	}
+
+	var rules, current []storage.LifecycleRule
+	for _, rule := range attrs.Lifecycle.Rules {
+		managed := (rule.Action.Type == storage.DeleteAction || rule.Action.Type == storage.SetStorageClassAction) &&
+			rule.Condition.AgeInDays > 0 && slices.Equal(rule.Condition.MatchesPrefix, prefixes)
+		if managed {
+			current = append(current, rule)
+		} else {
+			rules = append(rules, rule)
+		}
+	}
+
+	var want []storage.LifecycleRule
+	if policy.TransitionDays > 0 {
+		want = append(want, storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: policy.TransitionClass},
+			Condition: storage.LifecycleCondition{AgeInDays: int64(policy.TransitionDays), MatchesPrefix: prefixes},
+		})
+	}
+	if policy.ExpireDays > 0 {
+		want = append(want, storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+			Condition: storage.LifecycleCondition{AgeInDays: int64(policy.ExpireDays), MatchesPrefix: prefixes},
+		})
+	}
+	if len(current) == 0 && len(want) == 0 || reflect.DeepEqual(current, want) {
+		return false, nil
+	}
+
+	_, err = bucket.Update(ctx, storage.BucketAttrsToUpdate{
+		Lifecycle: &storage.Lifecycle{Rules: append(rules, want...)},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to update GCS lifecycle rules: %w", classify(err))
+	}
+	return true, nil
+}
+
 // Type returns the storage type name
 func (s *GCPStorage) Type() string {
 	return "gcp"
@@ -128,8 +410,13 @@ func (s *GCPStorage) Close() error {
 
 // getObjectName returns the full GCS object name for a backup
 func (s *GCPStorage) getObjectName(backupName string) string {
+	return s.prefixed(s.layout.path(backupName))
+}
+
+// prefixed returns the GCS object name for a path relative to the backup prefix
+func (s *GCPStorage) prefixed(p string) string {
 	if s.backupPrefix == "" {
-		return backupName
+		return p
 	}
-	return strings.TrimSuffix(s.backupPrefix, "/") + "/" + backupName
+	return strings.TrimSuffix(s.backupPrefix, "/") + "/" + p
 }
@@ -0,0 +1,375 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// gcsUploadURL initiates resumable uploads with the JSON API
+const gcsUploadURL = "https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s"
+
+// gcsChunkSize is the size of the chunks of a resumable upload, a multiple of
+// the 256 KiB required by GCS
+const gcsChunkSize = 16 * 1024 * 1024
+
+// gcsUploadState is the persisted state of an in-progress resumable upload
+// The session URI is all GCS needs to continue it, for up to a week
+type gcsUploadState struct {
+	Bucket        string    `json:"bucket"`
+	Object        string    `json:"object"`
+	BackupName    string    `json:"backup_name"`
+	SessionURI    string    `json:"session_uri"`
+	SourcePath    string    `json:"source_path"`
+	SourceSize    int64     `json:"source_size"`
+	SourceModTime time.Time `json:"source_mod_time"`
+	StagedPath    string    `json:"staged_path,omitempty"`
+}
+
+// readPath returns the file the chunks are read from, the staged copy of the
+// source when there is one
+func (state *gcsUploadState) readPath() string {
+	if state.StagedPath != "" {
+		return state.StagedPath
+	}
+	return state.SourcePath
+}
+
+// errSessionExpired is returned when GCS no longer knows a resumable session
+var errSessionExpired = errors.New("resumable upload session expired")
+
+// uploadResumable uploads a file with a resumable session whose URI is
+// persisted in the state directory, retrying each failed chunk
+func (s *GCPStorage) uploadResumable(ctx context.Context, sourcePath string, backupName string) error {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+
+	objectName := s.getObjectName(backupName)
+	state, err := s.loadUploadState(objectName)
+	if err != nil {
+		return err
+	}
+	if state != nil && (state.SourcePath != sourcePath || state.SourceSize != info.Size() || !state.SourceModTime.Equal(info.ModTime())) {
+		log.Printf("Source of interrupted upload %s changed, starting over", backupName)
+		s.cancelUpload(ctx, state)
+		state = nil
+	}
+	if state != nil {
+		log.Printf("Resuming upload of %s", backupName)
+		err := s.continueUpload(ctx, state)
+		if !errors.Is(err, errSessionExpired) {
+			return err
+		}
+		log.Printf("Session of interrupted upload %s expired, starting over", backupName)
+	}
+
+	sessionURI, err := s.startSession(ctx, objectName)
+	if err != nil {
+		return err
+	}
+	state = &gcsUploadState{
+		Bucket:        s.bucket,
+		Object:        objectName,
+		BackupName:    backupName,
+		SessionURI:    sessionURI,
+		SourcePath:    sourcePath,
+		SourceSize:    info.Size(),
+		SourceModTime: info.ModTime(),
+		StagedPath:    s.stagedPath(objectName),
+	}
+	// The state is saved first, so a crash while staging leaves a state
+	// whose staged file is incomplete, canceled by the next run
+	if err := s.saveUploadState(state); err != nil {
+		return err
+	}
+	if err := stageSource(sourcePath, state.StagedPath); err != nil {
+		log.Printf("Warning: failed to stage the source of %s, the upload cannot resume after a restart: %v", backupName, err)
+		state.StagedPath = ""
+		if err := s.saveUploadState(state); err != nil {
+			return err
+		}
+	}
+	return s.continueUpload(ctx, state)
+}
+
+// ResumePending completes resumable uploads interrupted by a previous process
+// Uploads whose source file changed or disappeared are canceled
+func (s *GCPStorage) ResumePending(ctx context.Context) ([]string, error) {
+	if s.stateDir == "" {
+		return nil, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.stateDir, "*.gcs.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var resumed []string
+	for _, file := range files {
+		state, err := readGCSUploadState(file)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid upload state %s: %v", file, err)
+			continue
+		}
+		if state.Bucket != s.bucket {
+			continue
+		}
+
+		info, err := os.Stat(state.readPath())
+		if err != nil || info.Size() != state.SourceSize || !info.ModTime().Equal(state.SourceModTime) {
+			log.Printf("Source of interrupted upload %s is gone or changed, canceling it", state.BackupName)
+			s.cancelUpload(ctx, state)
+			continue
+		}
+
+		log.Printf("Resuming interrupted upload of %s", state.BackupName)
+		err = s.continueUpload(ctx, state)
+		if errors.Is(err, errSessionExpired) {
+			log.Printf("Session of interrupted upload %s expired, it is uploaded again by the next run", state.BackupName)
+			if err := s.removeUploadState(state.Object); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			return resumed, fmt.Errorf("failed to resume upload of %s: %w", state.BackupName, err)
+		}
+		resumed = append(resumed, state.BackupName)
+	}
+	return resumed, nil
+}
+
+// startSession initiates a resumable upload of an object and returns its session URI
+func (s *GCPStorage) startSession(ctx context.Context, objectName string) (string, error) {
+	resource := map[string]interface{}{}
+	if len(s.metadata) > 0 {
+		resource["metadata"] = s.metadata
+	}
+	body, err := json.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+	endpoint := fmt.Sprintf(gcsUploadURL, url.PathEscape(s.bucket), url.QueryEscape(objectName))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to start resumable upload: %w", classify(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to start resumable upload: %w", classify(gcsResponseError(resp)))
+	}
+	sessionURI := resp.Header.Get("Location")
+	if sessionURI == "" {
+		return "", errors.New("failed to start resumable upload: no session URI returned")
+	}
+	return sessionURI, nil
+}
+
+// continueUpload asks GCS how much of the file it has and uploads the rest
+// chunk by chunk, then removes the state
+func (s *GCPStorage) continueUpload(ctx context.Context, state *gcsUploadState) error {
+	file, err := os.Open(state.readPath())
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer file.Close()
+
+	offset, done, err := s.sendChunk(ctx, state, file, -1)
+	for err == nil && !done {
+		offset, done, err = s.sendChunk(ctx, state, file, offset)
+	}
+	if err != nil {
+		return err
+	}
+	return s.removeUploadState(state.Object)
+}
+
+// sendChunk uploads the chunk starting at offset, retrying transient failures
+// with backoff, and returns the offset GCS expects next
+// An offset of -1 only queries the progress of the session
+func (s *GCPStorage) sendChunk(ctx context.Context, state *gcsUploadState, file *os.File, offset int64) (int64, bool, error) {
+	var lastErr error
+	for attempt := 0; attempt <= s.partRetries; attempt++ {
+		if attempt > 0 {
+			wait := time.Duration(attempt) * 2 * time.Second
+			log.Printf("Retrying chunk at %d of %s in %s (attempt %d/%d): %v", offset, state.BackupName, wait, attempt+1, s.partRetries+1, lastErr)
+			select {
+			case <-ctx.Done():
+				return 0, false, ctx.Err()
+			case <-time.After(wait):
+			}
+			// A failed chunk may have been partly stored, ask where to continue
+			next, done, err := s.putChunk(ctx, state, file, -1)
+			if err != nil {
+				lastErr = err
+				if errors.Is(err, errSessionExpired) {
+					return 0, false, err
+				}
+				continue
+			}
+			if done || offset < 0 {
+				return next, done, nil
+			}
+			offset = next
+		}
+
+		next, done, err := s.putChunk(ctx, state, file, offset)
+		if err == nil {
+			return next, done, nil
+		}
+		if ctx.Err() != nil {
+			return 0, false, ctx.Err()
+		}
+		if errors.Is(err, errSessionExpired) || errors.Is(err, ErrStorageAuth) {
+			return 0, false, err
+		}
+		lastErr = err
+	}
+	return 0, false, fmt.Errorf("failed to upload to GCS after %d attempts: %w", s.partRetries+1, lastErr)
+}
+
+// putChunk sends one request of the session: the chunk at offset, or a
+// progress query when offset is -1
+func (s *GCPStorage) putChunk(ctx context.Context, state *gcsUploadState, file *os.File, offset int64) (int64, bool, error) {
+	var body io.Reader = http.NoBody
+	contentRange := fmt.Sprintf("bytes */%d", state.SourceSize)
+	var size int64
+	if offset >= 0 && offset < state.SourceSize {
+		size = min(gcsChunkSize, state.SourceSize-offset)
+		body = io.NewSectionReader(file, offset, size)
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+size-1, state.SourceSize)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, state.SessionURI, body)
+	if err != nil {
+		return 0, false, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Range", contentRange)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return 0, false, classify(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return state.SourceSize, true, nil
+	case http.StatusPermanentRedirect:
+		// Range is "bytes=0-<last byte stored>", absent when nothing is stored
+		next := int64(0)
+		if stored := resp.Header.Get("Range"); stored != "" {
+			last, err := strconv.ParseInt(stored[strings.LastIndex(stored, "-")+1:], 10, 64)
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid Range %q in GCS response", stored)
+			}
+			next = last + 1
+		}
+		return next, false, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, false, errSessionExpired
+	default:
+		return 0, false, classify(gcsResponseError(resp))
+	}
+}
+
+// cancelUpload cancels a resumable session and removes its state
+func (s *GCPStorage) cancelUpload(ctx context.Context, state *gcsUploadState) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, state.SessionURI, nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = s.httpClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: failed to cancel resumable upload of %s: %v", state.BackupName, err)
+	}
+	if err := s.removeUploadState(state.Object); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// gcsResponseError describes an unexpected response of the upload API
+func gcsResponseError(resp *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &googleapi.Error{Code: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+}
+
+// statePath returns the state file path for an object name
+func (s *GCPStorage) statePath(objectName string) string {
+	return filepath.Join(s.stateDir, strings.ReplaceAll(objectName, "/", "_")+".gcs.json")
+}
+
+// stagedPath returns the path the source of an upload is staged at
+func (s *GCPStorage) stagedPath(objectName string) string {
+	return strings.TrimSuffix(s.statePath(objectName), ".json") + ".src"
+}
+
+func (s *GCPStorage) loadUploadState(objectName string) (*gcsUploadState, error) {
+	state, err := readGCSUploadState(s.statePath(objectName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return state, err
+}
+
+func (s *GCPStorage) saveUploadState(state *gcsUploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated state
+	path := s.statePath(state.Object)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	return nil
+}
+
+// removeUploadState removes the state of an upload and its staged source
+func (s *GCPStorage) removeUploadState(objectName string) error {
+	if err := os.Remove(s.statePath(objectName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove upload state: %w", err)
+	}
+	return removeStaged(s.stagedPath(objectName))
+}
+
+func readGCSUploadState(path string) (*gcsUploadState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state gcsUploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+)
+
+// ErrNotIsolated is returned when the credentials of a target reach the
+// objects of other targets
+var ErrNotIsolated = errors.New("storage credentials are not limited to the backup prefix")
+
+// isolationProbeSuffix names the missing object a target must not be able to
+// delete, beside its prefix
+const isolationProbeSuffix = ".isolation-probe"
+
+// IsolationChecker is implemented by storages whose credentials can be
+// limited to the backup prefix
+type IsolationChecker interface {
+	// CheckIsolation returns an error wrapping ErrNotIsolated when the
+	// credentials can list or delete objects beside the backup prefix
+	CheckIsolation(ctx context.Context) error
+}
+
+// isolationScope returns the backup prefix with a trailing slash, the parent
+// prefix listed by an isolation check and the key of the missing object it
+// deletes
+// It returns false for an empty prefix: the whole bucket belongs to the target
+func isolationScope(backupPrefix string) (own, parent, probe string, ok bool) {
+	prefix := strings.Trim(backupPrefix, "/")
+	if prefix == "" {
+		return "", "", "", false
+	}
+	if parent = path.Dir(prefix); parent == "." {
+		parent = ""
+	} else {
+		parent += "/"
+	}
+	return prefix + "/", parent, prefix + isolationProbeSuffix, true
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"path"
+	"regexp"
+)
+
+// Layout controls where backups are placed below the storage prefix
+type Layout string
+
+const (
+	// LayoutFlat stores every backup directly under the prefix
+	LayoutFlat Layout = "flat"
+	// LayoutDate stores backups under YYYY/MM/DD/ sub-directories
+	LayoutDate Layout = "date"
+)
+
+// backupDatePattern matches the date part of a backup timestamp (2006-01-02)
+var backupDatePattern = regexp.MustCompile(`(\d{4})-(\d{2})-(\d{2})`)
+
+// path returns the location of a backup relative to the storage prefix
+// Names without a date (and every name in the flat layout) are stored as-is
+func (l Layout) path(backupName string) string {
+	if l != LayoutDate {
+		return backupName
+	}
+
+	match := backupDatePattern.FindStringSubmatch(backupName)
+	if match == nil {
+		return backupName
+	}
+	return path.Join(match[1], match[2], match[3], backupName)
+}
+
+// nested reports whether the layout places backupName in a sub-directory
+func (l Layout) nested(backupName string) bool {
+	return l.path(backupName) != backupName
+}
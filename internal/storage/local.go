@@ -2,20 +2,45 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
-	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// partialSuffix is appended to the name of a local backup while it is written
+const partialSuffix = ".partial"
+
+// LocalOptions tunes how local backup files are written
+type LocalOptions struct {
+	// Fsync flushes each file and its directory to disk before the upload succeeds
+	Fsync bool
+	// FileMode is the mode of the files (0 = 0666 minus the umask)
+	FileMode os.FileMode
+	// UID and GID own the files (-1 = unchanged)
+	UID int
+	GID int
+	// HardLinks stores a backup identical to an existing one as a hard link to it
+	HardLinks bool
+	// NetworkFS writes in a way safe on NFS and SMB mounts, see writeNetwork
+	NetworkFS bool
+}
+
 // LocalStorage implements Storage interface for local filesystem
 type LocalStorage struct {
 	basePath string
+	layout   Layout
+	opts     LocalOptions
 }
 
 // NewLocalStorage creates a new local storage instance
-func NewLocalStorage(basePath string) (*LocalStorage, error) {
+func NewLocalStorage(basePath string, layout Layout, opts LocalOptions) (*LocalStorage, error) {
 	// Create backup directory if it doesn't exist
 	if err := os.MkdirAll(basePath, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create backup directory: %w", err)
@@ -23,13 +48,13 @@ func NewLocalStorage(basePath string) (*LocalStorage, error) {
 
 	return &LocalStorage{
 		basePath: basePath,
+		layout:   layout,
+		opts:     opts,
 	}, nil
 }
 
 // Upload copies a file to the local backup directory
 func (s *LocalStorage) Upload(ctx context.Context, sourcePath string, backupName string) error {
-	destPath := filepath.Join(s.basePath, backupName)
-
 	// Open source file
 	src, err := os.Open(sourcePath)
 	if err != nil {
@@ -37,61 +62,267 @@ func (s *LocalStorage) Upload(ctx context.Context, sourcePath string, backupName
 	}
 	defer src.Close()
 
+	return s.UploadStream(ctx, src, backupName)
+}
+
+// UploadStream writes the content of r to the local backup directory
+// The file is written with a .partial suffix and renamed once complete; it is
+// removed when the copy fails, or by CleanupPartial when the process died
+// With HardLinks, a backup identical to a stored one replaces it by a link
+func (s *LocalStorage) UploadStream(ctx context.Context, r io.Reader, backupName string) error {
+	destPath := filepath.Join(s.basePath, s.layout.path(backupName))
+	err := s.retryStale(func() error { return os.MkdirAll(filepath.Dir(destPath), 0755) })
+	if err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", classify(err))
+	}
+
 	// Create destination file
-	dst, err := os.Create(destPath)
+	partialPath := destPath + partialSuffix
+	var dst *os.File
+	err = s.retryStale(func() (err error) {
+		dst, err = os.Create(partialPath)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create destination file: %w", err)
+		return fmt.Errorf("failed to create destination file: %w", classify(err))
 	}
 	defer dst.Close()
 
+	// Backups are hashed while written to find an identical one
+	dedupe := s.opts.HardLinks && IsBackupName(backupName)
+	hash := sha256.New()
+	var w io.Writer = dst
+	if dedupe {
+		w = io.MultiWriter(dst, hash)
+	}
+
 	// Copy with context cancellation support
 	done := make(chan error, 1)
+	var written int64
 	go func() {
-		_, err := io.Copy(dst, src)
+		var err error
+		if s.opts.NetworkFS {
+			written, err = writeNetwork(w, r)
+		} else {
+			written, err = io.Copy(w, r)
+		}
 		done <- err
 	}()
 
 	select {
 	case <-ctx.Done():
+		_ = os.Remove(partialPath)
 		return ctx.Err()
 	case err := <-done:
+		if err == nil {
+			err = s.finishFile(dst)
+		}
+		if err == nil {
+			err = dst.Close()
+		}
+		if err == nil && s.opts.NetworkFS {
+			err = checkWritten(partialPath, written)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to copy file: %w", err)
+			_ = os.Remove(partialPath)
+			return fmt.Errorf("failed to copy file: %w", classify(err))
+		}
+	}
+
+	if dedupe && s.linkIdentical(ctx, partialPath, destPath, backupName, hash.Sum(nil)) {
+		_ = os.Remove(partialPath)
+	} else if err := s.retryStale(func() error { return os.Rename(partialPath, destPath) }); err != nil {
+		_ = os.Remove(partialPath)
+		return fmt.Errorf("failed to rename destination file: %w", classify(err))
+	}
+	if s.opts.Fsync {
+		// The rename is only durable once the directory is flushed
+		if err := syncDir(filepath.Dir(destPath)); err != nil {
+			return fmt.Errorf("failed to sync backup directory: %w", classify(err))
 		}
 	}
+	return nil
+}
+
+// finishFile applies the mode and owner of LocalOptions to a written file,
+// then flushes it, before it is renamed to its final name
+func (s *LocalStorage) finishFile(f *os.File) error {
+	if s.opts.FileMode != 0 {
+		if err := f.Chmod(s.opts.FileMode); err != nil {
+			return err
+		}
+	}
+	if s.opts.UID != -1 || s.opts.GID != -1 {
+		if err := f.Chown(s.opts.UID, s.opts.GID); err != nil {
+			return err
+		}
+	}
+	if s.opts.Fsync {
+		return f.Sync()
+	}
+	return nil
+}
+
+// syncDir flushes the entries of a directory to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Download copies a backup file to w
+func (s *LocalStorage) Download(ctx context.Context, backupName string, w io.Writer) error {
+	var src *os.File
+	err := s.retryStale(func() (err error) {
+		src, err = os.Open(s.filePath(backupName))
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNotFound, backupName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", classify(err))
+	}
+	defer src.Close()
 
+	if _, err := io.Copy(w, src); err != nil {
+		return fmt.Errorf("failed to read backup: %w", classify(err))
+	}
 	return nil
 }
 
-// List returns all backup files in the directory
+// Stat returns the size and modification time of a local file
+func (s *LocalStorage) Stat(ctx context.Context, backupName string) (ObjectInfo, error) {
+	info, err := os.Stat(s.filePath(backupName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, backupName)
+	}
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to stat backup: %w", classify(err))
+	}
+	return ObjectInfo{Name: backupName, Size: info.Size(), ModTime: backupModTime(backupName, info.ModTime())}, nil
+}
+
+// List returns all backup files in the directory (including date sub-directories)
 func (s *LocalStorage) List(ctx context.Context) ([]string, error) {
-	entries, err := os.ReadDir(s.basePath)
+	objects, err := s.ListObjects(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+		return nil, err
 	}
+	return backupNames(objects), nil
+}
 
-	var backups []string
-	for _, entry := range entries {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".rdb" {
-			backups = append(backups, entry.Name())
+// ListObjects returns every file in the directory (including date sub-directories)
+func (s *LocalStorage) ListObjects(ctx context.Context) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(s.basePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Walking a large directory stops with a cancelled run
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), partialSuffix) {
+			return nil
 		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: backupModTime(entry.Name(), info.ModTime()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %w", classify(err))
 	}
 
-	// Sort by name (which includes timestamp, so oldest first)
-	sort.Strings(backups)
+	return objects, nil
+}
+
+// CleanupPartial removes the .partial files last written before cutoff, left
+// by uploads interrupted by a crash
+func (s *LocalStorage) CleanupPartial(ctx context.Context, cutoff time.Time) ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(s.basePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), partialSuffix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed = append(removed, entry.Name())
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to remove partial files: %w", classify(err))
+	}
+	return removed, nil
+}
 
-	return backups, nil
+// FreeSpace returns the bytes available to the service on the backup volume
+func (s *LocalStorage) FreeSpace(ctx context.Context) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(s.basePath, &stat); err != nil {
+		return 0, fmt.Errorf("failed to get free space of %s: %w", s.basePath, classify(err))
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
 }
 
 // Delete removes a backup file
 func (s *LocalStorage) Delete(ctx context.Context, backupName string) error {
-	filePath := filepath.Join(s.basePath, backupName)
-	if err := os.Remove(filePath); err != nil {
-		return fmt.Errorf("failed to delete backup: %w", err)
+	filePath := s.filePath(backupName)
+	err := s.retryStale(func() error { return os.Remove(filePath) })
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNotFound, backupName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete backup: %w", classify(err))
+	}
+
+	// Remove date directories left empty (fails silently on non-empty ones)
+	for dir := filepath.Dir(filePath); dir != filepath.Clean(s.basePath) && len(dir) > len(s.basePath); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
 	}
 	return nil
 }
 
+// filePath returns the path of an existing backup
+// Backups stored before the date layout was enabled are found at the top level
+func (s *LocalStorage) filePath(backupName string) string {
+	filePath := filepath.Join(s.basePath, s.layout.path(backupName))
+	if s.layout.nested(backupName) {
+		if _, err := os.Stat(filePath); errors.Is(err, fs.ErrNotExist) {
+			return filepath.Join(s.basePath, backupName)
+		}
+	}
+	return filePath
+}
+
 // Type returns the storage type name
 func (s *LocalStorage) Type() string {
 	return "local"
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// maxLinkCandidates bounds the stored backups hashed to find one identical to
+// a new backup, newest first
+const maxLinkCandidates = 3
+
+// backupNameTime matches the UTC creation time in a backup name
+var backupNameTime = regexp.MustCompile(`_(\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2})\.rdb`)
+
+// linkIdentical links destPath to a stored backup identical to the file at
+// partialPath, whose SHA-256 is sum, and reports whether it did
+// The files share the modification time of the older one, which is left
+// untouched; backupModTime reports the new one at the time in its name
+func (s *LocalStorage) linkIdentical(ctx context.Context, partialPath, destPath, backupName string, sum []byte) bool {
+	info, err := os.Stat(partialPath)
+	if err != nil {
+		return false
+	}
+	objects, err := s.ListObjects(ctx)
+	if err != nil {
+		log.Printf("Warning: hard link skipped, failed to list backups: %v", err)
+		return false
+	}
+
+	var candidates []ObjectInfo
+	for _, obj := range objects {
+		if obj.Name != backupName && IsBackupName(obj.Name) && obj.Size == info.Size() {
+			candidates = append(candidates, obj)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ModTime.After(candidates[j].ModTime) })
+	if len(candidates) > maxLinkCandidates {
+		candidates = candidates[:maxLinkCandidates]
+	}
+
+	for _, candidate := range candidates {
+		path := s.filePath(candidate.Name)
+		if !fileHasSum(path, sum) {
+			continue
+		}
+		if err := os.Link(path, destPath); err != nil {
+			log.Printf("Warning: failed to link %s to the identical %s, storing a copy: %v", backupName, candidate.Name, err)
+			return false
+		}
+		log.Printf("Stored %s as a hard link to the identical %s", backupName, candidate.Name)
+		return true
+	}
+	return false
+}
+
+// backupModTime returns the modification time reported for a local backup
+// A hard link keeps the modification time of the older backup it links to, so
+// the creation time in its name is reported when it is later
+func backupModTime(name string, modTime time.Time) time.Time {
+	match := backupNameTime.FindStringSubmatch(name)
+	if match == nil {
+		return modTime
+	}
+	created, err := time.Parse("2006-01-02_15-04-05", match[1])
+	if err != nil || !created.After(modTime) {
+		return modTime
+	}
+	return created
+}
+
+// fileHasSum reports whether the SHA-256 of a file is sum
+func fileHasSum(path string, sum []byte) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return false
+	}
+	return bytes.Equal(hash.Sum(nil), sum)
+}
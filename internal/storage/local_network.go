@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// networkBlockSize is the size of each write to a network filesystem
+const networkBlockSize = 1 << 20
+
+// staleRetries is the number of retries of a file operation failing with
+// ESTALE, returned by NFS when a handle was invalidated by the server
+const staleRetries = 3
+
+// writeNetwork copies r to w with plain sequential writes of networkBlockSize
+// bytes, never with copy_file_range, sendfile or splice, which some NFS and
+// SMB servers and clients get wrong and which may leave holes in the file
+func writeNetwork(w io.Writer, r io.Reader) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{r}, make([]byte, networkBlockSize))
+}
+
+// checkWritten reports an error when the file at path is not as long as the
+// bytes written to it, e.g. after a write lost by the client cache
+func checkWritten(path string, written int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != written {
+		return fmt.Errorf("wrote %d bytes but the file has %d", written, info.Size())
+	}
+	return nil
+}
+
+// retryStale runs a file operation, retrying it on a network filesystem
+// while it fails with ESTALE
+func (s *LocalStorage) retryStale(op func() error) error {
+	err := op()
+	for attempt := 1; s.opts.NetworkFS && attempt <= staleRetries && errors.Is(err, syscall.ESTALE); attempt++ {
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		err = op()
+	}
+	return err
+}
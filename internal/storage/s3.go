@@ -2,34 +2,61 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/ermos/docker-redis-backup/internal/httpclient"
 )
 
+// maxDeleteObjects is the maximum number of keys per DeleteObjects request
+const maxDeleteObjects = 1000
+
 // S3Storage implements Storage interface for S3-compatible storage
 type S3Storage struct {
-	client       *s3.S3
-	uploader     *s3manager.Uploader
-	bucket       string
-	backupPrefix string
+	client        *s3.S3
+	lister        *s3.S3
+	uploader      *s3manager.Uploader
+	bucket        string
+	backupPrefix  string
+	layout        Layout
+	stateDir      string
+	partRetries   int
+	partSize      int64
+	metadata      map[string]*string
+	tagging       *string
+	checksum      string
+	listTimeout   time.Duration
+	deleteTimeout time.Duration
 }
 
 // NewS3Storage creates a new S3 storage instance
 // Compatible with AWS S3, GCP Cloud Storage, MinIO, and other S3-compatible services
-func NewS3Storage(endpoint, region, bucket, accessKey, secretKey string, pathStyle bool, backupPrefix string) (*S3Storage, error) {
+func NewS3Storage(endpoint, region, bucket, accessKey, secretKey string, pathStyle bool, backupPrefix string, layout Layout, opts UploadOptions, tlsOpts TLSOptions, s3Opts S3Options) (*S3Storage, error) {
 	if bucket == "" {
 		return nil, fmt.Errorf("S3 bucket name is required")
 	}
 
+	// Create upload state directory if resumable uploads are enabled
+	if opts.StateDir != "" {
+		if err := os.MkdirAll(opts.StateDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create upload state directory: %w", err)
+		}
+	}
+
 	cfg := &aws.Config{
 		Region:           aws.String(region),
 		S3ForcePathStyle: aws.Bool(pathStyle),
@@ -40,6 +67,20 @@ func NewS3Storage(endpoint, region, bucket, accessKey, secretKey string, pathSty
 		cfg.Endpoint = aws.String(endpoint)
 	}
 
+	// Use a custom HTTP client for extra CA certificates or disabled verification
+	if tlsOpts.custom() {
+		transport, err := httpclient.NewTransport(tlsOpts.InsecureSkipVerify, tlsOpts.CACertFiles...)
+		if err != nil {
+			return nil, err
+		}
+		cfg.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	// The SDK sends Content-MD5 with every upload request unless disabled
+	if opts.Checksum == "none" {
+		cfg.S3DisableContentMD5Validation = aws.Bool(true)
+	}
+
 	// Set credentials if provided
 	if accessKey != "" && secretKey != "" {
 		cfg.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
@@ -50,38 +91,200 @@ func NewS3Storage(endpoint, region, bucket, accessKey, secretKey string, pathSty
 		return nil, fmt.Errorf("failed to create AWS session: %w", err)
 	}
 
+	client := s3.New(sess)
+	if opts.Checksum == s3ChecksumSHA256 {
+		(&s3Checksums{}).register(client)
+	}
+
+	// Some gateways serve listings on their own endpoint
+	lister := client
+	if s3Opts.ListEndpoint != "" {
+		lister = s3.New(sess, &aws.Config{Endpoint: aws.String(s3Opts.ListEndpoint)})
+	}
+	if s3Opts.RequesterPays {
+		for _, c := range []*s3.S3{client, lister} {
+			c.Handlers.Build.PushBackNamed(request.NamedHandler{Name: "redisbackup.RequestPayer", Fn: setRequestPayer})
+		}
+	}
+
+	uploader := s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+		if opts.PartSize > 0 {
+			u.PartSize = opts.PartSize
+		}
+		if opts.Concurrency > 0 {
+			u.Concurrency = opts.Concurrency
+		}
+	})
+
+	var tagging *string
+	if opts.Tagging && len(opts.Labels) > 0 {
+		tags := url.Values{}
+		for key, value := range opts.Labels {
+			tags.Set(key, value)
+		}
+		tagging = aws.String(tags.Encode())
+	}
+
 	return &S3Storage{
-		client:       s3.New(sess),
-		uploader:     s3manager.NewUploader(sess),
-		bucket:       bucket,
-		backupPrefix: backupPrefix,
+		client:        client,
+		lister:        lister,
+		uploader:      uploader,
+		bucket:        bucket,
+		backupPrefix:  backupPrefix,
+		layout:        layout,
+		stateDir:      opts.StateDir,
+		partRetries:   opts.PartRetries,
+		partSize:      opts.PartSize,
+		metadata:      aws.StringMap(opts.Labels),
+		tagging:       tagging,
+		checksum:      opts.Checksum,
+		listTimeout:   opts.ListTimeout,
+		deleteTimeout: opts.DeleteTimeout,
 	}, nil
 }
 
 // Upload uploads a file to S3
+// With an upload state directory, a resumable multipart upload is used instead
 func (s *S3Storage) Upload(ctx context.Context, sourcePath string, backupName string) error {
+	if s.stateDir != "" {
+		return s.uploadResumable(ctx, sourcePath, backupName)
+	}
+
 	file, err := os.Open(sourcePath)
 	if err != nil {
 		return fmt.Errorf("failed to open source file: %w", err)
 	}
 	defer file.Close()
 
-	key := s.getKey(backupName)
+	return s.UploadStream(ctx, file, backupName)
+}
+
+// UploadStream uploads the content of r to S3 with a multipart upload
+func (s *S3Storage) UploadStream(ctx context.Context, r io.Reader, backupName string) error {
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(s.getKey(backupName)),
+		Body:     r,
+		Metadata: s.metadata,
+		Tagging:  s.tagging,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload to S3: %w", classify(err))
+	}
+
+	return nil
+}
+
+// Download streams a backup from S3 to w
+// With S3_UPLOAD_CHECKSUM=sha256, the SHA-256 stored with single-part objects
+// is checked against the downloaded bytes
+func (s *S3Storage) Download(ctx context.Context, backupName string, w io.Writer) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.getKey(backupName)),
+	}
+	if s.checksum == s3ChecksumSHA256 {
+		input.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+	}
+	out, err := s.client.GetObjectWithContext(ctx, input)
+	if isNoSuchKey(err) && s.layout.nested(backupName) {
+		// Backup stored before the date layout was enabled
+		input.Key = aws.String(s.prefixed(backupName))
+		out, err = s.client.GetObjectWithContext(ctx, input)
+	}
+	if err != nil {
+		if isNoSuchKey(err) {
+			return fmt.Errorf("%w: %s", ErrNotFound, backupName)
+		}
+		return fmt.Errorf("failed to download from S3: %w", classify(err))
+	}
+	defer out.Body.Close()
+
+	checked := newChecksumWriter(w, out.ChecksumSHA256)
+	if checked != nil {
+		w = checked
+	}
+	if _, err := io.Copy(w, out.Body); err != nil {
+		return fmt.Errorf("failed to download from S3: %w", classify(err))
+	}
+	if checked != nil {
+		if err := checked.check(); err != nil {
+			return fmt.Errorf("failed to download %s from S3: %w", backupName, err)
+		}
+	}
+	return nil
+}
+
+// Tags returns the S3 object tags of a backup
+func (s *S3Storage) Tags(ctx context.Context, backupName string) (map[string]string, error) {
+	out, err := s.client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.getKey(backupName)),
+	})
+	if isNoSuchKey(err) && s.layout.nested(backupName) {
+		// Backup stored before the date layout was enabled
+		out, err = s.client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.prefixed(backupName)),
+		})
+	}
+	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, backupName)
+		}
+		return nil, fmt.Errorf("failed to get S3 object tags: %w", classify(err))
+	}
+
+	tags := make(map[string]string, len(out.TagSet))
+	for _, tag := range out.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
 
-	_, err = s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+// Stat returns the size, modification time and tags of an S3 object
+func (s *S3Storage) Stat(ctx context.Context, backupName string) (ObjectInfo, error) {
+	key := s.getKey(backupName)
+	out, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
-		Body:   file,
 	})
+	if isNotFound(err) && s.layout.nested(backupName) {
+		// Backup stored before the date layout was enabled
+		out, err = s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.prefixed(backupName)),
+		})
+	}
 	if err != nil {
-		return fmt.Errorf("failed to upload to S3: %w", err)
+		if isNotFound(err) {
+			return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, backupName)
+		}
+		return ObjectInfo{}, fmt.Errorf("failed to get S3 object: %w", classify(err))
 	}
 
-	return nil
+	info := ObjectInfo{
+		Name:    backupName,
+		Size:    aws.Int64Value(out.ContentLength),
+		ModTime: aws.TimeValue(out.LastModified),
+	}
+	if info.Metadata, err = s.Tags(ctx, backupName); err != nil {
+		return ObjectInfo{}, err
+	}
+	return info, nil
 }
 
 // List returns all backup files in the S3 bucket with the configured prefix
 func (s *S3Storage) List(ctx context.Context) ([]string, error) {
+	objects, err := s.ListObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return backupNames(objects), nil
+}
+
+// ListObjects returns every object below the configured prefix
+func (s *S3Storage) ListObjects(ctx context.Context) ([]ObjectInfo, error) {
 	prefix := s.backupPrefix
 	if prefix != "" && !strings.HasSuffix(prefix, "/") {
 		prefix += "/"
@@ -92,52 +295,180 @@ func (s *S3Storage) List(ctx context.Context) ([]string, error) {
 		Prefix: aws.String(prefix),
 	}
 
-	var backups []string
-	err := s.client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+	ctx, cancel := withTimeout(ctx, s.listTimeout)
+	defer cancel()
+
+	var objects []ObjectInfo
+	err := s.lister.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 		for _, obj := range page.Contents {
 			if obj.Key != nil {
-				name := filepath.Base(*obj.Key)
-				if strings.HasSuffix(name, ".rdb") {
-					backups = append(backups, name)
-				}
+				objects = append(objects, ObjectInfo{
+					Name:    filepath.Base(*obj.Key),
+					Size:    aws.Int64Value(obj.Size),
+					ModTime: aws.TimeValue(obj.LastModified),
+				})
 			}
 		}
 		return true
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+		return nil, fmt.Errorf("failed to list S3 objects: %w", classify(err))
+	}
+
+	return objects, nil
+}
+
+// CheckIsolation lists the parent of the backup prefix and deletes a missing
+// object beside it, which the credentials of a target must both be denied
+// Listing only the backup prefix is not reported
+func (s *S3Storage) CheckIsolation(ctx context.Context) error {
+	own, parent, probe, ok := isolationScope(s.backupPrefix)
+	if !ok {
+		return nil
 	}
 
-	// Sort by name (oldest first)
-	sort.Strings(backups)
+	listCtx, cancel := withTimeout(ctx, s.listTimeout)
+	defer cancel()
+	page, err := s.lister.ListObjectsV2WithContext(listCtx, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(parent),
+		Delimiter: aws.String("/"),
+	})
+	switch err = classify(err); {
+	case err == nil:
+		for _, p := range page.CommonPrefixes {
+			if prefix := aws.StringValue(p.Prefix); prefix != own {
+				return fmt.Errorf("%w: %s can be listed", ErrNotIsolated, prefix)
+			}
+		}
+		if len(page.Contents) > 0 {
+			return fmt.Errorf("%w: %s can be listed", ErrNotIsolated, aws.StringValue(page.Contents[0].Key))
+		}
+	case !errors.Is(err, ErrStorageAuth):
+		return fmt.Errorf("failed to list S3 objects: %w", err)
+	}
 
-	return backups, nil
+	deleteCtx, cancel := withTimeout(ctx, s.deleteTimeout)
+	defer cancel()
+	_, err = s.client.DeleteObjectWithContext(deleteCtx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(probe),
+	})
+	switch err = classify(err); {
+	case err == nil:
+		return fmt.Errorf("%w: %s can be deleted", ErrNotIsolated, probe)
+	case !errors.Is(err, ErrStorageAuth):
+		return fmt.Errorf("failed to delete S3 object %s: %w", probe, err)
+	}
+	return nil
 }
 
 // Delete removes a backup from S3
 func (s *S3Storage) Delete(ctx context.Context, backupName string) error {
-	key := s.getKey(backupName)
+	keys := []string{s.getKey(backupName)}
+	if s.layout.nested(backupName) {
+		// Also remove a copy stored before the date layout was enabled
+		// (deleting a missing key is a no-op in S3)
+		keys = append(keys, s.prefixed(backupName))
+	}
 
-	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to delete S3 object: %w", err)
+	ctx, cancel := withTimeout(ctx, s.deleteTimeout)
+	defer cancel()
+	for _, key := range keys {
+		_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete S3 object: %w", classify(err))
+		}
 	}
 
 	return nil
 }
 
+// DeleteBatch removes backups with the DeleteObjects API (up to 1000 keys per request)
+func (s *S3Storage) DeleteBatch(ctx context.Context, backupNames []string) map[string]error {
+	keyNames := make(map[string]string)
+	var keys []string
+	for _, name := range backupNames {
+		key := s.getKey(name)
+		keyNames[key] = name
+		keys = append(keys, key)
+		if s.layout.nested(name) {
+			// Also remove a copy stored before the date layout was enabled
+			keyNames[s.prefixed(name)] = name
+			keys = append(keys, s.prefixed(name))
+		}
+	}
+
+	failed := make(map[string]error)
+	for start := 0; start < len(keys); start += maxDeleteObjects {
+		end := start + maxDeleteObjects
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		reqCtx, cancel := withTimeout(ctx, s.deleteTimeout)
+		out, err := s.client.DeleteObjectsWithContext(reqCtx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		cancel()
+		if err != nil {
+			for _, key := range keys[start:end] {
+				failed[keyNames[key]] = fmt.Errorf("failed to delete S3 objects: %w", classify(err))
+			}
+			continue
+		}
+
+		for _, e := range out.Errors {
+			name := keyNames[aws.StringValue(e.Key)]
+			failed[name] = fmt.Errorf("failed to delete S3 object: %w", classify(awserr.New(aws.StringValue(e.Code), aws.StringValue(e.Message), nil)))
+		}
+	}
+
+	return failed
+}
+
 // Type returns the storage type name
 func (s *S3Storage) Type() string {
 	return "s3"
 }
 
+// setRequestPayer acknowledges the charges of a requester-pays bucket, which
+// rejects requests without the header
+func setRequestPayer(r *request.Request) {
+	r.HTTPRequest.Header.Set("x-amz-request-payer", s3.RequestPayerRequester)
+}
+
 // getKey returns the full S3 key for a backup name
 func (s *S3Storage) getKey(backupName string) string {
+	return s.prefixed(s.layout.path(backupName))
+}
+
+// prefixed returns the S3 key for a path relative to the backup prefix
+func (s *S3Storage) prefixed(p string) string {
 	if s.backupPrefix == "" {
-		return backupName
+		return p
 	}
-	return strings.TrimSuffix(s.backupPrefix, "/") + "/" + backupName
+	return strings.TrimSuffix(s.backupPrefix, "/") + "/" + p
+}
+
+// isNoSuchKey reports whether err is an S3 missing object error
+func isNoSuchKey(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey
+}
+
+// isNotFound reports whether err is a missing object error of a HEAD request,
+// which has no body and so no NoSuchKey code
+func isNotFound(err error) bool {
+	var aerr awserr.RequestFailure
+	return isNoSuchKey(err) || errors.As(err, &aerr) && aerr.StatusCode() == http.StatusNotFound
 }
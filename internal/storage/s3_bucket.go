@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// BucketOptions configures the S3 bucket created when it is missing
+type BucketOptions struct {
+	// Create creates the bucket in the configured region when it does not exist
+	Create bool
+	// Versioning enables versioning on the created bucket
+	Versioning bool
+	// ObjectLock enables Object Lock (and so versioning) on the created bucket
+	ObjectLock bool
+}
+
+// prepareBucket checks that the bucket is in region, which avoids the
+// redirect errors of a client signing for another region, and creates it
+// when missing with BucketOptions.Create
+// A location that cannot be read only fails for AWS (isAWS), S3-compatible
+// services report regions loosely
+func (s *S3Storage) prepareBucket(ctx context.Context, region string, isAWS bool, opts BucketOptions) error {
+	out, err := s.client.GetBucketLocationWithContext(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(s.bucket)})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchBucket {
+		if !opts.Create {
+			return fmt.Errorf("S3 bucket %s does not exist (set S3_CREATE_BUCKET=true to create it)", s.bucket)
+		}
+		return s.createBucket(ctx, region, isAWS, opts)
+	}
+	if err != nil {
+		// Policies often omit s3:GetBucketLocation, the storage probe finds real problems
+		log.Printf("Warning: failed to check the region of S3 bucket %s: %v", s.bucket, classify(err))
+		return nil
+	}
+
+	location := aws.StringValue(out.LocationConstraint)
+	if isAWS {
+		// Buckets of us-east-1 and the legacy EU region have their own constraint
+		location = s3.NormalizeBucketLocation(location)
+	}
+	if location == "" || location == region {
+		return nil
+	}
+	message := fmt.Sprintf("S3 bucket %s is in region %s but S3_REGION is %s", s.bucket, location, region)
+	if !isAWS {
+		log.Printf("Warning: %s", message)
+		return nil
+	}
+	return fmt.Errorf("%s, set S3_REGION=%s", message, location)
+}
+
+// createBucket creates the bucket in region with the options of opts
+func (s *S3Storage) createBucket(ctx context.Context, region string, isAWS bool, opts BucketOptions) error {
+	input := &s3.CreateBucketInput{Bucket: aws.String(s.bucket)}
+	// us-east-1 is the default location, AWS rejects it as a constraint
+	if region != "" && !(isAWS && region == "us-east-1") {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(region)}
+	}
+	if opts.ObjectLock {
+		input.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+	if _, err := s.client.CreateBucketWithContext(ctx, input); err != nil {
+		return fmt.Errorf("failed to create S3 bucket %s: %w", s.bucket, classify(err))
+	}
+	if err := s.client.WaitUntilBucketExistsWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)}); err != nil {
+		return fmt.Errorf("failed to wait for S3 bucket %s: %w", s.bucket, classify(err))
+	}
+
+	// Object Lock enables versioning on its own
+	if opts.Versioning && !opts.ObjectLock {
+		_, err := s.client.PutBucketVersioningWithContext(ctx, &s3.PutBucketVersioningInput{
+			Bucket:                  aws.String(s.bucket),
+			VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(s3.BucketVersioningStatusEnabled)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable versioning on S3 bucket %s: %w", s.bucket, classify(err))
+		}
+	}
+	log.Printf("Created S3 bucket %s in %s", s.bucket, region)
+	return nil
+}
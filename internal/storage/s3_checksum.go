@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3ChecksumSHA256 makes S3 check the SHA-256 of every uploaded object and part
+const s3ChecksumSHA256 = "sha256"
+
+// s3PartKey identifies a part of a multipart upload
+type s3PartKey struct {
+	uploadID string
+	number   int64
+}
+
+// s3Checksums adds x-amz-checksum-sha256 to S3 uploads, so S3 rejects a
+// corrupted transfer instead of storing it
+// The SDK already sends Content-MD5 with each PutObject and UploadPart request;
+// this adds a stronger checksum that S3 also keeps with the object
+// s3manager does not pass part checksums to CompleteMultipartUpload, so they
+// are recorded per upload and filled in before it is sent
+type s3Checksums struct {
+	mu      sync.Mutex
+	uploads map[string]bool
+	parts   map[s3PartKey]string
+}
+
+// register adds the checksum handlers to an S3 client
+func (c *s3Checksums) register(client *s3.S3) {
+	c.uploads = make(map[string]bool)
+	c.parts = make(map[s3PartKey]string)
+	client.Handlers.Validate.PushBackNamed(request.NamedHandler{Name: "redisbackup.ChecksumSHA256", Fn: c.setChecksum})
+	client.Handlers.Complete.PushBackNamed(request.NamedHandler{Name: "redisbackup.ChecksumSHA256Record", Fn: c.record})
+}
+
+// setChecksum computes the checksum of upload requests that have none
+func (c *s3Checksums) setChecksum(r *request.Request) {
+	switch in := r.Params.(type) {
+	case *s3.PutObjectInput:
+		if in.ChecksumSHA256 == nil && aws.IsReaderSeekable(in.Body) {
+			in.ChecksumSHA256, r.Error = bodySHA256(in.Body)
+		}
+	case *s3.CreateMultipartUploadInput:
+		if in.ChecksumAlgorithm == nil {
+			in.ChecksumAlgorithm = aws.String(s3.ChecksumAlgorithmSha256)
+		}
+	case *s3.UploadPartInput:
+		// Parts of uploads created without the algorithm (e.g. by a previous
+		// version) must not have a checksum
+		c.mu.Lock()
+		enabled := c.uploads[aws.StringValue(in.UploadId)]
+		c.mu.Unlock()
+		if enabled && in.ChecksumSHA256 == nil && aws.IsReaderSeekable(in.Body) {
+			in.ChecksumSHA256, r.Error = bodySHA256(in.Body)
+		}
+	case *s3.CompleteMultipartUploadInput:
+		if in.MultipartUpload == nil {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, part := range in.MultipartUpload.Parts {
+			if part.ChecksumSHA256 != nil {
+				continue
+			}
+			if sum, ok := c.parts[s3PartKey{aws.StringValue(in.UploadId), aws.Int64Value(part.PartNumber)}]; ok {
+				part.ChecksumSHA256 = aws.String(sum)
+			}
+		}
+	}
+}
+
+// record keeps the checksums of the uploaded parts until their upload completes
+func (c *s3Checksums) record(r *request.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch in := r.Params.(type) {
+	case *s3.CreateMultipartUploadInput:
+		out, ok := r.Data.(*s3.CreateMultipartUploadOutput)
+		if r.Error == nil && ok && aws.StringValue(in.ChecksumAlgorithm) == s3.ChecksumAlgorithmSha256 {
+			c.uploads[aws.StringValue(out.UploadId)] = true
+		}
+	case *s3.UploadPartInput:
+		if r.Error == nil && in.ChecksumSHA256 != nil {
+			c.parts[s3PartKey{aws.StringValue(in.UploadId), aws.Int64Value(in.PartNumber)}] = aws.StringValue(in.ChecksumSHA256)
+		}
+	case *s3.CompleteMultipartUploadInput:
+		if r.Error == nil {
+			c.forget(aws.StringValue(in.UploadId))
+		}
+	case *s3.AbortMultipartUploadInput:
+		c.forget(aws.StringValue(in.UploadId))
+	}
+}
+
+// forget drops the state of a finished upload, the lock must be held
+func (c *s3Checksums) forget(uploadID string) {
+	delete(c.uploads, uploadID)
+	for key := range c.parts {
+		if key.uploadID == uploadID {
+			delete(c.parts, key)
+		}
+	}
+}
+
+// bodySHA256 returns the base64-encoded SHA-256 of a request body, as expected
+// by x-amz-checksum-sha256, and rewinds it
+func bodySHA256(body io.ReadSeeker) (*string, error) {
+	hash := sha256.New()
+	if _, err := aws.CopySeekableBody(hash, body); err != nil {
+		return nil, awserr.New(request.ErrCodeRead, "failed to compute upload checksum", err)
+	}
+	return aws.String(base64.StdEncoding.EncodeToString(hash.Sum(nil))), nil
+}
+
+// checksumWriter computes the SHA-256 of a download to compare it with the
+// checksum S3 stored with the object
+type checksumWriter struct {
+	w        io.Writer
+	hash     hash.Hash
+	expected string
+}
+
+// newChecksumWriter wraps w to check the x-amz-checksum-sha256 of an object
+// Checksums of multipart objects are checksums of the part checksums (with a
+// -<parts> suffix) and cannot be checked this way, nil is returned for them
+func newChecksumWriter(w io.Writer, expected *string) *checksumWriter {
+	if expected == nil || strings.Contains(*expected, "-") {
+		return nil
+	}
+	return &checksumWriter{w: w, hash: sha256.New(), expected: *expected}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.hash.Write(p[:n])
+	return n, err
+}
+
+// check compares the checksum of the downloaded bytes with the stored one
+func (c *checksumWriter) check() error {
+	if sum := base64.StdEncoding.EncodeToString(c.hash.Sum(nil)); sum != c.expected {
+		return fmt.Errorf("checksum mismatch: downloaded data has SHA-256 %s, S3 stored %s", sum, c.expected)
+	}
+	return nil
+}
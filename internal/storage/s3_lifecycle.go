@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// lifecycleRuleID returns the ID of the lifecycle rule managed for a prefix
+func lifecycleRuleID(prefix string) string {
+	return "redis-backup:" + prefix
+}
+
+// ApplyLifecycle replaces the lifecycle rule managed for the backup prefix
+// Rules of the bucket with another ID are kept as they are
+func (s *S3Storage) ApplyLifecycle(ctx context.Context, policy LifecyclePolicy) (bool, error) {
+	prefix := s.backupPrefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	id := lifecycleRuleID(prefix)
+
+	out, err := s.client.GetBucketLifecycleConfigurationWithContext(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(s.bucket),
+	})
+	var aerr awserr.Error
+	if err != nil && !(errors.As(err, &aerr) && aerr.Code() == "NoSuchLifecycleConfiguration") {
+		return false, fmt.Errorf("failed to get S3 lifecycle rules: %w", classify(err))
+	}
+
+	var rules []*s3.LifecycleRule
+	var current *s3.LifecycleRule
+	if out != nil {
+		for _, rule := range out.Rules {
+			if aws.StringValue(rule.ID) == id {
+				current = rule
+				continue
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	want := s3LifecycleRule(id, prefix, policy)
+	if current == nil && want == nil || current != nil && want != nil && current.String() == want.String() {
+		return false, nil
+	}
+
+	if want != nil {
+		rules = append(rules, want)
+	}
+	if len(rules) == 0 {
+		_, err = s.client.DeleteBucketLifecycleWithContext(ctx, &s3.DeleteBucketLifecycleInput{
+			Bucket: aws.String(s.bucket),
+		})
+	} else {
+		_, err = s.client.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 aws.String(s.bucket),
+			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+		})
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update S3 lifecycle rules: %w", classify(err))
+	}
+	return true, nil
+}
+
+// s3LifecycleRule returns the rule implementing policy, nil for an empty policy
+func s3LifecycleRule(id, prefix string, policy LifecyclePolicy) *s3.LifecycleRule {
+	if policy.TransitionDays == 0 && policy.ExpireDays == 0 {
+		return nil
+	}
+	rule := &s3.LifecycleRule{
+		ID:     aws.String(id),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+	}
+	if policy.TransitionDays > 0 {
+		rule.Transitions = []*s3.Transition{{
+			Days:         aws.Int64(int64(policy.TransitionDays)),
+			StorageClass: aws.String(policy.TransitionClass),
+		}}
+	}
+	if policy.ExpireDays > 0 {
+		rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(int64(policy.ExpireDays))}
+	}
+	return rule
+}
@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// resumablePartSize is the default part size used for resumable multipart uploads
+const resumablePartSize = 16 * 1024 * 1024
+
+// s3UploadState is the persisted state of an in-progress multipart upload
+type s3UploadState struct {
+	Bucket        string         `json:"bucket"`
+	Key           string         `json:"key"`
+	BackupName    string         `json:"backup_name"`
+	UploadID      string         `json:"upload_id"`
+	SourcePath    string         `json:"source_path"`
+	SourceSize    int64          `json:"source_size"`
+	SourceModTime time.Time      `json:"source_mod_time"`
+	StagedPath    string         `json:"staged_path,omitempty"`
+	PartSize      int64          `json:"part_size"`
+	Checksum      string         `json:"checksum,omitempty"`
+	Parts         []s3UploadPart `json:"parts"`
+}
+
+// readPath returns the file the parts are read from, the staged copy of the
+// source when there is one
+func (state *s3UploadState) readPath() string {
+	if state.StagedPath != "" {
+		return state.StagedPath
+	}
+	return state.SourcePath
+}
+
+// s3UploadPart is a part that was uploaded successfully
+type s3UploadPart struct {
+	Number   int64  `json:"number"`
+	ETag     string `json:"etag"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// uploadResumable uploads a file with a multipart upload whose progress is
+// persisted in the state directory, retrying each failed part
+func (s *S3Storage) uploadResumable(ctx context.Context, sourcePath string, backupName string) error {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+
+	key := s.getKey(backupName)
+	state, err := s.loadUploadState(key)
+	if err != nil {
+		return err
+	}
+
+	if state != nil && (state.SourcePath != sourcePath || state.SourceSize != info.Size() || !state.SourceModTime.Equal(info.ModTime())) {
+		log.Printf("Source of interrupted upload %s changed, starting over", backupName)
+		s.abortUpload(ctx, state)
+		state = nil
+	}
+
+	if state == nil {
+		input := &s3.CreateMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			Metadata: s.metadata,
+			Tagging:  s.tagging,
+		}
+		if s.checksum == s3ChecksumSHA256 {
+			input.ChecksumAlgorithm = aws.String(s3.ChecksumAlgorithmSha256)
+		}
+		out, err := s.client.CreateMultipartUploadWithContext(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to create multipart upload: %w", classify(err))
+		}
+
+		state = &s3UploadState{
+			Bucket:        s.bucket,
+			Key:           key,
+			BackupName:    backupName,
+			UploadID:      aws.StringValue(out.UploadId),
+			SourcePath:    sourcePath,
+			SourceSize:    info.Size(),
+			SourceModTime: info.ModTime(),
+			StagedPath:    s.stagedPath(key),
+			PartSize:      s.resumablePartSize(info.Size()),
+			Checksum:      aws.StringValue(input.ChecksumAlgorithm),
+		}
+		// The state is saved first, so a crash while staging leaves a state
+		// whose staged file is incomplete, aborted by the next run
+		if err := s.saveUploadState(state); err != nil {
+			return err
+		}
+		if err := stageSource(sourcePath, state.StagedPath); err != nil {
+			log.Printf("Warning: failed to stage the source of %s, the upload cannot resume after a restart: %v", backupName, err)
+			state.StagedPath = ""
+			if err := s.saveUploadState(state); err != nil {
+				return err
+			}
+		}
+	} else {
+		log.Printf("Resuming upload of %s (%d part(s) already uploaded)", backupName, len(state.Parts))
+	}
+
+	return s.continueUpload(ctx, state)
+}
+
+// ResumePending completes multipart uploads interrupted by a previous process
+// Uploads whose source file changed or disappeared are aborted
+func (s *S3Storage) ResumePending(ctx context.Context) ([]string, error) {
+	if s.stateDir == "" {
+		return nil, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.stateDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var resumed []string
+	for _, file := range files {
+		if strings.HasSuffix(file, ".gcs.json") {
+			continue
+		}
+		state, err := readUploadState(file)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid upload state %s: %v", file, err)
+			continue
+		}
+		if state.Bucket != s.bucket {
+			continue
+		}
+
+		info, err := os.Stat(state.readPath())
+		if err != nil || info.Size() != state.SourceSize || !info.ModTime().Equal(state.SourceModTime) {
+			log.Printf("Source of interrupted upload %s is gone or changed, aborting it", state.BackupName)
+			s.abortUpload(ctx, state)
+			continue
+		}
+
+		log.Printf("Resuming interrupted upload of %s (%d part(s) already uploaded)", state.BackupName, len(state.Parts))
+		if err := s.continueUpload(ctx, state); err != nil {
+			return resumed, fmt.Errorf("failed to resume upload of %s: %w", state.BackupName, err)
+		}
+		resumed = append(resumed, state.BackupName)
+	}
+
+	return resumed, nil
+}
+
+// resumablePartSize returns the part size for a resumable upload of size bytes
+// Parts are uploaded sequentially, so S3_UPLOAD_CONCURRENCY does not apply here
+func (s *S3Storage) resumablePartSize(size int64) int64 {
+	partSize := s.partSize
+	if partSize == 0 {
+		partSize = resumablePartSize
+	}
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.MinUploadPartSize
+	}
+
+	// S3 allows at most 10000 parts per upload
+	if minSize := (size + s3manager.MaxUploadParts - 1) / s3manager.MaxUploadParts; partSize < minSize {
+		partSize = minSize
+	}
+	return partSize
+}
+
+// continueUpload uploads the missing parts of a multipart upload and completes it
+func (s *S3Storage) continueUpload(ctx context.Context, state *s3UploadState) error {
+	file, err := os.Open(state.readPath())
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer file.Close()
+
+	done := make(map[int64]bool, len(state.Parts))
+	for _, part := range state.Parts {
+		done[part.Number] = true
+	}
+
+	totalParts := (state.SourceSize + state.PartSize - 1) / state.PartSize
+	if totalParts == 0 {
+		totalParts = 1
+	}
+
+	for number := int64(1); number <= totalParts; number++ {
+		if done[number] {
+			continue
+		}
+
+		offset := (number - 1) * state.PartSize
+		size := state.PartSize
+		if offset+size > state.SourceSize {
+			size = state.SourceSize - offset
+		}
+
+		part, err := s.uploadPart(ctx, state, file, number, offset, size)
+		if err != nil {
+			return err
+		}
+
+		state.Parts = append(state.Parts, part)
+		if err := s.saveUploadState(state); err != nil {
+			return err
+		}
+	}
+
+	parts := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for number := int64(1); number <= totalParts; number++ {
+		for _, part := range state.Parts {
+			if part.Number == number {
+				completed := &s3.CompletedPart{PartNumber: aws.Int64(part.Number), ETag: aws.String(part.ETag)}
+				if part.Checksum != "" {
+					completed.ChecksumSHA256 = aws.String(part.Checksum)
+				}
+				parts = append(parts, completed)
+				break
+			}
+		}
+	}
+
+	_, err = s.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(state.Bucket),
+		Key:             aws.String(state.Key),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", classify(err))
+	}
+
+	return s.removeUploadState(state.Key)
+}
+
+// uploadPart uploads a single part, retrying transient failures with backoff
+// Parts of uploads created with a checksum algorithm carry their checksum
+func (s *S3Storage) uploadPart(ctx context.Context, state *s3UploadState, file *os.File, number, offset, size int64) (s3UploadPart, error) {
+	part := s3UploadPart{Number: number}
+	if state.Checksum == s3.ChecksumAlgorithmSha256 {
+		sum, err := bodySHA256(io.NewSectionReader(file, offset, size))
+		if err != nil {
+			return part, err
+		}
+		part.Checksum = aws.StringValue(sum)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= s.partRetries; attempt++ {
+		if attempt > 0 {
+			wait := time.Duration(attempt) * 2 * time.Second
+			log.Printf("Retrying part %d of %s in %s (attempt %d/%d): %v", number, state.BackupName, wait, attempt+1, s.partRetries+1, lastErr)
+			select {
+			case <-ctx.Done():
+				return part, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		input := &s3.UploadPartInput{
+			Bucket:        aws.String(state.Bucket),
+			Key:           aws.String(state.Key),
+			UploadId:      aws.String(state.UploadID),
+			PartNumber:    aws.Int64(number),
+			ContentLength: aws.Int64(size),
+			Body:          io.NewSectionReader(file, offset, size),
+		}
+		if part.Checksum != "" {
+			input.ChecksumSHA256 = aws.String(part.Checksum)
+		}
+		out, err := s.client.UploadPartWithContext(ctx, input)
+		if err == nil {
+			part.ETag = aws.StringValue(out.ETag)
+			return part, nil
+		}
+		if ctx.Err() != nil {
+			return part, ctx.Err()
+		}
+		lastErr = err
+	}
+
+	return part, fmt.Errorf("failed to upload part %d after %d attempts: %w", number, s.partRetries+1, classify(lastErr))
+}
+
+// abortUpload aborts a multipart upload and removes its state
+func (s *S3Storage) abortUpload(ctx context.Context, state *s3UploadState) {
+	_, err := s.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+	})
+	if err != nil {
+		log.Printf("Warning: failed to abort multipart upload of %s: %v", state.BackupName, err)
+	}
+	if err := s.removeUploadState(state.Key); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// CleanupPartial aborts the multipart uploads below the prefix initiated
+// before cutoff, whose parts are billed until the upload is completed or aborted
+// The state of an aborted resumable upload is removed with it
+func (s *S3Storage) CleanupPartial(ctx context.Context, cutoff time.Time) ([]string, error) {
+	prefix := s.backupPrefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var stale []*s3.MultipartUpload
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}
+	listCtx, cancel := withTimeout(ctx, s.listTimeout)
+	defer cancel()
+	err := s.lister.ListMultipartUploadsPagesWithContext(listCtx, input, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if aws.TimeValue(upload.Initiated).Before(cutoff) {
+				stale = append(stale, upload)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list multipart uploads: %w", classify(err))
+	}
+
+	var aborted []string
+	for _, upload := range stale {
+		key := aws.StringValue(upload.Key)
+		_, err := s.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      upload.Key,
+			UploadId: upload.UploadId,
+		})
+		if err != nil {
+			return aborted, fmt.Errorf("failed to abort multipart upload of %s: %w", key, classify(err))
+		}
+		aborted = append(aborted, filepath.Base(key))
+
+		if s.stateDir == "" {
+			continue
+		}
+		if state, err := s.loadUploadState(key); err == nil && state != nil && state.UploadID == aws.StringValue(upload.UploadId) {
+			if err := s.removeUploadState(key); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}
+	return aborted, nil
+}
+
+// statePath returns the state file path for an object key
+func (s *S3Storage) statePath(key string) string {
+	return filepath.Join(s.stateDir, strings.ReplaceAll(key, "/", "_")+".json")
+}
+
+// stagedPath returns the path the source of an upload is staged at
+func (s *S3Storage) stagedPath(key string) string {
+	return strings.TrimSuffix(s.statePath(key), ".json") + ".src"
+}
+
+func (s *S3Storage) loadUploadState(key string) (*s3UploadState, error) {
+	state, err := readUploadState(s.statePath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return state, err
+}
+
+func (s *S3Storage) saveUploadState(state *s3UploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated state
+	path := s.statePath(state.Key)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	return nil
+}
+
+// removeUploadState removes the state of an upload and its staged source
+func (s *S3Storage) removeUploadState(key string) error {
+	if err := os.Remove(s.statePath(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove upload state: %w", err)
+	}
+	return removeStaged(s.stagedPath(key))
+}
+
+func readUploadState(path string) (*s3UploadState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state s3UploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
@@ -2,30 +2,267 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/ermos/docker-redis-backup/internal/config"
 )
 
+// ObjectInfo describes an object stored in the storage
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	// Metadata holds the tags (S3) or custom metadata (GCS) of the object,
+	// only set by Stat
+	Metadata map[string]string
+}
+
+// ErrNotFound is returned when a backup object does not exist in the storage
+var ErrNotFound = errors.New("backup not found")
+
 // Storage interface defines methods for backup storage
 type Storage interface {
 	// Upload uploads a backup file to the storage
 	Upload(ctx context.Context, sourcePath string, backupName string) error
+	// Download writes the content of a backup to w
+	Download(ctx context.Context, backupName string, w io.Writer) error
+	// Stat returns the size, modification time and metadata of an object
+	Stat(ctx context.Context, backupName string) (ObjectInfo, error)
 	// List returns a list of backup names in the storage
 	List(ctx context.Context) ([]string, error)
+	// ListObjects returns every object in the storage (backups and sidecars)
+	ListObjects(ctx context.Context) ([]ObjectInfo, error)
 	// Delete removes a backup from the storage
 	Delete(ctx context.Context, backupName string) error
 	// Type returns the storage type name
 	Type() string
 }
 
+// StreamUploader is implemented by storages that can upload from a stream without a local file
+type StreamUploader interface {
+	// UploadStream uploads the content of r as a backup object
+	UploadStream(ctx context.Context, r io.Reader, backupName string) error
+}
+
+// Resumer is implemented by storages that can resume uploads interrupted by a restart
+type Resumer interface {
+	// ResumePending completes interrupted uploads and returns the completed backup names
+	ResumePending(ctx context.Context) ([]string, error)
+}
+
+// PartialCleaner is implemented by storages where failed uploads leave data
+// behind (S3 multipart uploads, local .partial files)
+type PartialCleaner interface {
+	// CleanupPartial removes the partial uploads started before cutoff and
+	// returns their names
+	CleanupPartial(ctx context.Context, cutoff time.Time) ([]string, error)
+}
+
+// SpaceReporter is implemented by storages on a volume of limited size
+type SpaceReporter interface {
+	// FreeSpace returns the bytes available on the volume of the storage
+	FreeSpace(ctx context.Context) (int64, error)
+}
+
+// LifecyclePolicy describes the lifecycle rules of the backup prefix
+type LifecyclePolicy struct {
+	// TransitionDays is the age at which objects move to TransitionClass (0 = never)
+	TransitionDays  int
+	TransitionClass string
+	// ExpireDays is the age at which objects are deleted (0 = never)
+	ExpireDays int
+}
+
+// LifecycleManager is implemented by storages whose bucket has lifecycle rules
+type LifecycleManager interface {
+	// ApplyLifecycle replaces the lifecycle rules of the backup prefix with
+	// policy, keeping the other rules of the bucket, and reports whether
+	// they changed
+	ApplyLifecycle(ctx context.Context, policy LifecyclePolicy) (bool, error)
+}
+
+// BatchDeleter is implemented by storages that can delete many backups efficiently
+type BatchDeleter interface {
+	// DeleteBatch removes several backups and returns the error of each failed one
+	DeleteBatch(ctx context.Context, backupNames []string) map[string]error
+}
+
+// Tagger is implemented by storages that keep tags or custom metadata on objects
+type Tagger interface {
+	// Tags returns the tags (S3) or custom metadata (GCS) of an object
+	Tags(ctx context.Context, backupName string) (map[string]string, error)
+}
+
+// UploadOptions tunes how backups are uploaded to remote storage
+type UploadOptions struct {
+	// StateDir persists multipart upload progress (S3) or resumable sessions (GCS) so uploads can resume after a restart
+	StateDir string
+	// PartRetries is the number of retries for each failed part or chunk
+	PartRetries int
+	// PartSize is the S3 multipart part size in bytes (0 = SDK default)
+	PartSize int64
+	// Concurrency is the number of S3 parts uploaded in parallel (0 = SDK default)
+	Concurrency int
+	// DeleteConcurrency is the number of parallel deletes for storages without a batch API
+	DeleteConcurrency int
+	// ListTimeout bounds a listing of the storage (0 = no timeout)
+	ListTimeout time.Duration
+	// DeleteTimeout bounds each delete request (0 = no timeout)
+	DeleteTimeout time.Duration
+	// Labels are stored as object metadata (and S3 tags) on every uploaded object
+	Labels map[string]string
+	// Tagging stores Labels as S3 object tags in addition to metadata
+	Tagging bool
+	// Checksum is the integrity checksum sent with S3 uploads: sha256, md5 or none
+	Checksum string
+}
+
+// S3Options configures how requests are sent to an S3 bucket
+type S3Options struct {
+	// RequesterPays acknowledges the charges of a requester-pays bucket
+	RequesterPays bool
+	// ListEndpoint is the endpoint of listing requests (empty = the endpoint of the storage)
+	ListEndpoint string
+}
+
+// TLSOptions configures the HTTP client used to reach remote storage
+type TLSOptions struct {
+	// CACertFiles are PEM bundles trusted in addition to the system roots
+	CACertFiles []string
+	// InsecureSkipVerify disables certificate verification
+	InsecureSkipVerify bool
+}
+
+// custom reports whether a dedicated HTTP client is needed
+func (o TLSOptions) custom() bool {
+	for _, file := range o.CACertFiles {
+		if file != "" {
+			return true
+		}
+	}
+	return o.InsecureSkipVerify
+}
+
+// withTimeout bounds ctx by the timeout of an operation, 0 meaning none
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// backupNames returns the names of the backup files among objects, oldest first
+func backupNames(objects []ObjectInfo) []string {
+	var backups []string
+	for _, obj := range objects {
+		if IsBackupName(obj.Name) {
+			backups = append(backups, obj.Name)
+		}
+	}
+
+	// Sort by name (which includes timestamp, so oldest first)
+	sort.Strings(backups)
+
+	return backups
+}
+
+// transformSuffixes lists the suffixes compression or encryption may append
+// after the ".rdb" extension of a backup (e.g. ".rdb.gz.gpg")
+var transformSuffixes = []string{".gz", ".zst", ".lz4", ".age", ".gpg", ".enc"}
+
+// SplitBackupName strips compression and encryption suffixes from an object name
+// It returns the base name and the suffixes in the order they were applied
+func SplitBackupName(name string) (string, []string) {
+	var transforms []string
+	for {
+		stripped := false
+		for _, suffix := range transformSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				name = strings.TrimSuffix(name, suffix)
+				transforms = append([]string{suffix}, transforms...)
+				stripped = true
+				break
+			}
+		}
+		if !stripped {
+			return name, transforms
+		}
+	}
+}
+
+// IsBackupName reports whether an object name is a backup in any format (and not a sidecar)
+func IsBackupName(name string) bool {
+	base, _ := SplitBackupName(name)
+	return strings.HasSuffix(base, ".rdb")
+}
+
 // New creates a new storage instance based on configuration
+// With STORAGE_DEDUP, the storage is wrapped in a deduplicated chunk store
+// With TARGET_CREDENTIALS_DIR, the storage of a target is only created with
+// its own credentials, once checked that they cannot reach other targets
 func New(cfg *config.Config) (Storage, error) {
+	isolated := cfg.TargetCredentialsDir != "" && cfg.TargetName != ""
+	if isolated && cfg.TargetCredentials == "" {
+		return nil, fmt.Errorf("credentials of target %s not loaded from TARGET_CREDENTIALS_DIR", cfg.TargetName)
+	}
+	store, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if checker, ok := store.(IsolationChecker); ok && isolated {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := checker.CheckIsolation(ctx); err != nil {
+			if closer, ok := store.(io.Closer); ok {
+				closer.Close()
+			}
+			return nil, fmt.Errorf("refusing the credentials of target %s (%s): %w", cfg.TargetName, cfg.TargetCredentials, err)
+		}
+	}
+	if !cfg.StorageDedup {
+		return store, nil
+	}
+	return NewDedupStorage(store, cfg.DedupChunkSize*1024, time.Duration(cfg.PartialUploadMaxAge)*time.Hour), nil
+}
+
+// newBackend creates the storage backend selected by STORAGE_TYPE
+func newBackend(cfg *config.Config) (Storage, error) {
+	uploadOpts := UploadOptions{
+		StateDir:    cfg.UploadStateDir,
+		PartRetries: cfg.UploadPartRetries,
+		PartSize:    int64(cfg.S3UploadPartSize) * 1024 * 1024,
+		Concurrency: cfg.S3UploadConcurrency,
+
+		DeleteConcurrency: cfg.DeleteConcurrency,
+		ListTimeout:       time.Duration(cfg.ListTimeout) * time.Second,
+		DeleteTimeout:     time.Duration(cfg.DeleteTimeout) * time.Second,
+		Labels:            cfg.BackupLabels,
+		Tagging:           cfg.S3ObjectTagging,
+		Checksum:          cfg.S3Checksum(),
+	}
+	layout := Layout(cfg.StorageLayout)
+	tlsOpts := TLSOptions{
+		CACertFiles: []string{cfg.CACertFile},
+	}
+
 	switch cfg.StorageType {
 	case "local":
-		return NewLocalStorage(cfg.LocalBackupPath)
+		return NewLocalStorage(cfg.LocalBackupPath, layout, LocalOptions{
+			Fsync:    cfg.LocalFsync,
+			FileMode: cfg.BackupFileMode,
+			UID:      cfg.BackupUID,
+			GID:      cfg.BackupGID,
+
+			HardLinks: cfg.LocalHardLinks,
+			NetworkFS: cfg.LocalNetworkFS,
+		})
 	case "s3":
-		return NewS3Storage(
+		store, err := NewS3Storage(
 			cfg.S3Endpoint,
 			cfg.S3Region,
 			cfg.S3Bucket,
@@ -33,12 +270,39 @@ func New(cfg *config.Config) (Storage, error) {
 			cfg.S3SecretKey,
 			cfg.S3PathStyle,
 			cfg.S3BackupPrefix,
+			layout,
+			uploadOpts,
+			TLSOptions{
+				CACertFiles:        []string{cfg.CACertFile, cfg.S3CACertFile},
+				InsecureSkipVerify: cfg.S3InsecureSkipVerify,
+			},
+			S3Options{
+				RequesterPays: cfg.S3RequesterPays,
+				ListEndpoint:  cfg.S3ListEndpoint,
+			},
 		)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		err = store.prepareBucket(ctx, cfg.S3Region, cfg.S3Endpoint == "", BucketOptions{
+			Create:     cfg.S3CreateBucket,
+			Versioning: cfg.S3BucketVersioning,
+			ObjectLock: cfg.S3BucketObjectLock,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
 	case "gcp":
 		return NewGCPStorage(
 			cfg.GCPCredentialsFile,
 			cfg.GCPBucket,
 			cfg.GCPBackupPrefix,
+			layout,
+			uploadOpts,
+			tlsOpts,
 		)
 	default:
 		return nil, fmt.Errorf("unsupported storage type: %s (supported: local, s3, gcp)", cfg.StorageType)
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// stageSource links the source of a resumable upload to path in the state
+// directory, or copies it when they are on different filesystems
+// The source usually lives in the work directory of the run, which is removed
+// when the run ends and at startup, so the staged file is what a restart resumes from
+func stageSource(sourcePath, path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(sourcePath, path); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	// The copy keeps the modification time the upload state checks
+	if err == nil {
+		err = os.Chtimes(path, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	log.Printf("Copied upload source into the state directory (%d bytes)", info.Size())
+	return nil
+}
+
+// removeStaged removes the staged source of a resumable upload
+func removeStaged(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove staged upload source: %w", err)
+	}
+	return nil
+}
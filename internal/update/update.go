@@ -0,0 +1,185 @@
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/buildinfo"
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/httpclient"
+	"github.com/ermos/docker-redis-backup/internal/metrics"
+	"github.com/ermos/docker-redis-backup/internal/notify"
+)
+
+// securityPattern matches the release notes announcing security fixes
+var securityPattern = regexp.MustCompile(`(?i)\bsecurity\b|\bCVE-\d{4}-\d+|\bGHSA-`)
+
+// Release is a release of the GitHub releases API
+type Release struct {
+	TagName    string `json:"tag_name"`
+	Name       string `json:"name"`
+	Body       string `json:"body"`
+	URL        string `json:"html_url"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+}
+
+// Security reports whether the release notes mention security fixes
+func (r Release) Security() bool {
+	return securityPattern.MatchString(r.Name) || securityPattern.MatchString(r.Body)
+}
+
+// Result lists the releases newer than the running version
+type Result struct {
+	Current string
+	// Newer are the releases newer than Current, newest first
+	Newer []Release
+	// Security are the tags of the newer releases with security fixes
+	Security []string
+}
+
+// Latest returns the newest release, or nil when Current is up to date
+func (r Result) Latest() *Release {
+	if len(r.Newer) == 0 {
+		return nil
+	}
+	return &r.Newer[0]
+}
+
+// Check lists the releases of releasesURL newer than current
+// Drafts, pre-releases and tags that are not versions are ignored
+func Check(ctx context.Context, client *http.Client, releasesURL, current string) (Result, error) {
+	result := Result{Current: current}
+	u, err := url.Parse(releasesURL)
+	if err != nil {
+		return result, fmt.Errorf("invalid UPDATE_CHECK_URL: %w", err)
+	}
+	query := u.Query()
+	if !query.Has("per_page") {
+		query.Set("per_page", "100")
+		u.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", buildinfo.Name+"/"+current)
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, fmt.Errorf("failed to list releases: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return result, fmt.Errorf("failed to list releases: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var releases []Release
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return result, fmt.Errorf("failed to decode releases: %w", err)
+	}
+	for _, release := range releases {
+		if release.Draft || release.Prerelease {
+			continue
+		}
+		if cmp, ok := buildinfo.Compare(release.TagName, current); ok && cmp > 0 {
+			result.Newer = append(result.Newer, release)
+		}
+	}
+	sort.SliceStable(result.Newer, func(i, j int) bool {
+		cmp, _ := buildinfo.Compare(result.Newer[i].TagName, result.Newer[j].TagName)
+		return cmp > 0
+	})
+	for _, release := range result.Newer {
+		if release.Security() {
+			result.Security = append(result.Security, release.TagName)
+		}
+	}
+	return result, nil
+}
+
+// Watch checks for newer releases every UPDATE_CHECK_INTERVAL hours until ctx
+// is done
+// Newer releases are logged and exported as gauges; those with security fixes
+// also send an update_available event, once per latest release
+func Watch(ctx context.Context, cfg *config.Config, notifier notify.Notifier) {
+	current := buildinfo.Get().Version
+	if _, ok := buildinfo.Compare(current, current); !ok {
+		log.Printf("Update check disabled: %s is not a release version", current)
+		return
+	}
+	transport, err := httpclient.NewTransport(false, cfg.CACertFile)
+	if err != nil {
+		log.Printf("Update check disabled: %v", err)
+		return
+	}
+	client := &http.Client{Transport: transport, Timeout: 30 * time.Second}
+
+	ticker := time.NewTicker(time.Duration(cfg.UpdateCheckInterval) * time.Hour)
+	defer ticker.Stop()
+
+	notified := ""
+	for {
+		result, err := Check(ctx, client, cfg.UpdateCheckURL, current)
+		if err != nil {
+			log.Printf("Warning: update check failed: %v", err)
+		} else {
+			report(result)
+			if latest := result.Latest(); latest != nil && len(result.Security) > 0 && latest.TagName != notified {
+				notified = latest.TagName
+				event := notify.Event{
+					Type: notify.EventUpdateAvailable,
+					Message: fmt.Sprintf("%s %s is available (running %s), with security fixes in %s",
+						buildinfo.Name, latest.TagName, current, strings.Join(result.Security, ", ")),
+					Details: map[string]interface{}{
+						"current":           current,
+						"latest":            latest.TagName,
+						"url":               latest.URL,
+						"security_releases": result.Security,
+					},
+				}
+				if err := notifier.Notify(ctx, event); err != nil {
+					log.Printf("Warning: failed to send notification: %v", err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// report logs the result of a check and exports it as gauges
+func report(result Result) {
+	available, security := 0.0, 0.0
+	if latest := result.Latest(); latest != nil {
+		available = 1
+		fixes := ""
+		if len(result.Security) > 0 {
+			security = 1
+			fixes = fmt.Sprintf(", security fixes in %s", strings.Join(result.Security, ", "))
+		}
+		log.Printf("Update available: %s (running %s, %d newer release(s)%s): %s",
+			latest.TagName, result.Current, len(result.Newer), fixes, latest.URL)
+	} else {
+		log.Printf("Update check: %s is the latest release", result.Current)
+	}
+
+	metrics.SetGauge("redis_backup_update_available", "Whether a newer release than the running version exists", nil, available)
+	metrics.SetGauge("redis_backup_update_security_available", "Whether a newer release with security fixes exists", nil, security)
+	metrics.SetGauge("redis_backup_update_last_check_timestamp_seconds", "Unix time of the last successful update check", nil, float64(time.Now().Unix()))
+}
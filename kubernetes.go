@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/backup"
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/kube"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// runKubernetesBackups discovers Redis services and backs up each of them,
+// up to MAX_CONCURRENT_BACKUPS at a time
+// The result of each backup is recorded as an Event on the service
+func runKubernetesBackups(ctx context.Context, cfg *config.Config, client *kube.Client) ([]backup.StoredBackup, error) {
+	namespace := cfg.K8sNamespace
+	if namespace == "" {
+		namespace = client.Namespace()
+	}
+
+	services, err := client.ListServices(ctx, namespace, cfg.K8sLabelSelector, cfg.K8sPortName)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Discovered %d Redis service(s) in namespace %s", len(services), namespace)
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []string
+		stored []backup.StoredBackup
+	)
+	// Bounds the number of simultaneous forks and uploads
+	slots := make(chan struct{}, cfg.MaxConcurrentBackups)
+
+	for _, svc := range services {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return stored, ctx.Err()
+		case slots <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(svc kube.Service) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			log.Printf("Backing up service %s (%s:%d)...", svc.Name, svc.Host, svc.Port)
+
+			eventType, reason, message := "Normal", "BackupSucceeded", "Redis backup completed"
+			backups, err := backupService(ctx, cfg, svc)
+			mu.Lock()
+			stored = append(stored, backups...)
+			if err != nil {
+				failed = append(failed, svc.Name)
+			}
+			mu.Unlock()
+			if err != nil {
+				log.Printf("Backup of service %s failed: %v", svc.Name, err)
+				eventType, reason, message = "Warning", "BackupFailed", fmt.Sprintf("Redis backup failed: %v", err)
+			}
+
+			if cfg.DryRun {
+				return
+			}
+			if err := client.RecordEvent(ctx, svc, eventType, reason, message); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}(svc)
+	}
+	wg.Wait()
+
+	sort.Strings(failed)
+	if len(failed) > 0 {
+		return stored, fmt.Errorf("backup failed for service(s) %v", failed)
+	}
+	return stored, nil
+}
+
+// discoverTargets returns a function listing the services backed up on each run
+func discoverTargets(cfg *config.Config, client *kube.Client) func(ctx context.Context) ([]string, error) {
+	return func(ctx context.Context) ([]string, error) {
+		namespace := cfg.K8sNamespace
+		if namespace == "" {
+			namespace = client.Namespace()
+		}
+		services, err := client.ListServices(ctx, namespace, cfg.K8sLabelSelector, cfg.K8sPortName)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(services))
+		for _, svc := range services {
+			names = append(names, svc.Name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+}
+
+// useTargetSecrets replaces the shared storage credentials and encryption keys
+// with those of the target under TARGET_CREDENTIALS_DIR and TARGET_KEYS_DIR
+func useTargetSecrets(cfg *config.Config) error {
+	if cfg.TargetCredentialsDir != "" {
+		if err := cfg.UseTargetCredentials(); err != nil {
+			return err
+		}
+	}
+	if cfg.TargetKeysDir != "" {
+		if err := cfg.UseTargetKeys(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupService runs a backup of a single discovered service into its own storage location
+func backupService(ctx context.Context, cfg *config.Config, svc kube.Service) ([]backup.StoredBackup, error) {
+	targetCfg := cfg.ForTarget(svc.Name, svc.Host, strconv.Itoa(svc.Port))
+	// Discovered services are retried on the next run rather than blocking this one
+	targetCfg.RedisConnectRetries = 1
+
+	start := time.Now()
+	if err := useTargetSecrets(targetCfg); err != nil {
+		backup.RecordRun(ctx, targetCfg, start, err)
+		return nil, err
+	}
+	store, err := storage.New(targetCfg)
+	if err != nil {
+		err = fmt.Errorf("failed to initialize storage: %w", err)
+		backup.RecordRun(ctx, targetCfg, start, err)
+		return nil, err
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+	// Read before connecting, so a target down for maintenance is not alerted
+	backup.RefreshMaintenance(ctx, targetCfg, store)
+
+	backupManager, err := backup.New(targetCfg, store)
+	if err != nil {
+		// Run records its own result; connection failures must be recorded here
+		backup.RecordRun(ctx, targetCfg, start, err)
+		backup.RecordRunHistory(ctx, targetCfg, store, start, err)
+		return nil, err
+	}
+	defer backupManager.Close()
+
+	err = backupManager.Run(ctx)
+	return backupManager.Stored(), err
+}
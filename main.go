@@ -2,21 +2,47 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/ermos/docker-redis-backup/internal/backup"
+	"github.com/ermos/docker-redis-backup/internal/buildinfo"
 	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/kube"
+	"github.com/ermos/docker-redis-backup/internal/metrics"
+	"github.com/ermos/docker-redis-backup/internal/notify"
 	"github.com/ermos/docker-redis-backup/internal/storage"
+	"github.com/ermos/docker-redis-backup/internal/update"
 	"github.com/robfig/cron/v3"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.Println("Starting Redis Backup Service...")
+
+	// Global flags apply to any command, e.g. --dry-run restore
+	flags, args := parseGlobalFlags(os.Args[1:])
+	if flags.dryRun {
+		os.Setenv("DRY_RUN", "true")
+	}
+
+	// Run a one-shot command if one is given
+	switch {
+	case flags.once:
+		os.Exit(execute(command{name: "--once", run: onceCommand}, args))
+	case len(args) > 0:
+		os.Exit(runCommand(args[0], args[1:]))
+	case flags.dryRun:
+		os.Exit(execute(command{name: "--dry-run", run: dryRunCommand}, args))
+	}
+
+	build := buildinfo.Get()
+	log.Printf("Starting Redis Backup Service %s...", build)
 
 	// Load configuration
 	cfg, err := config.Load()
@@ -29,44 +55,199 @@ func main() {
 	log.Printf("  Backup schedule: %s", cfg.BackupCron)
 	log.Printf("  Storage type: %s", cfg.StorageType)
 	log.Printf("  Retention count: %d", cfg.RetentionCount)
+	if cfg.RetentionMinFree > 0 {
+		log.Printf("  Minimum free space: %s", config.FormatSize(cfg.RetentionMinFree))
+	}
+	if cfg.BackupSplitDatabases {
+		log.Printf("  Split databases: enabled")
+	}
+	if cfg.DryRun {
+		log.Printf("  Dry run: enabled, nothing is uploaded or deleted")
+	}
+	if cfg.ReadOnly {
+		log.Printf("  Read-only: enabled, only INFO, BGSAVE and read commands are sent to Redis")
+	}
+	if cfg.ReplicaStorage != "" {
+		log.Printf("  Replica: %s (alert after %d missing backup(s))", cfg.ReplicaStorage, cfg.ReplicaMaxLag)
+	}
+	if cfg.StandbyRedisHost != "" {
+		log.Printf("  Warm standby: %s:%s, flushed and seeded after each backup", cfg.StandbyRedisHost, cfg.StandbyRedisPort)
+	}
+	if cfg.AuditLogFile != "" {
+		log.Printf("  Audit log: %s", cfg.AuditLogFile)
+	}
 
-	// Initialize storage
-	store, err := storage.New(cfg)
-	if err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
+	if cfg.EncryptionKMSKey != "" {
+		log.Printf("  Encryption: enabled (KMS key: %s)", cfg.EncryptionKMSKey)
+	} else if cfg.EncryptionKey != "" {
+		log.Printf("  Encryption: enabled (key ID: %s)", cfg.EncryptionKeyID)
 	}
-	log.Printf("Storage initialized: %s", store.Type())
 
-	// Initialize backup manager
-	backupManager, err := backup.New(cfg, store)
-	if err != nil {
-		log.Fatalf("Failed to initialize backup manager: %v", err)
+	if cfg.StorageType == "s3" && cfg.S3InsecureSkipVerify {
+		log.Println("WARNING: S3_INSECURE_SKIP_VERIFY is enabled, S3 certificates are not verified")
+	}
+
+	// Expose Prometheus metrics if configured
+	if cfg.MetricsAddr != "" {
+		metrics.Handle("/status", backup.StatusHandler())
+		metrics.Handle("/version", buildinfo.Handler())
+		if cfg.ConfigEndpoint {
+			metrics.Handle("/config", configHandler())
+		}
+		metrics.SetGauge("redis_backup_build_info", "Build of the backup service, always 1", map[string]string{
+			"version":    build.Version,
+			"commit":     build.Commit,
+			"go_version": build.GoVersion,
+		}, 1)
+		metrics.Serve(cfg.MetricsAddr)
+		log.Printf("Metrics exposed on %s/metrics (status on /status, schedule on /schedule and /schedule.ics, version on /version)", cfg.MetricsAddr)
+	}
+
+	// The backup job runs either against the configured Redis or against every
+	// Redis discovered in Kubernetes
+	var runBackup func(ctx context.Context) error
+	// Targets backed up on each run, listed by the schedule
+	listTargets := func(context.Context) ([]string, error) { return []string{cfg.Target()}, nil }
+
+	// Background workers (AOF shipping, write trigger, control channel) run until shutdown
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+
+	if cfg.TargetDiscovery == "kubernetes" {
+		kubeClient, err := kube.NewInClusterClient()
+		if err != nil {
+			log.Fatalf("Failed to initialize Kubernetes client: %v", err)
+		}
+		log.Printf("Kubernetes mode: discovering services matching %q", cfg.K8sLabelSelector)
+
+		runBackup = func(ctx context.Context) error {
+			_, err := runKubernetesBackups(ctx, cfg, kubeClient)
+			return err
+		}
+		listTargets = discoverTargets(cfg, kubeClient)
+	} else {
+		// Initialize storage
+		store, err := storage.New(cfg)
+		if err != nil {
+			log.Fatalf("Failed to initialize storage: %v", err)
+		}
+		log.Printf("Storage initialized: %s", store.Type())
+		if err := probeStorage(cfg, store); err != nil {
+			log.Fatalf("Storage probe failed: %v", err)
+		}
+		backup.Audit(context.Background(), cfg, store, backup.AuditEntry{Operation: "start", Target: cfg.Target(), Details: "configuration loaded"}, nil)
+
+		// Initialize backup manager
+		backupManager, err := backup.New(cfg, store)
+		if err != nil {
+			log.Fatalf("Failed to initialize backup manager: %v", err)
+		}
+		defer backupManager.Close()
+		log.Printf("Backup manager initialized, connected to Redis (engine: %s)", backupManager.Engine())
+		if err := checkPermissions(cfg, backupManager, false); err != nil {
+			log.Fatalf("Permission check failed: %v", err)
+		}
+
+		runBackup = backupManager.Run
+		backup.RegisterTarget(cfg.Target())
+
+		// Ship the AOF between snapshots
+		if cfg.AOFShipping {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				backupManager.ShipAOF(workersCtx)
+			}()
+			log.Printf("AOF shipping enabled (every %ds)", cfg.AOFShipInterval)
+		}
+
+		// Extra backups after write bursts
+		if cfg.WriteTriggerThreshold > 0 {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				if err := backupManager.WatchWrites(workersCtx); err != nil {
+					log.Printf("Write-triggered backups disabled: %v", err)
+				}
+			}()
+			log.Printf("Write-triggered backups enabled (%d writes, at most every %ds, source: %s)",
+				cfg.WriteTriggerThreshold, cfg.WriteTriggerMinInterval, cfg.WriteTriggerSource)
+		}
+
+		// Stale partial uploads
+		if cfg.PartialUploadCleanupInterval > 0 && !cfg.DryRun {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				backupManager.CleanPartialUploads(workersCtx)
+			}()
+			log.Printf("Partial uploads older than %dh removed every %dh", cfg.PartialUploadMaxAge, cfg.PartialUploadCleanupInterval)
+		}
+
+		// Lifecycle rules of the bucket
+		if cfg.LifecycleManage && !cfg.DryRun {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				backupManager.ManageLifecycle(workersCtx)
+			}()
+			log.Printf("Lifecycle rules of the bucket managed (checked every day)")
+		}
+
+		// Commands published on the control channel
+		if cfg.ControlChannel != "" {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				if err := backupManager.ListenControl(workersCtx); err != nil {
+					log.Printf("Control channel disabled: %v", err)
+				}
+			}()
+			log.Printf("Listening for control commands on %s", cfg.ControlChannel)
+		}
+	}
+
+	// Upcoming runs, to plan change windows around them
+	if cfg.MetricsAddr != "" {
+		schedule := backup.ScheduleHandler(cfg, listTargets)
+		metrics.Handle("/schedule", schedule)
+		metrics.Handle("/schedule.ics", schedule)
+	}
+
+	// Newer releases, for images left running for years
+	if cfg.UpdateCheck {
+		notifier, err := notify.New(cfg)
+		if err != nil {
+			log.Fatalf("Failed to initialize notifications: %v", err)
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			update.Watch(workersCtx, cfg, notifier)
+		}()
+		log.Printf("Update check enabled (every %dh)", cfg.UpdateCheckInterval)
 	}
-	defer backupManager.Close()
-	log.Println("Backup manager initialized, connected to Redis")
 
 	// Run backup on start if configured
 	if cfg.BackupOnStart {
 		log.Println("Running initial backup on startup...")
-		if err := backupManager.Run(context.Background()); err != nil {
+		if err := runBackup(context.Background()); err != nil {
 			log.Printf("Initial backup failed: %v", err)
 		}
 	}
 
 	// Setup cron scheduler
-	c := cron.New(cron.WithParser(cron.NewParser(
-		cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
-	)))
+	c := cron.New(cron.WithParser(config.CronParser))
 
 	// Add backup job
-	entryID, err := c.AddFunc(cfg.BackupCron, func() {
+	var entryID cron.EntryID
+	entryID, err = c.AddFunc(cfg.BackupCron, func() {
 		log.Println("Cron triggered backup job")
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
-		defer cancel()
-
-		if err := backupManager.Run(ctx); err != nil {
+		// Each run is bounded by MAX_BACKUP_DURATION
+		if err := runBackup(context.Background()); err != nil {
 			log.Printf("Backup failed: %v", err)
 		}
+		log.Printf("Next backup scheduled at: %s", c.Entry(entryID).Next.Format("2006-01-02 15:04:05"))
 	})
 	if err != nil {
 		log.Fatalf("Failed to add cron job: %v", err)
@@ -77,11 +258,9 @@ func main() {
 	c.Start()
 	log.Println("Cron scheduler started, waiting for scheduled jobs...")
 
-	// Print next scheduled run time
-	entries := c.Entries()
-	if len(entries) > 0 {
-		log.Printf("Next backup scheduled at: %s", entries[0].Next.Format("2006-01-02 15:04:05"))
-	}
+	// Print next scheduled run time, also shown on /status
+	backup.SetNextRun(func() time.Time { return c.Entry(entryID).Next })
+	log.Printf("Next backup scheduled at: %s", c.Entry(entryID).Next.Format("2006-01-02 15:04:05"))
 
 	// Wait for shutdown signal
 	sigChan := make(chan os.Signal, 1)
@@ -93,6 +272,65 @@ func main() {
 	// Stop cron scheduler
 	ctx := c.Stop()
 	<-ctx.Done()
+	stopWorkers()
+	workers.Wait()
+	notify.Flush(notifyFlushTimeout)
 
 	log.Println("Shutdown complete")
 }
+
+// checkPermissions checks the ACL permissions of the Redis user at startup, so
+// a missing rule is found before the first scheduled backup
+// With ACL_CHECK=warn, missing rules are only logged
+func checkPermissions(cfg *config.Config, backupManager *backup.Manager, restore bool) error {
+	if cfg.ACLCheck == "off" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := backupManager.CheckPermissions(ctx, restore)
+	if err != nil && cfg.ACLCheck == "warn" {
+		log.Printf("WARNING: permission check failed, backups will likely fail: %v", err)
+		return nil
+	}
+	return err
+}
+
+// probeStorage checks the storage permissions at startup, so a bad secret or
+// policy is found before the first scheduled backup
+// With STORAGE_PROBE=warn, failures are only logged
+func probeStorage(cfg *config.Config, store storage.Storage) error {
+	if cfg.StorageProbe == "off" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := backup.ProbeStorage(ctx, store, cfg.DryRun)
+	if err == nil {
+		if cfg.DryRun {
+			log.Printf("Storage probe passed (list only in dry run)")
+		} else {
+			log.Printf("Storage probe passed (list, write, read and delete)")
+		}
+		return nil
+	}
+	if cfg.StorageProbe == "warn" {
+		log.Printf("WARNING: storage probe failed, backups will likely fail: %v", err)
+		return nil
+	}
+	return err
+}
+
+// configHandler serves the effective configuration as JSON, secrets redacted
+func configHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(config.Settings()); err != nil {
+			log.Printf("Warning: failed to encode configuration: %v", err)
+		}
+	})
+}
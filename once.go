@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ermos/docker-redis-backup/internal/backup"
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/kube"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+)
+
+// Exit codes of the commands, so wrapper scripts can branch on the failure type
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitConfigError = 3
+	exitRedisError  = 4
+	exitUploadError = 5
+	exitVerifyError = 6
+)
+
+// exitError is a command error with a specific exit code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// onceSummary is printed on stdout as a single JSON line at the end of --once
+type onceSummary struct {
+	Status          string                `json:"status"`
+	Name            string                `json:"name,omitempty"`
+	Bytes           int64                 `json:"bytes"`
+	Backups         []backup.StoredBackup `json:"backups"`
+	DurationSeconds float64               `json:"duration_seconds"`
+	Destination     string                `json:"destination,omitempty"`
+	Verified        bool                  `json:"verified,omitempty"`
+	Error           string                `json:"error,omitempty"`
+	ExitCode        int                   `json:"exit_code"`
+}
+
+// onceCommand runs a single backup, optionally verifies it, and prints a JSON summary
+func onceCommand(args []string) error {
+	flags := flag.NewFlagSet("--once", flag.ExitOnError)
+	verify := flags.Bool("verify", false, "verify the stored backups after the run")
+	_ = flags.Parse(args)
+
+	start := time.Now()
+	summary := onceSummary{Status: "success", Backups: []backup.StoredBackup{}}
+	err := runOnce(&summary, *verify)
+
+	summary.DurationSeconds = time.Since(start).Seconds()
+	if err != nil {
+		summary.Status = "failure"
+		summary.Error = err.Error()
+		summary.ExitCode = exitFailure
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			summary.ExitCode = exitErr.code
+		}
+	} else if len(summary.Backups) == 0 {
+		// Dry run, or another instance holds the backup lock
+		summary.Status = "skipped"
+	}
+
+	if encodeErr := json.NewEncoder(os.Stdout).Encode(summary); encodeErr != nil {
+		log.Printf("Warning: failed to print summary: %v", encodeErr)
+	}
+	return err
+}
+
+// runOnce runs the backup of --once and fills the summary
+// Errors are exitErrors carrying the exit code of their failure type
+func runOnce(summary *onceSummary, verify bool) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return &exitError{exitConfigError, fmt.Errorf("failed to load configuration: %w", err)}
+	}
+	summary.Destination = cfg.StorageURI()
+	ctx := context.Background()
+
+	if cfg.TargetDiscovery == "kubernetes" {
+		kubeClient, err := kube.NewInClusterClient()
+		if err != nil {
+			return &exitError{exitConfigError, fmt.Errorf("failed to initialize Kubernetes client: %w", err)}
+		}
+		stored, err := runKubernetesBackups(ctx, cfg, kubeClient)
+		summary.addBackups(stored)
+		if err != nil {
+			return &exitError{exitFailure, err}
+		}
+		return nil
+	}
+
+	store, err := storage.New(cfg)
+	if err != nil {
+		return &exitError{exitUploadError, fmt.Errorf("failed to initialize storage: %w", err)}
+	}
+
+	backupManager, err := backup.New(cfg, store)
+	if err != nil {
+		code := exitConfigError
+		if backup.ErrorStage(err) == backup.StageRedis {
+			code = exitRedisError
+		}
+		return &exitError{code, fmt.Errorf("failed to initialize backup manager: %w", err)}
+	}
+	defer backupManager.Close()
+
+	runErr := backupManager.Run(ctx)
+	summary.addBackups(backupManager.Stored())
+	if runErr != nil {
+		return &exitError{stageExitCode(runErr), runErr}
+	}
+
+	if !verify || len(summary.Backups) == 0 {
+		return nil
+	}
+	for _, stored := range summary.Backups {
+		if _, err := backupManager.Verify(ctx, stored.Name); err != nil {
+			return &exitError{exitVerifyError, fmt.Errorf("verification of %s failed: %w", stored.Name, err)}
+		}
+		log.Printf("%s verified", stored.Name)
+	}
+	summary.Verified = true
+	return nil
+}
+
+// addBackups records stored backups in the summary
+func (s *onceSummary) addBackups(stored []backup.StoredBackup) {
+	s.Backups = append(s.Backups, stored...)
+	for _, b := range stored {
+		s.Bytes += b.Bytes
+	}
+	if len(s.Backups) > 0 {
+		s.Name = s.Backups[0].Name
+	}
+}
+
+// stageExitCode returns the exit code of a backup run error
+func stageExitCode(err error) int {
+	switch backup.ErrorStage(err) {
+	case backup.StageRedis:
+		return exitRedisError
+	case backup.StageUpload:
+		return exitUploadError
+	case backup.StageVerify:
+		return exitVerifyError
+	default:
+		return exitFailure
+	}
+}
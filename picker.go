@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/ermos/docker-redis-backup/internal/backup"
+	"github.com/ermos/docker-redis-backup/internal/config"
+	"github.com/ermos/docker-redis-backup/internal/crypt"
+	"github.com/ermos/docker-redis-backup/internal/storage"
+	"golang.org/x/term"
+)
+
+// pickerRows is the number of backups shown at once by the picker
+const pickerRows = 15
+
+// errCanceled is returned when the operator cancels the interactive restore
+var errCanceled = errors.New("canceled")
+
+// Keys understood by the picker
+const (
+	keyOther = iota
+	keyUp
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyEnter
+	keyQuit
+)
+
+// pickRestore lets the operator pick a backup and confirm the restore
+// The terminal UI is written to stderr
+func pickRestore(ctx context.Context, cfg *config.Config, store storage.Storage, opts backup.RestoreOptions, in *bufio.Reader) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", errors.New("-interactive needs a terminal")
+	}
+
+	objects, err := store.ListObjects(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list objects: %w", err)
+	}
+	complete, _ := backup.BackupSets(objects)
+	var backups []storage.ObjectInfo
+	for _, obj := range objects {
+		if slices.Contains(complete, obj.Name) {
+			backups = append(backups, obj)
+		}
+	}
+	if len(backups) == 0 {
+		return "", errors.New("no backup found")
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].ModTime.After(backups[j].ModTime) })
+
+	picked, err := pickBackup(os.Stderr, in, backups)
+	if err != nil {
+		return "", err
+	}
+
+	out := os.Stderr
+	fmt.Fprintf(out, "\nBackup:   %s\n", picked.Name)
+	fmt.Fprintf(out, "Taken:    %s UTC\n", picked.ModTime.UTC().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(out, "Size:     %s\n", config.FormatSize(picked.Size))
+	keyring, _ := crypt.NewKeyring(cfg)
+	if manifest, err := backup.LoadManifest(ctx, store, picked.Name, keyring); err == nil {
+		fmt.Fprintf(out, "Keys:     %d\n", manifest.TotalKeys())
+		if manifest.Base != "" {
+			fmt.Fprintf(out, "Base:     %s (restored first)\n", manifest.Base)
+		}
+	}
+	database := "same as in the backup"
+	if opts.DB >= 0 {
+		database = fmt.Sprintf("%d", opts.DB)
+	}
+	fmt.Fprintf(out, "Target:   %s:%s (database: %s)\n", cfg.RedisHost, cfg.RedisPort, database)
+	fmt.Fprintf(out, "Patterns: %s\n", strings.Join(opts.Patterns, " "))
+	if opts.ReplayAOF {
+		fmt.Fprintf(out, "AOF:      the segments shipped after the backup are replayed\n")
+	}
+	if opts.Flush {
+		fmt.Fprintf(out, "Flush:    every key of the target is deleted first, after a safety backup\n")
+	}
+	switch opts.Conflict {
+	case backup.ConflictSkip:
+		fmt.Fprintf(out, "\nExisting keys with the same names are kept. Type yes to restore: ")
+	case backup.ConflictFail:
+		fmt.Fprintf(out, "\nThe restore stops at the first existing key with the same name. Type yes to restore: ")
+	default:
+		fmt.Fprintf(out, "\nExisting keys with the same names are replaced. Type yes to restore: ")
+	}
+
+	answer, err := in.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return "", errCanceled
+	}
+	return picked.Name, nil
+}
+
+// pickBackup shows the backups and returns the one chosen with the arrow keys
+// Enter selects, q, Esc or Ctrl-C cancels
+func pickBackup(out io.Writer, in *bufio.Reader, backups []storage.ObjectInfo) (storage.ObjectInfo, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return storage.ObjectInfo{}, fmt.Errorf("failed to configure the terminal: %w", err)
+	}
+	defer term.Restore(fd, state)
+
+	cursor, drawn := 0, 0
+	for {
+		drawn = drawPicker(out, backups, cursor, drawn)
+
+		key, err := readKey(in)
+		if err != nil {
+			return storage.ObjectInfo{}, err
+		}
+		switch key {
+		case keyUp:
+			cursor = max(cursor-1, 0)
+		case keyDown:
+			cursor = min(cursor+1, len(backups)-1)
+		case keyPageUp:
+			cursor = max(cursor-pickerRows, 0)
+		case keyPageDown:
+			cursor = min(cursor+pickerRows, len(backups)-1)
+		case keyEnter:
+			return backups[cursor], nil
+		case keyQuit:
+			return storage.ObjectInfo{}, errCanceled
+		}
+	}
+}
+
+// drawPicker draws the visible part of the list over the previous drawing
+// and returns the number of lines drawn
+func drawPicker(out io.Writer, backups []storage.ObjectInfo, cursor, previous int) int {
+	if previous > 0 {
+		fmt.Fprintf(out, "\x1b[%dA", previous)
+	}
+
+	first := min(max(cursor-pickerRows/2, 0), max(len(backups)-pickerRows, 0))
+	last := min(first+pickerRows, len(backups))
+
+	lines := []string{fmt.Sprintf("Select a backup (%d/%d), arrow keys to move, Enter to select, q to cancel", cursor+1, len(backups))}
+	for i := first; i < last; i++ {
+		obj := backups[i]
+		line := fmt.Sprintf("  %-55s %10s  %s", obj.Name, config.FormatSize(obj.Size), obj.ModTime.UTC().Format("2006-01-02 15:04:05"))
+		if i == cursor {
+			line = "\x1b[7m>" + line[1:] + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+	for _, line := range lines {
+		fmt.Fprintf(out, "\x1b[2K%s\r\n", line)
+	}
+	return len(lines)
+}
+
+// readKey reads a key press from a terminal in raw mode
+func readKey(in *bufio.Reader) (int, error) {
+	b, err := in.ReadByte()
+	if err != nil {
+		return keyOther, err
+	}
+
+	switch b {
+	case '\r', '\n':
+		return keyEnter, nil
+	case 'q', 3:
+		return keyQuit, nil
+	case 'k':
+		return keyUp, nil
+	case 'j':
+		return keyDown, nil
+	case 0x1b:
+	default:
+		return keyOther, nil
+	}
+
+	// Escape sequences: ESC [ A (up), ESC [ B (down), ESC [ 5 ~ and ESC [ 6 ~ (pages)
+	if in.Buffered() == 0 {
+		return keyQuit, nil
+	}
+	if next, _ := in.ReadByte(); next != '[' {
+		return keyOther, nil
+	}
+	code, err := in.ReadByte()
+	if err != nil {
+		return keyOther, err
+	}
+	switch code {
+	case 'A':
+		return keyUp, nil
+	case 'B':
+		return keyDown, nil
+	case '5', '6':
+		if tilde, _ := in.ReadByte(); tilde != '~' {
+			return keyOther, nil
+		}
+		if code == '5' {
+			return keyPageUp, nil
+		}
+		return keyPageDown, nil
+	}
+	return keyOther, nil
+}